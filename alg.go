@@ -0,0 +1,55 @@
+package natchecker
+
+import (
+	"fmt"
+	"net"
+)
+
+// ALGWarning はペイロード中のアドレスを書き換える ALG (Application Level Gateway) の痕跡
+//
+// RFC 8489 Section 14.2: "The XOR-MAPPED-ADDRESS attribute ... the reflexive
+// transport address is obfuscated through the XOR function. ... NATs ... were
+// modifying the IP address in MAPPED-ADDRESS"
+//
+// サーバーは両方の属性に同じアドレスを入れるため、MAPPED-ADDRESS だけが異なる値で
+// 届いた場合、経路上の NAT やファイアウォールがパケットの中身を書き換えています。
+// このような ALG は STUN 以外のプロトコル（SIP 等）のペイロードも書き換えるおそれがあります。
+type ALGWarning struct {
+	// MappedAddress は受信した MAPPED-ADDRESS（書き換えられた値）
+	MappedAddress *net.UDPAddr `json:"mapped_address"`
+	// XorMappedAddress は受信した XOR-MAPPED-ADDRESS（サーバーが観測した値）
+	XorMappedAddress *net.UDPAddr `json:"xor_mapped_address"`
+	// RewrittenToLocal は MAPPED-ADDRESS がクライアントのローカルアドレスに
+	// 書き戻されていた場合に true。外向きのアドレス変換を逆に適用する NAT の ALG に典型的
+	RewrittenToLocal bool `json:"rewritten_to_local"`
+}
+
+// String は警告の文字列表現を返す
+func (w ALGWarning) String() string {
+	if w.RewrittenToLocal {
+		return fmt.Sprintf("ALG detected: MAPPED-ADDRESS rewritten to local address %s (XOR-MAPPED-ADDRESS %s)",
+			w.MappedAddress, w.XorMappedAddress)
+	}
+	return fmt.Sprintf("ALG detected: MAPPED-ADDRESS %s differs from XOR-MAPPED-ADDRESS %s",
+		w.MappedAddress, w.XorMappedAddress)
+}
+
+// detectALG は 1 つの Binding レスポンスに含まれる MAPPED-ADDRESS と XOR-MAPPED-ADDRESS を
+// 比べ、食い違っていれば ALGWarning を返します。
+//
+// どちらかの属性が無い場合（RFC 3489 形式のレスポンスや XOR-MAPPED-ADDRESS のみを返す
+// サーバー）は比較できないため nil を返す。local はクライアントのローカルアドレスで、
+// 不明な場合は nil でよい
+func detectALG(result *BindingResult, local *net.UDPAddr) *ALGWarning {
+	if result == nil || result.PlainMappedAddress == nil || result.XorMappedAddress == nil {
+		return nil
+	}
+	if udpAddrEqual(result.PlainMappedAddress, result.XorMappedAddress) {
+		return nil
+	}
+	return &ALGWarning{
+		MappedAddress:    result.PlainMappedAddress,
+		XorMappedAddress: result.XorMappedAddress,
+		RewrittenToLocal: local != nil && result.PlainMappedAddress.IP.Equal(local.IP),
+	}
+}
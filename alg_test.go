@@ -0,0 +1,122 @@
+package natchecker
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectALG(t *testing.T) {
+	local := &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 40000}
+	public := &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 50000}
+
+	tests := []struct {
+		name     string
+		result   *BindingResult
+		expected *ALGWarning
+	}{
+		{
+			name:   "both attributes agree",
+			result: &BindingResult{PlainMappedAddress: public, XorMappedAddress: public},
+		},
+		{
+			name:   "XOR-MAPPED-ADDRESS only",
+			result: &BindingResult{XorMappedAddress: public},
+		},
+		{
+			name:   "MAPPED-ADDRESS only (RFC 3489 server)",
+			result: &BindingResult{PlainMappedAddress: public},
+		},
+		{
+			name:   "MAPPED-ADDRESS rewritten to the local address",
+			result: &BindingResult{PlainMappedAddress: local, XorMappedAddress: public},
+			expected: &ALGWarning{
+				MappedAddress:    local,
+				XorMappedAddress: public,
+				RewrittenToLocal: true,
+			},
+		},
+		{
+			name:   "MAPPED-ADDRESS rewritten to another address",
+			result: &BindingResult{PlainMappedAddress: &net.UDPAddr{IP: net.ParseIP("198.51.100.7"), Port: 50000}, XorMappedAddress: public},
+			expected: &ALGWarning{
+				MappedAddress:    &net.UDPAddr{IP: net.ParseIP("198.51.100.7"), Port: 50000},
+				XorMappedAddress: public,
+			},
+		},
+		{
+			name: "nil result",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, detectALG(test.result, local))
+		})
+	}
+}
+
+func TestParseBindingResponseKeepsBothMappedAddresses(t *testing.T) {
+	txID := [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	// MAPPED-ADDRESS: 10.0.0.2:12345（ALG に書き換えられた値）
+	// XOR-MAPPED-ADDRESS: 203.0.113.1:12345
+	attrs := []byte{
+		0x00, 0x01, 0x00, 0x08, 0x00, 0x01, 0x30, 0x39, 10, 0, 0, 2,
+		0x00, 0x20, 0x00, 0x08, 0x00, 0x01, 0x11, 0x2B, 0xEA, 0x12, 0xD5, 0x43,
+	}
+
+	c := &STUNClient{}
+	msg, err := c.decodeMessage(buildMessage(txID, attrs))
+	require.NoError(t, err)
+	result, err := c.parseBindingResponse(msg, &net.UDPAddr{IP: net.ParseIP("203.0.113.100"), Port: 3478})
+	require.NoError(t, err)
+
+	assert.Equal(t, "203.0.113.1:12345", result.MappedAddress.String(), "XOR-MAPPED-ADDRESS is preferred")
+	assert.Equal(t, "10.0.0.2:12345", result.PlainMappedAddress.String())
+	assert.Equal(t, "203.0.113.1:12345", result.XorMappedAddress.String())
+}
+
+func TestCheckMappingTypeReportsALG(t *testing.T) {
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer server.Close()
+
+	go serveRewrittenMappedAddress(server)
+
+	result, err := CheckMappingType(server.LocalAddr().String(), WithAddressFamily(IPv4Only))
+	require.NoError(t, err)
+
+	assert.False(t, result.NoNAT)
+	require.NotNil(t, result.ALG)
+	assert.True(t, result.ALG.RewrittenToLocal)
+	assert.Equal(t, "127.0.0.1", result.ALG.MappedAddress.IP.String())
+	assert.Equal(t, "198.51.100.1", result.ALG.XorMappedAddress.IP.String())
+	assert.Equal(t, result.ALG.XorMappedAddress, result.Response.Mapping1)
+}
+
+// serveRewrittenMappedAddress は MAPPED-ADDRESS にクライアントのローカルアドレスを、
+// XOR-MAPPED-ADDRESS に別の外部アドレス 198.51.100.1 を返すテスト用の STUN サーバー。
+// ALG がアドレスを書き戻した状況を模擬する
+func serveRewrittenMappedAddress(conn *net.UDPConn) {
+	buffer := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		if n < 20 {
+			continue
+		}
+		var txID [12]byte
+		copy(txID[:], buffer[8:20])
+		port := from.Port
+		xport := port ^ 0x2112
+		attrs := []byte{0x00, 0x01, 0x00, 0x08, 0x00, 0x01, byte(port >> 8), byte(port), 127, 0, 0, 1}
+		// 198.51.100.1 を Magic Cookie で XOR した値
+		attrs = append(attrs, 0x00, 0x20, 0x00, 0x08, 0x00, 0x01, byte(xport>>8), byte(xport),
+			198^0x21, 51^0x12, 100^0xA4, 1^0x42)
+		conn.WriteToUDP(buildMessage(txID, attrs), from)
+	}
+}
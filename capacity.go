@@ -0,0 +1,196 @@
+package natchecker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// defaultProbeInterval は CheckBindingCapacity で Binding Request を送る既定の間隔。
+// NAT や STUN サーバーに負荷をかけないよう、毎秒 20 パケット程度に抑える
+const defaultProbeInterval = 50 * time.Millisecond
+
+// maxBindingCapacityProbe は CheckBindingCapacity で作るマッピング数の上限
+const maxBindingCapacityProbe = 4096
+
+// WithProbeInterval は CheckBindingCapacity で Binding Request を送る最小の間隔を指定します。
+// 0 以下の値は無視され、既定値 (50ms) のままになります。
+func WithProbeInterval(d time.Duration) Option {
+	return func(c *config) {
+		if d > 0 {
+			c.probeInterval = d
+		}
+	}
+}
+
+// interval は有効な送信間隔を返します
+func (c config) interval() time.Duration {
+	if c.probeInterval > 0 {
+		return c.probeInterval
+	}
+	return defaultProbeInterval
+}
+
+// BindingEviction は後から作ったマッピングによって失われた（または変化した）マッピング
+type BindingEviction struct {
+	// Index は失われたマッピングの作成順の番号 (1 始まり)
+	Index int `json:"index"`
+	// OpenMappings は失われたことを検出した時点で開いていたマッピングの数
+	OpenMappings int `json:"open_mappings"`
+	// Original は最初に得られたマッピング
+	Original *net.UDPAddr `json:"original"`
+	// Current は再確認で得られたマッピング。応答が無かった場合は nil
+	Current *net.UDPAddr `json:"current"`
+}
+
+// CheckBindingCapacityResult は NAT のマッピング数の上限の判定結果
+type CheckBindingCapacityResult struct {
+	// Requested は作ろうとしたマッピングの数
+	Requested int `json:"requested"`
+	// Established は外部マッピングを得られたソケットの数
+	Established int `json:"established"`
+	// FirstFailure は最初に Binding が失敗したマッピングの作成順の番号 (1 始まり)。
+	// 0 ならすべてのマッピングが作られた
+	FirstFailure int `json:"first_failure"`
+	// LocalLimit は NAT ではなくローカルのソケット数の上限などで、新しいソケットを
+	// 作れずに中断した場合に true
+	LocalLimit bool `json:"local_limit"`
+	// ServerError はサーバーがエラーレスポンス (429 Too Many Requests、508 Insufficient
+	// Capacity など) で新しいマッピングの Binding を拒否して中断した場合のエラーコード。
+	// NAT の上限ではなくサーバー側の制限による中断であることを示す
+	ServerError int `json:"server_error,omitempty"`
+	// FailureError は中断した理由
+	FailureError string `json:"failure_error,omitempty"`
+	// Evictions は後から作ったマッピングによって失われたマッピング
+	Evictions []BindingEviction `json:"evictions,omitempty"`
+}
+
+// String は結果の文字列表現を返す
+func (r CheckBindingCapacityResult) String() string {
+	switch {
+	case r.ServerError > 0:
+		return fmt.Sprintf("Binding Capacity: server rejected new mappings at %d with error %d (%d established, %d evicted)",
+			r.FirstFailure, r.ServerError, r.Established, len(r.Evictions))
+	case r.FirstFailure > 0 && !r.LocalLimit:
+		return fmt.Sprintf("Binding Capacity: new mappings failed at %d (%d established, %d evicted)",
+			r.FirstFailure, r.Established, len(r.Evictions))
+	case len(r.Evictions) > 0:
+		return fmt.Sprintf("Binding Capacity: %d established, %d evicted (first at %d open mappings)",
+			r.Established, len(r.Evictions), r.Evictions[0].OpenMappings)
+	default:
+		return fmt.Sprintf("Binding Capacity: %d/%d established, no limit observed", r.Established, r.Requested)
+	}
+}
+
+// CheckBindingCapacity は NAT が 1 つのホストに割り当てるマッピング数の上限を調べます
+//
+// ローカルソケットを 1 つずつ開いて最大 maxMappings 個の外部マッピングを作り、
+// 新しいマッピングが作れなくなった時点、または古いマッピングが失われた時点を報告します。
+// CGN の加入者ごとのマッピング数制限 (RFC 6888 REQ-4) を検出するためのテストです。
+//
+// 開いているマッピングの数が 2 の累乗に達するたびと最後に、それまでのマッピングを
+// すべて再確認し、応答が無い、または外部アドレスが変わったものを失われたとみなします。
+// 新しいマッピングの Binding が（再送を含めて）タイムアウトした時点で中断します。
+// ソケットを作れなかった場合は LocalLimit を、サーバーがエラーレスポンスを返した場合は
+// ServerError を設定して中断し、いずれも NAT の上限とは区別します。
+//
+// このテストは NAT とサーバーに多数のマッピングを作らせるため、明示的に呼び出した
+// 場合のみ実行されます。送信は WithProbeInterval の間隔（既定 50ms）に制限されます。
+func CheckBindingCapacity(serverAddr string, maxMappings int, opts ...Option) (*CheckBindingCapacityResult, error) {
+	if maxMappings < 1 || maxMappings > maxBindingCapacityProbe {
+		return nil, fmt.Errorf("invalid mapping count %d (must be 1-%d)", maxMappings, maxBindingCapacityProbe)
+	}
+
+	cfg := newConfig(opts)
+	servers, err := cfg.resolveServers(serverAddr)
+	if err != nil {
+		return nil, fmt.Errorf("サーバーアドレス解決エラー: %w", err)
+	}
+
+	clients := make([]*STUNClient, 0, maxMappings)
+	defer func() {
+		for _, client := range clients {
+			client.Close()
+		}
+	}()
+
+	// 送信間隔を interval 以上に保つ
+	var last time.Time
+	wait := func() {
+		time.Sleep(time.Until(last.Add(cfg.interval())))
+		last = time.Now()
+	}
+
+	result := &CheckBindingCapacityResult{Requested: maxMappings}
+	mappings := make([]*net.UDPAddr, 0, maxMappings)
+	evicted := make(map[int]bool)
+
+	// recheck は開いているマッピングを再確認し、失われたものを記録する
+	recheck := func() {
+		for i, client := range clients {
+			if evicted[i] {
+				continue
+			}
+			wait()
+			eviction := BindingEviction{Index: i + 1, OpenMappings: len(clients), Original: mappings[i]}
+			current, err := client.SendBindingRequestTo(servers[0], false, false)
+			if err == nil {
+				if udpAddrEqual(current.MappedAddress, mappings[i]) {
+					continue
+				}
+				eviction.Current = current.MappedAddress
+			}
+			evicted[i] = true
+			result.Evictions = append(result.Evictions, eviction)
+		}
+	}
+
+	for i := 0; i < maxMappings; i++ {
+		client, err := NewSTUNClient(opts...)
+		if err != nil {
+			if i == 0 {
+				return nil, fmt.Errorf("STUNクライアント作成エラー: %w", err)
+			}
+			result.FirstFailure = i + 1
+			result.LocalLimit = true
+			result.FailureError = fmt.Sprintf("STUNクライアント作成エラー: %v", err)
+			break
+		}
+
+		wait()
+		server, binding, err := client.bindFirstResponsive(servers)
+		if err != nil {
+			client.Close()
+			if i == 0 {
+				return nil, fmt.Errorf("最初のマッピングの Binding 失敗: %w", err)
+			}
+			result.FirstFailure = i + 1
+			var stunErr *STUNError
+			if errors.As(err, &stunErr) {
+				result.ServerError = stunErr.Code
+			}
+			result.FailureError = err.Error()
+			break
+		}
+		servers = []*net.UDPAddr{server}
+		clients = append(clients, client)
+		mappings = append(mappings, binding.MappedAddress)
+
+		if isCapacityCheckpoint(len(clients)) {
+			recheck()
+		}
+	}
+	if !isCapacityCheckpoint(len(clients)) || result.FirstFailure > 0 {
+		recheck()
+	}
+
+	result.Established = len(clients)
+	return result, nil
+}
+
+// isCapacityCheckpoint は開いているマッピングが n 個のときに再確認を行うかを返します。
+// 再確認の送信数がマッピング数の 2 倍程度に収まるよう、2 の累乗ごとに行う
+func isCapacityCheckpoint(n int) bool {
+	return n >= 2 && n&(n-1) == 0
+}
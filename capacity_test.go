@@ -0,0 +1,172 @@
+package natchecker
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsCapacityCheckpoint(t *testing.T) {
+	tests := []struct {
+		n        int
+		expected bool
+	}{
+		{0, false},
+		{1, false},
+		{2, true},
+		{3, false},
+		{4, true},
+		{6, false},
+		{64, true},
+		{100, false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, isCapacityCheckpoint(test.n), "isCapacityCheckpoint(%d)", test.n)
+	}
+}
+
+// serveLimitedMappings は最初の limit 個の送信元ポートにだけ応答するテスト用の STUN サーバー。
+// マッピング数に上限のある NAT を模擬する
+func serveLimitedMappings(conn *net.UDPConn, limit int) {
+	seen := make(map[int]bool)
+	buffer := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		if n < 20 {
+			continue
+		}
+		if !seen[from.Port] {
+			if len(seen) >= limit {
+				continue
+			}
+			seen[from.Port] = true
+		}
+		var txID [12]byte
+		copy(txID[:], buffer[8:20])
+		attrs := []byte{0x00, 0x01, 0x00, 0x08, 0x00, 0x01, byte(from.Port >> 8), byte(from.Port)}
+		attrs = append(attrs, from.IP.To4()...)
+		conn.WriteToUDP(buildMessage(txID, attrs), from)
+	}
+}
+
+func TestCheckBindingCapacityLoopback(t *testing.T) {
+	tests := []struct {
+		name         string
+		limit        int
+		maxMappings  int
+		established  int
+		firstFailure int
+	}{
+		{name: "no limit", limit: 100, maxMappings: 10, established: 10},
+		{name: "limited to 5 mappings", limit: 5, maxMappings: 10, established: 5, firstFailure: 6},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+			require.NoError(t, err)
+			defer server.Close()
+			go serveLimitedMappings(server, test.limit)
+
+			result, err := CheckBindingCapacity(server.LocalAddr().String(), test.maxMappings,
+				WithAddressFamily(IPv4Only), WithRetransmission(20*time.Millisecond, 2),
+				WithProbeInterval(time.Millisecond))
+			require.NoError(t, err)
+
+			assert.Equal(t, test.maxMappings, result.Requested)
+			assert.Equal(t, test.established, result.Established)
+			assert.Equal(t, test.firstFailure, result.FirstFailure)
+			assert.False(t, result.LocalLimit)
+			assert.Empty(t, result.Evictions)
+		})
+	}
+}
+
+func TestCheckBindingCapacityInvalidCount(t *testing.T) {
+	for _, n := range []int{0, -1, maxBindingCapacityProbe + 1} {
+		_, err := CheckBindingCapacity("127.0.0.1:3478", n)
+		assert.Error(t, err, "maxMappings=%d", n)
+	}
+}
+
+// serveRejectAfter は最初の limit 個の送信元にだけ応答し、それ以降の送信元には
+// 429 Too Many Requests を返すテスト用の STUN サーバー
+func serveRejectAfter(t *MemoryTransport, limit int) {
+	seen := make(map[string]bool)
+	buffer := make([]byte, 1500)
+	for {
+		n, from, err := t.Receive(buffer, time.Time{})
+		if err != nil {
+			return
+		}
+		request, err := DecodeMessage(buffer[:n])
+		if err != nil || request.MessageType != BindingRequest {
+			continue
+		}
+		response := STUNMessage{
+			MessageType:   BindingResponse,
+			TransactionID: request.TransactionID,
+			Attributes:    []STUNAttribute{NewAddressAttribute(XorMappedAddress, from, request.TransactionID)},
+		}
+		if !seen[from.String()] {
+			if len(seen) >= limit {
+				response.MessageType = BindingErrorResponse
+				response.Attributes = []STUNAttribute{NewErrorCodeAttribute(429, "Too Many Requests")}
+			} else {
+				seen[from.String()] = true
+			}
+		}
+		t.Send(EncodeMessage(response), from)
+	}
+}
+
+func TestCheckBindingCapacityStopReason(t *testing.T) {
+	network := NewMemoryNetwork()
+	listen := func(t *testing.T, limit int) *MemoryTransport {
+		server, err := network.Listen(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 3478})
+		require.NoError(t, err)
+		t.Cleanup(func() { server.Close() })
+		go serveRejectAfter(server, limit)
+		return server
+	}
+	options := []Option{WithRetransmission(20*time.Millisecond, 2), WithProbeInterval(time.Millisecond)}
+
+	t.Run("server error", func(t *testing.T) {
+		server := listen(t, 3)
+		result, err := CheckBindingCapacity(server.Addr().String(), 10,
+			append(options, WithTransport(network.Factory(net.ParseIP("198.51.100.1"))))...)
+		require.NoError(t, err)
+		assert.Equal(t, 3, result.Established)
+		assert.Equal(t, 4, result.FirstFailure)
+		assert.Equal(t, 429, result.ServerError)
+		assert.False(t, result.LocalLimit, "a STUN error response is not a local limit")
+		assert.Contains(t, result.String(), "server rejected")
+	})
+
+	t.Run("socket creation error", func(t *testing.T) {
+		server := listen(t, 100)
+		factory := network.Factory(net.ParseIP("198.51.100.2"))
+		opened := 0
+		limited := func(n string) (Transport, error) {
+			if opened == 2 {
+				return nil, errors.New("too many open files")
+			}
+			opened++
+			return factory(n)
+		}
+		result, err := CheckBindingCapacity(server.Addr().String(), 10, append(options, WithTransport(limited))...)
+		require.NoError(t, err)
+		assert.Equal(t, 2, result.Established)
+		assert.Equal(t, 3, result.FirstFailure)
+		assert.True(t, result.LocalLimit)
+		assert.Zero(t, result.ServerError)
+	})
+}
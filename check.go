@@ -15,16 +15,6 @@ func isTimeoutError(err error) bool {
 // defaultSTUNPort は STUN の標準ポート (RFC 8489 Section 8)
 const defaultSTUNPort = "3478"
 
-// withDefaultPort は "host" または "host:port" 形式のアドレスを受け取り、
-// ポートが指定されていなければ STUN 標準ポート 3478 を補います。
-// IPv6 リテラルは "[::1]:3478" のように角括弧付きで解釈されます。
-func withDefaultPort(server string) string {
-	if _, _, err := net.SplitHostPort(server); err == nil {
-		return server
-	}
-	return net.JoinHostPort(server, defaultSTUNPort)
-}
-
 // NATマッピングタイプ
 type NATMappingType int
 
@@ -130,6 +120,7 @@ type STUNServerSupportInfo struct {
 
 // CheckFilteringResponseData はフィルタリング判定の詳細データ
 type CheckFilteringResponseData struct {
+	ServerAddress   *net.UDPAddr `json:"server_address"`    // Test I に応答したサーバーのアドレス
 	OtherAddress    *net.UDPAddr `json:"other_address"`     // Test I で取得した代替アドレス
 	TestIIResponse  bool         `json:"test_ii_response"`  // Test II (Change IP+Port) で代替IPからのレスポンスを受信したか
 	TestIIIResponse bool         `json:"test_iii_response"` // Test III (Change Port) で同一IP・別ポートからのレスポンスを受信したか
@@ -140,6 +131,8 @@ type CheckFilteringResult struct {
 	FilteringType NATFilteringType           `json:"filtering_type"`
 	Response      CheckFilteringResponseData `json:"response"`
 	ServerSupport STUNServerSupportInfo      `json:"server_support"`
+	// Legacy はサーバーが RFC 3489 形式で応答した（WithClassicMode 使用時）場合に true
+	Legacy bool `json:"legacy"`
 }
 
 // FullNATDetectionResult は包括的なNAT判定結果
@@ -147,6 +140,8 @@ type FullNATDetectionResult struct {
 	DetailedType    DetailedNATType       `json:"detailed_type"`
 	MappingResult   *CheckMappingResult   `json:"mapping_result"`
 	FilteringResult *CheckFilteringResult `json:"filtering_result"`
+	// NATLayers はクライアントとインターネットの間にある NAT の段数の推定
+	NATLayers NATLayerEstimate `json:"nat_layers"`
 }
 
 // String は結果の文字列表現を返す
@@ -161,22 +156,32 @@ type CheckMappingResult struct {
 	// （クライアントとサーバーの間に NAT が存在しない）場合に true
 	NoNAT    bool                     `json:"no_nat"`
 	Response CheckMappingResponseData `json:"response"`
+	// Legacy はサーバーが RFC 3489 形式で応答した（WithClassicMode 使用時）場合に true
+	Legacy bool `json:"legacy"`
+	// NAT64 はサーバーアドレスが NAT64 プレフィックスで合成されていた場合の情報。
+	// NAT64 が介在しない場合は nil
+	NAT64 *NAT64Info `json:"nat64,omitempty"`
+	// ALG は Test I の MAPPED-ADDRESS が XOR-MAPPED-ADDRESS と食い違っていた場合の警告。
+	// 経路上の ALG がペイロードを書き換えていることを示す。検出されなければ nil
+	ALG *ALGWarning `json:"alg,omitempty"`
 }
 
 // CheckMappingResponseData はマッピング結果の詳細データを含む構造体
 type CheckMappingResponseData struct {
-	LocalAddress *net.UDPAddr `json:"local_address"` // クライアントのローカルアドレス
-	OtherAddress *net.UDPAddr `json:"other_address"` // Test I で取得したサーバーの代替アドレス
-	Mapping1     *net.UDPAddr `json:"mapping_1"`     // Test I: 主アドレス宛のマッピング
-	Mapping2     *net.UDPAddr `json:"mapping_2"`     // Test II: 代替IP・主ポート宛のマッピング
-	Mapping3     *net.UDPAddr `json:"mapping_3"`     // Test III: 代替IP・代替ポート宛のマッピング
+	ServerAddress *net.UDPAddr `json:"server_address"` // Test I に応答したサーバーのアドレス
+	LocalAddress  *net.UDPAddr `json:"local_address"`  // クライアントのローカルアドレス
+	OtherAddress  *net.UDPAddr `json:"other_address"`  // Test I で取得したサーバーの代替アドレス
+	Mapping1      *net.UDPAddr `json:"mapping_1"`      // Test I: 主アドレス宛のマッピング
+	Mapping2      *net.UDPAddr `json:"mapping_2"`      // Test II: 代替IP・主ポート宛のマッピング
+	Mapping3      *net.UDPAddr `json:"mapping_3"`      // Test III: 代替IP・代替ポート宛のマッピング
 }
 
 // CheckMappingType はNATマッピングタイプを判定します
 // RFC 5780 Section 4.3: Determining NAT Mapping Behavior
 //
-// serverAddr は "host" または "host:port" 形式で指定します。
+// serverAddr は "host"、"host:port"、または STUN URI ("stun:host:port") 形式で指定します。
 // ポートを省略した場合は STUN 標準ポート 3478 が使われます。
+// opts は内部で使う STUNClient に渡されます（WithStrictValidation など）。
 //
 // AD/APD の区別には「同じサーバーの別 IP・別ポート」宛の送信結果の比較が
 // 必要なため、OTHER-ADDRESS (RFC 5780) をサポートするサーバーが必要です。
@@ -187,22 +192,30 @@ type CheckMappingResponseData struct {
 //     マッピングが Test I と同じ → Endpoint Independent
 //   - Test III: 代替 IP・代替ポート宛に Binding Request
 //     マッピングが Test II と同じ → Address Dependent、異なる → Address and Port Dependent
-func CheckMappingType(serverAddr string) (*CheckMappingResult, error) {
-	client, err := NewSTUNClient()
+func CheckMappingType(serverAddr string, opts ...Option) (*CheckMappingResult, error) {
+	// サーバーは 1 度だけ解決し、以降のテストは解決済みのアドレス宛に送る。
+	// 呼び出しごとに解決すると、複数の A/AAAA レコードを持つ名前では
+	// テストの途中で別のサーバーインスタンスに切り替わってしまう
+	servers, err := newConfig(opts).resolveServers(serverAddr)
 	if err != nil {
-		return nil, fmt.Errorf("STUNクライアント作成エラー: %w", err)
+		return nil, fmt.Errorf("サーバーアドレス解決エラー: %w", err)
 	}
-	defer client.Close()
+	return checkMappingType(servers, opts)
+}
 
-	server := withDefaultPort(serverAddr)
-	serverUDP, err := net.ResolveUDPAddr("udp", server)
+// checkMappingType は解決済みのサーバー候補 servers に対してマッピング判定を行います。
+// Test I に応答した最初の候補を主アドレスとして、以降のテストを行う
+func checkMappingType(servers []*net.UDPAddr, opts []Option) (*CheckMappingResult, error) {
+	client, err := NewSTUNClient(opts...)
 	if err != nil {
-		return nil, fmt.Errorf("サーバーアドレス解決エラー: %w", err)
+		return nil, fmt.Errorf("STUNクライアント作成エラー: %w", err)
 	}
+	defer client.Close()
 
 	// Test I: 主アドレス宛に Binding Request
 	// RFC 5780 Section 4.3: "the client performs the UDP connectivity check"
-	test1, err := client.SendBindingRequest(server, false, false)
+	// 応答が無ければ次の候補アドレスにフェイルオーバーする
+	serverUDP, test1, err := client.bindFirstResponsive(servers)
 	if err != nil {
 		return nil, fmt.Errorf("マッピング Test I 失敗: %w", err)
 	}
@@ -210,9 +223,12 @@ func CheckMappingType(serverAddr string) (*CheckMappingResult, error) {
 	result := &CheckMappingResult{
 		NATType: Unknown,
 		Response: CheckMappingResponseData{
-			Mapping1:     test1.MappedAddress,
-			OtherAddress: test1.OtherAddress,
+			ServerAddress: serverUDP,
+			Mapping1:      test1.MappedAddress,
+			OtherAddress:  test1.OtherAddress,
 		},
+		Legacy: test1.Legacy,
+		NAT64:  client.detectNAT64(serverUDP, test1.MappedAddress),
 	}
 
 	// NAT の有無を確認: 外部マッピングがローカルアドレスと一致すれば、
@@ -222,16 +238,19 @@ func CheckMappingType(serverAddr string) (*CheckMappingResult, error) {
 	// この場合、マッピングは定義上 Endpoint Independent となる
 	if localAddr, localErr := client.LocalAddr(serverUDP); localErr == nil {
 		result.Response.LocalAddress = localAddr
-		if udpAddrEqual(test1.MappedAddress, localAddr) {
-			result.NoNAT = true
-			result.NATType = EndpointIndependent
-			return result, nil
-		}
+	}
+	// ALG はアドレス変換をしないファイアウォールにもあるため、NAT の有無に関わらず確認する
+	result.ALG = detectALG(test1, result.Response.LocalAddress)
+	if udpAddrEqual(test1.MappedAddress, result.Response.LocalAddress) {
+		result.NoNAT = true
+		result.NATType = EndpointIndependent
+		return result, nil
 	}
 
 	// Test II/III には「同じサーバーの別 IP」宛の送信が必要。
 	// OTHER-ADDRESS が無い、または主アドレスと IP が同じ場合は判定不可能
-	other := test1.OtherAddress
+	// NAT64 経由の場合、IPv4 の OTHER-ADDRESS は同じプレフィックスで IPv6 に変換して送る
+	other := result.NAT64.synthesize(test1.OtherAddress)
 	if other == nil || other.IP.Equal(serverUDP.IP) {
 		return result, nil
 	}
@@ -239,8 +258,8 @@ func CheckMappingType(serverAddr string) (*CheckMappingResult, error) {
 	// Test II: 代替 IP・主ポート宛に Binding Request
 	// RFC 5780 Section 4.3: "the client sends a Binding Request to the
 	// alternate address, but primary port"
-	test2Target := (&net.UDPAddr{IP: other.IP, Port: serverUDP.Port}).String()
-	test2, err := client.SendBindingRequest(test2Target, false, false)
+	test2Target := &net.UDPAddr{IP: other.IP, Port: serverUDP.Port}
+	test2, err := client.SendBindingRequestTo(test2Target, false, false)
 	if err != nil {
 		return result, fmt.Errorf("マッピング Test II 失敗: %w", err)
 	}
@@ -255,7 +274,7 @@ func CheckMappingType(serverAddr string) (*CheckMappingResult, error) {
 	// Test III: 代替 IP・代替ポート宛に Binding Request
 	// RFC 5780 Section 4.3: "the client sends a Binding Request to the
 	// alternate address and port"
-	test3, err := client.SendBindingRequest(other.String(), false, false)
+	test3, err := client.SendBindingRequestTo(other, false, false)
 	if err != nil {
 		return result, fmt.Errorf("マッピング Test III 失敗: %w", err)
 	}
@@ -303,37 +322,47 @@ func udpAddrEqual(a, b *net.UDPAddr) bool {
 //   - Endpoint-Independent Filtering: すべての外部アドレスからのパケットを許可
 //   - Address-Dependent Filtering: 通信済みIPアドレスからのみ許可
 //   - Address and Port-Dependent Filtering: 通信済みIP:ポートのみ許可
-func CheckFilteringBehavior(serverAddr string) (*CheckFilteringResult, error) {
-	client, err := NewSTUNClient()
+//
+// opts は内部で使う STUNClient に渡されます。
+func CheckFilteringBehavior(serverAddr string, opts ...Option) (*CheckFilteringResult, error) {
+	servers, err := newConfig(opts).resolveServers(serverAddr)
 	if err != nil {
-		return nil, fmt.Errorf("STUNクライアント作成エラー: %w", err)
+		return nil, fmt.Errorf("サーバーアドレス解決エラー: %w", err)
 	}
-	defer client.Close()
+	return checkFilteringBehavior(servers, opts)
+}
 
-	serverWithPort := withDefaultPort(serverAddr)
-	serverUDP, err := net.ResolveUDPAddr("udp", serverWithPort)
+// checkFilteringBehavior は解決済みのサーバー候補 servers に対してフィルタリング判定を行います
+func checkFilteringBehavior(servers []*net.UDPAddr, opts []Option) (*CheckFilteringResult, error) {
+	client, err := NewSTUNClient(opts...)
 	if err != nil {
-		return nil, fmt.Errorf("サーバーアドレス解決エラー: %w", err)
+		return nil, fmt.Errorf("STUNクライアント作成エラー: %w", err)
 	}
+	defer client.Close()
 
 	// Test I: 基本的なBinding Requestを送信し、OTHER-ADDRESSを取得
 	// RFC 5780: "The client performs a UDP connectivity check by sending
 	//            a STUN Binding Request to the server."
 	// レスポンスに含まれるOTHER-ADDRESSは、サーバーの代替IP:Portを示す
 	// XOR-MAPPED-ADDRESS と同じ Binding Response から 1 往復で取得する
-	test1, err := client.SendBindingRequest(serverWithPort, false, false)
+	// 応答が無ければ次の候補アドレスにフェイルオーバーする
+	serverUDP, test1, err := client.bindFirstResponsive(servers)
 	if err != nil {
 		return nil, fmt.Errorf("フィルタリング Test I 失敗: %w", err)
 	}
-	otherAddr := test1.OtherAddress
+	// NAT64 経由の場合、代替アドレスからの応答は NAT64 プレフィックス付きの
+	// IPv6 アドレスから届くため、OTHER-ADDRESS も同じ形に変換して比較する
+	otherAddr := client.detectNAT64(serverUDP, test1.MappedAddress).synthesize(test1.OtherAddress)
 
 	result := &CheckFilteringResult{
 		ServerSupport: STUNServerSupportInfo{
 			SupportsOtherAddress: otherAddr != nil,
 		},
 		Response: CheckFilteringResponseData{
-			OtherAddress: otherAddr,
+			ServerAddress: serverUDP,
+			OtherAddress:  test1.OtherAddress,
 		},
+		Legacy: test1.Legacy,
 	}
 
 	// OTHER-ADDRESSが取得できない場合、フィルタリング判定は不可能。
@@ -350,7 +379,7 @@ func CheckFilteringBehavior(serverAddr string) (*CheckFilteringResult, error) {
 	// サーバーは代替IP:Portから応答を送信する
 	// 代替IPからのレスポンスを受信 → Endpoint-Independent Filtering
 	// タイムアウト → Test IIIへ進む
-	testII, testIIErr := client.SendBindingRequest(serverWithPort, true, true)
+	testII, testIIErr := client.SendBindingRequestTo(serverUDP, true, true)
 
 	if testIIErr == nil {
 		// 応答が本当に「代替 IP」から来たことを検証する。
@@ -396,7 +425,7 @@ func CheckFilteringBehavior(serverAddr string) (*CheckFilteringResult, error) {
 	// サーバーは同じIPの異なるポートから応答を送信する
 	// 同じIP・異なるポートからのレスポンスを受信 → Address-Dependent Filtering
 	// タイムアウト → Address and Port-Dependent Filtering
-	testIII, testIIIErr := client.SendBindingRequest(serverWithPort, false, true)
+	testIII, testIIIErr := client.SendBindingRequestTo(serverUDP, false, true)
 
 	if testIIIErr == nil {
 		// 応答が「主アドレスと同じ IP・異なるポート」から来たことを検証する
@@ -457,20 +486,37 @@ func CheckFilteringBehavior(serverAddr string) (*CheckFilteringResult, error) {
 // この組み合わせにより、以下の9種類のNATタイプに分類されます：
 //   - 3種類のマッピング × 3種類のフィルタリング = 9通り
 //
-// serverAddr は "host" または "host:port" 形式で指定します。
+// serverAddr は "host"、"host:port"、または STUN URI ("stun:host:port") 形式で指定します。
+// opts は内部で実行する CheckMappingType / CheckFilteringBehavior にそのまま渡されます。
 // マッピング・フィルタリングとも OTHER-ADDRESS/CHANGE-REQUEST を
 // サポートする RFC 5780 対応サーバー（例: stunserver2025.stunprotocol.org）が必要です。
-func FullNATDetection(serverAddr string) (*FullNATDetectionResult, error) {
+func FullNATDetection(serverAddr string, opts ...Option) (*FullNATDetectionResult, error) {
+	// サーバーは判定全体で 1 度だけ解決する
+	servers, err := newConfig(opts).resolveServers(serverAddr)
+	if err != nil {
+		return nil, fmt.Errorf("サーバーアドレス解決エラー: %w", err)
+	}
+	return fullNATDetection(servers, opts)
+}
+
+// fullNATDetection は解決済みのサーバー候補 servers に対して
+// マッピング・フィルタリングの両方を判定します
+func fullNATDetection(servers []*net.UDPAddr, opts []Option) (*FullNATDetectionResult, error) {
+	// NAT64 プレフィックスの探索は両フェーズで共有する
+	opts = withNAT64Discovery(opts)
+
 	// Phase 1: マッピング判定
 	// RFC 5780 Section 4.3: Determining NAT Mapping Behavior
-	mappingResult, err := CheckMappingType(serverAddr)
+	mappingResult, err := checkMappingType(servers, opts)
 	if err != nil {
 		return nil, fmt.Errorf("マッピング判定エラー: %w", err)
 	}
 
 	// Phase 2: フィルタリング判定
 	// RFC 5780 Section 4.4: Determining NAT Filtering Behavior
-	filteringResult, err := CheckFilteringBehavior(serverAddr)
+	// マッピング判定で応答したサーバーと同じアドレスを使い、
+	// 両フェーズが同じサーバーインスタンスを相手にするようにする
+	filteringResult, err := checkFilteringBehavior([]*net.UDPAddr{mappingResult.Response.ServerAddress}, opts)
 	if err != nil {
 		return nil, fmt.Errorf("フィルタリング判定エラー: %w", err)
 	}
@@ -481,9 +527,13 @@ func FullNATDetection(serverAddr string) (*FullNATDetectionResult, error) {
 		Filtering: filteringResult.FilteringType,
 	}
 
+	// Phase 4: CGN や多段 NAT の有無を推定
+	natLayers := newConfig(opts).probeNATLayers(mappingResult.Response.ServerAddress, mappingResult)
+
 	return &FullNATDetectionResult{
 		DetailedType:    detailedType,
 		MappingResult:   mappingResult,
 		FilteringResult: filteringResult,
+		NATLayers:       natLayers,
 	}, nil
 }
@@ -0,0 +1,264 @@
+package natchecker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ClassicNATType は RFC 3489 Section 10.1 の判定フローによる古典的な NAT 分類
+//
+// DetailedNATType.LegacyName は RFC 5780 の 2 軸分類をコーン名に読み替えるだけなので、
+// NAT が無い場合や UDP 自体が通らない場合の判定結果を持たない。
+// ClassicNATType は RFC 3489 のフローチャートをそのまま実行した結果であり、
+// 旧来のツールと同じ語彙で比較するために使う。
+type ClassicNATType int
+
+const (
+	// ClassicUnknown: サーバーが CHANGED-ADDRESS / CHANGE-REQUEST に対応しておらず判定できない。
+	// ゼロ値なので、判定前の ClassicNATType が UDP Blocked と読まれることはない
+	ClassicUnknown ClassicNATType = iota
+	// ClassicUDPBlocked: Test I に応答が無い（UDP が通らない）
+	ClassicUDPBlocked
+	// ClassicOpenInternet: NAT が無く、任意の送信元からのパケットを受信できる
+	ClassicOpenInternet
+	// ClassicSymmetricUDPFirewall: NAT は無いが、通信済みでない送信元からのパケットが遮断される
+	ClassicSymmetricUDPFirewall
+	// ClassicFullCone: 任意の外部ホストが外部マッピング宛に送信できる
+	ClassicFullCone
+	// ClassicRestrictedCone: 通信済みの IP からのみ受信できる
+	ClassicRestrictedCone
+	// ClassicPortRestrictedCone: 通信済みの IP:Port からのみ受信できる
+	ClassicPortRestrictedCone
+	// ClassicSymmetric: 宛先ごとに異なる外部マッピングが割り当てられる
+	ClassicSymmetric
+)
+
+func (n ClassicNATType) String() string {
+	switch n {
+	case ClassicUDPBlocked:
+		return "UDP Blocked"
+	case ClassicOpenInternet:
+		return "Open Internet"
+	case ClassicSymmetricUDPFirewall:
+		return "Symmetric UDP Firewall"
+	case ClassicFullCone:
+		return "Full Cone NAT"
+	case ClassicRestrictedCone:
+		return "Restricted Cone NAT"
+	case ClassicPortRestrictedCone:
+		return "Port Restricted Cone NAT"
+	case ClassicSymmetric:
+		return "Symmetric NAT"
+	default:
+		return "Unknown"
+	}
+}
+
+// ClassicNATResponseData は RFC 3489 の各テストで得られたデータ
+type ClassicNATResponseData struct {
+	LocalAddress          *net.UDPAddr `json:"local_address"`           // クライアントのローカルアドレス
+	MappedAddress         *net.UDPAddr `json:"mapped_address"`          // Test I: 主アドレス宛のマッピング
+	ChangedAddress        *net.UDPAddr `json:"changed_address"`         // Test I で取得したサーバーの代替アドレス
+	ChangedMappedAddress  *net.UDPAddr `json:"changed_mapped_address"`  // Test I: CHANGED-ADDRESS 宛のマッピング
+	TestIResponse         bool         `json:"test_i_response"`         // Test I に応答があったか
+	TestIIResponse        bool         `json:"test_ii_response"`        // Test II (Change IP+Port) で代替 IP から応答があったか
+	TestIIIResponse       bool         `json:"test_iii_response"`       // Test III (Change Port) で同一 IP・別ポートから応答があったか
+	ChangeRequestRejected bool         `json:"change_request_rejected"` // サーバーが CHANGE-REQUEST を拒否・無視したか
+}
+
+// ClassicNATDetectionResult は RFC 3489 のフローによる NAT 判定結果
+type ClassicNATDetectionResult struct {
+	NATType  ClassicNATType         `json:"nat_type"`
+	Response ClassicNATResponseData `json:"response"`
+	// Legacy はサーバーが RFC 3489 形式で応答した（WithClassicMode 使用時）場合に true
+	Legacy bool `json:"legacy"`
+}
+
+// String は結果の文字列表現を返す
+func (r ClassicNATDetectionResult) String() string {
+	return fmt.Sprintf("NAT Type: %s (RFC 3489)", r.NATType)
+}
+
+// classicObservation は RFC 3489 の判定フローで観測した結果
+//
+// フローは途中で分岐するため、判定に使われないフィールドは参照されない。
+type classicObservation struct {
+	testI          bool // Test I に応答があった
+	noNAT          bool // Test I のマッピングがローカルアドレスと一致した
+	changedAddress bool // Test I の応答に CHANGED-ADDRESS があった
+	testII         bool // Test II に代替 IP から応答があった
+	sameMapping    bool // CHANGED-ADDRESS 宛 Test I のマッピングが最初の Test I と一致した
+	testIII        bool // Test III に同一 IP・別ポートから応答があった
+	unsupported    bool // サーバーが CHANGE-REQUEST を拒否・無視した
+}
+
+// determineClassicNATType は RFC 3489 Section 10.1 のフローチャートに従って
+// 観測結果から ClassicNATType を決定します
+//
+//	Test I ─ 応答なし ──────────────────────────── UDP Blocked
+//	   │
+//	   ├ マッピング = ローカル ─ Test II ─ 応答あり ─ Open Internet
+//	   │                                 └ 応答なし ─ Symmetric UDP Firewall
+//	   │
+//	   └ マッピング ≠ ローカル ─ Test II ─ 応答あり ─ Full Cone
+//	                                     └ 応答なし ─ Test I (CHANGED-ADDRESS 宛)
+//	                                          ├ マッピングが異なる ─ Symmetric
+//	                                          └ 同じ ─ Test III ─ 応答あり ─ Restricted Cone
+//	                                                            └ 応答なし ─ Port Restricted Cone
+func determineClassicNATType(obs classicObservation) ClassicNATType {
+	if !obs.testI {
+		return ClassicUDPBlocked
+	}
+	// Test II の応答元が代替 IP であることを確認できなければ、
+	// 以降の判定は意味を持たない
+	if !obs.changedAddress || obs.unsupported {
+		return ClassicUnknown
+	}
+
+	if obs.noNAT {
+		if obs.testII {
+			return ClassicOpenInternet
+		}
+		return ClassicSymmetricUDPFirewall
+	}
+
+	if obs.testII {
+		return ClassicFullCone
+	}
+	if !obs.sameMapping {
+		return ClassicSymmetric
+	}
+	if obs.testIII {
+		return ClassicRestrictedCone
+	}
+	return ClassicPortRestrictedCone
+}
+
+// ClassicNATDetection は RFC 3489 Section 10.1 の判定フローで NAT を分類します
+//
+// RFC 5780 の FullNATDetection と異なり、"Open Internet"、"Symmetric UDP Firewall"、
+// "UDP Blocked" を含む古典的な分類を返します。旧来のツールとの比較用です。
+//
+// serverAddr は "host"、"host:port"、または STUN URI ("stun:host:port") 形式で指定します。
+// CHANGED-ADDRESS (または OTHER-ADDRESS) と CHANGE-REQUEST に対応したサーバーが必要です。
+// RFC 3489 のみに対応した古いサーバーを使う場合は WithClassicMode を指定してください。
+//
+// RFC 3489 の分類は RFC 4787 で「NAT の挙動を正しく表現できない」とされており、
+// 結果は参考情報として扱ってください。
+func ClassicNATDetection(serverAddr string, opts ...Option) (*ClassicNATDetectionResult, error) {
+	client, err := NewSTUNClient(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("STUNクライアント作成エラー: %w", err)
+	}
+	defer client.Close()
+
+	// サーバーは 1 度だけ解決し、以降のテストは解決済みのアドレス宛に送る
+	servers, err := client.cfg.resolveServers(serverAddr)
+	if err != nil {
+		return nil, fmt.Errorf("サーバーアドレス解決エラー: %w", err)
+	}
+
+	result := &ClassicNATDetectionResult{}
+	var obs classicObservation
+
+	// Test I: 主アドレス宛に Binding Request
+	// RFC 3489 Section 10.1: "If no response is received, the client knows
+	// right away that it is not capable of UDP connectivity."
+	// 応答が無ければ次の候補アドレスにフェイルオーバーし、すべての候補が
+	// タイムアウトした場合に UDP Blocked とする
+	serverUDP, test1, err := client.bindFirstResponsive(servers)
+	if err != nil {
+		if isTimeoutError(err) {
+			result.NATType = determineClassicNATType(obs)
+			return result, nil
+		}
+		return nil, fmt.Errorf("Test I エラー: %w", err)
+	}
+	obs.testI = true
+	result.Legacy = test1.Legacy
+	result.Response.TestIResponse = true
+	result.Response.MappedAddress = test1.MappedAddress
+	result.Response.ChangedAddress = test1.OtherAddress
+
+	if localAddr, localErr := client.LocalAddr(serverUDP); localErr == nil {
+		result.Response.LocalAddress = localAddr
+		obs.noNAT = udpAddrEqual(test1.MappedAddress, localAddr)
+	}
+
+	// NAT64 経由の場合、IPv4 の CHANGED-ADDRESS は同じプレフィックスで IPv6 に変換して送る
+	changed := client.detectNAT64(serverUDP, test1.MappedAddress).synthesize(test1.OtherAddress)
+	obs.changedAddress = changed != nil && !changed.IP.Equal(serverUDP.IP)
+	if !obs.changedAddress {
+		result.NATType = determineClassicNATType(obs)
+		return result, nil
+	}
+
+	// Test II: CHANGE-REQUEST で IP とポートの両方の変更を要求
+	// 応答が代替 IP から届けば、未通信の送信元からのパケットも受信できる
+	obs.testII, obs.unsupported, err = classicChangeTest(client, serverUDP, true, true, func(from *net.UDPAddr) bool {
+		return from.IP.Equal(changed.IP)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Test II エラー: %w", err)
+	}
+	result.Response.TestIIResponse = obs.testII
+	if obs.noNAT || obs.testII || obs.unsupported {
+		result.Response.ChangeRequestRejected = obs.unsupported
+		result.NATType = determineClassicNATType(obs)
+		return result, nil
+	}
+
+	// Test I を CHANGED-ADDRESS 宛に再実行し、宛先によってマッピングが変わるか確認する
+	// RFC 3489 Section 10.1: "If the IP address and port returned in MAPPED-ADDRESS
+	// are not the same as the ones from the first test, the client knows its
+	// behind a symmetric NAT."
+	test1Changed, err := client.SendBindingRequestTo(changed, false, false)
+	if err != nil {
+		return nil, fmt.Errorf("CHANGED-ADDRESS 宛 Test I エラー: %w", err)
+	}
+	result.Response.ChangedMappedAddress = test1Changed.MappedAddress
+	obs.sameMapping = udpAddrEqual(test1.MappedAddress, test1Changed.MappedAddress)
+	if !obs.sameMapping {
+		result.NATType = determineClassicNATType(obs)
+		return result, nil
+	}
+
+	// Test III: CHANGE-REQUEST でポートのみの変更を要求
+	obs.testIII, obs.unsupported, err = classicChangeTest(client, serverUDP, false, true, func(from *net.UDPAddr) bool {
+		return from.IP.Equal(serverUDP.IP) && from.Port != serverUDP.Port
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Test III エラー: %w", err)
+	}
+	result.Response.TestIIIResponse = obs.testIII
+	result.Response.ChangeRequestRejected = obs.unsupported
+	result.NATType = determineClassicNATType(obs)
+	return result, nil
+}
+
+// classicChangeTest は CHANGE-REQUEST 付きの Binding Request を送り、
+// 期待した送信元から応答が届いたかどうかを返します。
+//
+// タイムアウトは「応答なし」として扱う。STUN エラーレスポンスや、
+// expectedFrom を満たさない送信元からの応答は CHANGE-REQUEST 非対応
+// (unsupported) とみなす。
+func classicChangeTest(client *STUNClient, server *net.UDPAddr, changeIP, changePort bool, expectedFrom func(*net.UDPAddr) bool) (responded, unsupported bool, err error) {
+	res, err := client.SendBindingRequestTo(server, changeIP, changePort)
+	if err != nil {
+		var stunErr *STUNError
+		switch {
+		case errors.As(err, &stunErr):
+			return false, true, nil
+		case isTimeoutError(err):
+			return false, false, nil
+		default:
+			return false, false, err
+		}
+	}
+
+	if res.ResponseFrom != nil && expectedFrom(res.ResponseFrom) {
+		return true, false, nil
+	}
+	return false, true, nil
+}
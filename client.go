@@ -29,6 +29,12 @@ const (
 	//                      attribute containing the error code specified."
 	// メッセージタイプ構造: Method=0x001 (Binding), Class=0b11 (Error Response)
 	BindingErrorResponse STUNMessageType = 0x0111
+
+	// BindingIndication (0x0011) - STUNバインディングインディケーション
+	// RFC 8489 Section 6.3.2: "no response is generated for an indication"
+	// NAT のマッピングを維持するためのキープアライブとして使える
+	// メッセージタイプ構造: Method=0x001 (Binding), Class=0b01 (Indication)
+	BindingIndication STUNMessageType = 0x0011
 )
 
 // STUNアトリビュートタイプ
@@ -53,6 +59,12 @@ const (
 	// 注意: この属性はRFC 8489で削除されましたが、RFC 5780のNAT検出に必要です
 	ChangeRequest STUNAttributeType = 0x0003
 
+	// SOURCE-ADDRESS 属性 (Type 0x0004) - RFC 3489のみ
+	// RFC 3489 Section 11.2.5: "The SOURCE-ADDRESS attribute is present in Binding
+	//                           Responses. It indicates the source IP address and
+	//                           port that the server is sending the response from."
+	SourceAddress STUNAttributeType = 0x0004
+
 	// CHANGED-ADDRESS 属性 (Type 0x0005) - RFC 3489のみ
 	// RFC 3489: サーバーの代替IP:Portを示す（OTHER-ADDRESSの前身）
 	ChangedAddress STUNAttributeType = 0x0005
@@ -65,13 +77,45 @@ const (
 	// 注意: RFC 3489のCHANGED-ADDRESSと同じ属性番号を使用
 	OtherAddress STUNAttributeType = 0x802C
 
+	// RESPONSE-PORT 属性 (Type 0x0027)
+	// RFC 5780 Section 7.5: "The RESPONSE-PORT attribute contains a port. The
+	//                        attribute can be present in the Binding Request and
+	//                        indicates which port the Binding Response will be sent to."
+	ResponsePort STUNAttributeType = 0x0027
+
+	// RESPONSE-ORIGIN 属性 (Type 0x802B)
+	// RFC 5780 Section 7.3: "The RESPONSE-ORIGIN attribute is inserted by the server
+	//                        and indicates the source IP address and port the
+	//                        response was sent from."
+	ResponseOrigin STUNAttributeType = 0x802B
+
+	// UNKNOWN-ATTRIBUTES 属性 (Type 0x000A)
+	// RFC 8489 Section 14.9: エラーコード 420 のレスポンスで、サーバーが理解できなかった
+	// comprehension-required 属性のタイプを列挙する
+	UnknownAttributes STUNAttributeType = 0x000A
+
 	// ERROR-CODE 属性 (Type 0x0009)
 	// RFC 8489 Section 14.8: "The ERROR-CODE attribute is used in error response messages.
 	//                         It contains a numeric error code value in the range of
 	//                         300 to 699 plus a textual reason phrase"
 	ErrorCode STUNAttributeType = 0x0009
+
+	// FINGERPRINT 属性 (Type 0x8028)
+	// RFC 8489 Section 14.7: "When present, the FINGERPRINT attribute MUST be
+	//                         the last attribute in the message"
+	Fingerprint STUNAttributeType = 0x8028
 )
 
+// isAddressAttribute はアドレス形式 (RFC 8489 Section 14.1) の属性かどうかを返します。
+// 厳格モードではこれらの属性の重複を不正として扱う
+func isAddressAttribute(t STUNAttributeType) bool {
+	switch t {
+	case MappedAddress, XorMappedAddress, OtherAddress, ChangedAddress, SourceAddress:
+		return true
+	}
+	return false
+}
+
 // STUN Magic Cookie
 // RFC 8489 Section 5: "The magic cookie field MUST contain the fixed value 0x2112A442 in network byte order."
 const STUNMagicCookie uint32 = 0x2112A442
@@ -95,10 +139,18 @@ var STUNMagicCookieBytes = []byte{0x21, 0x12, 0xA4, 0x42}
 //	|                     Transaction ID (96 bits)                  |
 //	|                                                               |
 //	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//
+// RFC 3489 形式のメッセージには Magic Cookie が無く、その位置を含む
+// 128 ビットが Transaction ID になる。この場合 Legacy を true とし、
+// 先頭 32 ビットを TransactionIDPrefix、残り 96 ビットを TransactionID に保持する。
 type STUNMessage struct {
 	MessageType   STUNMessageType
 	TransactionID [12]byte
 	Attributes    []STUNAttribute
+	// Legacy は RFC 3489 形式（Magic Cookie なし）のメッセージであることを示す
+	Legacy bool
+	// TransactionIDPrefix は Legacy の場合の Transaction ID 先頭 32 ビット
+	TransactionIDPrefix [4]byte
 }
 
 // RFC 8489 Section 14: "STUN Attributes" の 1 要素を表す
@@ -137,46 +189,39 @@ func (e *STUNError) Error() string {
 
 // STUNクライアント
 type STUNClient struct {
-	conn *net.UDPConn
+	transport Transport
+	cfg       config
 }
 
-func NewSTUNClient() (*STUNClient, error) {
-	addr, err := net.ResolveUDPAddr("udp", ":0")
-	if err != nil {
-		return nil, err
-	}
+func NewSTUNClient(opts ...Option) (*STUNClient, error) {
+	cfg := newConfig(opts)
 
-	conn, err := net.ListenUDP("udp", addr)
+	// WithAddressFamily で IPv4/IPv6 のみを指定した場合はソケットもその
+	// ファミリーに限定する。それ以外はデュアルスタックのソケットを使う
+	transport, err := cfg.newTransport(cfg.family.network())
 	if err != nil {
 		return nil, err
 	}
 
-	return &STUNClient{conn: conn}, nil
+	return &STUNClient{transport: transport, cfg: cfg}, nil
+}
+
+// NewSTUNClientWithTransport は transport で送受信するクライアントを作ります。
+// transport はクライアントの Close で閉じられる
+func NewSTUNClientWithTransport(transport Transport, opts ...Option) *STUNClient {
+	return &STUNClient{transport: transport, cfg: newConfig(opts)}
 }
 
 func (c *STUNClient) Close() {
-	if c.conn != nil {
-		c.conn.Close()
+	if c.transport != nil {
+		c.transport.Close()
 	}
 }
 
 // LocalAddr は server へ送信する際に使われるローカル IP と、クライアントが
-// バインドしているポートの組を返します。
-//
-// conn は ":0"（全インターフェース・任意ポート）にバインドされているため
-// conn.LocalAddr() だけでは送信元 IP が分からない。実際の送信元 IP は
-// 宛先へのルーティングで決まるので、プローブ用の接続で解決する。
+// バインドしているポートの組を返します。解決方法は Transport の実装による
 func (c *STUNClient) LocalAddr(server *net.UDPAddr) (*net.UDPAddr, error) {
-	probe, err := net.DialUDP("udp", nil, server)
-	if err != nil {
-		return nil, err
-	}
-	defer probe.Close()
-
-	return &net.UDPAddr{
-		IP:   probe.LocalAddr().(*net.UDPAddr).IP,
-		Port: c.conn.LocalAddr().(*net.UDPAddr).Port,
-	}, nil
+	return c.transport.LocalAddr(server)
 }
 
 // BindingResult は Binding トランザクション 1 往復で得られる情報
@@ -184,20 +229,64 @@ type BindingResult struct {
 	// MappedAddress はクライアントの外部アドレス
 	// (XOR-MAPPED-ADDRESS または MAPPED-ADDRESS)
 	MappedAddress *net.UDPAddr
+	// PlainMappedAddress, XorMappedAddress はレスポンスに含まれていた MAPPED-ADDRESS と
+	// XOR-MAPPED-ADDRESS そのもの。含まれていなければ nil。
+	// 両者の食い違いはペイロードを書き換える ALG の痕跡になる
+	PlainMappedAddress *net.UDPAddr
+	XorMappedAddress   *net.UDPAddr
 	// OtherAddress はサーバーの代替アドレス
 	// (OTHER-ADDRESS または CHANGED-ADDRESS)。レスポンスに含まれなければ nil
 	OtherAddress *net.UDPAddr
 	// ResponseFrom はレスポンスの送信元アドレス
 	ResponseFrom *net.UDPAddr
+	// SourceAddress はサーバーが申告したレスポンスの送信元アドレス
+	// (RFC 3489 SOURCE-ADDRESS)。レスポンスに含まれなければ nil
+	SourceAddress *net.UDPAddr
+	// Legacy はレスポンスが RFC 3489 形式（Magic Cookie なし）だった場合に true
+	Legacy bool
 }
 
 // RFC 8489 Section 2: "The Binding method can be used to determine the particular binding a NAT has allocated to a STUN client"
+//
+// serverAddr は "host"、"host:port"、または STUN URI ("stun:host:port") 形式で指定します。
+// ポートを省略したドメイン名は DNS SRV (_stun._udp) で探索されます。
 func (c *STUNClient) SendBindingRequest(serverAddr string, changeIP, changePort bool) (*BindingResult, error) {
-	addr, err := net.ResolveUDPAddr("udp", serverAddr)
+	addr, err := c.resolveServer(serverAddr)
 	if err != nil {
 		return nil, err
 	}
 
+	return c.SendBindingRequestTo(addr, changeIP, changePort)
+}
+
+// SendBindingRequestTo は解決済みのアドレス addr 宛に Binding Request を送信します。
+//
+// 同じサーバーに対して複数回のテストを行う場合は、名前解決の結果が呼び出しごとに
+// 変わらないよう、解決済みのアドレスを使ってこのメソッドを呼び出します。
+func (c *STUNClient) SendBindingRequestTo(addr *net.UDPAddr, changeIP, changePort bool) (*BindingResult, error) {
+	_, transmitCount := c.cfg.retransmission()
+	return c.sendBindingRequest(addr, changeIP, changePort, transmitCount)
+}
+
+// sendBindingRequest は送信回数を transmitCount に制限して SendBindingRequestTo と同じ処理を行います
+func (c *STUNClient) sendBindingRequest(addr *net.UDPAddr, changeIP, changePort bool, transmitCount int) (*BindingResult, error) {
+	msg := c.newBindingRequest(changeIP, changePort)
+
+	// メッセージをバイト列に変換
+	data := c.encodeMessage(msg)
+
+	// 送信・レスポンス受信（応答がなければ再送）
+	// RFC 8489 Section 6.3.1.1: "When forming the success response, the server adds an XOR-MAPPED-ADDRESS attribute"
+	response, from, err := c.roundTripN(addr, data, msg.TransactionID, nil, transmitCount)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.parseBindingResponse(response, from)
+}
+
+// newBindingRequest は新しい Transaction ID を持つ Binding Request を組み立てます
+func (c *STUNClient) newBindingRequest(changeIP, changePort bool) STUNMessage {
 	// トランザクションID生成
 	// RFC 8489 Section 5: "The transaction ID is a 96-bit identifier, used to uniquely identify STUN transactions."
 	// RFC 8489 Section 5: "The transaction ID MUST be uniformly and randomly chosen from the interval 0 .. 2**96-1, and MUST be cryptographically random."
@@ -209,6 +298,19 @@ func (c *STUNClient) SendBindingRequest(serverAddr string, changeIP, changePort
 		TransactionID: txID,
 	}
 
+	// クラシックモードでは RFC 3489 形式の 128 ビット Transaction ID を使う
+	// RFC 3489 Section 11.1: "The transaction ID is a 128 bit identifier."
+	// 先頭 32 ビットが偶然 Magic Cookie と一致すると RFC 8489 形式と区別できないため避ける
+	if c.cfg.classic {
+		msg.Legacy = true
+		for {
+			rand.Read(msg.TransactionIDPrefix[:])
+			if binary.BigEndian.Uint32(msg.TransactionIDPrefix[:]) != STUNMagicCookie {
+				break
+			}
+		}
+	}
+
 	// Change Requestアトリビュート追加
 	// RFC 3489 Section 11.2.4: CHANGE-REQUEST Attribute
 	// 注意: この属性はRFC 3489で定義され、RFC 8489では削除されています。
@@ -242,32 +344,80 @@ func (c *STUNClient) SendBindingRequest(serverAddr string, changeIP, changePort
 		})
 	}
 
-	// メッセージをバイト列に変換
-	data := c.encodeMessage(msg)
+	return msg
+}
 
-	// 送信・レスポンス受信（応答がなければ再送）
-	// RFC 8489 Section 6.3.1.1: "When forming the success response, the server adds an XOR-MAPPED-ADDRESS attribute"
-	response, from, err := c.roundTrip(addr, data, txID)
+// SendBindingIndication は addr 宛に Binding Indication を送信します。
+//
+// RFC 8489 Section 6.3.2: インディケーションには応答が返らないため、
+// サーバーからの受信を伴わずに NAT のマッピングを外向きの通信だけで維持できる。
+func (c *STUNClient) SendBindingIndication(addr *net.UDPAddr) error {
+	var txID [12]byte
+	rand.Read(txID[:])
+
+	data := c.encodeMessage(STUNMessage{
+		MessageType:   BindingIndication,
+		TransactionID: txID,
+	})
+	return c.transport.Send(data, addr)
+}
+
+// sendBindingRequestWithResponsePort は RESPONSE-PORT 付きの Binding Request を
+// addr 宛に 1 度だけ送信し、その Transaction ID を返します。応答は待たない。
+// changeIP, changePort を指定すると CHANGE-REQUEST も付ける。
+//
+// RFC 5780 Section 7.5: サーバーは応答を送信元 IP の port 宛に送るため、
+// 応答は別のソケット（外部マッピングのポートが port のもの）で受信する。
+func (c *STUNClient) sendBindingRequestWithResponsePort(addr *net.UDPAddr, port int, changeIP, changePort bool) ([12]byte, error) {
+	msg := c.newBindingRequest(changeIP, changePort)
+
+	// RFC 5780 Section 7.5: 16 ビットのポートに 16 ビットのパディングが続く
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint16(value, uint16(port))
+	msg.Attributes = append(msg.Attributes, STUNAttribute{
+		Type:   ResponsePort,
+		Length: 4,
+		Value:  value,
+	})
+
+	err := c.transport.Send(c.encodeMessage(msg), addr)
+	return msg.TransactionID, err
+}
+
+// awaitBindingResponse は Transaction ID が txID の Binding Response を
+// timeout まで待って返します。リクエストは再送しない
+func (c *STUNClient) awaitBindingResponse(txID [12]byte, timeout time.Duration) (*BindingResult, error) {
+	response, from, err := c.readResponse(time.Now().Add(timeout), txID, nil)
 	if err != nil {
 		return nil, err
 	}
+	return c.parseBindingResponse(response, from)
+}
 
+// parseBindingResponse は Binding レスポンスから BindingResult を組み立てます。
+// from はレスポンスの送信元アドレス
+func (c *STUNClient) parseBindingResponse(response *STUNMessage, from *net.UDPAddr) (*BindingResult, error) {
 	// エラーレスポンスのチェック
 	if response.MessageType == BindingErrorResponse {
 		code, reason := extractErrorCode(response)
 		return nil, &STUNError{Code: code, Reason: reason}
 	}
 
-	result := &BindingResult{ResponseFrom: from}
+	result := &BindingResult{ResponseFrom: from, Legacy: response.Legacy}
 
 	// RFC 8489 Section 14.2: "The XOR-MAPPED-ADDRESS attribute is identical to the MAPPED-ADDRESS attribute, except that the reflexive transport address is obfuscated."
 	// RFC 8489 Section 14.1: "The MAPPED-ADDRESS attribute indicates a reflexive transport address of the client."
 	// RFC 5780 Section 7.2: OTHER-ADDRESS も同じ Binding Response に含まれるため、
 	// 1 往復でまとめて取得する
 	var mappedAddress, xorMappedAddress *net.UDPAddr
+	var err error
 	for _, attr := range response.Attributes {
 		switch attr.Type {
 		case XorMappedAddress:
+			// XOR の鍵となる Magic Cookie が無い RFC 3489 形式では解釈できない
+			if response.Legacy {
+				continue
+			}
 			xorMappedAddress, err = c.parseAddress(attr.Value, true, response.TransactionID)
 			if err != nil {
 				return nil, err
@@ -283,10 +433,16 @@ func (c *STUNClient) SendBindingRequest(serverAddr string, changeIP, changePort
 			if otherAddr, parseErr := c.parseAddress(attr.Value, false, response.TransactionID); parseErr == nil {
 				result.OtherAddress = otherAddr
 			}
+		case SourceAddress:
+			if sourceAddr, parseErr := c.parseAddress(attr.Value, false, response.TransactionID); parseErr == nil {
+				result.SourceAddress = sourceAddr
+			}
 		}
 	}
 
 	// XOR-MAPPED-ADDRESS を優先する
+	result.PlainMappedAddress = mappedAddress
+	result.XorMappedAddress = xorMappedAddress
 	result.MappedAddress = xorMappedAddress
 	if result.MappedAddress == nil {
 		result.MappedAddress = mappedAddress
@@ -314,16 +470,25 @@ const (
 // "the client retransmits the request, doubling the RTO"
 // UDP パケットが 1 つ落ちただけでタイムアウト（＝フィルタリング判定では
 // 「フィルタされた」と解釈される）になるのを防ぐため、再送してから結論を出す。
-func (c *STUNClient) roundTrip(server *net.UDPAddr, request []byte, txID [12]byte) (*STUNMessage, *net.UDPAddr, error) {
-	rto := stunInitialRTO
+//
+// key は長期認証で署名したリクエストの鍵で、応答の MESSAGE-INTEGRITY の検証に使う。
+// 署名していないリクエストでは nil
+func (c *STUNClient) roundTrip(server *net.UDPAddr, request []byte, txID [12]byte, key []byte) (*STUNMessage, *net.UDPAddr, error) {
+	_, transmitCount := c.cfg.retransmission()
+	return c.roundTripN(server, request, txID, key, transmitCount)
+}
+
+// roundTripN は送信回数を transmitCount に制限して roundTrip と同じ処理を行います
+func (c *STUNClient) roundTripN(server *net.UDPAddr, request []byte, txID [12]byte, key []byte, transmitCount int) (*STUNMessage, *net.UDPAddr, error) {
+	rto, _ := c.cfg.retransmission()
 	var lastErr error
 
-	for attempt := 0; attempt < stunTransmitCount; attempt++ {
-		if _, err := c.conn.WriteToUDP(request, server); err != nil {
+	for attempt := 0; attempt < transmitCount; attempt++ {
+		if err := c.transport.Send(request, server); err != nil {
 			return nil, nil, err
 		}
 
-		msg, from, err := c.readResponse(time.Now().Add(rto), txID)
+		msg, from, err := c.readResponse(time.Now().Add(rto), txID, key)
 		if err == nil {
 			return msg, from, nil
 		}
@@ -348,14 +513,13 @@ func (c *STUNClient) roundTrip(server *net.UDPAddr, request []byte, txID [12]byt
 // 遅延応答や無関係な UDP パケットなので、読み捨てて再受信します。
 // これにより、タイムアウトした Test II の遅延応答がソケットバッファに残って
 // Test III の応答として誤読されることを防ぎます。
-func (c *STUNClient) readResponse(deadline time.Time, txID [12]byte) (*STUNMessage, *net.UDPAddr, error) {
+//
+// RFC 8489 Section 9.2.5: key が nil でなければ、MESSAGE-INTEGRITY が無い、または
+// 一致しない応答も "discarded, as if it had never been received" として読み捨てます。
+func (c *STUNClient) readResponse(deadline time.Time, txID [12]byte, key []byte) (*STUNMessage, *net.UDPAddr, error) {
 	buffer := make([]byte, 1500)
 	for {
-		if err := c.conn.SetReadDeadline(deadline); err != nil {
-			return nil, nil, err
-		}
-
-		n, from, err := c.conn.ReadFromUDP(buffer)
+		n, from, err := c.transport.Receive(buffer, deadline)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -366,15 +530,33 @@ func (c *STUNClient) readResponse(deadline time.Time, txID [12]byte) (*STUNMessa
 			continue
 		}
 
+		// RFC 3489 形式の応答も下位 96 ビットで照合する。下位 96 ビットは
+		// 暗号論的乱数なので、先頭 32 ビットを照合しなくても取り違えは起きない
 		if msg.TransactionID != txID {
 			// 別トランザクションの応答は無視して再受信
 			continue
 		}
 
+		if key != nil && !unauthenticatedErrorResponse(msg) && !VerifyIntegrity(buffer[:n], key) {
+			// 改ざんされた、または第三者が偽造した応答は無視して再受信
+			continue
+		}
+
 		return msg, from, nil
 	}
 }
 
+// unauthenticatedErrorResponse は msg がサーバーが資格情報を検証する前に返すエラーレスポンス
+// (400 Bad Request、401 Unauthenticated、438 Stale Nonce) かどうかを返します。
+// これらにはサーバーが鍵を持たないため MESSAGE-INTEGRITY が付かない (RFC 8489 Section 9.2.4)
+func unauthenticatedErrorResponse(msg *STUNMessage) bool {
+	if uint16(msg.MessageType)&0x0110 != 0x0110 {
+		return false
+	}
+	code, _ := extractErrorCode(msg)
+	return code == 400 || code == 401 || code == 438
+}
+
 // RFC 8489 Section 5: "All STUN messages comprise a 20-byte header followed by zero or more attributes"
 func (c *STUNClient) encodeMessage(msg STUNMessage) []byte {
 	// アトリビュート部分の長さ計算
@@ -396,7 +578,12 @@ func (c *STUNClient) encodeMessage(msg STUNMessage) []byte {
 	// RFC 8489 Section 5: "The message length MUST contain the size of the message in bytes, not including the 20-byte STUN header."
 	binary.BigEndian.PutUint16(data[2:4], uint16(attrLen))
 	// RFC 8489 Section 5: "The magic cookie field MUST contain the fixed value 0x2112A442"
-	binary.BigEndian.PutUint32(data[4:8], STUNMagicCookie)
+	// RFC 3489 形式では Magic Cookie の位置に Transaction ID の先頭 32 ビットが入る
+	if msg.Legacy {
+		copy(data[4:8], msg.TransactionIDPrefix[:])
+	} else {
+		binary.BigEndian.PutUint32(data[4:8], STUNMagicCookie)
+	}
 	// RFC 8489 Section 5: "The transaction ID is a 96-bit (12-byte) identifier"
 	copy(data[8:20], msg.TransactionID[:])
 
@@ -431,9 +618,14 @@ func (c *STUNClient) decodeMessage(data []byte) (*STUNMessage, error) {
 	}
 
 	// RFC 8489 Section 5: "The magic cookie field MUST contain the fixed value 0x2112A442"
-	// Magic Cookie が一致しないパケットは STUN メッセージではないため弾く
+	// Magic Cookie が一致しないパケットは STUN メッセージではないため弾く。
+	// ただしクラシックモードでは RFC 3489 形式（128 ビット Transaction ID）として受け入れる
 	if binary.BigEndian.Uint32(data[4:8]) != STUNMagicCookie {
-		return nil, fmt.Errorf("invalid magic cookie: 0x%08x", binary.BigEndian.Uint32(data[4:8]))
+		if !c.cfg.classic {
+			return nil, fmt.Errorf("invalid magic cookie: 0x%08x", binary.BigEndian.Uint32(data[4:8]))
+		}
+		msg.Legacy = true
+		copy(msg.TransactionIDPrefix[:], data[4:8])
 	}
 
 	// RFC 8489 Section 5: "The message length MUST contain the size, in bytes, of the message not including the 20-byte STUN header."
@@ -445,11 +637,19 @@ func (c *STUNClient) decodeMessage(data []byte) (*STUNMessage, error) {
 	// （UDP パケット末尾に余分なデータがあっても無視する）
 	end := 20 + messageLength
 
+	// RFC 8489 Section 5: "the message length MUST be a multiple of 4"
+	// 全属性は 4 バイト境界にパディングされるため、厳格モードでは端数を許さない
+	if c.cfg.strict && messageLength%4 != 0 {
+		return nil, fmt.Errorf("message length %d is not a multiple of 4", messageLength)
+	}
+
 	copy(msg.TransactionID[:], data[8:20])
 
 	// アトリビュート解析
 	// RFC 8489 Section 14: "After the STUN header are zero or more attributes."
 	offset := 20
+	seenAddress := make(map[STUNAttributeType]bool)
+	seenFingerprint := false
 	for offset < end {
 		if offset+4 > end {
 			return nil, fmt.Errorf("truncated attribute header at offset %d", offset)
@@ -463,6 +663,18 @@ func (c *STUNClient) decodeMessage(data []byte) (*STUNMessage, error) {
 			return nil, fmt.Errorf("truncated attribute value at offset %d", offset)
 		}
 
+		if c.cfg.strict {
+			if err := checkStrictAttribute(data[:end], offset, attrType, attrLength, seenAddress, seenFingerprint); err != nil {
+				return nil, err
+			}
+			if isAddressAttribute(attrType) {
+				seenAddress[attrType] = true
+			}
+			if attrType == Fingerprint {
+				seenFingerprint = true
+			}
+		}
+
 		attr := STUNAttribute{
 			Type:   attrType,
 			Length: attrLength,
@@ -483,6 +695,38 @@ func (c *STUNClient) decodeMessage(data []byte) (*STUNMessage, error) {
 	return msg, nil
 }
 
+// checkStrictAttribute は厳格モードで offset にある属性を検証します。
+// data は Message Length が示す範囲までのメッセージ全体
+func checkStrictAttribute(data []byte, offset int, attrType STUNAttributeType, attrLength uint16, seenAddress map[STUNAttributeType]bool, seenFingerprint bool) error {
+	// RFC 8489 Section 14.7: "the FINGERPRINT attribute MUST be the last attribute in the message"
+	if seenFingerprint {
+		return fmt.Errorf("attribute 0x%04x after FINGERPRINT at offset %d", uint16(attrType), offset)
+	}
+
+	// 同じアドレス属性が複数あると、どちらを信じるかが実装依存になる
+	if isAddressAttribute(attrType) && seenAddress[attrType] {
+		return fmt.Errorf("duplicate address attribute 0x%04x at offset %d", uint16(attrType), offset)
+	}
+
+	// RFC 8489 Section 14: パディングはメッセージ内に収まり、値は 0 でなければならない
+	// (受信側は無視してよいとされているが、送信側は 0 を詰める)
+	valueEnd := offset + 4 + int(attrLength)
+	padding := 0
+	if attrLength%4 != 0 {
+		padding = 4 - int(attrLength%4)
+	}
+	if valueEnd+padding > len(data) {
+		return fmt.Errorf("attribute 0x%04x padding exceeds message length at offset %d", uint16(attrType), offset)
+	}
+	for _, b := range data[valueEnd : valueEnd+padding] {
+		if b != 0 {
+			return fmt.Errorf("non-zero padding in attribute 0x%04x at offset %d", uint16(attrType), offset)
+		}
+	}
+
+	return nil
+}
+
 // RFC 8489 Section 14.1 (MAPPED-ADDRESS) と Section 14.2 (XOR-MAPPED-ADDRESS) のアドレス解析
 // MAPPED-ADDRESS と XOR-MAPPED-ADDRESS は同じ形式だが、XOR-MAPPED-ADDRESS は Magic Cookie と Transaction ID で XOR される
 //
@@ -515,6 +759,11 @@ func (c *STUNClient) parseAddress(data []byte, isXor bool, txID [12]byte) (*net.
 	// RFC 8489 Section 14.1: "The address family can take on the following values: 0x01 (IPv4), 0x02 (IPv6)"
 	// STUNアドレス形式: 1バイト予約 + 1バイトファミリー + 2バイトポート + IPアドレス
 	family := data[1] // 2バイト目がファミリー
+
+	// RFC 8489 Section 14.1: "The first 8 bits of the MAPPED-ADDRESS MUST be set to 0"
+	if c.cfg.strict && data[0] != 0 {
+		return nil, fmt.Errorf("address reserved bits are not zero: 0x%02x", data[0])
+	}
 	port := binary.BigEndian.Uint16(data[2:4])
 
 	var ip net.IP
@@ -525,6 +774,9 @@ func (c *STUNClient) parseAddress(data []byte, isXor bool, txID [12]byte) (*net.
 		if len(data) < 8 {
 			return nil, fmt.Errorf("IPv4 address data too short: %d bytes", len(data))
 		}
+		if c.cfg.strict && len(data) != 8 {
+			return nil, fmt.Errorf("IPv4 address data has %d trailing bytes", len(data)-8)
+		}
 		ip = make(net.IP, 4)
 		copy(ip, data[4:8])
 
@@ -542,6 +794,9 @@ func (c *STUNClient) parseAddress(data []byte, isXor bool, txID [12]byte) (*net.
 		if len(data) < 20 {
 			return nil, fmt.Errorf("IPv6 address data too short: %d bytes", len(data))
 		}
+		if c.cfg.strict && len(data) != 20 {
+			return nil, fmt.Errorf("IPv6 address data has %d trailing bytes", len(data)-20)
+		}
 		ip = make(net.IP, 16)
 		copy(ip, data[4:20])
 
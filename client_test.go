@@ -16,7 +16,7 @@ func TestSTUNClientCreation(t *testing.T) {
 	require.NoError(t, err, "NewSTUNClient() should not fail")
 	defer client.Close()
 
-	assert.NotNil(t, client.conn, "STUNClient connection should not be nil")
+	assert.NotNil(t, client.transport, "STUNClient transport should not be nil")
 }
 
 func TestLocalAddr(t *testing.T) {
@@ -30,10 +30,28 @@ func TestLocalAddr(t *testing.T) {
 	require.NoError(t, err, "LocalAddr() should not fail")
 
 	assert.True(t, localAddr.IP.IsLoopback(), "local IP toward loopback should be loopback")
-	assert.Equal(t, client.conn.LocalAddr().(*net.UDPAddr).Port, localAddr.Port,
+	assert.Equal(t, client.transport.(*UDPTransport).conn.LocalAddr().(*net.UDPAddr).Port, localAddr.Port,
 		"port should be the client's bound port")
 }
 
+func TestWithListenPacket(t *testing.T) {
+	var gotNetwork string
+	listen := func(network string, laddr *net.UDPAddr) (net.PacketConn, error) {
+		gotNetwork = network
+		return net.ListenUDP(network, &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: laddr.Port})
+	}
+
+	client, err := NewSTUNClient(WithListenPacket(listen), WithAddressFamily(IPv4Only))
+	require.NoError(t, err)
+	defer client.Close()
+	assert.Equal(t, "udp4", gotNetwork)
+
+	// 特定の IP にバインドしたソケットでは、その IP がそのままローカルアドレスになる
+	localAddr, err := client.LocalAddr(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3478})
+	require.NoError(t, err)
+	assert.True(t, localAddr.IP.Equal(net.ParseIP("127.0.0.2")), "got %s", localAddr)
+}
+
 func TestSTUNMessageEncoding(t *testing.T) {
 	client, err := NewSTUNClient()
 	require.NoError(t, err, "NewSTUNClient() should not fail")
@@ -145,7 +163,7 @@ func TestReadResponseDiscardsUnmatchedPackets(t *testing.T) {
 	require.NoError(t, err)
 	defer sender.Close()
 
-	clientPort := client.conn.LocalAddr().(*net.UDPAddr).Port
+	clientPort := client.transport.(*UDPTransport).conn.LocalAddr().(*net.UDPAddr).Port
 	clientAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: clientPort}
 
 	wantTxID := [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
@@ -170,7 +188,7 @@ func TestReadResponseDiscardsUnmatchedPackets(t *testing.T) {
 	_, err = sender.WriteToUDP(makeResponse(wantTxID), clientAddr)
 	require.NoError(t, err)
 
-	msg, from, err := client.readResponse(time.Now().Add(2*time.Second), wantTxID)
+	msg, from, err := client.readResponse(time.Now().Add(2*time.Second), wantTxID, nil)
 	require.NoError(t, err, "readResponse() should return the matching response")
 	assert.Equal(t, wantTxID, msg.TransactionID)
 	assert.Equal(t, sender.LocalAddr().(*net.UDPAddr).Port, from.Port)
@@ -213,7 +231,7 @@ func TestRoundTripRetransmits(t *testing.T) {
 		TransactionID: txID,
 	})
 
-	msg, _, err := client.roundTrip(server.LocalAddr().(*net.UDPAddr), request, txID)
+	msg, _, err := client.roundTrip(server.LocalAddr().(*net.UDPAddr), request, txID, nil)
 	require.NoError(t, err, "roundTrip() should succeed after retransmission")
 	assert.Equal(t, BindingResponse, msg.MessageType)
 	assert.Equal(t, txID, msg.TransactionID)
@@ -276,3 +294,230 @@ func TestSTUNErrorIsDetectableWithErrorsAs(t *testing.T) {
 	assert.Equal(t, "Unknown Attribute", stunErr.Reason)
 	assert.Contains(t, stunErr.Error(), "code=420")
 }
+
+// buildMessage はテスト用に、生の属性バイト列を持つ Binding Response を組み立てます
+func buildMessage(txID [12]byte, attrs []byte) []byte {
+	data := make([]byte, 20+len(attrs))
+	data[0] = 0x01 // Binding Response
+	data[1] = 0x01
+	data[2] = byte(len(attrs) >> 8)
+	data[3] = byte(len(attrs))
+	copy(data[4:8], STUNMagicCookieBytes)
+	copy(data[8:20], txID[:])
+	copy(data[20:], attrs)
+	return data
+}
+
+func TestStrictDecodingRejectsMalformedMessages(t *testing.T) {
+	txID := [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	mapped := []byte{0x00, 0x01, 0x00, 0x08, 0x00, 0x01, 0x30, 0x39, 203, 0, 113, 1}
+
+	tests := []struct {
+		name  string
+		attrs []byte
+	}{
+		{
+			name: "non-zero padding",
+			// 長さ 1 の SOFTWARE 属性 + 0 以外のパディング
+			attrs: []byte{0x80, 0x22, 0x00, 0x01, 'a', 0xFF, 0x00, 0x00},
+		},
+		{
+			name: "misaligned message length",
+			// パディングが Message Length の外にはみ出している
+			attrs: []byte{0x80, 0x22, 0x00, 0x01, 'a'},
+		},
+		{
+			name:  "duplicate address attribute",
+			attrs: append(append([]byte{}, mapped...), mapped...),
+		},
+		{
+			name: "attribute after FINGERPRINT",
+			attrs: append([]byte{0x80, 0x28, 0x00, 0x04, 0x01, 0x02, 0x03, 0x04},
+				mapped...),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := buildMessage(txID, test.attrs)
+
+			lenient := &STUNClient{}
+			_, err := lenient.decodeMessage(data)
+			assert.NoError(t, err, "default decoding should tolerate the deviation")
+
+			strict := &STUNClient{cfg: newConfig([]Option{WithStrictValidation()})}
+			_, err = strict.decodeMessage(data)
+			assert.Error(t, err, "strict decoding should reject the message")
+		})
+	}
+}
+
+func TestStrictAddressParsing(t *testing.T) {
+	var txID [12]byte
+	lenient := &STUNClient{}
+	strict := &STUNClient{cfg: newConfig([]Option{WithStrictValidation()})}
+
+	valid := []byte{0x00, 0x01, 0x30, 0x39, 203, 0, 113, 1}
+	addr, err := strict.parseAddress(valid, false, txID)
+	require.NoError(t, err)
+	assert.Equal(t, "203.0.113.1:12345", addr.String())
+
+	// 予約バイトが 0 でない
+	reserved := []byte{0x80, 0x01, 0x30, 0x39, 203, 0, 113, 1}
+	_, err = lenient.parseAddress(reserved, false, txID)
+	assert.NoError(t, err)
+	_, err = strict.parseAddress(reserved, false, txID)
+	assert.Error(t, err)
+
+	// 末尾に余分なバイトがある
+	trailing := append(append([]byte{}, valid...), 0x00, 0x00, 0x00, 0x00)
+	_, err = lenient.parseAddress(trailing, false, txID)
+	assert.NoError(t, err)
+	_, err = strict.parseAddress(trailing, false, txID)
+	assert.Error(t, err)
+}
+
+// fuzzSeeds はファズテスト共通のシードコーパス
+func fuzzSeeds(f *testing.F) {
+	txID := [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	f.Add(buildMessage(txID, nil), false)
+	f.Add(buildMessage(txID, []byte{0x00, 0x20, 0x00, 0x08, 0x00, 0x01, 0x11, 0x2B, 0xEA, 0x12, 0xD7, 0x43}), false)
+	f.Add(buildMessage(txID, []byte{0x00, 0x01, 0x00, 0x08, 0x00, 0x01, 0x30, 0x39, 203, 0, 113, 1}), true)
+	f.Add(buildMessage(txID, []byte{0x80, 0x2C, 0x00, 0x14, 0x00, 0x02, 0x0D, 0x96,
+		0x20, 0x01, 0x0D, 0xB8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}), true)
+	f.Add(buildMessage(txID, []byte{0x00, 0x09, 0x00, 0x04, 0x00, 0x00, 0x04, 0x14}), false)
+	f.Add([]byte("not a stun packet"), false)
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	fuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte, strict bool) {
+		c := &STUNClient{cfg: config{strict: strict}}
+		msg, err := c.decodeMessage(data)
+		if err != nil {
+			return
+		}
+
+		// デコードできたメッセージは再エンコード後も同じ内容にデコードされる
+		again, err := c.decodeMessage(c.encodeMessage(*msg))
+		require.NoError(t, err, "re-encoded message should decode")
+		assert.Equal(t, msg.MessageType, again.MessageType)
+		assert.Equal(t, msg.TransactionID, again.TransactionID)
+		require.Len(t, again.Attributes, len(msg.Attributes))
+		for i := range msg.Attributes {
+			assert.Equal(t, msg.Attributes[i].Type, again.Attributes[i].Type)
+			assert.Equal(t, msg.Attributes[i].Value, again.Attributes[i].Value)
+		}
+	})
+}
+
+func FuzzParseBindingResponse(f *testing.F) {
+	fuzzSeeds(f)
+	from := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 3478}
+	f.Fuzz(func(t *testing.T, data []byte, strict bool) {
+		c := &STUNClient{cfg: config{strict: strict}}
+		msg, err := c.decodeMessage(data)
+		if err != nil {
+			return
+		}
+
+		// 属性を走査してもパニックせず、成功時は必ず外部アドレスが得られる
+		result, err := c.parseBindingResponse(msg, from)
+		if err == nil {
+			require.NotNil(t, result.MappedAddress)
+		}
+	})
+}
+
+func FuzzParseAddress(f *testing.F) {
+	f.Add([]byte{0x00, 0x01, 0x30, 0x39, 203, 0, 113, 1}, false, false)
+	f.Add([]byte{0x00, 0x01, 0x11, 0x2B, 0xEA, 0x12, 0xD7, 0x43}, true, true)
+	f.Add([]byte{0x00, 0x02, 0x0D, 0x96, 0x20, 0x01, 0x0D, 0xB8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, true, false)
+	f.Add([]byte{0x00, 0x03, 0x00, 0x00}, false, true)
+	txID := [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	f.Fuzz(func(t *testing.T, data []byte, isXor, strict bool) {
+		c := &STUNClient{cfg: config{strict: strict}}
+		addr, err := c.parseAddress(data, isXor, txID)
+		if err != nil {
+			return
+		}
+
+		switch len(addr.IP) {
+		case net.IPv4len:
+			assert.Equal(t, byte(0x01), data[1])
+		case net.IPv6len:
+			assert.Equal(t, byte(0x02), data[1])
+		default:
+			t.Fatalf("unexpected IP length %d", len(addr.IP))
+		}
+		if strict {
+			assert.Equal(t, byte(0), data[0], "strict parsing should reject reserved bits")
+			assert.Equal(t, 4+len(addr.IP), len(data), "strict parsing should reject trailing bytes")
+		}
+	})
+}
+
+func TestClassicModeDecodesLegacyMessage(t *testing.T) {
+	// Magic Cookie の位置に Transaction ID の先頭 32 ビットがある RFC 3489 形式
+	data := make([]byte, 20)
+	data[0] = 0x01 // Binding Response
+	data[1] = 0x01
+	copy(data[4:8], []byte{0xDE, 0xAD, 0xBE, 0xEF})
+
+	standard := &STUNClient{}
+	_, err := standard.decodeMessage(data)
+	assert.Error(t, err, "cookie-less message should be rejected without classic mode")
+
+	classic := &STUNClient{cfg: newConfig([]Option{WithClassicMode()})}
+	msg, err := classic.decodeMessage(data)
+	require.NoError(t, err)
+	assert.True(t, msg.Legacy)
+	assert.Equal(t, [4]byte{0xDE, 0xAD, 0xBE, 0xEF}, msg.TransactionIDPrefix)
+
+	// 再エンコードしても先頭 32 ビットが保たれる
+	assert.Equal(t, data, classic.encodeMessage(*msg))
+}
+
+func TestSendBindingRequestClassicMode(t *testing.T) {
+	client, err := NewSTUNClient(WithClassicMode())
+	require.NoError(t, err, "NewSTUNClient() should not fail")
+	defer client.Close()
+
+	// RFC 3489 サーバーを模擬: 128 ビット Transaction ID をそのままエコーし、
+	// MAPPED-ADDRESS / SOURCE-ADDRESS / CHANGED-ADDRESS を返す
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer server.Close()
+
+	requestCookie := make(chan []byte, 1)
+	go func() {
+		buffer := make([]byte, 1500)
+		_, from, err := server.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		requestCookie <- append([]byte{}, buffer[4:8]...)
+
+		attrs := []byte{
+			0x00, 0x01, 0x00, 0x08, 0x00, 0x01, 0x30, 0x39, 203, 0, 113, 1, // MAPPED-ADDRESS
+			0x00, 0x04, 0x00, 0x08, 0x00, 0x01, 0x0D, 0x96, 127, 0, 0, 1, // SOURCE-ADDRESS
+			0x00, 0x05, 0x00, 0x08, 0x00, 0x01, 0x0D, 0x97, 198, 51, 100, 1, // CHANGED-ADDRESS
+		}
+		response := make([]byte, 20+len(attrs))
+		response[0] = 0x01 // Binding Response
+		response[1] = 0x01
+		response[3] = byte(len(attrs))
+		copy(response[4:20], buffer[4:20]) // 128 ビット Transaction ID をエコー
+		copy(response[20:], attrs)
+		server.WriteToUDP(response, from)
+	}()
+
+	result, err := client.SendBindingRequest(server.LocalAddr().String(), false, false)
+	require.NoError(t, err)
+
+	assert.NotEqual(t, STUNMagicCookieBytes, <-requestCookie, "classic request should not carry the magic cookie")
+	assert.True(t, result.Legacy)
+	assert.Equal(t, "203.0.113.1:12345", result.MappedAddress.String())
+	assert.Equal(t, "127.0.0.1:3478", result.SourceAddress.String())
+	assert.Equal(t, "198.51.100.1:3479", result.OtherAddress.String())
+}
@@ -0,0 +1,110 @@
+// natemu はループバック上で STUN 応答サーバーとその手前の NAT エミュレーターを起動します。
+//
+// 表示された STUN サーバーのアドレスに対して判定を実行すると、指定したプロファイルの
+// NAT の内側にいるように判定されます。Linux の 127.0.0.1 から 127.0.0.5 を使います。
+//
+// Build and run:
+//
+//	go run ./cmd/natemu -profile symmetric
+//	go run ./example 127.0.0.1:<port>
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+
+	checker "github.com/moepig/nat-checker"
+	"github.com/moepig/nat-checker/natemu"
+)
+
+func main() {
+	profileName := flag.String("profile", "", "プロファイル名 ("+strings.Join(profileNames(), ", ")+")")
+	mapping := flag.String("mapping", "eim", "マッピング動作 (eim, adm, apdm)")
+	filtering := flag.String("filtering", "eif", "フィルタリング動作 (eif, adf, apdf)")
+	ports := flag.String("ports", "preserve", "ポート割り当て方式 (preserve, sequential, random)")
+	timeout := flag.Duration("timeout", 0, "マッピングのタイムアウト (0 なら失効しない)")
+	inboundRefresh := flag.Bool("inbound-refresh", false, "外部からのパケットでもマッピングのタイマーを更新する")
+	flag.Parse()
+
+	profile, err := buildProfile(*profileName, *mapping, *filtering, *ports)
+	if err != nil {
+		log.Fatal(err)
+	}
+	profile.MappingTimeout = *timeout
+	profile.InboundRefresh = *inboundRefresh
+
+	lab, err := natemu.StartLab(profile)
+	if err != nil {
+		log.Fatalf("起動エラー: %v", err)
+	}
+	defer lab.Close()
+
+	fmt.Printf("NAT: %s / %s, ports=%s, timeout=%s, inbound refresh=%v\n",
+		profile.Mapping, profile.Filtering, profile.PortAllocation, profile.MappingTimeout, profile.InboundRefresh)
+	fmt.Printf("外部 IP: %s\n", lab.Emulator.PublicIP())
+	fmt.Printf("STUN サーバー: %s\n", lab.ServerAddr())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+}
+
+// buildProfile は -profile の名前、またはマッピング・フィルタリング・ポート割り当ての指定から
+// プロファイルを組み立てます
+func buildProfile(name, mapping, filtering, ports string) (natemu.Profile, error) {
+	if name != "" {
+		profile, ok := natemu.Profiles[name]
+		if !ok {
+			return natemu.Profile{}, fmt.Errorf("unknown profile %q", name)
+		}
+		return profile, nil
+	}
+
+	var profile natemu.Profile
+	switch mapping {
+	case "eim":
+		profile.Mapping = checker.EndpointIndependent
+	case "adm":
+		profile.Mapping = checker.AddressDependent
+	case "apdm":
+		profile.Mapping = checker.AddressPortDependent
+	default:
+		return profile, fmt.Errorf("unknown mapping %q", mapping)
+	}
+	switch filtering {
+	case "eif":
+		profile.Filtering = checker.EndpointIndependentFiltering
+	case "adf":
+		profile.Filtering = checker.AddressDependentFiltering
+	case "apdf":
+		profile.Filtering = checker.AddressPortDependentFiltering
+	default:
+		return profile, fmt.Errorf("unknown filtering %q", filtering)
+	}
+	switch ports {
+	case "preserve":
+		profile.PortAllocation = checker.PortPreservation
+	case "sequential":
+		profile.PortAllocation = checker.PortSequential
+	case "random":
+		profile.PortAllocation = checker.PortRandom
+	default:
+		return profile, fmt.Errorf("unknown port allocation %q", ports)
+	}
+	return profile, nil
+}
+
+func profileNames() []string {
+	names := make([]string, 0, len(natemu.Profiles))
+	for name := range natemu.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
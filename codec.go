@@ -0,0 +1,121 @@
+package natchecker
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+)
+
+// このファイルは STUN メッセージの符号化・復号を、STUNClient を使わずに行うための
+// 関数を提供します。stunserver や turnserver などのサーバー実装と共通の codec として使います。
+
+// EncodeMessage は msg を STUN メッセージ (RFC 8489 Section 5) のバイト列に符号化します
+func EncodeMessage(msg STUNMessage) []byte {
+	return (&STUNClient{}).encodeMessage(msg)
+}
+
+// DecodeMessage は data を STUN メッセージとして復号します。
+// Magic Cookie の無い RFC 3489 形式のメッセージはエラーになります
+func DecodeMessage(data []byte) (*STUNMessage, error) {
+	return (&STUNClient{}).decodeMessage(data)
+}
+
+// EncodeWithIntegrity は msg の末尾に key による MESSAGE-INTEGRITY
+// (RFC 8489 Section 14.5) を付けて符号化します。key は LongTermKey などで作ります
+func EncodeWithIntegrity(msg STUNMessage, key []byte) []byte {
+	return (&STUNClient{}).encodeWithIntegrity(msg, key)
+}
+
+// VerifyIntegrity は受信した STUN メッセージ data の MESSAGE-INTEGRITY が
+// key による HMAC-SHA1 と一致するかを返します。属性が無ければ false
+//
+// RFC 8489 Section 14.5: HMAC は MESSAGE-INTEGRITY の直前までを対象とし、
+// ヘッダーの Message Length は MESSAGE-INTEGRITY 属性の末尾までの長さとして計算する。
+// 後ろに FINGERPRINT があっても検証できるよう、長さを書き換えてから計算する
+func VerifyIntegrity(data, key []byte) bool {
+	if len(data) < 20 {
+		return false
+	}
+	end := 20 + int(binary.BigEndian.Uint16(data[2:4]))
+	for offset := 20; offset+4 <= end && end <= len(data); {
+		attrType := STUNAttributeType(binary.BigEndian.Uint16(data[offset : offset+2]))
+		attrLength := int(binary.BigEndian.Uint16(data[offset+2 : offset+4]))
+		if attrType == MessageIntegrity {
+			if attrLength != messageIntegrityLength || offset+4+attrLength > end {
+				return false
+			}
+			header := make([]byte, offset)
+			copy(header, data[:offset])
+			binary.BigEndian.PutUint16(header[2:4], uint16(offset+4+attrLength-20))
+
+			mac := hmac.New(sha1.New, key)
+			mac.Write(header)
+			return hmac.Equal(mac.Sum(nil), data[offset+4:offset+4+attrLength])
+		}
+		offset += 4 + (attrLength+3)/4*4
+	}
+	return false
+}
+
+// Attribute は msg の中で最初に現れる t 型の属性を返します
+func (msg *STUNMessage) Attribute(t STUNAttributeType) (STUNAttribute, bool) {
+	for _, attr := range msg.Attributes {
+		if attr.Type == t {
+			return attr, true
+		}
+	}
+	return STUNAttribute{}, false
+}
+
+// isXorAddressAttribute は XOR で難読化されたアドレス属性かどうかを返します
+func isXorAddressAttribute(t STUNAttributeType) bool {
+	switch t {
+	case XorMappedAddress, XorPeerAddress, XorRelayedAddress:
+		return true
+	}
+	return false
+}
+
+// NewAddressAttribute は addr を値に持つアドレス属性を返します。
+// t が XOR-MAPPED-ADDRESS などの XOR 形式の属性なら、txID を使って XOR します
+// (RFC 8489 Section 14.1, 14.2)
+func NewAddressAttribute(t STUNAttributeType, addr *net.UDPAddr, txID [12]byte) STUNAttribute {
+	var value []byte
+	if isXorAddressAttribute(t) {
+		value = xorAddressValue(addr, txID)
+	} else {
+		ip := addr.IP.To4()
+		family := byte(0x01)
+		if ip == nil {
+			ip = addr.IP.To16()
+			family = 0x02
+		}
+		value = make([]byte, 4+len(ip))
+		value[1] = family
+		binary.BigEndian.PutUint16(value[2:4], uint16(addr.Port))
+		copy(value[4:], ip)
+	}
+	return STUNAttribute{Type: t, Length: uint16(len(value)), Value: value}
+}
+
+// ParseAddressAttribute はアドレス属性の値を解析します。
+// XOR 形式の属性は txID を使って元のアドレスに戻す
+func ParseAddressAttribute(attr STUNAttribute, txID [12]byte) (*net.UDPAddr, error) {
+	return (&STUNClient{}).parseAddress(attr.Value, isXorAddressAttribute(attr.Type), txID)
+}
+
+// NewErrorCodeAttribute は ERROR-CODE 属性 (RFC 8489 Section 14.8) を返します
+func NewErrorCodeAttribute(code int, reason string) STUNAttribute {
+	value := make([]byte, 4+len(reason))
+	value[2] = byte(code / 100)
+	value[3] = byte(code % 100)
+	copy(value[4:], reason)
+	return STUNAttribute{Type: ErrorCode, Length: uint16(len(value)), Value: value}
+}
+
+// ErrorCodeOf はエラーレスポンスの ERROR-CODE 属性からエラーコードと理由を返します。
+// 属性が無ければ 0 と空文字列を返す
+func ErrorCodeOf(msg *STUNMessage) (int, string) {
+	return extractErrorCode(msg)
+}
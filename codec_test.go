@@ -0,0 +1,70 @@
+package natchecker
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddressAttributeRoundTrip(t *testing.T) {
+	txID := [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	addrs := []*net.UDPAddr{
+		{IP: net.ParseIP("203.0.113.1"), Port: 49152},
+		{IP: net.ParseIP("2001:db8::1"), Port: 3478},
+	}
+	types := []STUNAttributeType{MappedAddress, XorMappedAddress, OtherAddress, ResponseOrigin, XorPeerAddress, XorRelayedAddress}
+
+	for _, attrType := range types {
+		for _, addr := range addrs {
+			attr := NewAddressAttribute(attrType, addr, txID)
+			parsed, err := ParseAddressAttribute(attr, txID)
+			require.NoError(t, err)
+			assert.True(t, udpAddrEqual(addr, parsed), "type 0x%04x %s: got %s", uint16(attrType), addr, parsed)
+		}
+	}
+
+	// XOR 形式でない属性はアドレスがそのまま入る
+	attr := NewAddressAttribute(MappedAddress, addrs[0], txID)
+	assert.Equal(t, []byte{0x00, 0x01, 0xC0, 0x00, 203, 0, 113, 1}, attr.Value)
+}
+
+func TestErrorCodeAttributeRoundTrip(t *testing.T) {
+	msg := &STUNMessage{
+		MessageType: BindingErrorResponse,
+		Attributes:  []STUNAttribute{NewErrorCodeAttribute(438, "Stale Nonce")},
+	}
+
+	data := EncodeMessage(*msg)
+	decoded, err := DecodeMessage(data)
+	require.NoError(t, err)
+
+	code, reason := ErrorCodeOf(decoded)
+	assert.Equal(t, 438, code)
+	assert.Equal(t, "Stale Nonce", reason)
+}
+
+func TestVerifyIntegrity(t *testing.T) {
+	key := LongTermKey("alice", "example.org", "secret")
+	msg := STUNMessage{
+		MessageType:   AllocateRequest,
+		TransactionID: [12]byte{1, 2, 3},
+		Attributes:    []STUNAttribute{stringAttribute(Username, "alice"), stringAttribute(Realm, "example.org")},
+	}
+	data := EncodeWithIntegrity(msg, key)
+
+	assert.True(t, VerifyIntegrity(data, key))
+	assert.False(t, VerifyIntegrity(data, LongTermKey("alice", "example.org", "wrong")), "wrong key")
+	assert.False(t, VerifyIntegrity(EncodeMessage(msg), key), "no MESSAGE-INTEGRITY")
+
+	tampered := append([]byte(nil), data...)
+	tampered[25] ^= 0xFF
+	assert.False(t, VerifyIntegrity(tampered, key), "tampered attribute")
+
+	// MESSAGE-INTEGRITY の後ろに FINGERPRINT が続いても検証できる
+	withFingerprint := append([]byte(nil), data...)
+	withFingerprint = append(withFingerprint, 0x80, 0x28, 0x00, 0x04, 0, 0, 0, 0)
+	withFingerprint[3] += 8
+	assert.True(t, VerifyIntegrity(withFingerprint, key))
+}
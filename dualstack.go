@@ -0,0 +1,142 @@
+package natchecker
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+)
+
+// DualStackComparison は IPv4 と IPv6 の判定結果の比較
+type DualStackComparison int
+
+const (
+	// DualStackSame: マッピング・フィルタリングとも同じ
+	DualStackSame DualStackComparison = iota
+	// DualStackIPv4Better: IPv4 の方が制限が緩い（P2P 接続に有利）
+	DualStackIPv4Better
+	// DualStackIPv6Better: IPv6 の方が制限が緩い（P2P 接続に有利）
+	DualStackIPv6Better
+	// DualStackMixed: マッピングとフィルタリングで有利なファミリーが異なる
+	DualStackMixed
+	// DualStackIncomparable: 一方の判定に失敗した、または Unknown を含む
+	DualStackIncomparable
+)
+
+func (c DualStackComparison) String() string {
+	switch c {
+	case DualStackSame:
+		return "Same"
+	case DualStackIPv4Better:
+		return "IPv4 Better"
+	case DualStackIPv6Better:
+		return "IPv6 Better"
+	case DualStackMixed:
+		return "Mixed"
+	default:
+		return "Incomparable"
+	}
+}
+
+// DualStackDetectionResult は IPv4 と IPv6 それぞれの判定結果と、その比較
+type DualStackDetectionResult struct {
+	// IPv4, IPv6 は各ファミリーでの判定結果。判定に失敗した場合は nil
+	IPv4 *FullNATDetectionResult `json:"ipv4"`
+	IPv6 *FullNATDetectionResult `json:"ipv6"`
+	// IPv4Error, IPv6Error は各ファミリーで判定に失敗した理由
+	IPv4Error string `json:"ipv4_error,omitempty"`
+	IPv6Error string `json:"ipv6_error,omitempty"`
+	// MappingDiffers はマッピング動作がファミリー間で異なる場合に true
+	MappingDiffers bool `json:"mapping_differs"`
+	// FilteringDiffers はフィルタリング動作がファミリー間で異なる場合に true
+	FilteringDiffers bool `json:"filtering_differs"`
+	// Comparison はどちらのファミリーの方が制限が緩いか
+	Comparison DualStackComparison `json:"comparison"`
+}
+
+// String は結果の文字列表現を返す
+func (r DualStackDetectionResult) String() string {
+	describe := func(result *FullNATDetectionResult, errMsg string) string {
+		if result == nil {
+			return "unavailable (" + errMsg + ")"
+		}
+		return result.DetailedType.String()
+	}
+	return fmt.Sprintf("IPv4: %s / IPv6: %s (%s)",
+		describe(r.IPv4, r.IPv4Error), describe(r.IPv6, r.IPv6Error), r.Comparison)
+}
+
+// DualStackNATDetection は同じサーバー名に対して IPv4 (udp4) と IPv6 (udp6) で
+// それぞれ FullNATDetection と同じ判定を行い、結果を並べて比較します
+//
+// 一方のファミリーだけが失敗した場合は、その理由を IPv4Error / IPv6Error に記録して
+// 結果を返します。両方とも失敗した場合のみエラーを返します。
+// opts に WithAddressFamily を指定しても、各判定ではファミリーが上書きされます。
+func DualStackNATDetection(serverAddr string, opts ...Option) (*DualStackDetectionResult, error) {
+	result := &DualStackDetectionResult{}
+
+	ipv4, err4 := detectWithFamily(serverAddr, IPv4Only, opts)
+	if err4 != nil {
+		result.IPv4Error = err4.Error()
+	}
+	ipv6, err6 := detectWithFamily(serverAddr, IPv6Only, opts)
+	if err6 != nil {
+		result.IPv6Error = err6.Error()
+	}
+	if err4 != nil && err6 != nil {
+		return nil, fmt.Errorf("IPv4/IPv6 とも判定できません: %w", errors.Join(err4, err6))
+	}
+
+	result.IPv4 = ipv4
+	result.IPv6 = ipv6
+	if ipv4 == nil || ipv6 == nil {
+		result.Comparison = DualStackIncomparable
+		return result, nil
+	}
+
+	result.MappingDiffers = ipv4.DetailedType.Mapping != ipv6.DetailedType.Mapping
+	result.FilteringDiffers = ipv4.DetailedType.Filtering != ipv6.DetailedType.Filtering
+	result.Comparison = compareDualStack(ipv4.DetailedType, ipv6.DetailedType)
+	return result, nil
+}
+
+// detectWithFamily はアドレスファミリーを family に限定して FullNATDetection を行います
+func detectWithFamily(serverAddr string, family AddressFamily, opts []Option) (*FullNATDetectionResult, error) {
+	opts = withOption(opts, WithAddressFamily(family))
+
+	servers, err := newConfig(opts).resolveServers(serverAddr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: サーバーアドレス解決エラー: %w", family, err)
+	}
+	result, err := fullNATDetection(servers, opts)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", family, err)
+	}
+	return result, nil
+}
+
+// compareDualStack は IPv4 と IPv6 の判定結果を比較し、どちらの制限が緩いかを返します
+//
+// マッピング・フィルタリングとも Endpoint Independent が最も緩く、
+// Address and Port Dependent が最も厳しい (RFC 4787)。
+// 一方の軸だけが異なる場合はその軸で比較し、両軸で逆の結果になった場合は Mixed とする。
+func compareDualStack(ipv4, ipv6 DetailedNATType) DualStackComparison {
+	if ipv4.Mapping == Unknown || ipv6.Mapping == Unknown ||
+		ipv4.Filtering == FilteringUnknown || ipv6.Filtering == FilteringUnknown {
+		return DualStackIncomparable
+	}
+
+	// 定数は緩い順に定義されているため、値が小さい方が緩い
+	mapping := cmp.Compare(ipv4.Mapping, ipv6.Mapping)
+	filtering := cmp.Compare(ipv4.Filtering, ipv6.Filtering)
+
+	switch {
+	case mapping == 0 && filtering == 0:
+		return DualStackSame
+	case mapping <= 0 && filtering <= 0:
+		return DualStackIPv4Better
+	case mapping >= 0 && filtering >= 0:
+		return DualStackIPv6Better
+	default:
+		return DualStackMixed
+	}
+}
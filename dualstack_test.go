@@ -0,0 +1,97 @@
+package natchecker
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDualStackComparisonString(t *testing.T) {
+	tests := []struct {
+		comparison DualStackComparison
+		expected   string
+	}{
+		{DualStackSame, "Same"},
+		{DualStackIPv4Better, "IPv4 Better"},
+		{DualStackIPv6Better, "IPv6 Better"},
+		{DualStackMixed, "Mixed"},
+		{DualStackIncomparable, "Incomparable"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, test.comparison.String(), "DualStackComparison(%d).String()", test.comparison)
+	}
+}
+
+func TestCompareDualStack(t *testing.T) {
+	tests := []struct {
+		name     string
+		ipv4     DetailedNATType
+		ipv6     DetailedNATType
+		expected DualStackComparison
+	}{
+		{
+			name:     "identical behavior",
+			ipv4:     DetailedNATType{Mapping: EndpointIndependent, Filtering: AddressPortDependentFiltering},
+			ipv6:     DetailedNATType{Mapping: EndpointIndependent, Filtering: AddressPortDependentFiltering},
+			expected: DualStackSame,
+		},
+		{
+			name:     "IPv6 without NAT beats symmetric IPv4",
+			ipv4:     DetailedNATType{Mapping: AddressPortDependent, Filtering: AddressPortDependentFiltering},
+			ipv6:     DetailedNATType{Mapping: EndpointIndependent, Filtering: AddressPortDependentFiltering},
+			expected: DualStackIPv6Better,
+		},
+		{
+			name:     "IPv6 firewall stricter than full cone IPv4",
+			ipv4:     DetailedNATType{Mapping: EndpointIndependent, Filtering: EndpointIndependentFiltering},
+			ipv6:     DetailedNATType{Mapping: EndpointIndependent, Filtering: AddressDependentFiltering},
+			expected: DualStackIPv4Better,
+		},
+		{
+			name:     "each family wins on one axis",
+			ipv4:     DetailedNATType{Mapping: AddressDependent, Filtering: EndpointIndependentFiltering},
+			ipv6:     DetailedNATType{Mapping: EndpointIndependent, Filtering: AddressPortDependentFiltering},
+			expected: DualStackMixed,
+		},
+		{
+			name:     "unknown filtering",
+			ipv4:     DetailedNATType{Mapping: EndpointIndependent, Filtering: FilteringUnknown},
+			ipv6:     DetailedNATType{Mapping: EndpointIndependent, Filtering: EndpointIndependentFiltering},
+			expected: DualStackIncomparable,
+		},
+		{
+			name:     "unknown mapping",
+			ipv4:     DetailedNATType{Mapping: EndpointIndependent, Filtering: EndpointIndependentFiltering},
+			ipv6:     DetailedNATType{Mapping: Unknown, Filtering: EndpointIndependentFiltering},
+			expected: DualStackIncomparable,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, compareDualStack(test.ipv4, test.ipv6))
+		})
+	}
+}
+
+// 統合テスト - IPv4 / IPv6 の比較
+func TestDualStackNATDetectionIntegration(t *testing.T) {
+	if os.Getenv("INTEGRATION") != "1" {
+		t.Skip("Skipping integration test. Set INTEGRATION=1 to run.")
+	}
+
+	server := "stunserver2025.stunprotocol.org"
+
+	result, err := DualStackNATDetection(server)
+	require.NoError(t, err)
+	require.NotNil(t, result)
+
+	t.Logf("=== Dual-Stack NAT Detection ===")
+	t.Logf("Server: %s", server)
+	t.Logf("%s", result)
+	t.Logf("Mapping differs: %v", result.MappingDiffers)
+	t.Logf("Filtering differs: %v", result.FilteringDiffers)
+}
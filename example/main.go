@@ -5,12 +5,16 @@
 //
 // Build and run:
 //
-//	go run ./example
+//	go run ./example [server]
+//
+// server を省略すると stunserver2025.stunprotocol.org を使います。
+// cmd/natemu が表示する STUN サーバーのアドレスを指定すると、エミュレートした NAT を判定します。
 package main
 
 import (
 	"fmt"
 	"log"
+	"os"
 
 	checker "github.com/moepig/nat-checker"
 )
@@ -22,6 +26,9 @@ func main() {
 	// Mapping/Filtering 判定には RFC 5780 (OTHER-ADDRESS/CHANGE-REQUEST)
 	// 対応の STUN サーバーが必要。
 	server := "stunserver2025.stunprotocol.org"
+	if len(os.Args) > 1 {
+		server = os.Args[1]
+	}
 
 	result, err := checker.FullNATDetection(server)
 	if err != nil {
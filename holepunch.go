@@ -0,0 +1,398 @@
+package natchecker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// holePunchInterval はランデブーサーバーへの登録とホールパンチングのパケットを送る間隔
+const holePunchInterval = 50 * time.Millisecond
+
+// holePunchLinger は接続を確認した後も、相手の PUNCH に ACK を返し続ける時間。
+// 相手が自分の ACK を受け取る前に受信をやめないようにする
+const holePunchLinger = 5 * holePunchInterval
+
+// rendezvousSessionTTL はランデブーサーバーが登録を保持する時間
+const rendezvousSessionTTL = time.Minute
+
+// rendezvousMessage はランデブーサーバーとピアの間、およびピア同士で交換する JSON メッセージ
+//
+//   - register: ピア → サーバー。自分の外部マッピングとローカルアドレスを登録する
+//   - peer:     サーバー → ピア。同じセッションに登録した相手の情報
+//   - punch:    ピア → ピア。ホールパンチングのプローブ
+//   - ack:      ピア → ピア。punch の受信確認
+type rendezvousMessage struct {
+	Type    string `json:"type"`
+	Session string `json:"session"`
+	Peer    string `json:"peer"`
+	// Mapped は STUN で得た外部マッピング、Local はローカルアドレス
+	Mapped string `json:"mapped,omitempty"`
+	Local  string `json:"local,omitempty"`
+	// Observed はランデブーサーバーが観測した送信元アドレス（peer メッセージのみ）
+	Observed string `json:"observed,omitempty"`
+}
+
+// rendezvousPeer はランデブーサーバーに登録されたピア
+type rendezvousPeer struct {
+	message    rendezvousMessage
+	observed   *net.UDPAddr
+	registered time.Time
+}
+
+// RendezvousServer はホールパンチングのためにピア同士の外部アドレスを仲介する
+// UDP のシグナリングサーバーです。
+//
+// 同じセッション名で登録した 2 つのピアに、互いの外部マッピング・ローカルアドレス・
+// サーバーから見た送信元アドレスを通知します。メッセージは JSON で、1 パケットに 1 つです。
+type RendezvousServer struct {
+	conn *net.UDPConn
+
+	mu       sync.Mutex
+	sessions map[string]map[string]rendezvousPeer
+}
+
+// NewRendezvousServer は addr ("host:port") で待ち受けるランデブーサーバーを起動します。
+// ポートに 0 を指定した場合は空いているポートが使われ、Addr で参照できます。
+func NewRendezvousServer(addr string) (*RendezvousServer, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("アドレス解決エラー: %w", err)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &RendezvousServer{conn: conn, sessions: make(map[string]map[string]rendezvousPeer)}
+	go s.serve()
+	return s, nil
+}
+
+// Addr はサーバーが待ち受けているアドレスを返します
+func (s *RendezvousServer) Addr() *net.UDPAddr {
+	return s.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Close はサーバーを停止します
+func (s *RendezvousServer) Close() error {
+	return s.conn.Close()
+}
+
+func (s *RendezvousServer) serve() {
+	buffer := make([]byte, 1500)
+	for {
+		n, from, err := s.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+
+		var msg rendezvousMessage
+		if err := json.Unmarshal(buffer[:n], &msg); err != nil || msg.Type != "register" || msg.Session == "" || msg.Peer == "" {
+			continue
+		}
+
+		if other, ok := s.register(msg, from); ok {
+			reply, _ := json.Marshal(rendezvousMessage{
+				Type:     "peer",
+				Session:  msg.Session,
+				Peer:     other.message.Peer,
+				Mapped:   other.message.Mapped,
+				Local:    other.message.Local,
+				Observed: other.observed.String(),
+			})
+			s.conn.WriteToUDP(reply, from)
+		}
+	}
+}
+
+// register は msg を登録し、同じセッションに相手のピアがいればそれを返します
+func (s *RendezvousServer) register(msg rendezvousMessage, from *net.UDPAddr) (rendezvousPeer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for name, peers := range s.sessions {
+		for id, peer := range peers {
+			if now.Sub(peer.registered) > rendezvousSessionTTL {
+				delete(peers, id)
+			}
+		}
+		if len(peers) == 0 {
+			delete(s.sessions, name)
+		}
+	}
+
+	peers := s.sessions[msg.Session]
+	if peers == nil {
+		peers = make(map[string]rendezvousPeer)
+		s.sessions[msg.Session] = peers
+	}
+	if _, ok := peers[msg.Peer]; !ok && len(peers) >= 2 {
+		// 1 つのセッションに参加できるのは 2 つのピアまで
+		return rendezvousPeer{}, false
+	}
+	peers[msg.Peer] = rendezvousPeer{message: msg, observed: from, registered: now}
+
+	for id, peer := range peers {
+		if id != msg.Peer {
+			return peer, true
+		}
+	}
+	return rendezvousPeer{}, false
+}
+
+// CandidateType はホールパンチングで使った相手のアドレスの種類 (RFC 8445 Section 5.1.1 の用語に準ずる)
+type CandidateType int
+
+const (
+	// HostCandidate: 相手のローカルアドレス（同じ LAN 内）
+	HostCandidate CandidateType = iota
+	// ServerReflexiveCandidate: STUN サーバーまたはランデブーサーバーが観測した相手の外部アドレス
+	ServerReflexiveCandidate
+	// PeerReflexiveCandidate: 候補に無いアドレスから相手のパケットが届いた
+	PeerReflexiveCandidate
+)
+
+func (t CandidateType) String() string {
+	switch t {
+	case HostCandidate:
+		return "host"
+	case ServerReflexiveCandidate:
+		return "srflx"
+	default:
+		return "prflx"
+	}
+}
+
+// HolePunchCandidate はホールパンチングの宛先候補
+type HolePunchCandidate struct {
+	Address *net.UDPAddr  `json:"address"`
+	Type    CandidateType `json:"type"`
+}
+
+// HolePunchResult はホールパンチングによる直接通信の試行結果
+type HolePunchResult struct {
+	// Success は相手との双方向の通信を確認できた場合に true
+	Success bool `json:"success"`
+	// PeerID は相手のピアの ID
+	PeerID string `json:"peer_id"`
+	// LocalMapping は STUN サーバー (Test I) で得た自分の外部マッピング
+	LocalMapping *net.UDPAddr `json:"local_mapping"`
+	// Candidates はランデブーサーバーから得た相手の宛先候補（優先順）
+	Candidates []HolePunchCandidate `json:"candidates"`
+	// Path は相手のパケットが届いたアドレスと、その種類。失敗した場合は nil
+	Path *HolePunchCandidate `json:"path,omitempty"`
+	// TimeToConnect はパンチングの開始から双方向の通信を確認するまでの時間
+	TimeToConnect time.Duration `json:"time_to_connect"`
+	// PunchesSent は送信した punch パケットの数
+	PunchesSent int `json:"punches_sent"`
+}
+
+// String は結果の文字列表現を返す
+func (r HolePunchResult) String() string {
+	if !r.Success {
+		return fmt.Sprintf("Hole Punch: failed (peer %s, %d punches)", r.PeerID, r.PunchesSent)
+	}
+	return fmt.Sprintf("Hole Punch: connected to %s via %s %s in %s",
+		r.PeerID, r.Path.Type, r.Path.Address, r.TimeToConnect)
+}
+
+// HolePunch は新しいソケットから STUNClient.HolePunch を実行します
+func HolePunch(stunServer, rendezvousAddr, session, peerID string, timeout time.Duration, opts ...Option) (*HolePunchResult, error) {
+	client, err := NewSTUNClient(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("STUNクライアント作成エラー: %w", err)
+	}
+	defer client.Close()
+
+	return client.HolePunch(stunServer, rendezvousAddr, session, peerID, timeout)
+}
+
+// HolePunch はランデブーサーバーを介して相手のピアとアドレスを交換し、
+// UDP ホールパンチングで直接通信できるかを試します
+//
+//  1. stunServer への Binding (Test I) で自分の外部マッピングを得る
+//  2. 同じソケットから rendezvousAddr に session と peerID を登録し、
+//     同じセッションに登録した相手の外部マッピング・ローカルアドレスを受け取る
+//  3. 相手の各候補アドレスに punch を送り続け、相手の punch には ack を返す。
+//     相手から ack が届けば双方向の通信が確認できたとして成功する
+//
+// 相手も同時に同じセッションで HolePunch を実行している必要があります。
+// timeout は登録とパンチングを合わせた時間の上限で、時間内に相手が登録しなければ
+// エラーを、パンチングが成功しなければ Success が false の結果を返します。
+// 外部マッピングを維持したまま通信するため、同じ STUNClient のソケットを使います。
+func (c *STUNClient) HolePunch(stunServer, rendezvousAddr, session, peerID string, timeout time.Duration) (*HolePunchResult, error) {
+	deadline := time.Now().Add(timeout)
+
+	servers, err := c.cfg.resolveServers(stunServer)
+	if err != nil {
+		return nil, fmt.Errorf("サーバーアドレス解決エラー: %w", err)
+	}
+	_, binding, err := c.bindFirstResponsive(servers)
+	if err != nil {
+		return nil, fmt.Errorf("外部マッピングの取得に失敗: %w", err)
+	}
+
+	rendezvous, err := net.ResolveUDPAddr(c.cfg.family.network(), rendezvousAddr)
+	if err != nil {
+		return nil, fmt.Errorf("ランデブーサーバーのアドレス解決エラー: %w", err)
+	}
+	register := rendezvousMessage{Type: "register", Session: session, Peer: peerID, Mapped: binding.MappedAddress.String()}
+	if local, err := c.LocalAddr(rendezvous); err == nil {
+		register.Local = local.String()
+	}
+
+	peer, err := c.exchangeRendezvous(rendezvous, register, deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &HolePunchResult{
+		PeerID:       peer.Peer,
+		LocalMapping: binding.MappedAddress,
+		Candidates:   holePunchCandidates(peer),
+	}
+	if err := c.punch(result, session, peerID, deadline); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// exchangeRendezvous は register をランデブーサーバーに送り続け、
+// 相手のピアの情報が届くまで待ちます
+func (c *STUNClient) exchangeRendezvous(rendezvous *net.UDPAddr, register rendezvousMessage, deadline time.Time) (rendezvousMessage, error) {
+	request, _ := json.Marshal(register)
+	buffer := make([]byte, 1500)
+	for time.Now().Before(deadline) {
+		if err := c.transport.Send(request, rendezvous); err != nil {
+			return rendezvousMessage{}, fmt.Errorf("ランデブーサーバーへの送信エラー: %w", err)
+		}
+
+		wait := earliest(time.Now().Add(holePunchInterval), deadline)
+		for {
+			n, from, err := c.transport.Receive(buffer, wait)
+			if err != nil {
+				if isTimeoutError(err) {
+					break
+				}
+				return rendezvousMessage{}, fmt.Errorf("ランデブーサーバーからの受信エラー: %w", err)
+			}
+			var msg rendezvousMessage
+			if !udpAddrEqual(from, rendezvous) || json.Unmarshal(buffer[:n], &msg) != nil {
+				continue
+			}
+			if msg.Type == "peer" && msg.Session == register.Session && msg.Peer != register.Peer {
+				return msg, nil
+			}
+		}
+	}
+	return rendezvousMessage{}, fmt.Errorf("セッション %q に相手のピアが登録されませんでした", register.Session)
+}
+
+// punch は result.Candidates に punch を送り続け、相手から ack が届くまで待ちます。
+// 成功した後も holePunchLinger の間は相手の punch に ack を返す
+func (c *STUNClient) punch(result *HolePunchResult, session, peerID string, deadline time.Time) error {
+	punch, _ := json.Marshal(rendezvousMessage{Type: "punch", Session: session, Peer: peerID})
+	ack, _ := json.Marshal(rendezvousMessage{Type: "ack", Session: session, Peer: peerID})
+
+	start := time.Now()
+	buffer := make([]byte, 1500)
+	for time.Now().Before(deadline) {
+		if !result.Success {
+			for _, candidate := range result.Candidates {
+				// 到達できない候補（別の LAN のローカルアドレス等）への送信エラーは無視する
+				c.transport.Send(punch, candidate.Address)
+				result.PunchesSent++
+			}
+		}
+
+		wait := earliest(time.Now().Add(holePunchInterval), deadline)
+		for {
+			n, from, err := c.transport.Receive(buffer, wait)
+			if err != nil {
+				if isTimeoutError(err) {
+					break
+				}
+				// ICMP Port Unreachable 等で受信がエラーになっても、他の候補の応答を待ち続ける
+				if isICMPError(err) {
+					continue
+				}
+				return fmt.Errorf("ピアからの受信エラー: %w", err)
+			}
+			var msg rendezvousMessage
+			if json.Unmarshal(buffer[:n], &msg) != nil || msg.Session != session || msg.Peer != result.PeerID {
+				continue
+			}
+
+			switch msg.Type {
+			case "punch":
+				c.transport.Send(ack, from)
+			case "ack":
+				if !result.Success {
+					result.Success = true
+					result.TimeToConnect = time.Since(start)
+					result.Path = classifyPath(result.Candidates, from)
+					deadline = earliest(time.Now().Add(holePunchLinger), deadline)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// isICMPError は受信エラーが、以前に送信したパケットに対する ICMP エラー
+// (Port Unreachable、Host/Network Unreachable) の通知かどうかを判定します
+func isICMPError(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH)
+}
+
+// holePunchCandidates は相手のピアの情報から、重複を除いた宛先候補を優先順に返します。
+// 外部マッピング、ランデブーサーバーが観測したアドレス、ローカルアドレスの順
+//
+// アドレスは相手のピアが送ってきた文字列なので、名前解決はせず "ip:port" のリテラルのみ受け付ける
+func holePunchCandidates(peer rendezvousMessage) []HolePunchCandidate {
+	var candidates []HolePunchCandidate
+	add := func(addr string, candidateType CandidateType) {
+		addrPort, err := netip.ParseAddrPort(addr)
+		if err != nil || addrPort.Port() == 0 {
+			return
+		}
+		udpAddr := net.UDPAddrFromAddrPort(addrPort)
+		for _, candidate := range candidates {
+			if udpAddrEqual(candidate.Address, udpAddr) {
+				return
+			}
+		}
+		candidates = append(candidates, HolePunchCandidate{Address: udpAddr, Type: candidateType})
+	}
+
+	add(peer.Mapped, ServerReflexiveCandidate)
+	add(peer.Observed, ServerReflexiveCandidate)
+	add(peer.Local, HostCandidate)
+	return candidates
+}
+
+// classifyPath は相手のパケットの送信元 from がどの候補に当たるかを返します
+func classifyPath(candidates []HolePunchCandidate, from *net.UDPAddr) *HolePunchCandidate {
+	for _, candidate := range candidates {
+		if udpAddrEqual(candidate.Address, from) {
+			return &candidate
+		}
+	}
+	return &HolePunchCandidate{Address: from, Type: PeerReflexiveCandidate}
+}
+
+// earliest は a と b のうち早い方の時刻を返します
+func earliest(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
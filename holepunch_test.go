@@ -0,0 +1,140 @@
+package natchecker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHolePunchCandidates(t *testing.T) {
+	tests := []struct {
+		name     string
+		peer     rendezvousMessage
+		expected []HolePunchCandidate
+	}{
+		{
+			name: "distinct addresses",
+			peer: rendezvousMessage{Mapped: "203.0.113.1:40000", Observed: "203.0.113.1:40002", Local: "192.168.1.10:5000"},
+			expected: []HolePunchCandidate{
+				{Address: &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 40000}, Type: ServerReflexiveCandidate},
+				{Address: &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 40002}, Type: ServerReflexiveCandidate},
+				{Address: &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 5000}, Type: HostCandidate},
+			},
+		},
+		{
+			name: "endpoint independent mapping and no NAT collapse to one candidate",
+			peer: rendezvousMessage{Mapped: "198.51.100.7:5000", Observed: "198.51.100.7:5000", Local: "198.51.100.7:5000"},
+			expected: []HolePunchCandidate{
+				{Address: &net.UDPAddr{IP: net.ParseIP("198.51.100.7"), Port: 5000}, Type: ServerReflexiveCandidate},
+			},
+		},
+		{
+			name: "missing and malformed addresses are skipped",
+			peer: rendezvousMessage{Mapped: "203.0.113.1:40000", Local: "not an address"},
+			expected: []HolePunchCandidate{
+				{Address: &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 40000}, Type: ServerReflexiveCandidate},
+			},
+		},
+		{
+			name: "host names are not resolved",
+			peer: rendezvousMessage{Mapped: "peer.example.com:40000", Observed: "localhost:40002", Local: "[2001:db8::10]:5000"},
+			expected: []HolePunchCandidate{
+				{Address: &net.UDPAddr{IP: net.ParseIP("2001:db8::10"), Port: 5000}, Type: HostCandidate},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			candidates := holePunchCandidates(test.peer)
+			require.Len(t, candidates, len(test.expected))
+			for i := range test.expected {
+				assert.True(t, udpAddrEqual(test.expected[i].Address, candidates[i].Address), "candidate %d address", i)
+				assert.Equal(t, test.expected[i].Type, candidates[i].Type, "candidate %d type", i)
+			}
+		})
+	}
+}
+
+func TestClassifyPath(t *testing.T) {
+	candidates := []HolePunchCandidate{
+		{Address: &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 40000}, Type: ServerReflexiveCandidate},
+		{Address: &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 5000}, Type: HostCandidate},
+	}
+
+	path := classifyPath(candidates, &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 5000})
+	assert.Equal(t, HostCandidate, path.Type)
+
+	path = classifyPath(candidates, &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 40001})
+	assert.Equal(t, PeerReflexiveCandidate, path.Type)
+	assert.Equal(t, 40001, path.Address.Port)
+}
+
+func TestHolePunchLoopback(t *testing.T) {
+	stun, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer stun.Close()
+	go serveMappedAddress(stun, false)
+
+	rendezvous, err := NewRendezvousServer("127.0.0.1:0")
+	require.NoError(t, err)
+	defer rendezvous.Close()
+
+	type outcome struct {
+		result *HolePunchResult
+		err    error
+	}
+	results := make(chan outcome, 2)
+	for _, peerID := range []string{"alice", "bob"} {
+		go func() {
+			result, err := HolePunch(stun.LocalAddr().String(), rendezvous.Addr().String(), "session-1", peerID, 5*time.Second,
+				WithAddressFamily(IPv4Only), WithRetransmission(50*time.Millisecond, 3))
+			results <- outcome{result, err}
+		}()
+	}
+
+	peers := map[string]bool{}
+	for range 2 {
+		o := <-results
+		require.NoError(t, o.err)
+		assert.True(t, o.result.Success, "hole punch should succeed on loopback")
+		assert.Positive(t, o.result.TimeToConnect)
+		require.NotNil(t, o.result.Path)
+		assert.Equal(t, ServerReflexiveCandidate, o.result.Path.Type)
+		peers[o.result.PeerID] = true
+	}
+	assert.Equal(t, map[string]bool{"alice": true, "bob": true}, peers)
+}
+
+func TestHolePunchWithoutPeer(t *testing.T) {
+	stun, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer stun.Close()
+	go serveMappedAddress(stun, false)
+
+	rendezvous, err := NewRendezvousServer("127.0.0.1:0")
+	require.NoError(t, err)
+	defer rendezvous.Close()
+
+	_, err = HolePunch(stun.LocalAddr().String(), rendezvous.Addr().String(), "lonely", "alice", 200*time.Millisecond,
+		WithAddressFamily(IPv4Only))
+	assert.Error(t, err, "should fail when the peer never registers")
+}
+
+func TestPunchStopsOnClosedTransport(t *testing.T) {
+	transport, err := NewMemoryNetwork().Listen(&net.UDPAddr{IP: net.ParseIP("198.51.100.1")})
+	require.NoError(t, err)
+	client := NewSTUNClientWithTransport(transport)
+	client.Close()
+
+	// 閉じた Transport の受信エラーは ICMP エラーとして読み捨てず、期限を待たずに返す
+	result := &HolePunchResult{PeerID: "bob"}
+	start := time.Now()
+	err = client.punch(result, "session", "alice", time.Now().Add(5*time.Second))
+	require.Error(t, err)
+	assert.ErrorIs(t, err, net.ErrClosed)
+	assert.Less(t, time.Since(start), time.Second)
+}
@@ -0,0 +1,33 @@
+package natchecker
+
+import "time"
+
+// hopProbeBasePort は中間ホップの探索で送るパケットの宛先ポートの基準。
+// traceroute と同じく、TTL ごとに基準 + TTL のポート宛に送って応答を対応付ける
+const hopProbeBasePort = 33434
+
+// defaultHopProbeWait は最後のプローブを送ってから ICMP エラーを待つ既定の時間
+const defaultHopProbeWait = time.Second
+
+// UDPHopProber は TTL (IPv6 ではホップリミット) を 1 から増やした UDP パケットを送り、
+// 中間ルーターが返す ICMP Time Exceeded の送信元から経路上のホップを調べる HopProber です。
+//
+// RFC 792 / RFC 4443: TTL が 0 になったパケットを破棄したルーターは Time Exceeded を返す。
+// Linux では IP_RECVERR (IPV6_RECVERR) でソケットのエラーキューから ICMP エラーを
+// 受け取るため、raw ソケットや特権を必要としません。それ以外の OS では
+// errors.ErrUnsupported を返します。
+//
+// WithHopProber を指定せず、WithTransport (WithListenPacket) で OS 以外の
+// ネットワークも指定していない場合は、FullNATDetection がこの実装を使います。
+type UDPHopProber struct {
+	// Wait は最後のプローブを送ってから ICMP エラーを待つ時間。0 なら既定値 (1 秒)
+	Wait time.Duration
+}
+
+// wait は有効な待ち時間を返します
+func (p UDPHopProber) wait() time.Duration {
+	if p.Wait > 0 {
+		return p.Wait
+	}
+	return defaultHopProbeWait
+}
@@ -0,0 +1,171 @@
+package natchecker
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// sock_extended_err の ee_origin (linux/errqueue.h)
+const (
+	soEEOriginICMP  = 2
+	soEEOriginICMP6 = 3
+)
+
+// ICMP / ICMPv6 のメッセージタイプ (RFC 792, RFC 4443)
+const (
+	icmpDestinationUnreachable  = 3
+	icmpTimeExceeded            = 11
+	icmp6DestinationUnreachable = 1
+	icmp6TimeExceeded           = 3
+)
+
+// ProbeHops は dst までの経路上のルーターのアドレスを近い順に最大 maxHops 個返します。
+// Time Exceeded の無かったホップは nil とし、宛先 (または到達不能を通知したホップ) に
+// 届いた TTL より先は返さない
+func (p UDPHopProber) ProbeHops(ctx context.Context, dst net.IP, maxHops int) ([]net.IP, error) {
+	network, level, hopLimit, recvErr := "udp4", syscall.IPPROTO_IP, syscall.IP_TTL, syscall.IP_RECVERR
+	if dst.To4() == nil {
+		network, level, hopLimit, recvErr = "udp6", syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, syscall.IPV6_RECVERR
+	}
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, fmt.Errorf("ソケット作成エラー: %w", err)
+	}
+	defer conn.Close()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("ソケット作成エラー: %w", err)
+	}
+	setsockopt := func(opt, value int) error {
+		var serr error
+		if err := raw.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptInt(int(fd), level, opt, value)
+		}); err != nil {
+			return err
+		}
+		return serr
+	}
+	if err := setsockopt(recvErr, 1); err != nil {
+		return nil, fmt.Errorf("ICMP エラー受信の設定エラー: %w", err)
+	}
+
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		if err := setsockopt(hopLimit, ttl); err != nil {
+			return nil, fmt.Errorf("TTL 設定エラー: %w", err)
+		}
+		// 先に送ったプローブの ICMP エラーは送信エラーとしても通知されるが、
+		// エラーキューに残っているので読み捨てずに後で受け取る
+		_, err := conn.WriteToUDP([]byte("nat-checker hop probe"), &net.UDPAddr{IP: dst, Port: hopProbeBasePort + ttl})
+		if err != nil && !isICMPError(err) {
+			return nil, fmt.Errorf("プローブ送信エラー: %w", err)
+		}
+	}
+
+	deadline := time.Now().Add(p.wait())
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+
+	hops := make([]net.IP, maxHops)
+	reached := maxHops + 1
+	buffer := make([]byte, 1500)
+	oob := make([]byte, 512)
+	for !hopsComplete(hops, reached) {
+		var oobn int
+		var from syscall.Sockaddr
+		var rerr error
+		err := raw.Read(func(fd uintptr) bool {
+			_, oobn, _, from, rerr = syscall.Recvmsg(int(fd), buffer, oob, syscall.MSG_ERRQUEUE)
+			if errors.Is(rerr, syscall.EAGAIN) {
+				// 通常のデータは読み捨てて、エラーキューへの通知を待つ
+				syscall.Recvfrom(int(fd), buffer, syscall.MSG_DONTWAIT)
+				return false
+			}
+			return true
+		})
+		if err != nil {
+			// 待ち時間が過ぎたら、それまでに応答のあったホップを返す
+			if isTimeoutError(err) {
+				break
+			}
+			return nil, fmt.Errorf("ICMP エラー受信エラー: %w", err)
+		}
+		if rerr != nil {
+			return nil, fmt.Errorf("ICMP エラー受信エラー: %w", rerr)
+		}
+
+		ttl := sockaddrPort(from) - hopProbeBasePort
+		if ttl < 1 || ttl > maxHops {
+			continue
+		}
+		offender, timeExceeded, unreachable := parseHopError(oob[:oobn])
+		switch {
+		case timeExceeded:
+			hops[ttl-1] = offender
+		case unreachable:
+			reached = min(reached, ttl)
+		}
+	}
+	return hops[:min(reached-1, maxHops)], nil
+}
+
+// hopsComplete は宛先に届いた TTL より手前のホップがすべて応答したかを返します
+func hopsComplete(hops []net.IP, reached int) bool {
+	for _, hop := range hops[:min(reached-1, len(hops))] {
+		if hop == nil {
+			return false
+		}
+	}
+	return reached <= len(hops)
+}
+
+// sockaddrPort はエラーキューから読んだ元のパケットの宛先ポートを返します
+func sockaddrPort(sa syscall.Sockaddr) int {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return sa.Port
+	case *syscall.SockaddrInet6:
+		return sa.Port
+	}
+	return 0
+}
+
+// parseHopError は IP_RECVERR / IPV6_RECVERR の制御メッセージから、ICMP エラーを
+// 送ったホップのアドレスと、Time Exceeded か Destination Unreachable かを返します。
+//
+// 制御メッセージの本体は struct sock_extended_err (16 バイト) とその後に続く
+// SO_EE_OFFENDER (sockaddr_in / sockaddr_in6)
+func parseHopError(oob []byte) (offender net.IP, timeExceeded, unreachable bool) {
+	messages, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, false, false
+	}
+	for _, m := range messages {
+		isIPv4 := m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_RECVERR
+		isIPv6 := m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_RECVERR
+		if (!isIPv4 && !isIPv6) || len(m.Data) < 16 {
+			continue
+		}
+		origin, icmpType := m.Data[4], m.Data[5]
+		sa := m.Data[16:]
+		switch origin {
+		case soEEOriginICMP:
+			if len(sa) >= 8 && binary.NativeEndian.Uint16(sa) == syscall.AF_INET {
+				offender = net.IP(append([]byte(nil), sa[4:8]...))
+			}
+			return offender, icmpType == icmpTimeExceeded, icmpType == icmpDestinationUnreachable
+		case soEEOriginICMP6:
+			if len(sa) >= 24 && binary.NativeEndian.Uint16(sa) == syscall.AF_INET6 {
+				offender = net.IP(append([]byte(nil), sa[8:24]...))
+			}
+			return offender, icmpType == icmp6TimeExceeded, icmpType == icmp6DestinationUnreachable
+		}
+	}
+	return nil, false, false
+}
@@ -0,0 +1,93 @@
+package natchecker
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recvErrMessage は IP_RECVERR / IPV6_RECVERR の制御メッセージを組み立てます
+func recvErrMessage(level, typ int32, origin, icmpType byte, offender net.IP) []byte {
+	data := make([]byte, 16)
+	data[4], data[5] = origin, icmpType
+	if ip4 := offender.To4(); ip4 != nil {
+		sa := make([]byte, 16)
+		binary.NativeEndian.PutUint16(sa, syscall.AF_INET)
+		copy(sa[4:], ip4)
+		data = append(data, sa...)
+	} else {
+		sa := make([]byte, 28)
+		binary.NativeEndian.PutUint16(sa, syscall.AF_INET6)
+		copy(sa[8:], offender.To16())
+		data = append(data, sa...)
+	}
+
+	b := make([]byte, syscall.CmsgSpace(len(data)))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level, h.Type = level, typ
+	h.SetLen(syscall.CmsgLen(len(data)))
+	copy(b[syscall.CmsgLen(0):], data)
+	return b
+}
+
+func TestParseHopError(t *testing.T) {
+	tests := []struct {
+		name         string
+		oob          []byte
+		offender     string
+		timeExceeded bool
+		unreachable  bool
+	}{
+		{
+			name:         "IPv4 time exceeded from a shared address hop",
+			oob:          recvErrMessage(syscall.IPPROTO_IP, syscall.IP_RECVERR, soEEOriginICMP, icmpTimeExceeded, net.ParseIP("100.64.0.1")),
+			offender:     "100.64.0.1",
+			timeExceeded: true,
+		},
+		{
+			name:        "IPv4 port unreachable from the destination",
+			oob:         recvErrMessage(syscall.IPPROTO_IP, syscall.IP_RECVERR, soEEOriginICMP, icmpDestinationUnreachable, net.ParseIP("198.51.100.1")),
+			offender:    "198.51.100.1",
+			unreachable: true,
+		},
+		{
+			name:         "IPv6 time exceeded",
+			oob:          recvErrMessage(syscall.IPPROTO_IPV6, syscall.IPV6_RECVERR, soEEOriginICMP6, icmp6TimeExceeded, net.ParseIP("2001:db8::1")),
+			offender:     "2001:db8::1",
+			timeExceeded: true,
+		},
+		{
+			name: "unrelated control message",
+			oob:  recvErrMessage(syscall.IPPROTO_IP, syscall.IP_TTL, soEEOriginICMP, icmpTimeExceeded, net.ParseIP("192.0.2.1")),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			offender, timeExceeded, unreachable := parseHopError(test.oob)
+			if test.offender == "" {
+				assert.Nil(t, offender)
+			} else {
+				assert.Equal(t, test.offender, offender.String())
+			}
+			assert.Equal(t, test.timeExceeded, timeExceeded, "time exceeded")
+			assert.Equal(t, test.unreachable, unreachable, "unreachable")
+		})
+	}
+}
+
+func TestUDPHopProberLoopback(t *testing.T) {
+	// ループバックは TTL 1 で宛先に届き、Port Unreachable で探索が終わる
+	start := time.Now()
+	hops, err := UDPHopProber{Wait: 5 * time.Second}.ProbeHops(context.Background(), net.ParseIP("127.0.0.1"), defaultHopProbeLimit)
+	require.NoError(t, err)
+	assert.Empty(t, hops, "no router between the host and itself")
+	assert.Less(t, time.Since(start), time.Second, "the probe ends once the destination answers")
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package natchecker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ProbeHops は Linux 以外では対応していないため、常に errors.ErrUnsupported を返します
+func (p UDPHopProber) ProbeHops(ctx context.Context, dst net.IP, maxHops int) ([]net.IP, error) {
+	return nil, fmt.Errorf("中間ホップの探索エラー: %w", errors.ErrUnsupported)
+}
@@ -0,0 +1,197 @@
+package natchecker
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+// IPv6TranslationType は IPv6 経路上のアドレス変換の種類
+type IPv6TranslationType int
+
+const (
+	// IPv6NoTranslation: 外部マッピングがローカルアドレスと一致する（変換なし）
+	IPv6NoTranslation IPv6TranslationType = iota
+	// IPv6NPTv6: プレフィックスのみを書き換えるステートレスな変換 (RFC 6296)
+	IPv6NPTv6
+	// IPv6NAT66: アドレスやポートを書き換えるステートフルな変換
+	IPv6NAT66
+	// IPv6TranslationUnknown: ローカルアドレスまたはマッピングが得られず判定できない
+	IPv6TranslationUnknown
+)
+
+func (t IPv6TranslationType) String() string {
+	switch t {
+	case IPv6NoTranslation:
+		return "No Translation"
+	case IPv6NPTv6:
+		return "NPTv6"
+	case IPv6NAT66:
+		return "NAT66"
+	default:
+		return "Unknown"
+	}
+}
+
+// IPv6NATDetectionResult は IPv6 経路の判定結果
+type IPv6NATDetectionResult struct {
+	// Translation は IPv6 アドレス変換の種類
+	Translation IPv6TranslationType `json:"translation"`
+	// LocalAddress はクライアントのローカルアドレス
+	LocalAddress *net.UDPAddr `json:"local_address"`
+	// MappedAddress は Test I で得られた外部マッピング
+	MappedAddress *net.UDPAddr `json:"mapped_address"`
+	// PortPreserved は外部マッピングのポートがローカルのポートと一致した場合に true
+	PortPreserved bool `json:"port_preserved"`
+	// PrefixPreserved は外部アドレスの上位 64 ビット（/64 プレフィックス）が
+	// ローカルアドレスと一致した場合に true
+	PrefixPreserved bool `json:"prefix_preserved"`
+	// IIDPreserved は外部アドレスの下位 64 ビット（インターフェース識別子）が
+	// ローカルアドレスと一致した場合に true
+	IIDPreserved bool `json:"iid_preserved"`
+	// ChecksumNeutral はローカルアドレスと外部アドレスの 1 の補数和が一致した場合に true
+	// (RFC 6296 Section 3.1 の checksum-neutral な書き換え)
+	ChecksumNeutral bool `json:"checksum_neutral"`
+	// StatefulFirewall はアドレス変換が無い（またはステートレスな NPTv6 のみの）
+	// 経路で、未通信の送信元からのパケットが遮断された場合に true
+	StatefulFirewall bool `json:"stateful_firewall"`
+	// DetailedType はマッピング・フィルタリングの判定結果
+	DetailedType    DetailedNATType       `json:"detailed_type"`
+	MappingResult   *CheckMappingResult   `json:"mapping_result"`
+	FilteringResult *CheckFilteringResult `json:"filtering_result"`
+}
+
+// String は結果の文字列表現を返す
+func (r IPv6NATDetectionResult) String() string {
+	if r.StatefulFirewall {
+		return fmt.Sprintf("IPv6: %s, stateful firewall (%s)", r.Translation, r.DetailedType.Filtering)
+	}
+	return fmt.Sprintf("IPv6: %s (%s)", r.Translation, r.DetailedType)
+}
+
+// IPv6NATDetection は IPv6 経路のアドレス変換とフィルタリングを判定します
+//
+// ソケットとサーバーアドレスを IPv6 に限定して FullNATDetection と同じテストを行い、
+// 外部マッピングとローカルアドレスを比較して変換の種類を分類します:
+//   - /64 プレフィックスとインターフェース識別子が一致する → 変換なし
+//   - プレフィックスのみが異なり、インターフェース識別子が保存されるか
+//     書き換えが checksum-neutral → NPTv6 (RFC 6296)
+//   - それ以外 → NAT66
+//
+// NPTv6 も変換なしもポートは書き換えないため、ポートが変わった場合は NAT66 とする。
+//
+// IPv6 ではアドレス変換が無くてもステートフルファイアウォールで未通信の送信元が
+// 遮断されることが多いため、フィルタリングの判定結果から StatefulFirewall を設定します。
+//
+// serverAddr は AAAA レコードを持つ名前、または IPv6 アドレスを指定します。
+// IPv6 で到達できない場合はエラーを返します。
+func IPv6NATDetection(serverAddr string, opts ...Option) (*IPv6NATDetectionResult, error) {
+	opts = withOption(opts, WithAddressFamily(IPv6Only))
+
+	servers, err := newConfig(opts).resolveServers(serverAddr)
+	if err != nil {
+		return nil, fmt.Errorf("サーバーアドレス解決エラー: %w", err)
+	}
+
+	full, err := fullNATDetection(servers, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	local := full.MappingResult.Response.LocalAddress
+	mapped := full.MappingResult.Response.Mapping1
+	result := &IPv6NATDetectionResult{
+		Translation:     determineIPv6Translation(local, mapped),
+		LocalAddress:    local,
+		MappedAddress:   mapped,
+		DetailedType:    full.DetailedType,
+		MappingResult:   full.MappingResult,
+		FilteringResult: full.FilteringResult,
+	}
+	if local != nil && mapped != nil {
+		result.PortPreserved = local.Port == mapped.Port
+		result.PrefixPreserved = ipv6PrefixEqual(local.IP, mapped.IP)
+		result.IIDPreserved = ipv6IIDEqual(local.IP, mapped.IP)
+		result.ChecksumNeutral = checksumNeutral(local.IP, mapped.IP)
+	}
+
+	// ステートレスな変換しか無い経路でフィルタリングが行われていれば、
+	// それはファイアウォールによるもの
+	switch result.Translation {
+	case IPv6NoTranslation, IPv6NPTv6:
+		switch full.DetailedType.Filtering {
+		case AddressDependentFiltering, AddressPortDependentFiltering:
+			result.StatefulFirewall = true
+		}
+	}
+	return result, nil
+}
+
+// determineIPv6Translation はローカルアドレスと外部マッピングから
+// IPv6 アドレス変換の種類を判定します
+//
+// /64 プレフィックスとインターフェース識別子 (IID) を個別に比較する。
+// RFC 6296 Section 3.1: NPTv6 は 1 対 1 のステートレスなプレフィックス変換で、
+// "the IPv6 NPTv6 algorithm ... is checksum-neutral"
+// /48 以下のプレフィックスではサブネット ID で補正されるため IID はそのまま残り、
+// それより長いプレフィックスでは IID のワードで補正されるが 1 の補数和は変わらない。
+// NPTv6 はポートを書き換えないため、ポートの変化や同じプレフィックス内での
+// IID の書き換えはステートフルな NAT66 とみなす。
+func determineIPv6Translation(local, mapped *net.UDPAddr) IPv6TranslationType {
+	if local == nil || mapped == nil || local.IP.To4() != nil || mapped.IP.To4() != nil ||
+		local.IP.To16() == nil || mapped.IP.To16() == nil {
+		return IPv6TranslationUnknown
+	}
+	if local.Port != mapped.Port {
+		return IPv6NAT66
+	}
+
+	samePrefix := ipv6PrefixEqual(local.IP, mapped.IP)
+	sameIID := ipv6IIDEqual(local.IP, mapped.IP)
+	switch {
+	case samePrefix && sameIID:
+		return IPv6NoTranslation
+	case !samePrefix && (sameIID || checksumNeutral(local.IP, mapped.IP)):
+		return IPv6NPTv6
+	default:
+		return IPv6NAT66
+	}
+}
+
+// ipv6PrefixEqual は a と b の上位 64 ビット（/64 プレフィックス）が一致するかどうかを返します
+func ipv6PrefixEqual(a, b net.IP) bool {
+	a16, b16 := a.To16(), b.To16()
+	return a16 != nil && b16 != nil && bytes.Equal(a16[:8], b16[:8])
+}
+
+// ipv6IIDEqual は a と b の下位 64 ビット（インターフェース識別子）が一致するかどうかを返します
+func ipv6IIDEqual(a, b net.IP) bool {
+	a16, b16 := a.To16(), b.To16()
+	return a16 != nil && b16 != nil && bytes.Equal(a16[8:], b16[8:])
+}
+
+// checksumNeutral は a と b の 16 ビットワードの 1 の補数和が一致するかどうかを返します。
+// どちらかが IPv6 アドレスでなければ false を返す
+func checksumNeutral(a, b net.IP) bool {
+	a16, b16 := a.To16(), b.To16()
+	if a16 == nil || b16 == nil || a.To4() != nil || b.To4() != nil {
+		return false
+	}
+	return onesComplementSum(a16) == onesComplementSum(b16)
+}
+
+// onesComplementSum は data を 16 ビットワード列とみなした 1 の補数和を返します。
+// 1 の補数表現では 0x0000 と 0xFFFF はどちらも 0 を表すため、0xFFFF は 0 に正規化する
+func onesComplementSum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	for sum > 0xFFFF {
+		sum = sum&0xFFFF + sum>>16
+	}
+	if sum == 0xFFFF {
+		return 0
+	}
+	return uint16(sum)
+}
@@ -0,0 +1,140 @@
+package natchecker
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPv6TranslationTypeString(t *testing.T) {
+	tests := []struct {
+		translation IPv6TranslationType
+		expected    string
+	}{
+		{IPv6NoTranslation, "No Translation"},
+		{IPv6NPTv6, "NPTv6"},
+		{IPv6NAT66, "NAT66"},
+		{IPv6TranslationUnknown, "Unknown"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, test.translation.String(), "IPv6TranslationType(%d).String()", test.translation)
+	}
+}
+
+func TestDetermineIPv6Translation(t *testing.T) {
+	udp := func(ip string, port int) *net.UDPAddr {
+		return &net.UDPAddr{IP: net.ParseIP(ip), Port: port}
+	}
+
+	tests := []struct {
+		name     string
+		local    *net.UDPAddr
+		mapped   *net.UDPAddr
+		expected IPv6TranslationType
+	}{
+		{
+			name:     "same address and port",
+			local:    udp("2001:db8:1:2::10", 50000),
+			mapped:   udp("2001:db8:1:2::10", 50000),
+			expected: IPv6NoTranslation,
+		},
+		{
+			// RFC 6296 Section 3.3 の例: fd01:203:405::/48 → 2001:db8:1::/48
+			name:     "checksum-neutral prefix translation",
+			local:    udp("fd01:203:405:1::1234", 50000),
+			mapped:   udp("2001:db8:1:d550::1234", 50000),
+			expected: IPv6NPTv6,
+		},
+		{
+			name:     "same address with port rewrite",
+			local:    udp("2001:db8:1:2::10", 50000),
+			mapped:   udp("2001:db8:1:2::10", 61000),
+			expected: IPv6NAT66,
+		},
+		{
+			// /64 の書き換えで IID はそのまま（checksum-neutral ではない）
+			name:     "prefix translation preserving interface identifier",
+			local:    udp("fd00:1:2:3::10", 50000),
+			mapped:   udp("2001:db8:aa:bb::10", 50000),
+			expected: IPv6NPTv6,
+		},
+		{
+			// /64 の NPTv6 は IID の先頭ワードで補正する (RFC 6296 Section 3.5)
+			name:     "checksum-neutral /64 translation adjusting interface identifier",
+			local:    udp("fd00:1:2:3::1234", 50000),
+			mapped:   udp("2001:db8:1:2:cf4a::1234", 50000),
+			expected: IPv6NPTv6,
+		},
+		{
+			// 1 の補数和は一致するがプレフィックスは変わっていない
+			name:     "interface identifier rewrite within the same prefix",
+			local:    udp("2001:db8::1:0", 50000),
+			mapped:   udp("2001:db8::1", 50000),
+			expected: IPv6NAT66,
+		},
+		{
+			name:     "prefix translation with port rewrite",
+			local:    udp("fd01:203:405:1::1234", 50000),
+			mapped:   udp("2001:db8:1:d550::1234", 61000),
+			expected: IPv6NAT66,
+		},
+		{
+			name:     "address rewrite that is not checksum-neutral",
+			local:    udp("fd00::2", 50000),
+			mapped:   udp("2001:db8::1", 50000),
+			expected: IPv6NAT66,
+		},
+		{
+			name:     "missing mapping",
+			local:    udp("fd00::2", 50000),
+			expected: IPv6TranslationUnknown,
+		},
+		{
+			name:     "IPv4 mapping",
+			local:    udp("192.0.2.2", 50000),
+			mapped:   udp("203.0.113.1", 50000),
+			expected: IPv6TranslationUnknown,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, determineIPv6Translation(test.local, test.mapped))
+		})
+	}
+}
+
+func TestOnesComplementSum(t *testing.T) {
+	assert.Equal(t, uint16(0x0003), onesComplementSum([]byte{0x00, 0x01, 0x00, 0x02}))
+	// 桁あふれは下位に折り返す
+	assert.Equal(t, uint16(0x0002), onesComplementSum([]byte{0x80, 0x00, 0x80, 0x01}))
+	// 0xFFFF は 0 と同じ値として扱う
+	assert.Equal(t, onesComplementSum([]byte{0x00, 0x00}), onesComplementSum([]byte{0xFF, 0xFF}))
+}
+
+// 統合テスト - IPv6 経路の判定
+func TestIPv6NATDetectionIntegration(t *testing.T) {
+	if os.Getenv("INTEGRATION") != "1" {
+		t.Skip("Skipping integration test. Set INTEGRATION=1 to run.")
+	}
+
+	server := "stunserver2025.stunprotocol.org"
+
+	result, err := IPv6NATDetection(server)
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	require.NotNil(t, result)
+
+	t.Logf("=== IPv6 NAT Detection ===")
+	t.Logf("Server: %s", server)
+	t.Logf("Translation: %s", result.Translation)
+	t.Logf("LocalAddress: %s", result.LocalAddress)
+	t.Logf("MappedAddress: %s", result.MappedAddress)
+	t.Logf("Detailed Type: %s", result.DetailedType)
+	t.Logf("Stateful Firewall: %v", result.StatefulFirewall)
+}
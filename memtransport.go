@@ -0,0 +1,188 @@
+package natchecker
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// memoryQueueLength は MemoryTransport が受信待ちにできるデータグラムの数。
+// 溢れた分は UDP と同じく捨てる
+const memoryQueueLength = 64
+
+// memoryFirstPort は MemoryNetwork がポート 0 の Listen に割り当てる最初のポート
+const memoryFirstPort = 40000
+
+// MemoryNetwork は MemoryTransport 同士をつなぐプロセス内のネットワークです。
+//
+// NAT もパケットロスも無く、送信したデータグラムは宛先アドレスで Listen している
+// MemoryTransport にそのまま届きます。宛先が無い場合は捨てられます。
+// OS のソケットを使わずに STUNClient や Check* 関数を試験するために使います。
+type MemoryNetwork struct {
+	mu         sync.Mutex
+	transports map[netip.AddrPort]*MemoryTransport
+	nextPort   map[netip.Addr]int
+}
+
+// NewMemoryNetwork は空の MemoryNetwork を作ります
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		transports: make(map[netip.AddrPort]*MemoryTransport),
+		nextPort:   make(map[netip.Addr]int),
+	}
+}
+
+// Listen は addr で送受信する MemoryTransport を作ります。
+// ポートが 0 の場合は空いているポートを割り当てる
+func (n *MemoryNetwork) Listen(addr *net.UDPAddr) (*MemoryTransport, error) {
+	ip, ok := netip.AddrFromSlice(addr.IP)
+	if !ok {
+		return nil, fmt.Errorf("不正な IP アドレス: %v", addr.IP)
+	}
+	ip = ip.Unmap()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	port := addr.Port
+	if port == 0 {
+		var err error
+		if port, err = n.allocatePort(ip); err != nil {
+			return nil, err
+		}
+	}
+	key := netip.AddrPortFrom(ip, uint16(port))
+	if _, used := n.transports[key]; used {
+		return nil, fmt.Errorf("アドレス %s は使用中です", key)
+	}
+
+	t := &MemoryTransport{
+		network: n,
+		addr:    key,
+		queue:   make(chan memoryDatagram, memoryQueueLength),
+		closed:  make(chan struct{}),
+	}
+	n.transports[key] = t
+	return t, nil
+}
+
+// Factory は ip の空いているポートで Listen する TransportFactory を返します。
+// WithTransport に渡すと、クライアントのソケットがすべてこのネットワーク上に作られる。
+// ip のアドレスファミリーと異なる network ("udp4" に IPv6 アドレスなど) を
+// 要求された場合はエラーを返す
+func (n *MemoryNetwork) Factory(ip net.IP) TransportFactory {
+	return func(network string) (Transport, error) {
+		is4 := ip.To4() != nil
+		if (network == "udp4" && !is4) || (network == "udp6" && is4) {
+			return nil, fmt.Errorf("%s は %s のアドレスではありません", ip, network)
+		}
+		return n.Listen(&net.UDPAddr{IP: ip})
+	}
+}
+
+// allocatePort は ip で使われていないポートを返します。n.mu を保持して呼ぶこと
+func (n *MemoryNetwork) allocatePort(ip netip.Addr) (int, error) {
+	port := n.nextPort[ip]
+	for i := 0; i < 65536-memoryFirstPort; i++ {
+		if port < memoryFirstPort || port > 65535 {
+			port = memoryFirstPort
+		}
+		if _, used := n.transports[netip.AddrPortFrom(ip, uint16(port))]; !used {
+			n.nextPort[ip] = port + 1
+			return port, nil
+		}
+		port++
+	}
+	return 0, fmt.Errorf("%s に空いているポートがありません", ip)
+}
+
+// deliver は to で Listen している MemoryTransport に datagram を届けます
+func (n *MemoryNetwork) deliver(to *net.UDPAddr, datagram memoryDatagram) {
+	ip, ok := netip.AddrFromSlice(to.IP)
+	if !ok {
+		return
+	}
+	n.mu.Lock()
+	t := n.transports[netip.AddrPortFrom(ip.Unmap(), uint16(to.Port))]
+	n.mu.Unlock()
+	if t == nil {
+		return
+	}
+
+	select {
+	case t.queue <- datagram:
+	default:
+		// 受信キューが溢れた分は捨てる
+	}
+}
+
+// memoryDatagram は MemoryNetwork 上を流れる 1 つのデータグラム
+type memoryDatagram struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// MemoryTransport は MemoryNetwork 上の 1 つのアドレスで送受信する Transport です
+type MemoryTransport struct {
+	network   *MemoryNetwork
+	addr      netip.AddrPort
+	queue     chan memoryDatagram
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Addr はこの Transport のアドレスを返します
+func (t *MemoryTransport) Addr() *net.UDPAddr {
+	return net.UDPAddrFromAddrPort(t.addr)
+}
+
+// Send は addr 宛に data を送信します。宛先が無い場合は何もしない
+func (t *MemoryTransport) Send(data []byte, addr *net.UDPAddr) error {
+	select {
+	case <-t.closed:
+		return &net.OpError{Op: "write", Net: "memory", Addr: addr, Err: net.ErrClosed}
+	default:
+	}
+	t.network.deliver(addr, memoryDatagram{data: append([]byte(nil), data...), from: t.Addr()})
+	return nil
+}
+
+// Receive は deadline まで待って 1 つのデータグラムを受信します。
+// buffer に収まらない部分は捨てる
+func (t *MemoryTransport) Receive(buffer []byte, deadline time.Time) (int, *net.UDPAddr, error) {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case datagram := <-t.queue:
+		return copy(buffer, datagram.data), datagram.from, nil
+	case <-t.closed:
+		return 0, nil, &net.OpError{Op: "read", Net: "memory", Addr: t.Addr(), Err: net.ErrClosed}
+	case <-timeout:
+		return 0, nil, &net.OpError{Op: "read", Net: "memory", Addr: t.Addr(), Err: os.ErrDeadlineExceeded}
+	}
+}
+
+// LocalAddr は Listen したアドレスを返します。MemoryNetwork には NAT が無いので
+// 宛先によらず同じアドレスになる
+func (t *MemoryTransport) LocalAddr(dst *net.UDPAddr) (*net.UDPAddr, error) {
+	return t.Addr(), nil
+}
+
+// Close は Transport を閉じ、アドレスを解放します
+func (t *MemoryTransport) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		t.network.mu.Lock()
+		delete(t.network.transports, t.addr)
+		t.network.mu.Unlock()
+	})
+	return nil
+}
@@ -0,0 +1,230 @@
+package natchecker
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// WellKnownNAT64Prefix は NAT64 の Well-Known Prefix 64:ff9b::/96 (RFC 6052 Section 2.1)
+var WellKnownNAT64Prefix = &net.IPNet{IP: net.ParseIP("64:ff9b::"), Mask: net.CIDRMask(96, 128)}
+
+// ipv4OnlyARPA は DNS64 の合成プレフィックスを探索するための名前 (RFC 7050 Section 2)
+const ipv4OnlyARPA = "ipv4only.arpa"
+
+// ipv4OnlyAddresses は ipv4only.arpa の A レコードとして定義された IPv4 アドレス
+// RFC 7050 Section 2.2: "192.0.0.170" および "192.0.0.171"
+var ipv4OnlyAddresses = []net.IP{
+	net.IPv4(192, 0, 0, 170).To4(),
+	net.IPv4(192, 0, 0, 171).To4(),
+}
+
+// nat64PrefixLengths は RFC 6052 Section 2.2 で定義された IPv4-embedded IPv6
+// アドレスのプレフィックス長
+var nat64PrefixLengths = []int{96, 64, 56, 48, 40, 32}
+
+// NAT64Info はサーバーへの経路に NAT64 が介在している場合の情報
+type NAT64Info struct {
+	// Prefix はサーバーアドレスの合成に使われた NAT64 プレフィックス
+	Prefix string `json:"prefix"`
+	// WellKnownPrefix は Prefix が 64:ff9b::/96 の場合に true
+	WellKnownPrefix bool `json:"well_known_prefix"`
+	// ServerIPv4 はサーバーの IPv6 アドレスに埋め込まれた IPv4 アドレス
+	ServerIPv4 net.IP `json:"server_ipv4"`
+	// Translated は外部マッピングが IPv4 アドレスだった
+	// （サーバーからは NAT64 の IPv4 アドレスとして見えている）場合に true
+	Translated bool `json:"translated"`
+
+	prefix *net.IPNet
+}
+
+// synthesize は IPv4 アドレス addr を NAT64 プレフィックスで IPv6 アドレスに変換します。
+// NAT64 が介在しない (n が nil) 場合や addr が IPv4 でない場合は addr をそのまま返す。
+//
+// NAT64 経由のサーバーが返す OTHER-ADDRESS は IPv4 アドレスのため、
+// IPv6 のみのネットワークからはそのままでは送信できない。
+func (n *NAT64Info) synthesize(addr *net.UDPAddr) *net.UDPAddr {
+	if n == nil || addr == nil || addr.IP.To4() == nil {
+		return addr
+	}
+	return &net.UDPAddr{IP: embedIPv4(n.prefix, addr.IP), Port: addr.Port}
+}
+
+// nat64Discovery は 1 回の判定の中で RFC 7050 の探索結果を共有するためのキャッシュ。
+// 探索は DNS64 が無い環境ではタイムアウトまで待つことがあるため、1 度だけ行う
+type nat64Discovery struct {
+	once     sync.Once
+	prefixes []*net.IPNet
+}
+
+// withNAT64Discovery は opts に新しい探索結果のキャッシュを加えた Option を返します。
+// 複数のフェーズで別々のクライアントを作る判定が、探索を 1 度で済ませるために使う
+func withNAT64Discovery(opts []Option) []Option {
+	discovery := &nat64Discovery{}
+	return withOption(opts, func(c *config) {
+		c.nat64 = discovery
+	})
+}
+
+// discoveredNAT64Prefixes は RFC 7050 の探索で得た NAT64 プレフィックスを返します。
+// 同じ判定の中では最初の呼び出しの結果を使い回す
+func (c config) discoveredNAT64Prefixes() []*net.IPNet {
+	discover := func() []*net.IPNet {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultResolveTimeout)
+		defer cancel()
+		// DNS64 が無い環境では探索に失敗するのが普通なので、エラーは無視する
+		prefixes, _ := DiscoverNAT64Prefixes(ctx, c.resolver)
+		return prefixes
+	}
+	if c.nat64 == nil {
+		return discover()
+	}
+	c.nat64.once.Do(func() {
+		c.nat64.prefixes = discover()
+	})
+	return c.nat64.prefixes
+}
+
+// detectNAT64 はサーバーアドレス server が NAT64 プレフィックスで合成された
+// アドレスかどうかを判定します。
+//
+// Well-Known Prefix に加え、RFC 7050 の ipv4only.arpa 探索で得たプレフィックスも
+// 確認する。NAT64 が介在しない場合は nil を返す。
+//
+// DNS64 がアドレスを合成するのは IPv6 のみのネットワークなので、ホストが IPv4 で通信できる
+// (ipv6Only が false) 場合と、サーバーに IPv6 のまま届いている (外部マッピングが IPv6) 場合は
+// 探索しない。
+func (c config) detectNAT64(server, mapped *net.UDPAddr, ipv6Only bool) *NAT64Info {
+	if server == nil || server.IP.To4() != nil {
+		return nil
+	}
+
+	prefixes := []*net.IPNet{WellKnownNAT64Prefix}
+	if !WellKnownNAT64Prefix.Contains(server.IP) {
+		if !ipv6Only || (mapped != nil && mapped.IP.To4() == nil) {
+			return nil
+		}
+		prefixes = c.discoveredNAT64Prefixes()
+	}
+
+	for _, prefix := range prefixes {
+		ipv4 := extractIPv4(server.IP, prefix)
+		if ipv4 == nil {
+			continue
+		}
+		return &NAT64Info{
+			Prefix:          prefix.String(),
+			WellKnownPrefix: prefix.String() == WellKnownNAT64Prefix.String(),
+			ServerIPv4:      ipv4,
+			Translated:      mapped != nil && mapped.IP.To4() != nil,
+			prefix:          prefix,
+		}
+	}
+	return nil
+}
+
+// detectNAT64 はクライアントの Transport で IPv4 の宛先への送信元を調べ、
+// ホストが IPv6 のみのネットワークにあるかを判断してから NAT64 の介在を判定します
+func (c *STUNClient) detectNAT64(server, mapped *net.UDPAddr) *NAT64Info {
+	if server == nil || server.IP.To4() != nil {
+		return nil
+	}
+	// 経路を調べるだけで、実際には送信しない
+	local, err := c.LocalAddr(&net.UDPAddr{IP: ipv4OnlyAddresses[0], Port: 3478})
+	ipv6Only := err != nil || local.IP.To4() == nil
+	return c.cfg.detectNAT64(server, mapped, ipv6Only)
+}
+
+// DiscoverNAT64Prefixes は RFC 7050 の手順で DNS64 が合成に使う NAT64 プレフィックスを探索します。
+//
+// ipv4only.arpa の AAAA レコードを問い合わせ、既知の IPv4 アドレス
+// (192.0.0.170 / 192.0.0.171) が埋め込まれた位置からプレフィックスとその長さを求めます。
+// DNS64 が無い（AAAA レコードが無い）場合は空のスライスを返します。
+// r が nil の場合は net.DefaultResolver を使います。
+func DiscoverNAT64Prefixes(ctx context.Context, r Resolver) ([]*net.IPNet, error) {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+
+	addrs, err := r.LookupIPAddr(ctx, ipv4OnlyARPA)
+	if err != nil {
+		return nil, err
+	}
+
+	var prefixes []*net.IPNet
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			continue
+		}
+		prefix := nat64PrefixOf(addr.IP)
+		if prefix == nil || seen[prefix.String()] {
+			continue
+		}
+		seen[prefix.String()] = true
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// nat64PrefixOf は ipv4only.arpa の AAAA レコード ip から NAT64 プレフィックスを求めます。
+// RFC 7050 Section 3: 既知の IPv4 アドレスが埋め込まれている位置を
+// RFC 6052 の各プレフィックス長について調べる
+func nat64PrefixOf(ip net.IP) *net.IPNet {
+	for _, length := range nat64PrefixLengths {
+		prefix := &net.IPNet{IP: ip.Mask(net.CIDRMask(length, 128)), Mask: net.CIDRMask(length, 128)}
+		embedded := extractIPv4(ip, prefix)
+		for _, known := range ipv4OnlyAddresses {
+			if embedded != nil && embedded.Equal(known) {
+				return prefix
+			}
+		}
+	}
+	return nil
+}
+
+// embeddedIPv4Offsets は IPv4-embedded IPv6 アドレスで IPv4 アドレスの各バイトが
+// 置かれる位置を返します (RFC 6052 Section 2.2)。
+// ビット 64-71 ("u" オクテット) は常に 0 で、IPv4 アドレスはそこを飛ばして配置される
+func embeddedIPv4Offsets(prefixLength int) []int {
+	offsets := make([]int, 0, net.IPv4len)
+	for i := prefixLength / 8; len(offsets) < net.IPv4len && i < net.IPv6len; i++ {
+		if i == 8 {
+			continue
+		}
+		offsets = append(offsets, i)
+	}
+	return offsets
+}
+
+// extractIPv4 は ip が prefix に含まれる場合に、埋め込まれた IPv4 アドレスを返します。
+// 含まれない場合や "u" オクテットが 0 でない場合は nil を返す
+func extractIPv4(ip net.IP, prefix *net.IPNet) net.IP {
+	ip16 := ip.To16()
+	if ip16 == nil || ip.To4() != nil || !prefix.Contains(ip16) {
+		return nil
+	}
+	prefixLength, _ := prefix.Mask.Size()
+	if prefixLength < 96 && ip16[8] != 0 {
+		return nil
+	}
+
+	ipv4 := make(net.IP, 0, net.IPv4len)
+	for _, offset := range embeddedIPv4Offsets(prefixLength) {
+		ipv4 = append(ipv4, ip16[offset])
+	}
+	return ipv4
+}
+
+// embedIPv4 は prefix に IPv4 アドレス ipv4 を埋め込んだ IPv6 アドレスを返します
+// (RFC 6052 Section 2.2)
+func embedIPv4(prefix *net.IPNet, ipv4 net.IP) net.IP {
+	prefixLength, _ := prefix.Mask.Size()
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16().Mask(prefix.Mask))
+	v4 := ipv4.To4()
+	for i, offset := range embeddedIPv4Offsets(prefixLength) {
+		ip[offset] = v4[i]
+	}
+	return ip
+}
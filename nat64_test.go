@@ -0,0 +1,133 @@
+package natchecker
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbedAndExtractIPv4(t *testing.T) {
+	// RFC 6052 Section 2.4 の例 (192.0.2.33)
+	tests := []struct {
+		prefix   string
+		embedded string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::192.0.2.33"},
+		{"64:ff9b::/96", "64:ff9b::192.0.2.33"},
+	}
+
+	ipv4 := net.ParseIP("192.0.2.33")
+	for _, test := range tests {
+		t.Run(test.prefix, func(t *testing.T) {
+			_, prefix, err := net.ParseCIDR(test.prefix)
+			require.NoError(t, err)
+
+			embedded := embedIPv4(prefix, ipv4)
+			assert.Equal(t, net.ParseIP(test.embedded).String(), embedded.String())
+			assert.Equal(t, "192.0.2.33", extractIPv4(embedded, prefix).String())
+		})
+	}
+
+	_, prefix, _ := net.ParseCIDR("2001:db8::/32")
+	assert.Nil(t, extractIPv4(net.ParseIP("2001:db9::1"), prefix), "address outside the prefix")
+	assert.Nil(t, extractIPv4(net.ParseIP("2001:db8:c000:221:ff00::"), prefix), "non-zero u octet")
+}
+
+func TestDiscoverNAT64Prefixes(t *testing.T) {
+	r := &fakeResolver{ips: map[string][]net.IPAddr{
+		"ipv4only.arpa": ipAddrs(
+			"2001:db8:122:344::192.0.0.170",
+			"2001:db8:122:344::192.0.0.171",
+			"2001:db8:122:344:c0:0:aa00:0",
+			"192.0.0.170",
+		),
+	}}
+
+	prefixes, err := DiscoverNAT64Prefixes(context.Background(), r)
+	require.NoError(t, err)
+	var got []string
+	for _, prefix := range prefixes {
+		got = append(got, prefix.String())
+	}
+	assert.Equal(t, []string{"2001:db8:122:344::/96", "2001:db8:122:344::/64"}, got)
+
+	// DNS64 が無い環境
+	_, err = DiscoverNAT64Prefixes(context.Background(), &fakeResolver{})
+	assert.Error(t, err)
+}
+
+func TestDetectNAT64(t *testing.T) {
+	mappedIPv4 := &net.UDPAddr{IP: net.ParseIP("203.0.113.5"), Port: 40000}
+
+	t.Run("well-known prefix", func(t *testing.T) {
+		server := &net.UDPAddr{IP: net.ParseIP("64:ff9b::198.51.100.10"), Port: 3478}
+		info := newConfig(nil).detectNAT64(server, mappedIPv4, true)
+		require.NotNil(t, info)
+		assert.Equal(t, "64:ff9b::/96", info.Prefix)
+		assert.True(t, info.WellKnownPrefix)
+		assert.Equal(t, "198.51.100.10", info.ServerIPv4.String())
+		assert.True(t, info.Translated)
+
+		other := info.synthesize(&net.UDPAddr{IP: net.ParseIP("198.51.100.11"), Port: 3479})
+		assert.Equal(t, "[64:ff9b::c633:640b]:3479", other.String())
+	})
+
+	t.Run("discovered prefix", func(t *testing.T) {
+		r := &fakeResolver{ips: map[string][]net.IPAddr{
+			"ipv4only.arpa": ipAddrs("2001:db8:64::192.0.0.170"),
+		}}
+		server := &net.UDPAddr{IP: net.ParseIP("2001:db8:64::198.51.100.10"), Port: 3478}
+		info := newConfig([]Option{WithResolver(r)}).detectNAT64(server, mappedIPv4, true)
+		require.NotNil(t, info)
+		assert.Equal(t, "2001:db8:64::/96", info.Prefix)
+		assert.False(t, info.WellKnownPrefix)
+		assert.Equal(t, "198.51.100.10", info.ServerIPv4.String())
+	})
+
+	t.Run("discovery is skipped when not needed", func(t *testing.T) {
+		r := &fakeResolver{ips: map[string][]net.IPAddr{
+			"ipv4only.arpa": ipAddrs("2001:db8:64::192.0.0.170"),
+		}}
+		cfg := newConfig([]Option{WithResolver(r)})
+		server := &net.UDPAddr{IP: net.ParseIP("2001:db8:64::198.51.100.10"), Port: 3478}
+
+		// IPv4 でも通信できるホストは DNS64 の合成アドレスを使わない
+		assert.Nil(t, cfg.detectNAT64(server, mappedIPv4, false))
+		// IPv6 のままサーバーに届いていれば変換は介在しない
+		assert.Nil(t, cfg.detectNAT64(server, &net.UDPAddr{IP: net.ParseIP("2001:db8::5"), Port: 40000}, true))
+		assert.Empty(t, r.queries)
+	})
+
+	t.Run("discovery is shared within a detection", func(t *testing.T) {
+		r := &fakeResolver{}
+		cfg := newConfig(withNAT64Discovery([]Option{WithResolver(r)}))
+		server := &net.UDPAddr{IP: net.ParseIP("2001:db8::10"), Port: 3478}
+
+		assert.Nil(t, cfg.detectNAT64(server, mappedIPv4, true))
+		assert.Nil(t, cfg.detectNAT64(server, mappedIPv4, true))
+		assert.Equal(t, []string{"ipv4only.arpa"}, r.queries)
+	})
+
+	t.Run("native IPv6 server", func(t *testing.T) {
+		server := &net.UDPAddr{IP: net.ParseIP("2001:db8::10"), Port: 3478}
+		assert.Nil(t, newConfig([]Option{WithResolver(&fakeResolver{})}).detectNAT64(server, nil, true))
+	})
+
+	t.Run("IPv4 server", func(t *testing.T) {
+		server := &net.UDPAddr{IP: net.ParseIP("198.51.100.10"), Port: 3478}
+		info := newConfig(nil).detectNAT64(server, mappedIPv4, true)
+		assert.Nil(t, info)
+
+		// NAT64 が介在しなければアドレスは変換しない
+		other := &net.UDPAddr{IP: net.ParseIP("198.51.100.11"), Port: 3479}
+		assert.Same(t, other, info.synthesize(other))
+	})
+}
@@ -0,0 +1,461 @@
+// Package natemu は実際の UDP ソケットで動くユーザー空間の NAT エミュレーターです。
+//
+// カーネルのルーティングを変えずに NAT を挟むため、エミュレーターは外側の相手
+// (リモート) ごとに内側のアドレス (プロキシ) を公開します。クライアントがプロキシに
+// 送ったパケットは、RFC 4787 の動作プロファイルに従って割り当てた外部アドレスの
+// ソケットからリモートに転送され、リモートからの応答はフィルタリングを通ったものだけが
+// プロキシからクライアントに返されます。リモートから見たクライアントのアドレスは
+// 外部アドレスになるため、ライブラリを変更せずに NAT の判定を端から端まで試験できます。
+//
+// クライアントから見えるアドレスをそろえるため、STUN の応答に含まれる OTHER-ADDRESS、
+// RESPONSE-ORIGIN、CHANGED-ADDRESS、SOURCE-ADDRESS は、公開しているリモートであれば
+// 対応するプロキシのアドレスに書き換えます。XOR-MAPPED-ADDRESS と MAPPED-ADDRESS は
+// 書き換えません。公開していないリモートからのパケットは捨てられ、ヘアピンは模擬しません。
+package natemu
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	natchecker "github.com/moepig/nat-checker"
+)
+
+// 外部ポートの既定の範囲
+const (
+	defaultMinPort = 20000
+	defaultMaxPort = 40000
+)
+
+// expiryInterval は失効したマッピングのソケットを閉じる間隔
+const expiryInterval = 50 * time.Millisecond
+
+// messageIntegritySHA256 は MESSAGE-INTEGRITY-SHA256 属性 (RFC 8489 Section 14.6)
+const messageIntegritySHA256 natchecker.STUNAttributeType = 0x001C
+
+// Profile は NAT の動作 (RFC 4787) のプロファイル。ゼロ値は Full Cone NAT
+// (Endpoint-Independent Mapping / Filtering、ポート保存、タイムアウトなし)
+type Profile struct {
+	// Mapping は外部アドレスの割り当て方 (RFC 4787 Section 4.1)
+	Mapping natchecker.NATMappingType
+	// Filtering は外部からのパケットを通す条件 (RFC 4787 Section 5)
+	Filtering natchecker.NATFilteringType
+	// MappingTimeout は通信の無いマッピングを削除するまでの時間。0 なら削除しない
+	MappingTimeout time.Duration
+	// InboundRefresh が true なら、外部からのパケットでもマッピングのタイマーを更新する。
+	// 内側からのパケットでは常に更新する (RFC 4787 REQ-6)
+	InboundRefresh bool
+	// PortAllocation は外部ポートの割り当て方式 (RFC 4787 Section 4.2)。
+	// PortPreservation は内部ポートを確保できなければ PortSequential と同じく次の空きポートを使う。
+	// クライアントが同じホストの全インターフェース (0.0.0.0) にバインドしていると外部 IP でも
+	// 同じポートは使えないため、ポートを保存するにはクライアントを特定の IP にバインドする
+	PortAllocation natchecker.PortAllocationBehavior
+	// MinPort, MaxPort は外部ポートの範囲。0 なら 20000-40000
+	MinPort, MaxPort int
+	// Seed は PortRandom の乱数の種
+	Seed uint64
+}
+
+// Profiles は代表的な NAT のプロファイル。cmd/natemu の -profile で名前を指定できる
+var Profiles = map[string]Profile{
+	"full-cone": {
+		Mapping:   natchecker.EndpointIndependent,
+		Filtering: natchecker.EndpointIndependentFiltering,
+	},
+	"restricted-cone": {
+		Mapping:   natchecker.EndpointIndependent,
+		Filtering: natchecker.AddressDependentFiltering,
+	},
+	"port-restricted-cone": {
+		Mapping:   natchecker.EndpointIndependent,
+		Filtering: natchecker.AddressPortDependentFiltering,
+	},
+	"symmetric": {
+		Mapping:        natchecker.AddressPortDependent,
+		Filtering:      natchecker.AddressPortDependentFiltering,
+		PortAllocation: natchecker.PortRandom,
+	},
+}
+
+// Emulator は NAT エミュレーター
+type Emulator struct {
+	profile  Profile
+	publicIP net.IP
+
+	mu sync.Mutex
+	// proxies はリモートのアドレスごとの、内側に公開したプロキシ
+	proxies map[string]*proxy
+	// mappings は内部アドレスと (マッピング方式に応じた) リモートの組ごとのマッピング
+	mappings map[string]*mapping
+	nextPort int
+	rng      *rand.Rand
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// proxy は 1 つのリモートを内側に見せるソケット
+type proxy struct {
+	remote *net.UDPAddr
+	conn   *net.UDPConn
+}
+
+// mapping は外部アドレスのソケットを持つ 1 つのマッピング
+type mapping struct {
+	key      string
+	internal *net.UDPAddr
+	conn     *net.UDPConn
+	expires  time.Time
+	// contacted はこのマッピングから送信したリモートの IP と IP:ポート。フィルタリングに使う
+	contacted map[string]bool
+}
+
+// New は外部 IP アドレス publicIP で profile のように振る舞うエミュレーターを作ります。
+// リモートを Expose するまではパケットを中継しない
+func New(publicIP string, profile Profile) (*Emulator, error) {
+	ip := net.ParseIP(publicIP)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid public IP %q", publicIP)
+	}
+	if profile.MinPort == 0 {
+		profile.MinPort = defaultMinPort
+	}
+	if profile.MaxPort == 0 {
+		profile.MaxPort = defaultMaxPort
+	}
+	if profile.MinPort < 1 || profile.MaxPort > 65535 || profile.MinPort > profile.MaxPort {
+		return nil, fmt.Errorf("invalid port range %d-%d", profile.MinPort, profile.MaxPort)
+	}
+
+	e := &Emulator{
+		profile:  profile,
+		publicIP: ip,
+		proxies:  make(map[string]*proxy),
+		mappings: make(map[string]*mapping),
+		nextPort: profile.MinPort,
+		rng:      rand.New(rand.NewPCG(profile.Seed, profile.Seed)),
+		done:     make(chan struct{}),
+	}
+	e.wg.Add(1)
+	go e.expire()
+	return e, nil
+}
+
+// PublicIP はエミュレーターの外部 IP アドレスを返します
+func (e *Emulator) PublicIP() net.IP {
+	return e.publicIP
+}
+
+// Expose は remote を内側のアドレス inside に公開し、実際に待ち受けたアドレスを返します。
+// inside のポートが 0 なら空いているポートが選ばれる
+func (e *Emulator) Expose(remote, inside *net.UDPAddr) (*net.UDPAddr, error) {
+	conn, err := net.ListenUDP("udp", inside)
+	if err != nil {
+		return nil, fmt.Errorf("プロキシのソケット作成エラー: %w", err)
+	}
+	if err := e.expose(remote, conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn.LocalAddr().(*net.UDPAddr), nil
+}
+
+// expose は開いたソケット conn を remote のプロキシとして使い始めます
+func (e *Emulator) expose(remote *net.UDPAddr, conn *net.UDPConn) error {
+	remote = normalize(remote)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed() {
+		return fmt.Errorf("emulator is closed")
+	}
+	if _, exists := e.proxies[remote.String()]; exists {
+		return fmt.Errorf("remote %s is already exposed", remote)
+	}
+	p := &proxy{remote: remote, conn: conn}
+	e.proxies[remote.String()] = p
+	e.wg.Add(1)
+	go e.forward(p)
+	return nil
+}
+
+// Mappings は有効なマッピングの数を返します
+func (e *Emulator) Mappings() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	count := 0
+	for _, m := range e.mappings {
+		if !e.expired(m, now) {
+			count++
+		}
+	}
+	return count
+}
+
+// Close はすべてのソケットを閉じ、中継の終了を待ちます。2 回目以降の呼び出しは何もしない
+func (e *Emulator) Close() error {
+	e.closeOnce.Do(func() {
+		close(e.done)
+		var errs []error
+		e.mu.Lock()
+		for _, p := range e.proxies {
+			errs = append(errs, p.conn.Close())
+		}
+		for _, m := range e.mappings {
+			e.remove(m)
+		}
+		e.mu.Unlock()
+		e.wg.Wait()
+		e.closeErr = errors.Join(errs...)
+	})
+	return e.closeErr
+}
+
+// closed は Close が始まっているかを返します。Close は e.mu を取ってからマッピングを
+// 削除するため、e.mu を保持して呼べば以降に作るマッピングが削除漏れにならない
+func (e *Emulator) closed() bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// forward はプロキシに内側から届いたパケットを、マッピングのソケットからリモートに送ります
+func (e *Emulator) forward(p *proxy) {
+	defer e.wg.Done()
+	buffer := make([]byte, 65536)
+	for {
+		n, from, err := p.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		from = normalize(from)
+
+		e.mu.Lock()
+		// Close の後に読み込んだパケットでマッピングを作ると、Close が閉じない
+		// ソケットの受信を待ち続けてしまう
+		if e.closed() {
+			e.mu.Unlock()
+			return
+		}
+		now := time.Now()
+		key := e.mappingKey(from, p.remote)
+		m := e.mappings[key]
+		if m != nil && e.expired(m, now) {
+			e.remove(m)
+			m = nil
+		}
+		if m == nil {
+			conn, err := e.bind(from.Port)
+			if err != nil {
+				// 外部ポートを確保できなければ捨てる
+				e.mu.Unlock()
+				continue
+			}
+			m = &mapping{key: key, internal: from, conn: conn, contacted: make(map[string]bool)}
+			e.mappings[key] = m
+			e.wg.Add(1)
+			go e.receive(m)
+		}
+		e.refresh(m, now)
+		m.contacted[p.remote.IP.String()] = true
+		m.contacted[p.remote.String()] = true
+		conn := m.conn
+		e.mu.Unlock()
+
+		conn.WriteToUDP(buffer[:n], p.remote)
+	}
+}
+
+// receive はマッピングのソケットにリモートから届いたパケットをフィルタリングし、
+// リモートのプロキシから内側のクライアントに送ります
+func (e *Emulator) receive(m *mapping) {
+	defer e.wg.Done()
+	buffer := make([]byte, 65536)
+	for {
+		n, from, err := m.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		from = normalize(from)
+
+		e.mu.Lock()
+		now := time.Now()
+		if e.expired(m, now) {
+			e.remove(m)
+			e.mu.Unlock()
+			return
+		}
+		p := e.proxies[from.String()]
+		if p == nil || !e.permits(m, from) {
+			e.mu.Unlock()
+			continue
+		}
+		if e.profile.InboundRefresh {
+			e.refresh(m, now)
+		}
+		data := e.rewrite(buffer[:n])
+		e.mu.Unlock()
+
+		p.conn.WriteToUDP(data, m.internal)
+	}
+}
+
+// rewrite は STUN メッセージに含まれるリモートのアドレスを、対応するプロキシのアドレスに
+// 書き換えます。STUN 以外のパケットや書き換えの不要なメッセージはそのまま返す。e.mu を保持して呼ぶ
+func (e *Emulator) rewrite(data []byte) []byte {
+	msg, err := natchecker.DecodeMessage(data)
+	if err != nil {
+		return data
+	}
+	changed := false
+	for i, attr := range msg.Attributes {
+		switch attr.Type {
+		case natchecker.OtherAddress, natchecker.ResponseOrigin, natchecker.ChangedAddress, natchecker.SourceAddress:
+		default:
+			continue
+		}
+		addr, err := natchecker.ParseAddressAttribute(attr, msg.TransactionID)
+		if err != nil {
+			continue
+		}
+		if p := e.proxies[normalize(addr).String()]; p != nil {
+			msg.Attributes[i] = natchecker.NewAddressAttribute(attr.Type, p.conn.LocalAddr().(*net.UDPAddr), msg.TransactionID)
+			changed = true
+		}
+	}
+	if !changed {
+		return data
+	}
+
+	// 書き換えたメッセージでは MESSAGE-INTEGRITY と FINGERPRINT が一致しなくなり、
+	// 署名する実際のサーバーの応答が検証に失敗する。鍵を持たないため再計算はできないので、
+	// それらと、MESSAGE-INTEGRITY の後ろにある (保護されない) 属性を取り除く
+	for i, attr := range msg.Attributes {
+		if attr.Type == natchecker.MessageIntegrity || attr.Type == messageIntegritySHA256 || attr.Type == natchecker.Fingerprint {
+			msg.Attributes = msg.Attributes[:i]
+			break
+		}
+	}
+	return natchecker.EncodeMessage(*msg)
+}
+
+// expire は失効したマッピングのソケットを定期的に閉じます
+func (e *Emulator) expire() {
+	defer e.wg.Done()
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.done:
+			return
+		case now := <-ticker.C:
+			e.mu.Lock()
+			for _, m := range e.mappings {
+				if e.expired(m, now) {
+					e.remove(m)
+				}
+			}
+			e.mu.Unlock()
+		}
+	}
+}
+
+// mappingKey はマッピング方式に応じて、同じ外部アドレスを使う通信をまとめるキーを返します
+// RFC 4787 Section 4.1: EIM はリモートによらず、ADM はリモートの IP ごと、APDM は IP とポートごと
+func (e *Emulator) mappingKey(internal, remote *net.UDPAddr) string {
+	switch e.profile.Mapping {
+	case natchecker.AddressDependent:
+		return internal.String() + "|" + remote.IP.String()
+	case natchecker.AddressPortDependent:
+		return internal.String() + "|" + remote.String()
+	default:
+		return internal.String()
+	}
+}
+
+// permits はマッピング m に from からのパケットを通すかを返します
+// RFC 4787 Section 5: EIF はすべて、ADF は送信したことのある IP から、
+// APDF は送信したことのある IP とポートからのパケットだけを通す
+func (e *Emulator) permits(m *mapping, from *net.UDPAddr) bool {
+	switch e.profile.Filtering {
+	case natchecker.AddressDependentFiltering:
+		return m.contacted[from.IP.String()]
+	case natchecker.AddressPortDependentFiltering:
+		return m.contacted[from.String()]
+	default:
+		return true
+	}
+}
+
+// bind はプロファイルのポート割り当て方式で外部アドレスのソケットを開きます。e.mu を保持して呼ぶ
+func (e *Emulator) bind(internalPort int) (*net.UDPConn, error) {
+	size := e.profile.MaxPort - e.profile.MinPort + 1
+	listen := func(port int) (*net.UDPConn, error) {
+		return net.ListenUDP("udp", &net.UDPAddr{IP: e.publicIP, Port: port})
+	}
+
+	switch e.profile.PortAllocation {
+	case natchecker.PortRandom:
+		for attempt := 0; attempt < size; attempt++ {
+			if conn, err := listen(e.profile.MinPort + e.rng.IntN(size)); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, fmt.Errorf("no free external port")
+	case natchecker.PortPreservation:
+		if internalPort >= e.profile.MinPort && internalPort <= e.profile.MaxPort {
+			if conn, err := listen(internalPort); err == nil {
+				return conn, nil
+			}
+			e.nextPort = max(e.nextPort, internalPort)
+		}
+	}
+
+	for attempt := 0; attempt < size; attempt++ {
+		port := e.nextPort
+		e.nextPort++
+		if e.nextPort > e.profile.MaxPort {
+			e.nextPort = e.profile.MinPort
+		}
+		if conn, err := listen(port); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, fmt.Errorf("no free external port")
+}
+
+// refresh はマッピングのタイマーを更新します
+func (e *Emulator) refresh(m *mapping, now time.Time) {
+	if e.profile.MappingTimeout > 0 {
+		m.expires = now.Add(e.profile.MappingTimeout)
+	}
+}
+
+// expired はマッピングが失効しているかを返します
+func (e *Emulator) expired(m *mapping, now time.Time) bool {
+	return e.profile.MappingTimeout > 0 && now.After(m.expires)
+}
+
+// remove はマッピングを削除し、外部アドレスのソケットを閉じます。e.mu を保持して呼ぶ
+func (e *Emulator) remove(m *mapping) {
+	if e.mappings[m.key] == m {
+		delete(e.mappings, m.key)
+	}
+	m.conn.Close()
+}
+
+// normalize は IPv4 アドレスを 4 バイト形式にそろえたアドレスを返します
+func normalize(addr *net.UDPAddr) *net.UDPAddr {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		return &net.UDPAddr{IP: ip4, Port: addr.Port}
+	}
+	return addr
+}
@@ -0,0 +1,249 @@
+package natemu
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	natchecker "github.com/moepig/nat-checker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testOptions = []natchecker.Option{
+	natchecker.WithAddressFamily(natchecker.IPv4Only),
+	natchecker.WithRetransmission(50*time.Millisecond, 2),
+}
+
+func startLab(t *testing.T, profile Profile) *Lab {
+	t.Helper()
+	lab, err := StartLab(profile)
+	require.NoError(t, err)
+	t.Cleanup(func() { lab.Close() })
+	return lab
+}
+
+func TestProfiles(t *testing.T) {
+	for name, profile := range Profiles {
+		t.Run(name, func(t *testing.T) {
+			lab := startLab(t, profile)
+
+			result, err := natchecker.FullNATDetection(lab.ServerAddr().String(), testOptions...)
+			require.NoError(t, err)
+			assert.False(t, result.MappingResult.NoNAT)
+			assert.True(t, result.MappingResult.Response.Mapping1.IP.Equal(lab.Emulator.PublicIP()))
+			assert.Equal(t, profile.Mapping, result.DetailedType.Mapping)
+			assert.Equal(t, profile.Filtering, result.DetailedType.Filtering)
+			// OTHER-ADDRESS はクライアントから見える内側のアドレスに書き換えられている
+			assert.True(t, result.MappingResult.Response.OtherAddress.IP.Equal(net.ParseIP(labInsideIP2)))
+		})
+	}
+}
+
+func TestAddressDependentMapping(t *testing.T) {
+	lab := startLab(t, Profile{
+		Mapping:   natchecker.AddressDependent,
+		Filtering: natchecker.AddressDependentFiltering,
+	})
+
+	result, err := natchecker.FullNATDetection(lab.ServerAddr().String(), testOptions...)
+	require.NoError(t, err)
+	assert.Equal(t, natchecker.AddressDependent, result.DetailedType.Mapping)
+	assert.Equal(t, natchecker.AddressDependentFiltering, result.DetailedType.Filtering)
+}
+
+func TestPortAllocation(t *testing.T) {
+	for _, allocation := range []natchecker.PortAllocationBehavior{
+		natchecker.PortPreservation,
+		natchecker.PortSequential,
+		natchecker.PortRandom,
+	} {
+		t.Run(allocation.String(), func(t *testing.T) {
+			profile := Profile{
+				Mapping:        natchecker.AddressPortDependent,
+				PortAllocation: allocation,
+				Seed:           1,
+			}
+			opts := testOptions
+			if allocation == natchecker.PortPreservation {
+				// クライアントのエフェメラルポートを含む範囲にし、クライアントのソケットを
+				// 127.0.0.1 にバインドして外部 IP で同じポートを使えるようにする
+				profile.MinPort, profile.MaxPort = 1024, 65535
+				opts = append(opts[:len(opts):len(opts)], natchecker.WithListenPacket(
+					func(network string, laddr *net.UDPAddr) (net.PacketConn, error) {
+						return net.ListenUDP(network, &net.UDPAddr{IP: net.ParseIP(labInsideIP1), Port: laddr.Port})
+					}))
+			}
+			lab := startLab(t, profile)
+
+			result, err := natchecker.CheckPortAllocation(lab.ServerAddr().String(), opts...)
+			require.NoError(t, err)
+			assert.Equal(t, allocation, result.Behavior)
+		})
+	}
+}
+
+func TestMappingExpiry(t *testing.T) {
+	lab := startLab(t, Profile{
+		MappingTimeout: 200 * time.Millisecond,
+		PortAllocation: natchecker.PortSequential,
+	})
+
+	client, err := natchecker.NewSTUNClient(testOptions...)
+	require.NoError(t, err)
+	defer client.Close()
+
+	first, err := client.SendBindingRequestTo(lab.ServerAddr(), false, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, lab.Emulator.Mappings())
+
+	// タイムアウト内の通信ではマッピングが維持される
+	time.Sleep(100 * time.Millisecond)
+	kept, err := client.SendBindingRequestTo(lab.ServerAddr(), false, false)
+	require.NoError(t, err)
+	assert.Equal(t, first.MappedAddress.Port, kept.MappedAddress.Port)
+
+	// 通信が途絶えるとマッピングは失効し、次の通信では新しい外部ポートが割り当てられる
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, 0, lab.Emulator.Mappings())
+	renewed, err := client.SendBindingRequestTo(lab.ServerAddr(), false, false)
+	require.NoError(t, err)
+	assert.NotEqual(t, first.MappedAddress.Port, renewed.MappedAddress.Port)
+}
+
+func TestRefreshDirection(t *testing.T) {
+	tests := []struct {
+		name           string
+		inboundRefresh bool
+		expected       natchecker.RefreshBehavior
+	}{
+		{"outbound only", false, natchecker.RefreshFalse},
+		{"inbound refresh", true, natchecker.RefreshTrue},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lab := startLab(t, Profile{
+				MappingTimeout: 300 * time.Millisecond,
+				InboundRefresh: tt.inboundRefresh,
+				PortAllocation: natchecker.PortSequential,
+			})
+
+			result, err := natchecker.CheckRefreshDirection(lab.ServerAddr().String(),
+				time.Second, 100*time.Millisecond, testOptions...)
+			require.NoError(t, err)
+			assert.True(t, result.ControlExpired)
+			assert.Equal(t, natchecker.RefreshTrue, result.OutboundRefresh)
+			assert.Equal(t, tt.expected, result.InboundRefresh)
+			assert.Equal(t, natchecker.InboundStimulusChangeRequest, result.InboundStimulus)
+		})
+	}
+}
+
+func TestUnexposedRemoteIsDropped(t *testing.T) {
+	lab := startLab(t, Profile{})
+
+	// クライアント側のソケットで直接受信し、届いたパケットをすべて観測する
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer client.Close()
+	request := natchecker.STUNMessage{MessageType: natchecker.BindingRequest, TransactionID: [12]byte{1, 2, 3}}
+	_, err = client.WriteToUDP(natchecker.EncodeMessage(request), lab.ServerAddr())
+	require.NoError(t, err)
+
+	buffer := make([]byte, 1500)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := client.ReadFromUDP(buffer)
+	require.NoError(t, err)
+	response, err := natchecker.DecodeMessage(buffer[:n])
+	require.NoError(t, err)
+	attr, ok := response.Attribute(natchecker.XorMappedAddress)
+	require.True(t, ok)
+	mapped, err := natchecker.ParseAddressAttribute(attr, response.TransactionID)
+	require.NoError(t, err)
+
+	// Full Cone でも、公開していないリモートからのパケットは内側に届かない
+	stranger, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer stranger.Close()
+	_, err = stranger.WriteToUDP([]byte("hello"), mapped)
+	require.NoError(t, err)
+
+	client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, _, err = client.ReadFromUDP(buffer)
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr, "the stray packet must not be forwarded")
+	assert.True(t, netErr.Timeout())
+}
+
+func TestForwardAfterClose(t *testing.T) {
+	e, err := New("127.0.0.1", Profile{})
+	require.NoError(t, err)
+
+	// Close の前に読み込まれていたパケットを、Close の後に forward が処理する
+	proxyConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer proxyConn.Close()
+	inside, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer inside.Close()
+	_, err = inside.WriteToUDP([]byte("hello"), proxyConn.LocalAddr().(*net.UDPAddr))
+	require.NoError(t, err)
+
+	require.NoError(t, e.Close())
+	e.wg.Add(1)
+	go e.forward(&proxy{remote: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9}, conn: proxyConn})
+
+	// 新しいマッピングを作らずに終了するので、待ち合わせはすぐに終わる
+	waited := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("forward created a mapping after Close")
+	}
+	assert.Empty(t, e.mappings)
+
+	_, err = e.Expose(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9}, &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	assert.Error(t, err, "a closed emulator cannot expose remotes")
+}
+
+func TestNewValidation(t *testing.T) {
+	_, err := New("not-an-ip", Profile{})
+	assert.Error(t, err)
+	_, err = New("127.0.0.5", Profile{MinPort: 5000, MaxPort: 4000})
+	assert.Error(t, err)
+}
+
+func TestRewriteDropsIntegrity(t *testing.T) {
+	lab := startLab(t, Profile{})
+
+	txID := [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	other := lab.Responder.OtherAddr()
+	signed := natchecker.EncodeWithIntegrity(natchecker.STUNMessage{
+		MessageType:   natchecker.BindingResponse,
+		TransactionID: txID,
+		Attributes:    []natchecker.STUNAttribute{natchecker.NewAddressAttribute(natchecker.OtherAddress, other, txID)},
+	}, []byte("key"))
+
+	msg, err := natchecker.DecodeMessage(lab.Emulator.rewrite(signed))
+	require.NoError(t, err)
+	attr, ok := msg.Attribute(natchecker.OtherAddress)
+	require.True(t, ok)
+	rewritten, err := natchecker.ParseAddressAttribute(attr, txID)
+	require.NoError(t, err)
+	assert.True(t, rewritten.IP.Equal(net.ParseIP(labInsideIP2)))
+
+	// 書き換えると一致しなくなる MESSAGE-INTEGRITY は取り除かれる
+	_, ok = msg.Attribute(natchecker.MessageIntegrity)
+	assert.False(t, ok)
+}
+
+func TestCloseTwice(t *testing.T) {
+	emulator, err := New(labPublicIP, Profile{})
+	require.NoError(t, err)
+	require.NoError(t, emulator.Close())
+	assert.NotPanics(t, func() { emulator.Close() })
+}
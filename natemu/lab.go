@@ -0,0 +1,121 @@
+package natemu
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/moepig/nat-checker/stunserver"
+)
+
+// Lab で使うループバックアドレス。Linux では 127.0.0.0/8 全体がループバックになる
+const (
+	// labInsideIP1, labInsideIP2 は内側のクライアントから見た STUN サーバーの 2 つの IP
+	labInsideIP1 = "127.0.0.1"
+	labInsideIP2 = "127.0.0.2"
+	// labResponderIP1, labResponderIP2 は STUN 応答サーバーが実際に待ち受ける 2 つの IP
+	labResponderIP1 = "127.0.0.3"
+	labResponderIP2 = "127.0.0.4"
+	// labPublicIP はエミュレーターの外部 IP
+	labPublicIP = "127.0.0.5"
+)
+
+// listenAttempts は内側の 2 つの IP で同じポートの組を確保できるまで試す回数
+const listenAttempts = 16
+
+// Lab は RFC 5780 対応の STUN 応答サーバーと、その手前に置いた NAT エミュレーターの組です。
+//
+// 応答サーバーの 2 つの IP と 2 つのポートの 4 つのアドレスを、それぞれ内側の
+// 2 つの IP と 2 つのポートに公開するため、クライアントは ServerAddr を STUN サーバーとして
+// 使うだけで、プロファイルどおりの NAT の内側にいるように判定されます。
+type Lab struct {
+	Emulator  *Emulator
+	Responder *stunserver.Server
+	server    *net.UDPAddr
+}
+
+// StartLab は profile の NAT エミュレーターと、その外側の STUN 応答サーバーを起動します。
+// 127.0.0.1 から 127.0.0.5 までのループバックアドレスを使う
+func StartLab(profile Profile) (*Lab, error) {
+	responder, err := stunserver.Listen(stunserver.Config{PrimaryIP: labResponderIP1, AlternateIP: labResponderIP2})
+	if err != nil {
+		return nil, fmt.Errorf("STUN 応答サーバーの起動エラー: %w", err)
+	}
+	emulator, err := New(labPublicIP, profile)
+	if err != nil {
+		responder.Close()
+		return nil, err
+	}
+
+	grid, err := listenGrid([2]net.IP{net.ParseIP(labInsideIP1), net.ParseIP(labInsideIP2)})
+	if err != nil {
+		emulator.Close()
+		responder.Close()
+		return nil, fmt.Errorf("プロキシのソケット作成エラー: %w", err)
+	}
+
+	// 応答サーバーの (i 番目の IP, j 番目のポート) を内側の (i 番目の IP, j 番目のポート) に公開する
+	primary, other := responder.PrimaryAddr(), responder.OtherAddr()
+	ips := [2]net.IP{primary.IP, other.IP}
+	ports := [2]int{primary.Port, other.Port}
+	for i := range grid {
+		for j := range grid[i] {
+			if err := emulator.expose(&net.UDPAddr{IP: ips[i], Port: ports[j]}, grid[i][j]); err != nil {
+				closeGrid(grid)
+				emulator.Close()
+				responder.Close()
+				return nil, err
+			}
+		}
+	}
+
+	return &Lab{
+		Emulator:  emulator,
+		Responder: responder,
+		server:    grid[0][0].LocalAddr().(*net.UDPAddr),
+	}, nil
+}
+
+// ServerAddr はクライアントが STUN サーバーとして使う内側のアドレスを返します
+func (l *Lab) ServerAddr() *net.UDPAddr {
+	return l.server
+}
+
+// Close はエミュレーターと応答サーバーを停止します
+func (l *Lab) Close() error {
+	return errors.Join(l.Emulator.Close(), l.Responder.Close())
+}
+
+// listenGrid は 2 つの IP のそれぞれで、同じ 2 つのポートのソケットを開きます。
+// grid[i][j] は i 番目の IP、j 番目のポートのソケット
+func listenGrid(ips [2]net.IP) ([2][2]*net.UDPConn, error) {
+	var err error
+	for attempt := 0; attempt < listenAttempts; attempt++ {
+		var grid [2][2]*net.UDPConn
+		ports := [2]int{}
+		err = nil
+		for i := 0; i < 2 && err == nil; i++ {
+			for j := 0; j < 2 && err == nil; j++ {
+				grid[i][j], err = net.ListenUDP("udp", &net.UDPAddr{IP: ips[i], Port: ports[j]})
+				if err == nil {
+					ports[j] = grid[i][j].LocalAddr().(*net.UDPAddr).Port
+				}
+			}
+		}
+		if err == nil {
+			return grid, nil
+		}
+		closeGrid(grid)
+	}
+	return [2][2]*net.UDPConn{}, err
+}
+
+func closeGrid(grid [2][2]*net.UDPConn) {
+	for i := range grid {
+		for j := range grid[i] {
+			if grid[i][j] != nil {
+				grid[i][j].Close()
+			}
+		}
+	}
+}
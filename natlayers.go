@@ -0,0 +1,132 @@
+package natchecker
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// SharedAddressSpace は CGN で使われる共有アドレス空間 100.64.0.0/10 (RFC 6598)
+var SharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0).To4(), Mask: net.CIDRMask(10, 32)}
+
+// HopProber は宛先までの経路上にある中間ホップのアドレスを調べます。
+//
+// 既定では UDPHopProber (TTL を増やしながら UDP を送る traceroute 相当の処理) を
+// 使います。特権の要る ICMP ソケットを使う実装などは WithHopProber で指定できます。
+type HopProber interface {
+	// ProbeHops は dst までの経路上のルーターのアドレスを近い順に最大 maxHops 個返す。
+	// 応答の無かったホップは nil とする
+	ProbeHops(ctx context.Context, dst net.IP, maxHops int) ([]net.IP, error)
+}
+
+// defaultHopProbeLimit は中間ホップを調べる最大のホップ数。
+// CGN は通常アクセス網の数ホップ以内にあるため、経路全体は調べない
+const defaultHopProbeLimit = 8
+
+// defaultHopProbeTimeout は中間ホップの探索全体のタイムアウト
+const defaultHopProbeTimeout = 10 * time.Second
+
+// WithHopProber は FullNATDetection で NAT の段数を推定する際に、
+// サーバーまでの中間ホップを調べる HopProber を指定します。
+//
+// 指定しない場合は UDPHopProber を使います。ただし WithTransport (WithListenPacket) で
+// OS 以外のネットワークを指定した場合は、OS の経路を調べても意味が無いため探索せず、
+// 推定はローカルアドレスと外部マッピングのみから行われます。
+func WithHopProber(p HopProber) Option {
+	return func(c *config) {
+		c.hopProber = p
+	}
+}
+
+// NATLayerEstimate はクライアントとインターネットの間にある NAT の段数の推定
+type NATLayerEstimate struct {
+	// Layers は推定した NAT の段数。0 は NAT なし
+	Layers int `json:"layers"`
+	// CGNAT は共有アドレス空間 (100.64.0.0/10) が経路上に見つかった場合に true
+	CGNAT bool `json:"cgnat"`
+	// LocalPrivate はローカルアドレスがプライベートアドレス (RFC 1918 / RFC 4193) の場合に true
+	LocalPrivate bool `json:"local_private"`
+	// MappedPrivate は外部マッピングがプライベートアドレスまたは共有アドレスの場合に true。
+	// サーバーも NAT の内側にあり、その先にさらに NAT があることを示す
+	MappedPrivate bool `json:"mapped_private"`
+	// SharedAddressHops は中間ホップのうち共有アドレス空間に属するもの。
+	// 中間ホップを探索できなかった場合 (Linux 以外の OS で WithHopProber を
+	// 指定しない場合など) は空になり、理由が HopProbeError に入る
+	SharedAddressHops []net.IP `json:"shared_address_hops,omitempty"`
+	// HopProbeError は中間ホップの探索に失敗した場合の理由
+	HopProbeError string `json:"hop_probe_error,omitempty"`
+}
+
+// String は推定結果の文字列表現を返す
+func (e NATLayerEstimate) String() string {
+	if e.CGNAT {
+		return fmt.Sprintf("%d NAT layer(s), CGNAT", e.Layers)
+	}
+	return fmt.Sprintf("%d NAT layer(s)", e.Layers)
+}
+
+// isSharedAddress は ip が共有アドレス空間 100.64.0.0/10 に属するかどうかを返します
+func isSharedAddress(ip net.IP) bool {
+	return ip != nil && SharedAddressSpace.Contains(ip)
+}
+
+// estimateNATLayers は NAT の有無、ローカルアドレス、外部マッピング、中間ホップから
+// NAT の段数を推定します
+//
+//   - 外部マッピングがローカルアドレスと異なれば、少なくとも 1 段の NAT がある
+//   - 外部マッピングがプライベート/共有アドレスなら、サーバー自体が NAT の内側にあり、
+//     インターネットとの間にさらに 1 段の NAT がある。ただし NAT が無い場合は
+//     LAN 内のサーバーがローカルアドレスをそのまま返しているだけなので数えない
+//   - そうでなく、プライベートなローカルアドレスから共有アドレスのホップを経由して
+//     サーバーに届いていれば、宅内 NAT と CGN の 2 段構成である (RFC 6598 Section 1)
+func estimateNATLayers(noNAT bool, local, mapped *net.UDPAddr, hops []net.IP) NATLayerEstimate {
+	var estimate NATLayerEstimate
+	if local != nil {
+		estimate.LocalPrivate = local.IP.IsPrivate()
+		estimate.CGNAT = isSharedAddress(local.IP)
+	}
+	if mapped != nil {
+		estimate.MappedPrivate = mapped.IP.IsPrivate() || isSharedAddress(mapped.IP)
+		estimate.CGNAT = estimate.CGNAT || isSharedAddress(mapped.IP)
+	}
+	for _, hop := range hops {
+		if isSharedAddress(hop) {
+			estimate.SharedAddressHops = append(estimate.SharedAddressHops, hop)
+			estimate.CGNAT = true
+		}
+	}
+
+	if !noNAT {
+		estimate.Layers++
+	}
+	switch {
+	case !noNAT && estimate.MappedPrivate:
+		estimate.Layers++
+	case !noNAT && estimate.LocalPrivate && len(estimate.SharedAddressHops) > 0:
+		estimate.Layers++
+	}
+	return estimate
+}
+
+// probeNATLayers は server までの中間ホップを調べ、マッピング判定の結果と合わせて
+// NAT の段数を推定します
+func (c config) probeNATLayers(server *net.UDPAddr, mapping *CheckMappingResult) NATLayerEstimate {
+	var hops []net.IP
+	var probeErr error
+	prober := c.hopProber
+	if prober == nil && c.transport == nil {
+		prober = UDPHopProber{}
+	}
+	if prober != nil && server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultHopProbeTimeout)
+		defer cancel()
+		hops, probeErr = prober.ProbeHops(ctx, server.IP, defaultHopProbeLimit)
+	}
+
+	estimate := estimateNATLayers(mapping.NoNAT, mapping.Response.LocalAddress, mapping.Response.Mapping1, hops)
+	if probeErr != nil {
+		estimate.HopProbeError = probeErr.Error()
+	}
+	return estimate
+}
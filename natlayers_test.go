@@ -0,0 +1,139 @@
+package natchecker
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEstimateNATLayers(t *testing.T) {
+	udp := func(ip string) *net.UDPAddr {
+		return &net.UDPAddr{IP: net.ParseIP(ip), Port: 50000}
+	}
+	ips := func(addrs ...string) []net.IP {
+		var result []net.IP
+		for _, addr := range addrs {
+			result = append(result, net.ParseIP(addr))
+		}
+		return result
+	}
+
+	tests := []struct {
+		name          string
+		noNAT         bool
+		local         *net.UDPAddr
+		mapped        *net.UDPAddr
+		hops          []net.IP
+		layers        int
+		cgnat         bool
+		mappedPrivate bool
+	}{
+		{
+			name:   "public address without NAT",
+			noNAT:  true,
+			local:  udp("203.0.113.10"),
+			mapped: udp("203.0.113.10"),
+			layers: 0,
+		},
+		{
+			name:          "private address without NAT on a LAN server",
+			noNAT:         true,
+			local:         udp("192.168.1.10"),
+			mapped:        udp("192.168.1.10"),
+			layers:        0,
+			mappedPrivate: true,
+		},
+		{
+			name:   "single home NAT",
+			local:  udp("192.168.1.10"),
+			mapped: udp("203.0.113.10"),
+			hops:   ips("192.168.1.1", "198.51.100.1"),
+			layers: 1,
+		},
+		{
+			name:   "device directly behind CGN",
+			local:  udp("100.64.12.34"),
+			mapped: udp("203.0.113.10"),
+			layers: 1,
+			cgnat:  true,
+		},
+		{
+			name:   "home NAT behind CGN detected via shared address hop",
+			local:  udp("192.168.1.10"),
+			mapped: udp("203.0.113.10"),
+			hops:   []net.IP{net.ParseIP("192.168.1.1"), nil, net.ParseIP("100.64.0.1"), net.ParseIP("198.51.100.1")},
+			layers: 2,
+			cgnat:  true,
+		},
+		{
+			name:          "server inside CGN sees shared address",
+			local:         udp("192.168.1.10"),
+			mapped:        udp("100.72.1.2"),
+			layers:        2,
+			cgnat:         true,
+			mappedPrivate: true,
+		},
+		{
+			name:          "double NAT with private mapped address",
+			local:         udp("192.168.1.10"),
+			mapped:        udp("10.0.0.5"),
+			layers:        2,
+			mappedPrivate: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			estimate := estimateNATLayers(test.noNAT, test.local, test.mapped, test.hops)
+			assert.Equal(t, test.layers, estimate.Layers, "Layers")
+			assert.Equal(t, test.cgnat, estimate.CGNAT, "CGNAT")
+			assert.Equal(t, test.mappedPrivate, estimate.MappedPrivate, "MappedPrivate")
+		})
+	}
+}
+
+// fakeHopProber はテスト用の HopProber
+type fakeHopProber struct {
+	hops    []net.IP
+	err     error
+	dst     net.IP
+	maxHops int
+}
+
+func (p *fakeHopProber) ProbeHops(ctx context.Context, dst net.IP, maxHops int) ([]net.IP, error) {
+	p.dst = dst
+	p.maxHops = maxHops
+	return p.hops, p.err
+}
+
+func TestProbeNATLayers(t *testing.T) {
+	server := &net.UDPAddr{IP: net.ParseIP("198.51.100.20"), Port: 3478}
+	mapping := &CheckMappingResult{
+		Response: CheckMappingResponseData{
+			LocalAddress: &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 50000},
+			Mapping1:     &net.UDPAddr{IP: net.ParseIP("203.0.113.10"), Port: 61000},
+		},
+	}
+
+	prober := &fakeHopProber{hops: []net.IP{net.ParseIP("192.168.1.1"), net.ParseIP("100.64.0.1")}}
+	estimate := newConfig([]Option{WithHopProber(prober)}).probeNATLayers(server, mapping)
+	assert.Equal(t, server.IP, prober.dst)
+	assert.Equal(t, defaultHopProbeLimit, prober.maxHops)
+	assert.Equal(t, 2, estimate.Layers)
+	assert.Equal(t, "2 NAT layer(s), CGNAT", estimate.String())
+
+	// 探索に失敗してもアドレスだけで推定する
+	failing := &fakeHopProber{err: errors.New("permission denied")}
+	estimate = newConfig([]Option{WithHopProber(failing)}).probeNATLayers(server, mapping)
+	assert.Equal(t, 1, estimate.Layers)
+	assert.Equal(t, "permission denied", estimate.HopProbeError)
+
+	// OS 以外のネットワークでは既定の UDPHopProber で探索しない
+	memory := WithTransport(NewMemoryNetwork().Factory(net.ParseIP("192.168.1.10")))
+	estimate = newConfig([]Option{memory}).probeNATLayers(server, mapping)
+	assert.Equal(t, 1, estimate.Layers)
+	assert.Empty(t, estimate.HopProbeError)
+}
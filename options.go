@@ -0,0 +1,153 @@
+package natchecker
+
+import (
+	"net"
+	"time"
+)
+
+// Option は STUNClient および Check* 関数の動作を変更する関数オプションです。
+//
+// 省略した場合は従来どおりの動作になるため、既存の呼び出しはそのまま使えます。
+type Option func(*config)
+
+// config は Option によって設定される値の集合
+type config struct {
+	// strict が true の場合、受信した STUN メッセージを厳格に検証する
+	strict bool
+	// classic が true の場合、RFC 3489 形式のメッセージを送受信する
+	classic bool
+	// resolver は STUN サーバーの探索に使うリゾルバー。nil なら net.DefaultResolver
+	resolver Resolver
+	// family はサーバーアドレスの選択とソケットのアドレスファミリー
+	family AddressFamily
+	// initialRTO, transmitCount は再送パラメータ。0 なら既定値
+	initialRTO    time.Duration
+	transmitCount int
+	// hopProber は NAT の段数の推定に使う中間ホップの探索。nil なら UDPHopProber
+	hopProber HopProber
+	// sampleCount は複数ソケットでマッピングを採取するテストのソケット数。0 なら既定値
+	sampleCount int
+	// probeInterval は多数のマッピングを作るテストの送信間隔。0 なら既定値
+	probeInterval time.Duration
+	// transport はクライアントの Transport を作る関数。nil なら net.ListenUDP のソケットを使う。
+	// WithListenPacket もこの関数を設定する
+	transport TransportFactory
+	// nat64 は判定の中で共有する NAT64 プレフィックスの探索結果。nil なら共有しない
+	nat64 *nat64Discovery
+}
+
+// newConfig は opts を順に適用した設定を返します
+func newConfig(opts []Option) config {
+	var cfg config
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&cfg)
+		}
+	}
+	return cfg
+}
+
+// WithStrictValidation は受信した STUN メッセージを厳格に検証します。
+//
+// 既定の検証は RFC 8489 のヘッダーと属性長の整合性のみを確認し、
+// 実装差で生じがちな逸脱は読み飛ばします。このオプションを指定すると、
+// 以下のいずれかに該当するメッセージを不正として扱います:
+//   - Message Length が 4 の倍数でない (RFC 8489 Section 5)
+//   - 属性のパディングが 0 でない、またはメッセージ末尾を越える (Section 14)
+//   - アドレス系属性 (MAPPED-ADDRESS 等) が重複している
+//   - FINGERPRINT の後に属性がある (Section 14.7)
+//   - アドレス属性の予約バイトが 0 でない、または末尾に余分なバイトがある
+func WithStrictValidation() Option {
+	return func(c *config) {
+		c.strict = true
+	}
+}
+
+// WithClassicMode は RFC 3489 (classic STUN) サーバーとの互換モードを有効にします。
+//
+// Magic Cookie を持たない RFC 3489 サーバーの応答は既定では STUN メッセージとして
+// 扱われず破棄されます。このオプションを指定すると、リクエストを RFC 3489 形式の
+// 128 ビット Transaction ID で送信し、Magic Cookie の無い応答も受け入れます。
+// 応答に含まれる SOURCE-ADDRESS / CHANGED-ADDRESS も解析され、判定結果の
+// Legacy フィールドで RFC 3489 形式の応答に基づく結果であることが示されます。
+func WithClassicMode() Option {
+	return func(c *config) {
+		c.classic = true
+	}
+}
+
+// WithRetransmission は Binding リクエストの再送パラメータを指定します。
+//
+// initialRTO は最初の再送までの待ち時間で、再送ごとに倍になります。
+// transmitCount は最初の送信を含む送信回数です。0 以下を指定した値は既定値
+// (500ms, 4 回) のままになります。応答の無いサーバーからのフェイルオーバーや
+// フィルタリング判定のタイムアウトを短くしたい場合に使います。
+func WithRetransmission(initialRTO time.Duration, transmitCount int) Option {
+	return func(c *config) {
+		if initialRTO > 0 {
+			c.initialRTO = initialRTO
+		}
+		if transmitCount > 0 {
+			c.transmitCount = transmitCount
+		}
+	}
+}
+
+// retransmission は有効な再送パラメータを返します
+func (c config) retransmission() (time.Duration, int) {
+	rto, count := stunInitialRTO, stunTransmitCount
+	if c.initialRTO > 0 {
+		rto = c.initialRTO
+	}
+	if c.transmitCount > 0 {
+		count = c.transmitCount
+	}
+	return rto, count
+}
+
+// ListenPacketFunc は network ("udp", "udp4", "udp6") と laddr からソケットを作る関数です。
+// net.ListenUDP と同じ引数で、*net.UDPConn 以外の net.PacketConn も返せます。
+type ListenPacketFunc func(network string, laddr *net.UDPAddr) (net.PacketConn, error)
+
+// Listen は f で laddr に待ち受けるソケットを作ります。f が nil なら net.ListenUDP を使います。
+// stunserver・turnserver のように ListenPacketFunc を省略可能な設定として受け取る側で使う。
+// これらのサーバーは待ち受けアドレスを LocalAddr から得るため、f が返すソケットの
+// LocalAddr は *net.UDPAddr でなければならない
+func (f ListenPacketFunc) Listen(network string, laddr *net.UDPAddr) (net.PacketConn, error) {
+	if f != nil {
+		return f(network, laddr)
+	}
+	conn, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// WithListenPacket はクライアントのソケットを listen で作ります。
+//
+// 既定では net.ListenUDP で OS のソケットを開きます。インメモリの仮想ネットワーク
+// (vnet パッケージ) などを指定すると、実際のネットワークを使わずにすべての判定を
+// 実行できます。Check* 関数が内部で開く複数のソケットもすべて listen で作られます。
+//
+// listen で開いたソケットを UDPTransport で使う WithTransport の簡略形で、
+// WithTransport と両方を指定した場合は後に指定したものが使われます。
+func WithListenPacket(listen ListenPacketFunc) Option {
+	return WithTransport(func(network string) (Transport, error) {
+		addr, err := net.ResolveUDPAddr(network, ":0")
+		if err != nil {
+			return nil, err
+		}
+		conn, err := listen.Listen(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return NewUDPTransport(conn), nil
+	})
+}
+
+// withOption は opts の末尾に opt を追加した新しいスライスを返します。
+// 呼び出し元のスライスを書き換えないよう、常にコピーする
+func withOption(opts []Option, opt Option) []Option {
+	return append(opts[:len(opts):len(opts)], opt)
+}
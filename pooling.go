@@ -0,0 +1,149 @@
+package natchecker
+
+import (
+	"fmt"
+	"net"
+	"slices"
+)
+
+// IPPoolingBehavior は NAT が外部 IP アドレスのプールをどう使うか (RFC 4787 Section 4.1)
+type IPPoolingBehavior int
+
+const (
+	// PairedPooling: 同じ内部 IP からのマッピングには常に同じ外部 IP を使う
+	PairedPooling IPPoolingBehavior = iota
+	// ArbitraryPooling: 同じ内部 IP からのマッピングに異なる外部 IP を使うことがある
+	ArbitraryPooling
+	// PoolingUnknown: マッピングが足りず判定できない
+	PoolingUnknown
+)
+
+func (b IPPoolingBehavior) String() string {
+	switch b {
+	case PairedPooling:
+		return "Paired"
+	case ArbitraryPooling:
+		return "Arbitrary"
+	default:
+		return "Unknown"
+	}
+}
+
+// IPPoolingSample は 1 つのローカルソケットで得られたマッピング
+type IPPoolingSample struct {
+	LocalAddress *net.UDPAddr `json:"local_address"`
+	// PrimaryMapping は主アドレス宛のマッピング
+	PrimaryMapping *net.UDPAddr `json:"primary_mapping"`
+	// AlternateMapping は OTHER-ADDRESS 宛のマッピング。OTHER-ADDRESS が無ければ nil
+	AlternateMapping *net.UDPAddr `json:"alternate_mapping"`
+}
+
+// CheckIPPoolingResult は IP アドレスプーリングの判定結果
+type CheckIPPoolingResult struct {
+	Behavior IPPoolingBehavior `json:"behavior"`
+	// ExternalIPs は観測された外部 IP アドレス（重複なし、観測順）
+	ExternalIPs []net.IP `json:"external_ips"`
+	// UsedOtherAddress は OTHER-ADDRESS 宛のマッピングも採取した場合に true
+	UsedOtherAddress bool `json:"used_other_address"`
+	// Samples は採取したマッピング（作成順）
+	Samples []IPPoolingSample `json:"samples"`
+}
+
+// String は結果の文字列表現を返す
+func (r CheckIPPoolingResult) String() string {
+	return fmt.Sprintf("IP Pooling: %s (%d external IP(s))", r.Behavior, len(r.ExternalIPs))
+}
+
+// CheckIPPooling は NAT の IP アドレスプーリングの挙動を判定します
+// RFC 4787 Section 4.1: IP Address Pooling Behavior
+//
+// RFC 4787 REQ-2: "It is RECOMMENDED that a NAT have an "IP address pooling"
+// behavior of "Paired"."
+//
+// 複数のローカルソケット（既定 8 個、WithSampleCount で変更可能）を開き、
+// それぞれから主アドレスと OTHER-ADDRESS の両方にマッピングを作ります。
+// すべてのマッピングが同じ外部 IP を共有していれば Paired、
+// 複数の外部 IP にばらついていれば Arbitrary と判定し、観測した IP の集合を返します。
+//
+// OTHER-ADDRESS に対応していないサーバーでは主アドレス宛のマッピングのみで判定します。
+func CheckIPPooling(serverAddr string, opts ...Option) (*CheckIPPoolingResult, error) {
+	cfg := newConfig(opts)
+	servers, err := cfg.resolveServers(serverAddr)
+	if err != nil {
+		return nil, fmt.Errorf("サーバーアドレス解決エラー: %w", err)
+	}
+
+	clients := make([]*STUNClient, 0, cfg.samples())
+	defer func() {
+		for _, client := range clients {
+			client.Close()
+		}
+	}()
+
+	result := &CheckIPPoolingResult{}
+	var other *net.UDPAddr
+	for i := 0; i < cfg.samples(); i++ {
+		client, err := NewSTUNClient(opts...)
+		if err != nil {
+			return nil, fmt.Errorf("STUNクライアント作成エラー: %w", err)
+		}
+		clients = append(clients, client)
+
+		server, primary, err := client.bindFirstResponsive(servers)
+		if err != nil {
+			return nil, fmt.Errorf("ソケット %d の Binding 失敗: %w", i+1, err)
+		}
+		if i == 0 {
+			servers = []*net.UDPAddr{server}
+			// NAT64 経由の場合、IPv4 の OTHER-ADDRESS は IPv6 に変換して送る
+			other = client.detectNAT64(server, primary.MappedAddress).synthesize(primary.OtherAddress)
+			if other != nil && other.IP.Equal(server.IP) {
+				other = nil
+			}
+			result.UsedOtherAddress = other != nil
+		}
+
+		sample := IPPoolingSample{PrimaryMapping: primary.MappedAddress}
+		if localAddr, localErr := client.LocalAddr(server); localErr == nil {
+			sample.LocalAddress = localAddr
+		}
+		if other != nil {
+			alternate, err := client.SendBindingRequestTo(other, false, false)
+			if err != nil {
+				return nil, fmt.Errorf("ソケット %d の OTHER-ADDRESS 宛 Binding 失敗: %w", i+1, err)
+			}
+			sample.AlternateMapping = alternate.MappedAddress
+		}
+		result.Samples = append(result.Samples, sample)
+	}
+
+	result.Behavior, result.ExternalIPs = classifyIPPooling(result.Samples)
+	return result, nil
+}
+
+// classifyIPPooling は採取したマッピングから IP アドレスプーリングの挙動を判定し、
+// 観測した外部 IP アドレスの集合とともに返します
+func classifyIPPooling(samples []IPPoolingSample) (IPPoolingBehavior, []net.IP) {
+	var ips []net.IP
+	mappings := 0
+	for _, sample := range samples {
+		for _, mapped := range []*net.UDPAddr{sample.PrimaryMapping, sample.AlternateMapping} {
+			if mapped == nil {
+				continue
+			}
+			mappings++
+			if !slices.ContainsFunc(ips, mapped.IP.Equal) {
+				ips = append(ips, mapped.IP)
+			}
+		}
+	}
+
+	switch {
+	case mappings < 2:
+		return PoolingUnknown, ips
+	case len(ips) == 1:
+		return PairedPooling, ips
+	default:
+		return ArbitraryPooling, ips
+	}
+}
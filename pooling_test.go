@@ -0,0 +1,106 @@
+package natchecker
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPPoolingBehaviorString(t *testing.T) {
+	tests := []struct {
+		behavior IPPoolingBehavior
+		expected string
+	}{
+		{PairedPooling, "Paired"},
+		{ArbitraryPooling, "Arbitrary"},
+		{PoolingUnknown, "Unknown"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, test.behavior.String(), "IPPoolingBehavior(%d).String()", test.behavior)
+	}
+}
+
+func TestClassifyIPPooling(t *testing.T) {
+	udp := func(addr string) *net.UDPAddr {
+		if addr == "" {
+			return nil
+		}
+		a, err := net.ResolveUDPAddr("udp", addr)
+		require.NoError(t, err)
+		return a
+	}
+
+	tests := []struct {
+		name     string
+		samples  []IPPoolingSample
+		behavior IPPoolingBehavior
+		ips      []string
+	}{
+		{
+			name: "all mappings share one IP",
+			samples: []IPPoolingSample{
+				{PrimaryMapping: udp("203.0.113.1:1000"), AlternateMapping: udp("203.0.113.1:1001")},
+				{PrimaryMapping: udp("203.0.113.1:2000"), AlternateMapping: udp("203.0.113.1:2001")},
+			},
+			behavior: PairedPooling,
+			ips:      []string{"203.0.113.1"},
+		},
+		{
+			name: "different sockets get different IPs",
+			samples: []IPPoolingSample{
+				{PrimaryMapping: udp("203.0.113.1:1000")},
+				{PrimaryMapping: udp("203.0.113.2:2000")},
+				{PrimaryMapping: udp("203.0.113.1:3000")},
+			},
+			behavior: ArbitraryPooling,
+			ips:      []string{"203.0.113.1", "203.0.113.2"},
+		},
+		{
+			name: "alternate destination gets a different IP",
+			samples: []IPPoolingSample{
+				{PrimaryMapping: udp("203.0.113.1:1000"), AlternateMapping: udp("203.0.113.7:1000")},
+			},
+			behavior: ArbitraryPooling,
+			ips:      []string{"203.0.113.1", "203.0.113.7"},
+		},
+		{
+			name: "single mapping",
+			samples: []IPPoolingSample{
+				{PrimaryMapping: udp("203.0.113.1:1000")},
+			},
+			behavior: PoolingUnknown,
+			ips:      []string{"203.0.113.1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			behavior, ips := classifyIPPooling(test.samples)
+			assert.Equal(t, test.behavior, behavior)
+			var got []string
+			for _, ip := range ips {
+				got = append(got, ip.String())
+			}
+			assert.Equal(t, test.ips, got)
+		})
+	}
+}
+
+func TestCheckIPPoolingLoopback(t *testing.T) {
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer server.Close()
+	go serveMappedAddress(server, false)
+
+	// OTHER-ADDRESS を返さないサーバーでは主アドレス宛のマッピングのみで判定する
+	result, err := CheckIPPooling(server.LocalAddr().String(), WithAddressFamily(IPv4Only), WithSampleCount(3))
+	require.NoError(t, err)
+	assert.Len(t, result.Samples, 3)
+	assert.False(t, result.UsedOtherAddress)
+	assert.Equal(t, PairedPooling, result.Behavior)
+	require.Len(t, result.ExternalIPs, 1)
+	assert.Equal(t, "127.0.0.1", result.ExternalIPs[0].String())
+}
@@ -0,0 +1,226 @@
+package natchecker
+
+import (
+	"fmt"
+	"net"
+)
+
+// defaultSampleCount は複数のソケットでマッピングを採取するテストの既定のソケット数
+const defaultSampleCount = 8
+
+// maxSequentialDelta は連番割り当てとみなすポートの最大の増分。
+// 他のホストの通信で間のポートが使われても連番と判定できるよう、ある程度の幅を持たせる
+const maxSequentialDelta = 64
+
+// WithSampleCount は CheckPortAllocation などで開くローカルソケットの数と、
+// PredictPorts のバーストで送るプローブの数を指定します。
+// 2 未満の値は無視され、既定値 (8) のままになります。
+func WithSampleCount(n int) Option {
+	return func(c *config) {
+		if n >= 2 {
+			c.sampleCount = n
+		}
+	}
+}
+
+// samples は有効なサンプル数を返します
+func (c config) samples() int {
+	if c.sampleCount > 0 {
+		return c.sampleCount
+	}
+	return defaultSampleCount
+}
+
+// PortAllocationBehavior は NAT が外部ポートを割り当てる方式 (RFC 4787 Section 4.2)
+type PortAllocationBehavior int
+
+const (
+	// PortPreservation: ローカルのポート番号をそのまま外部ポートに使う
+	PortPreservation PortAllocationBehavior = iota
+	// PortSequential: 新しいマッピングごとに外部ポートが小さな増分で増える
+	PortSequential
+	// PortRandom: 外部ポートに規則性が無い
+	PortRandom
+	// PortAllocationUnknown: サンプルが足りず判定できない
+	PortAllocationUnknown
+)
+
+func (b PortAllocationBehavior) String() string {
+	switch b {
+	case PortPreservation:
+		return "Port Preservation"
+	case PortSequential:
+		return "Sequential"
+	case PortRandom:
+		return "Random"
+	default:
+		return "Unknown"
+	}
+}
+
+// PortAllocationSample は 1 つのローカルソケットで得られたマッピング
+type PortAllocationSample struct {
+	LocalAddress  *net.UDPAddr `json:"local_address"`
+	MappedAddress *net.UDPAddr `json:"mapped_address"`
+}
+
+// CheckPortAllocationResult はポート割り当て方式の判定結果
+type CheckPortAllocationResult struct {
+	Behavior PortAllocationBehavior `json:"behavior"`
+	// PortPreserved はすべてのマッピングでローカルのポート番号が保存された場合に true
+	// (RFC 4787 Section 4.2.1)
+	PortPreserved bool `json:"port_preserved"`
+	// ParityPreserved はすべてのマッピングでポート番号の偶奇が保存された場合に true
+	// (RFC 4787 Section 4.2.2)
+	ParityPreserved bool `json:"parity_preserved"`
+	// Consecutive は順に作ったマッピングの外部ポートがすべて 1 ずつ増えた場合に true。
+	// RFC 4787 Section 4.2.3 の Port Contiguity（隣り合うローカルポートのマッピングが
+	// 隣り合う外部ポートになること）とは異なり、ローカルポートの並びは問わない
+	Consecutive bool `json:"consecutive"`
+	// Delta は連続するマッピング間で最も多く観測された外部ポートの増分
+	Delta int `json:"delta"`
+	// Deltas は連続するマッピング間の外部ポートの増分
+	Deltas []int `json:"deltas"`
+	// Samples は採取したマッピング（作成順）
+	Samples []PortAllocationSample `json:"samples"`
+}
+
+// String は結果の文字列表現を返す
+func (r CheckPortAllocationResult) String() string {
+	return fmt.Sprintf("Port Allocation: %s (delta=%d, parity preserved=%v, consecutive=%v)",
+		r.Behavior, r.Delta, r.ParityPreserved, r.Consecutive)
+}
+
+// CheckPortAllocation は NAT のポート割り当て方式を判定します
+// RFC 4787 Section 4.2: Port Assignment Behavior
+//
+// 複数のローカルソケット（既定 8 個、WithSampleCount で変更可能）を順に開き、
+// それぞれから同じサーバーに Binding Request を送って外部マッピングを採取します。
+// 採取中はすべてのソケットを開いたままにし、NAT がポートを再利用しないようにします。
+// 得られたポート番号から、ポートの保存・偶奇の保存・連続性・増分を判定します。
+//
+// OTHER-ADDRESS 等の RFC 5780 の機能は不要で、通常の STUN サーバーで判定できます。
+func CheckPortAllocation(serverAddr string, opts ...Option) (*CheckPortAllocationResult, error) {
+	cfg := newConfig(opts)
+	servers, err := cfg.resolveServers(serverAddr)
+	if err != nil {
+		return nil, fmt.Errorf("サーバーアドレス解決エラー: %w", err)
+	}
+
+	samples, err := collectMappings(servers, cfg.samples(), opts)
+	if err != nil {
+		return nil, err
+	}
+	return classifyPortAllocation(samples), nil
+}
+
+// collectMappings は count 個のローカルソケットを順に開き、それぞれの外部マッピングを返します。
+// 最初のソケットで応答したサーバーを、以降のソケットでも使う
+func collectMappings(servers []*net.UDPAddr, count int, opts []Option) ([]PortAllocationSample, error) {
+	clients := make([]*STUNClient, 0, count)
+	defer func() {
+		for _, client := range clients {
+			client.Close()
+		}
+	}()
+
+	samples := make([]PortAllocationSample, 0, count)
+	for i := 0; i < count; i++ {
+		client, err := NewSTUNClient(opts...)
+		if err != nil {
+			return nil, fmt.Errorf("STUNクライアント作成エラー: %w", err)
+		}
+		clients = append(clients, client)
+
+		server, result, err := client.bindFirstResponsive(servers)
+		if err != nil {
+			return nil, fmt.Errorf("ソケット %d の Binding 失敗: %w", i+1, err)
+		}
+		servers = []*net.UDPAddr{server}
+
+		sample := PortAllocationSample{MappedAddress: result.MappedAddress}
+		if localAddr, localErr := client.LocalAddr(server); localErr == nil {
+			sample.LocalAddress = localAddr
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// classifyPortAllocation は採取したマッピングからポート割り当て方式を判定します
+func classifyPortAllocation(samples []PortAllocationSample) *CheckPortAllocationResult {
+	result := &CheckPortAllocationResult{
+		Behavior: PortAllocationUnknown,
+		Samples:  samples,
+	}
+	if len(samples) < 2 {
+		return result
+	}
+
+	result.PortPreserved = true
+	result.ParityPreserved = true
+	for _, sample := range samples {
+		if sample.LocalAddress == nil || sample.MappedAddress == nil {
+			result.PortPreserved = false
+			result.ParityPreserved = false
+			break
+		}
+		if sample.LocalAddress.Port != sample.MappedAddress.Port {
+			result.PortPreserved = false
+		}
+		if sample.LocalAddress.Port%2 != sample.MappedAddress.Port%2 {
+			result.ParityPreserved = false
+		}
+	}
+
+	result.Deltas = portDeltas(samples)
+	result.Delta = mostFrequent(result.Deltas)
+
+	result.Consecutive = true
+	sequential := true
+	for _, delta := range result.Deltas {
+		if delta != 1 {
+			result.Consecutive = false
+		}
+		if delta <= 0 || delta > maxSequentialDelta {
+			sequential = false
+		}
+	}
+
+	switch {
+	case result.PortPreserved:
+		result.Behavior = PortPreservation
+	case sequential:
+		result.Behavior = PortSequential
+	default:
+		result.Behavior = PortRandom
+	}
+	return result
+}
+
+// portDeltas は連続するサンプル間の外部ポートの増分を返します
+func portDeltas(samples []PortAllocationSample) []int {
+	deltas := make([]int, 0, len(samples))
+	for i := 1; i < len(samples); i++ {
+		prev, cur := samples[i-1].MappedAddress, samples[i].MappedAddress
+		if prev == nil || cur == nil {
+			continue
+		}
+		deltas = append(deltas, cur.Port-prev.Port)
+	}
+	return deltas
+}
+
+// mostFrequent は values で最も多く現れる値を返します。
+// 同数の場合は先にその回数に達した値を返し、values が空なら 0 を返す
+func mostFrequent(values []int) int {
+	counts := make(map[int]int)
+	best, bestCount := 0, 0
+	for _, v := range values {
+		counts[v]++
+		if counts[v] > bestCount {
+			best, bestCount = v, counts[v]
+		}
+	}
+	return best
+}
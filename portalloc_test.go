@@ -0,0 +1,151 @@
+package natchecker
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortAllocationBehaviorString(t *testing.T) {
+	tests := []struct {
+		behavior PortAllocationBehavior
+		expected string
+	}{
+		{PortPreservation, "Port Preservation"},
+		{PortSequential, "Sequential"},
+		{PortRandom, "Random"},
+		{PortAllocationUnknown, "Unknown"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, test.behavior.String(), "PortAllocationBehavior(%d).String()", test.behavior)
+	}
+}
+
+// portSamples はローカルポートと外部ポートの組からサンプルを作る
+func portSamples(pairs ...[2]int) []PortAllocationSample {
+	samples := make([]PortAllocationSample, 0, len(pairs))
+	for _, pair := range pairs {
+		samples = append(samples, PortAllocationSample{
+			LocalAddress:  &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: pair[0]},
+			MappedAddress: &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: pair[1]},
+		})
+	}
+	return samples
+}
+
+func TestClassifyPortAllocation(t *testing.T) {
+	tests := []struct {
+		name        string
+		samples     []PortAllocationSample
+		behavior    PortAllocationBehavior
+		parity      bool
+		consecutive bool
+		delta       int
+	}{
+		{
+			name:     "ports preserved",
+			samples:  portSamples([2]int{50000, 50000}, [2]int{50123, 50123}, [2]int{50246, 50246}),
+			behavior: PortPreservation,
+			parity:   true,
+			delta:    123,
+		},
+		{
+			name:        "consecutive allocation",
+			samples:     portSamples([2]int{50001, 1024}, [2]int{50123, 1025}, [2]int{49152, 1026}, [2]int{40001, 1027}),
+			behavior:    PortSequential,
+			consecutive: true,
+			delta:       1,
+		},
+		{
+			name:     "sequential allocation preserving parity",
+			samples:  portSamples([2]int{50000, 2000}, [2]int{50001, 2001}, [2]int{50002, 2002}, [2]int{50003, 2003}),
+			behavior: PortSequential,
+			parity:   true,
+			// 1 ずつ増えているので Consecutive
+			consecutive: true,
+			delta:       1,
+		},
+		{
+			name:     "sequential allocation with gaps from other hosts",
+			samples:  portSamples([2]int{50000, 3000}, [2]int{50123, 3002}, [2]int{49152, 3004}, [2]int{40001, 3009}),
+			behavior: PortSequential,
+			delta:    2,
+		},
+		{
+			name:     "random allocation",
+			samples:  portSamples([2]int{50000, 61234}, [2]int{50123, 3002}, [2]int{49152, 45000}),
+			behavior: PortRandom,
+			delta:    -58232,
+		},
+		{
+			name:     "not enough samples",
+			samples:  portSamples([2]int{50000, 50000}),
+			behavior: PortAllocationUnknown,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := classifyPortAllocation(test.samples)
+			assert.Equal(t, test.behavior, result.Behavior, "Behavior")
+			if test.behavior == PortAllocationUnknown {
+				return
+			}
+			assert.Equal(t, test.parity, result.ParityPreserved, "ParityPreserved")
+			assert.Equal(t, test.consecutive, result.Consecutive, "Consecutive")
+			assert.Equal(t, test.delta, result.Delta, "Delta")
+		})
+	}
+}
+
+func TestMostFrequent(t *testing.T) {
+	assert.Equal(t, 0, mostFrequent(nil))
+	assert.Equal(t, 2, mostFrequent([]int{1, 2, 2, 3}))
+	assert.Equal(t, 5, mostFrequent([]int{5, 7}))
+}
+
+// serveMappedAddress は受信した Binding Request の送信元を MAPPED-ADDRESS として返す
+// テスト用の STUN サーバーを conn 上で動かす。conn が閉じられると終了する。
+// honorResponsePort が true なら RESPONSE-PORT で指定されたポートに応答を送る
+func serveMappedAddress(conn *net.UDPConn, honorResponsePort bool) {
+	buffer := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		if n < 20 || buffer[0] != 0x00 || buffer[1] != 0x01 {
+			continue
+		}
+		var txID [12]byte
+		copy(txID[:], buffer[8:20])
+		ip := from.IP.To4()
+		attrs := []byte{0x00, 0x01, 0x00, 0x08, 0x00, 0x01, byte(from.Port >> 8), byte(from.Port)}
+		attrs = append(attrs, ip...)
+
+		to := from
+		for offset := 20; honorResponsePort && offset+8 <= n; offset += 4 + int(buffer[offset+3]) {
+			if buffer[offset] == 0x00 && buffer[offset+1] == 0x27 {
+				to = &net.UDPAddr{IP: from.IP, Port: int(buffer[offset+4])<<8 | int(buffer[offset+5])}
+			}
+		}
+		conn.WriteToUDP(buildMessage(txID, attrs), to)
+	}
+}
+
+func TestCheckPortAllocationLoopback(t *testing.T) {
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer server.Close()
+	go serveMappedAddress(server, false)
+
+	// NAT が無いので、すべてのポートが保存される
+	result, err := CheckPortAllocation(server.LocalAddr().String(), WithAddressFamily(IPv4Only), WithSampleCount(4))
+	require.NoError(t, err)
+	assert.Len(t, result.Samples, 4)
+	assert.Equal(t, PortPreservation, result.Behavior)
+	assert.True(t, result.ParityPreserved)
+}
@@ -0,0 +1,123 @@
+package natchecker
+
+import (
+	"fmt"
+	"net"
+	"slices"
+)
+
+// DefaultSensitivePorts は CheckPortSensitivity でポートを指定しなかった場合に調べる宛先ポート。
+// ALG や個別のタイムアウトが適用されやすい DNS, NTP, HTTPS, SIP のポート
+var DefaultSensitivePorts = []int{53, 123, 443, 5060}
+
+// PortBehavior はある宛先ポートで観測された NAT の挙動
+type PortBehavior struct {
+	Port      int              `json:"port"`
+	Mapping   NATMappingType   `json:"mapping"`
+	Filtering NATFilteringType `json:"filtering"`
+	// ALG はこのポート宛の Binding で MAPPED-ADDRESS が書き換えられていた場合の警告
+	ALG *ALGWarning `json:"alg,omitempty"`
+	// Error はこのポートで判定できなかった場合の理由。
+	// 既定のポートでは応答があったのにこのポートで応答が無い場合、経路上で遮断されている可能性がある
+	Error string `json:"error,omitempty"`
+	// Deviates は既定のポートと挙動が異なる場合に true
+	Deviates bool `json:"deviates"`
+}
+
+// CheckPortSensitivityResult は宛先ポートによる NAT の挙動の違いの判定結果
+type CheckPortSensitivityResult struct {
+	// Baseline はサーバーアドレスで指定したポート（既定 3478）での挙動
+	Baseline PortBehavior `json:"baseline"`
+	// Ports は指定した各ポートでの挙動（指定順）
+	Ports []PortBehavior `json:"ports"`
+	// Deviations は Baseline と挙動が異なったポート
+	Deviations []int `json:"deviations"`
+}
+
+// String は結果の文字列表現を返す
+func (r CheckPortSensitivityResult) String() string {
+	if len(r.Deviations) == 0 {
+		return fmt.Sprintf("Port Sensitivity: no deviation on %d port(s)", len(r.Ports))
+	}
+	return fmt.Sprintf("Port Sensitivity: deviation on port(s) %v", r.Deviations)
+}
+
+// CheckPortSensitivity は宛先ポートによって NAT の挙動が変わるかを判定します
+//
+// 一部の NAT やファイアウォールは、よく知られたポート (53, 123, 443, 5060 等) 宛の
+// 通信に ALG を適用したり、異なるマッピング・フィルタリングを行ったりします。
+// サーバーアドレスのポートを基準として、ports の各ポート宛にマッピング判定
+// (RFC 5780 Section 4.3) とフィルタリング判定 (Section 4.4) を繰り返し、
+// 基準と結果が異なるポートを報告します。ports が空なら DefaultSensitivePorts を使います。
+//
+// サーバーは主アドレスと OTHER-ADDRESS の IP のそれぞれで、指定したすべてのポートを
+// 待ち受けている必要があります（協力的なサーバー）。
+// 基準のポートで判定できない場合はエラーを返します。
+func CheckPortSensitivity(serverAddr string, ports []int, opts ...Option) (*CheckPortSensitivityResult, error) {
+	if len(ports) == 0 {
+		ports = DefaultSensitivePorts
+	}
+	for _, port := range ports {
+		if port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %d", port)
+		}
+	}
+
+	servers, err := newConfig(opts).resolveServers(serverAddr)
+	if err != nil {
+		return nil, fmt.Errorf("サーバーアドレス解決エラー: %w", err)
+	}
+	// NAT64 プレフィックスの探索はすべてのポートの判定で共有する
+	opts = withNAT64Discovery(opts)
+
+	baseline, server, err := probePortBehavior(servers, opts)
+	if err != nil {
+		return nil, fmt.Errorf("基準ポート %d の判定エラー: %w", servers[0].Port, err)
+	}
+	result := &CheckPortSensitivityResult{Baseline: baseline}
+
+	for _, port := range ports {
+		// 基準と同じサーバー IP の別ポートに送る
+		behavior, _, err := probePortBehavior([]*net.UDPAddr{{IP: server.IP, Port: port, Zone: server.Zone}}, opts)
+		if err != nil {
+			behavior = PortBehavior{Port: port, Mapping: Unknown, Filtering: FilteringUnknown, Error: err.Error()}
+		}
+		behavior.Deviates = portBehaviorDeviates(baseline, behavior)
+		if behavior.Deviates && !slices.Contains(result.Deviations, port) {
+			result.Deviations = append(result.Deviations, port)
+		}
+		result.Ports = append(result.Ports, behavior)
+	}
+	return result, nil
+}
+
+// probePortBehavior は servers に対してマッピング・フィルタリングを判定し、
+// 応答したサーバーのアドレスとともに返します
+func probePortBehavior(servers []*net.UDPAddr, opts []Option) (PortBehavior, *net.UDPAddr, error) {
+	mapping, err := checkMappingType(servers, opts)
+	if err != nil {
+		return PortBehavior{}, nil, fmt.Errorf("マッピング判定エラー: %w", err)
+	}
+	server := mapping.Response.ServerAddress
+
+	filtering, err := checkFilteringBehavior([]*net.UDPAddr{server}, opts)
+	if err != nil {
+		return PortBehavior{}, nil, fmt.Errorf("フィルタリング判定エラー: %w", err)
+	}
+
+	return PortBehavior{
+		Port:      server.Port,
+		Mapping:   mapping.NATType,
+		Filtering: filtering.FilteringType,
+		ALG:       mapping.ALG,
+	}, server, nil
+}
+
+// portBehaviorDeviates は behavior が基準 baseline と異なる挙動を示したかを返します。
+// 判定できなかったポート、および基準に無い ALG が検出されたポートも異なるとみなす
+func portBehaviorDeviates(baseline, behavior PortBehavior) bool {
+	return behavior.Error != "" ||
+		behavior.Mapping != baseline.Mapping ||
+		behavior.Filtering != baseline.Filtering ||
+		(behavior.ALG != nil) != (baseline.ALG != nil)
+}
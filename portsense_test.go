@@ -0,0 +1,93 @@
+package natchecker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortBehaviorDeviates(t *testing.T) {
+	baseline := PortBehavior{Port: 3478, Mapping: EndpointIndependent, Filtering: AddressPortDependentFiltering}
+	alg := &ALGWarning{}
+
+	tests := []struct {
+		name     string
+		behavior PortBehavior
+		expected bool
+	}{
+		{
+			name:     "same behavior",
+			behavior: PortBehavior{Port: 443, Mapping: EndpointIndependent, Filtering: AddressPortDependentFiltering},
+			expected: false,
+		},
+		{
+			name:     "different mapping",
+			behavior: PortBehavior{Port: 53, Mapping: AddressPortDependent, Filtering: AddressPortDependentFiltering},
+			expected: true,
+		},
+		{
+			name:     "different filtering",
+			behavior: PortBehavior{Port: 123, Mapping: EndpointIndependent, Filtering: EndpointIndependentFiltering},
+			expected: true,
+		},
+		{
+			name:     "ALG on this port only",
+			behavior: PortBehavior{Port: 5060, Mapping: EndpointIndependent, Filtering: AddressPortDependentFiltering, ALG: alg},
+			expected: true,
+		},
+		{
+			name:     "unreachable port",
+			behavior: PortBehavior{Port: 5060, Mapping: Unknown, Filtering: FilteringUnknown, Error: "timeout"},
+			expected: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, portBehaviorDeviates(baseline, test.behavior))
+		})
+	}
+}
+
+func TestCheckPortSensitivityLoopback(t *testing.T) {
+	listen := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		require.NoError(t, err)
+		return conn
+	}
+
+	baseline := listen()
+	defer baseline.Close()
+	go serveMappedAddress(baseline, false)
+
+	// ALG が適用されるポートを模擬する
+	rewriting := listen()
+	defer rewriting.Close()
+	go serveRewrittenMappedAddress(rewriting)
+
+	// 誰も待ち受けていないポート
+	closed := listen()
+	closedPort := closed.LocalAddr().(*net.UDPAddr).Port
+	closed.Close()
+
+	baselinePort := baseline.LocalAddr().(*net.UDPAddr).Port
+	rewritingPort := rewriting.LocalAddr().(*net.UDPAddr).Port
+	result, err := CheckPortSensitivity(baseline.LocalAddr().String(), []int{baselinePort, rewritingPort, closedPort},
+		WithAddressFamily(IPv4Only), WithRetransmission(20*time.Millisecond, 2))
+	require.NoError(t, err)
+
+	assert.Equal(t, baselinePort, result.Baseline.Port)
+	assert.Nil(t, result.Baseline.ALG)
+	require.Len(t, result.Ports, 3)
+	assert.False(t, result.Ports[0].Deviates)
+	assert.NotNil(t, result.Ports[1].ALG)
+	assert.True(t, result.Ports[1].Deviates)
+	assert.NotEmpty(t, result.Ports[2].Error)
+	assert.Equal(t, []int{rewritingPort, closedPort}, result.Deviations)
+
+	_, err = CheckPortSensitivity(baseline.LocalAddr().String(), []int{0})
+	assert.Error(t, err, "port 0 should be rejected")
+}
@@ -0,0 +1,258 @@
+package natchecker
+
+import (
+	"fmt"
+	"math"
+	"net"
+)
+
+// accuracyCandidates は予測精度の測定で「当たり」とみなす上位の候補数。
+// ホールパンチングで 1 回に試す候補数の目安で、バーストの大きさとは関係しない
+const accuracyCandidates = 5
+
+// predictionDestinations はサーバーの主アドレスと OTHER-ADDRESS から作れる宛先の数
+const predictionDestinations = 4
+
+// PortProbe は予測のために送信した 1 回の Binding の宛先と、得られたマッピング
+type PortProbe struct {
+	Destination *net.UDPAddr `json:"destination"`
+	Mapping     *net.UDPAddr `json:"mapping"`
+	// Auxiliary はクライアント自身のソケットではなく、新しいマッピングを作るために
+	// 一時的に開いたソケットから送信したプローブの場合に true
+	Auxiliary bool `json:"auxiliary,omitempty"`
+}
+
+// PortPredictionResult は NAT のポート割り当てのモデルと、その予測精度
+type PortPredictionResult struct {
+	// MappingType はプローブの結果から判定したマッピング動作
+	MappingType NATMappingType `json:"mapping_type"`
+	// Probes は送信した順のプローブ
+	Probes []PortProbe `json:"probes"`
+	// Delta は新しいマッピングが作られるたびに外部ポートが増える量（最頻値）
+	Delta int `json:"delta"`
+	// Jitter は増分の Delta からの平均絶対偏差。0 なら完全に規則的
+	Jitter float64 `json:"jitter"`
+	// Accuracy はプローブ済みのマッピングに対して予測を検証した的中率 (0〜1)。
+	// 上位 accuracyCandidates 個の候補に実際のポートが含まれれば的中とする
+	Accuracy float64 `json:"accuracy"`
+	// AccuracyTrials は的中率の算出に使った検証の回数。0 なら Accuracy は意味を持たない
+	AccuracyTrials int `json:"accuracy_trials"`
+}
+
+// String は結果の文字列表現を返す
+func (r PortPredictionResult) String() string {
+	return fmt.Sprintf("Port Prediction: %s, delta=%d, jitter=%.1f, accuracy=%.0f%% (%d trials)",
+		r.MappingType, r.Delta, r.Jitter, r.Accuracy*100, r.AccuracyTrials)
+}
+
+// PredictPorts は新しいソケットから PredictPorts を実行します。
+// 予測したポートでホールパンチングを行う場合は、同じソケットを使う
+// STUNClient.PredictPorts を使ってください。
+func PredictPorts(serverAddr string, opts ...Option) (*PortPredictionResult, error) {
+	client, err := NewSTUNClient(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("STUNクライアント作成エラー: %w", err)
+	}
+	defer client.Close()
+
+	return client.PredictPorts(serverAddr)
+}
+
+// PredictPorts は Address and Port Dependent Mapping (Symmetric NAT) の
+// ホールパンチングのために、このソケットの外部ポートの割り当てをモデル化します
+//
+// サーバーの主アドレスと OTHER-ADDRESS の組み合わせ（主 IP・主ポート、代替 IP・主ポート、
+// 代替 IP・代替ポート、主 IP・代替ポート）の 4 つの宛先に続けて送信し、
+// 新しいマッピングが作られるたびの外部ポートの増分 (Delta) とばらつき (Jitter) を求めます。
+// 先頭からのプローブで次のプローブのポートを予測し、実際の値と比べて的中率も測定します。
+//
+// バーストのプローブ数は WithSampleCount で指定します（既定 8）。
+// 1 つのソケットから新しいマッピングを作れる宛先は 4 つしか無いため、
+// 5 つ目以降のプローブは一時的に開いたソケットから主アドレスに送ります。
+// 一時的なソケットはバーストが終わるまで開いたままにし、NAT がポートを再利用しないようにします。
+//
+// OTHER-ADDRESS が無いサーバーでは宛先が 1 つしか無いためエラーを返します。
+// 予測は NAT が同じ外部 IP を使い続けること (Paired pooling) を前提とします。
+func (c *STUNClient) PredictPorts(serverAddr string) (*PortPredictionResult, error) {
+	servers, err := c.cfg.resolveServers(serverAddr)
+	if err != nil {
+		return nil, fmt.Errorf("サーバーアドレス解決エラー: %w", err)
+	}
+
+	server, first, err := c.bindFirstResponsive(servers)
+	if err != nil {
+		return nil, fmt.Errorf("ポート予測のプローブ 1 失敗: %w", err)
+	}
+	other := c.detectNAT64(server, first.MappedAddress).synthesize(first.OtherAddress)
+	if other == nil || other.IP.Equal(server.IP) || other.Port == server.Port {
+		return nil, fmt.Errorf("ポート予測には OTHER-ADDRESS (異なる IP とポート) に対応したサーバーが必要です")
+	}
+
+	// 主アドレス宛に続けて、RFC 5780 の Test II / Test III と同じ宛先、
+	// 最後に主 IP・代替ポートに送る。最初の 3 つでマッピング動作も判定できる
+	destinations := []*net.UDPAddr{
+		server,
+		{IP: other.IP, Port: server.Port},
+		other,
+		{IP: server.IP, Port: other.Port},
+	}
+	burst := c.cfg.samples()
+	probes := make([]PortProbe, 0, burst)
+	probes = append(probes, PortProbe{Destination: server, Mapping: first.MappedAddress})
+	for i := 1; i < burst && i < predictionDestinations; i++ {
+		result, err := c.SendBindingRequestTo(destinations[i], false, false)
+		if err != nil {
+			return nil, fmt.Errorf("ポート予測のプローブ %d 失敗: %w", i+1, err)
+		}
+		probes = append(probes, PortProbe{Destination: destinations[i], Mapping: result.MappedAddress})
+	}
+
+	var auxiliaries []*STUNClient
+	defer func() {
+		for _, auxiliary := range auxiliaries {
+			auxiliary.Close()
+		}
+	}()
+	for i := predictionDestinations; i < burst; i++ {
+		transport, err := c.cfg.newTransport(c.cfg.family.network())
+		if err != nil {
+			return nil, fmt.Errorf("ポート予測のプローブ %d のソケット作成エラー: %w", i+1, err)
+		}
+		auxiliary := &STUNClient{transport: transport, cfg: c.cfg}
+		auxiliaries = append(auxiliaries, auxiliary)
+
+		result, err := auxiliary.SendBindingRequestTo(server, false, false)
+		if err != nil {
+			return nil, fmt.Errorf("ポート予測のプローブ %d 失敗: %w", i+1, err)
+		}
+		probes = append(probes, PortProbe{Destination: server, Mapping: result.MappedAddress, Auxiliary: true})
+	}
+
+	return modelPortAllocation(probes), nil
+}
+
+// modelPortAllocation はプローブの結果からポート割り当てのモデルを作り、
+// 予測精度を検証します
+func modelPortAllocation(probes []PortProbe) *PortPredictionResult {
+	result := &PortPredictionResult{
+		MappingType: Unknown,
+		Probes:      probes,
+	}
+	if len(probes) >= 3 {
+		result.MappingType = determineNATType(probes[0].Mapping, probes[1].Mapping, probes[2].Mapping)
+	}
+
+	ports := newMappingPorts(probes)
+	result.Delta, result.Jitter = portDeltaModel(ports)
+
+	// 先頭 i 個の新しいマッピングから i+1 個目を予測して検証する
+	hits := 0
+	for i := 2; i < len(ports); i++ {
+		delta, _ := portDeltaModel(ports[:i])
+		for _, candidate := range portCandidates(ports[i-1], delta, accuracyCandidates) {
+			if candidate == ports[i] {
+				hits++
+				break
+			}
+		}
+		result.AccuracyTrials++
+	}
+	if result.AccuracyTrials > 0 {
+		result.Accuracy = float64(hits) / float64(result.AccuracyTrials)
+	}
+	return result
+}
+
+// Predict は destination に送信したときに使われる外部ポートの候補を、
+// 可能性の高い順に最大 n 個返します
+//
+// クライアント自身のソケットでプローブ済みの宛先、または Address Dependent Mapping で
+// IP が同じ宛先なら、既存のマッピングが再利用されるためそのポートだけを返す。
+// それ以外は最後に作られたマッピングのポートに Delta を加えた値を中心に、
+// 近いポートから順に返す。
+func (r *PortPredictionResult) Predict(destination *net.UDPAddr, n int) []int {
+	if n <= 0 || len(r.Probes) == 0 {
+		return nil
+	}
+
+	for _, probe := range r.Probes {
+		if probe.Mapping == nil || probe.Auxiliary {
+			continue
+		}
+		reused := r.MappingType == EndpointIndependent ||
+			udpAddrEqual(probe.Destination, destination) ||
+			(r.MappingType == AddressDependent && destination != nil && probe.Destination.IP.Equal(destination.IP))
+		if reused {
+			return []int{probe.Mapping.Port}
+		}
+	}
+
+	ports := newMappingPorts(r.Probes)
+	if len(ports) == 0 {
+		return nil
+	}
+	return portCandidates(ports[len(ports)-1], r.Delta, n)
+}
+
+// newMappingPorts はプローブのうち、新しいマッピングが作られたものの外部ポートを
+// 作られた順に返します。既存のマッピングが再利用されたプローブは除く
+func newMappingPorts(probes []PortProbe) []int {
+	var ports []int
+	var seen []*net.UDPAddr
+	for _, probe := range probes {
+		if probe.Mapping == nil {
+			continue
+		}
+		reused := false
+		for _, mapping := range seen {
+			if udpAddrEqual(mapping, probe.Mapping) {
+				reused = true
+				break
+			}
+		}
+		if reused {
+			continue
+		}
+		seen = append(seen, probe.Mapping)
+		ports = append(ports, probe.Mapping.Port)
+	}
+	return ports
+}
+
+// portDeltaModel は連続するポートの増分の最頻値と、最頻値からの平均絶対偏差を返します
+func portDeltaModel(ports []int) (int, float64) {
+	if len(ports) < 2 {
+		return 0, 0
+	}
+	deltas := make([]int, 0, len(ports)-1)
+	for i := 1; i < len(ports); i++ {
+		deltas = append(deltas, ports[i]-ports[i-1])
+	}
+	delta := mostFrequent(deltas)
+
+	var deviation float64
+	for _, d := range deltas {
+		deviation += math.Abs(float64(d - delta))
+	}
+	return delta, deviation / float64(len(deltas))
+}
+
+// portCandidates は last+delta を中心に、近い順に最大 n 個のポート候補を返します。
+// 他のホストの通信でポートが消費されると実際のポートは予測より大きくなりやすいため、
+// 同じ距離なら大きい方を先に並べる
+func portCandidates(last, delta, n int) []int {
+	base := last + delta
+	candidates := make([]int, 0, n)
+	add := func(port int) {
+		if len(candidates) < n && port >= 1 && port <= 65535 {
+			candidates = append(candidates, port)
+		}
+	}
+
+	add(base)
+	for offset := 1; len(candidates) < n && offset <= 65535; offset++ {
+		add(base + offset)
+		add(base - offset)
+	}
+	return candidates
+}
@@ -0,0 +1,124 @@
+package natchecker
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// predictionProbes は RFC 5780 サーバーの 4 つの宛先に対して
+// mappedPorts のマッピングが得られたプローブ列を作る
+func predictionProbes(mappedPorts ...int) []PortProbe {
+	primary := net.ParseIP("198.51.100.1")
+	alternate := net.ParseIP("198.51.100.2")
+	destinations := []*net.UDPAddr{
+		{IP: primary, Port: 3478},
+		{IP: alternate, Port: 3478},
+		{IP: alternate, Port: 3479},
+		{IP: primary, Port: 3479},
+	}
+
+	probes := make([]PortProbe, 0, len(mappedPorts))
+	for i, port := range mappedPorts {
+		probes = append(probes, PortProbe{
+			Destination: destinations[i],
+			Mapping:     &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: port},
+		})
+	}
+	return probes
+}
+
+func TestModelPortAllocation(t *testing.T) {
+	tests := []struct {
+		name        string
+		ports       []int
+		mappingType NATMappingType
+		delta       int
+		jitter      float64
+		accuracy    float64
+		trials      int
+	}{
+		{
+			name:        "sequential symmetric NAT",
+			ports:       []int{40000, 40001, 40002, 40003},
+			mappingType: AddressPortDependent,
+			delta:       1,
+			accuracy:    1,
+			trials:      2,
+		},
+		{
+			name:        "symmetric NAT with gaps from other hosts",
+			ports:       []int{40000, 40002, 40004, 40007},
+			mappingType: AddressPortDependent,
+			delta:       2,
+			jitter:      1.0 / 3,
+			accuracy:    1,
+			trials:      2,
+		},
+		{
+			name:        "random allocation",
+			ports:       []int{40000, 12345, 61000, 2222},
+			mappingType: AddressPortDependent,
+			delta:       -27655,
+			jitter:      (0 + 76310 + 31123) / 3.0,
+			accuracy:    0,
+			trials:      2,
+		},
+		{
+			name:        "address dependent mapping reuses the mapping per IP",
+			ports:       []int{40000, 40010, 40010, 40000},
+			mappingType: AddressDependent,
+			delta:       10,
+		},
+		{
+			name:        "endpoint independent mapping",
+			ports:       []int{40000, 40000, 40000, 40000},
+			mappingType: EndpointIndependent,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := modelPortAllocation(predictionProbes(test.ports...))
+			assert.Equal(t, test.mappingType, result.MappingType, "MappingType")
+			assert.Equal(t, test.delta, result.Delta, "Delta")
+			assert.InDelta(t, test.jitter, result.Jitter, 1e-9, "Jitter")
+			assert.InDelta(t, test.accuracy, result.Accuracy, 1e-9, "Accuracy")
+			assert.Equal(t, test.trials, result.AccuracyTrials, "AccuracyTrials")
+		})
+	}
+}
+
+func TestPortPredictionPredict(t *testing.T) {
+	peer := &net.UDPAddr{IP: net.ParseIP("192.0.2.50"), Port: 9000}
+
+	symmetric := modelPortAllocation(predictionProbes(40000, 40001, 40002, 40003))
+	assert.Equal(t, []int{40004, 40005, 40003}, symmetric.Predict(peer, 3))
+	assert.Equal(t, []int{40001}, symmetric.Predict(symmetric.Probes[1].Destination, 3),
+		"a probed destination reuses its mapping")
+
+	addressDependent := modelPortAllocation(predictionProbes(40000, 40010, 40010, 40000))
+	samePrimaryIP := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 5000}
+	assert.Equal(t, []int{40000}, addressDependent.Predict(samePrimaryIP, 3))
+	assert.Equal(t, []int{40020, 40021}, addressDependent.Predict(peer, 2))
+
+	// 一時的なソケットのマッピングは、同じ宛先でもクライアントのソケットでは再利用されない
+	withAuxiliary := modelPortAllocation(append(predictionProbes(40000, 40001, 40002, 40003),
+		PortProbe{Destination: symmetric.Probes[0].Destination, Mapping: &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 40004}, Auxiliary: true}))
+	assert.Equal(t, []int{40000}, withAuxiliary.Predict(symmetric.Probes[0].Destination, 3))
+	assert.Equal(t, []int{40005, 40006}, withAuxiliary.Predict(peer, 2))
+	assert.Equal(t, 3, withAuxiliary.AccuracyTrials)
+
+	endpointIndependent := modelPortAllocation(predictionProbes(40000, 40000, 40000, 40000))
+	assert.Equal(t, []int{40000}, endpointIndependent.Predict(peer, 3))
+
+	assert.Nil(t, symmetric.Predict(peer, 0))
+}
+
+func TestPortCandidates(t *testing.T) {
+	assert.Equal(t, []int{101, 102, 100, 103, 99}, portCandidates(100, 1, 5))
+	// ポート範囲の外は除く
+	assert.Equal(t, []int{65535, 65534, 65533}, portCandidates(65534, 1, 3))
+	assert.Equal(t, []int{1, 2, 3}, portCandidates(2, -2, 3))
+}
@@ -0,0 +1,352 @@
+package natchecker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// RefreshBehavior はある方向の通信で NAT のマッピングのタイマーが更新されるか (RFC 4787 Section 4.3)
+type RefreshBehavior int
+
+const (
+	// RefreshTrue: その方向の通信でマッピングが維持された
+	RefreshTrue RefreshBehavior = iota
+	// RefreshFalse: その方向の通信があってもマッピングが失効した
+	RefreshFalse
+	// RefreshUnknown: 判定できない
+	RefreshUnknown
+)
+
+func (b RefreshBehavior) String() string {
+	switch b {
+	case RefreshTrue:
+		return "True"
+	case RefreshFalse:
+		return "False"
+	default:
+		return "Unknown"
+	}
+}
+
+// InboundStimulus は内向きの更新の判定で、サーバーからの通信を起こした方法
+type InboundStimulus int
+
+const (
+	// InboundStimulusNone: サーバーからの通信を起こせず、内向きの更新は判定していない
+	InboundStimulusNone InboundStimulus = iota
+	// InboundStimulusChangeRequest: CHANGE-REQUEST でサーバーの代替アドレスから送らせた
+	InboundStimulusChangeRequest
+	// InboundStimulusResponsePort: CHANGE-REQUEST が使えず、RESPONSE-PORT だけで
+	// サーバーの主アドレスから送らせた
+	InboundStimulusResponsePort
+)
+
+func (s InboundStimulus) String() string {
+	switch s {
+	case InboundStimulusChangeRequest:
+		return "CHANGE-REQUEST"
+	case InboundStimulusResponsePort:
+		return "RESPONSE-PORT"
+	default:
+		return "None"
+	}
+}
+
+// CheckRefreshDirectionResult はマッピングを更新する通信方向の判定結果
+type CheckRefreshDirectionResult struct {
+	// OutboundRefresh はクライアントからサーバーへの通信だけでマッピングが維持されたか
+	// RFC 4787 REQ-6: "The NAT mapping Refresh Direction MUST have a "NAT
+	// Outbound refresh behavior" of "True"."
+	OutboundRefresh RefreshBehavior `json:"outbound_refresh"`
+	// InboundRefresh はサーバーからクライアントへの通信だけでマッピングが維持されたか
+	InboundRefresh RefreshBehavior `json:"inbound_refresh"`
+	// ControlExpired は何も通信しなかった対照のマッピングが保持時間内に失効した場合に true。
+	// false の場合は保持時間が NAT のタイムアウトより短く、両方向とも判定できない
+	ControlExpired bool `json:"control_expired"`
+	// InboundStimulus は内向きの通信を起こした方法。None なら InboundRefresh は Unknown
+	InboundStimulus InboundStimulus `json:"inbound_stimulus"`
+	// SupportsResponsePort はサーバーが RESPONSE-PORT (RFC 5780 Section 7.5) に対応していたか。
+	// 対応していない場合、サーバーからの通信だけを送ることができず InboundRefresh は判定できない
+	SupportsResponsePort bool `json:"supports_response_port"`
+	// InboundPackets は保持中にサーバーから受信できたパケットの数
+	InboundPackets int `json:"inbound_packets"`
+	// HoldTime, Interval はマッピングを保持した時間と、更新の間隔
+	HoldTime time.Duration `json:"hold_time"`
+	Interval time.Duration `json:"interval"`
+}
+
+// String は結果の文字列表現を返す
+func (r CheckRefreshDirectionResult) String() string {
+	return fmt.Sprintf("Refresh Direction: outbound=%s, inbound=%s (%s)", r.OutboundRefresh, r.InboundRefresh, r.InboundStimulus)
+}
+
+// CheckRefreshDirection はどの方向の通信で NAT のマッピングが維持されるかを判定します
+// RFC 4787 Section 4.3: Mapping Refresh
+//
+// 3 つのソケットでそれぞれマッピングを作り、holdTime の間 interval ごとに:
+//   - 外向き: クライアントから Binding Indication を送る（応答は返らない）
+//   - 内向き: サーバーからの通信だけを対象のマッピングに届ける（対象のソケットは送信しない）
+//   - 対照: 何も送受信しない
+//
+// 内向きの通信は、別のソケットから CHANGE-REQUEST (RFC 5780 Section 7.2) で IP と
+// ポートの変更を要求し、サーバーの代替アドレス (OTHER-ADDRESS) から送らせます。
+// CHANGE-REQUEST の応答はリクエストの送信元に返るため、応答の宛先を対象のマッピングに
+// 向ける RESPONSE-PORT (Section 7.5) も付けます。対象のソケットは保持を始める前に
+// 代替アドレスへ 1 度だけ送信し、フィルタリングで代替アドレスからの通信が遮断されないようにします。
+// サーバーが OTHER-ADDRESS や CHANGE-REQUEST に対応していない場合や、代替アドレスからの
+// 通信が届かない場合（Address Dependent Mapping で代替アドレス宛に別のマッピングが作られる NAT など）は、
+// RESPONSE-PORT だけを使い主アドレスから送らせる方法に切り替えます。
+// 使った方法は InboundStimulus に記録されます。
+//
+// 保持時間の後、各マッピングがまだ有効かを確認します。対照のマッピングが失効して
+// いなければ holdTime が NAT のタイムアウトより短いため、両方向とも Unknown になります。
+// holdTime には NAT のマッピングのタイムアウトより十分長い時間（一般的な NAT では
+// 数分）を、interval にはそれより短い時間を指定してください。
+//
+// マッピングの有効性は RESPONSE-PORT による主アドレスからの受信で確認し、非対応サーバーでは
+// 再度の Binding Request で得たマッピングが変わっていないかで確認します
+// （ポートを保存する NAT では失効を見逃すことがあります）。
+func CheckRefreshDirection(serverAddr string, holdTime, interval time.Duration, opts ...Option) (*CheckRefreshDirectionResult, error) {
+	if interval <= 0 || holdTime < interval {
+		return nil, fmt.Errorf("invalid refresh interval %s for hold time %s", interval, holdTime)
+	}
+
+	cfg := newConfig(opts)
+	servers, err := cfg.resolveServers(serverAddr)
+	if err != nil {
+		return nil, fmt.Errorf("サーバーアドレス解決エラー: %w", err)
+	}
+
+	// control: 対照、outbound: 外向きで更新、inbound: 内向きで更新、
+	// helper: inbound 宛の CHANGE-REQUEST / RESPONSE-PORT 付きリクエストを送るためのソケット
+	names := []string{"control", "outbound", "inbound", "helper"}
+	clients := make([]*STUNClient, 0, len(names))
+	mappings := make([]*net.UDPAddr, 0, len(names))
+	var other *net.UDPAddr
+	defer func() {
+		for _, client := range clients {
+			client.Close()
+		}
+	}()
+	for _, name := range names {
+		client, err := NewSTUNClient(opts...)
+		if err != nil {
+			return nil, fmt.Errorf("STUNクライアント作成エラー: %w", err)
+		}
+		clients = append(clients, client)
+
+		server, result, err := client.bindFirstResponsive(servers)
+		if err != nil {
+			return nil, fmt.Errorf("%s ソケットの Binding 失敗: %w", name, err)
+		}
+		servers = []*net.UDPAddr{server}
+		mappings = append(mappings, result.MappedAddress)
+		if name == "inbound" {
+			other = client.detectNAT64(server, result.MappedAddress).synthesize(result.OtherAddress)
+		}
+	}
+	server := servers[0]
+	control, outbound, inbound, helper := clients[0], clients[1], clients[2], clients[3]
+
+	result := &CheckRefreshDirectionResult{HoldTime: holdTime, Interval: interval}
+
+	// 代替アドレスから inbound のマッピングに応答を届けられるか確認し、
+	// 届かなければ RESPONSE-PORT だけで主アドレスから届けられるか確認する。
+	// どちらも拒否するサーバーはエラーにせず非対応として扱い、内向きを Unknown にする
+	result.InboundStimulus, result.SupportsResponsePort, err = selectInboundStimulus(helper, inbound, server, other, mappings[2].Port)
+	if err != nil {
+		return nil, fmt.Errorf("内向きの通信方法の確認に失敗: %w", err)
+	}
+
+	// 外向きの更新は内向きの刺激の待ち時間に影響されないよう、別の goroutine で送る。
+	// 外向き更新マッピングの確認が終わるまで送り続ける
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	stopOutbound := sync.OnceFunc(func() {
+		close(stop)
+		wg.Wait()
+	})
+	defer stopOutbound()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				outbound.SendBindingIndication(server)
+			}
+		}
+	}()
+
+	deadline := time.Now().Add(holdTime)
+	for time.Now().Before(deadline) {
+		time.Sleep(min(interval, time.Until(deadline)))
+		if result.InboundStimulus == InboundStimulusNone || !time.Now().Before(deadline) {
+			continue
+		}
+		changeRequest := result.InboundStimulus == InboundStimulusChangeRequest
+		received, err := stimulateMapping(helper, inbound, server, mappings[2].Port, changeRequest)
+		if errors.Is(err, errResponsePortUnsupported) || errors.Is(err, errChangeRequestUnsupported) {
+			// 途中で拒否された場合も内向きは判定できない
+			result.InboundStimulus = InboundStimulusNone
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("内向きの更新に失敗: %w", err)
+		}
+		if received {
+			result.InboundPackets++
+		}
+	}
+
+	// 保持時間の後、各マッピングが有効かを確認する。失効したマッピングの確認は
+	// 再送を待ち切るため時間がかかるので、更新していたマッピングを先に確認し、
+	// 失効しても結果の変わらない対照を最後に確認する。
+	// 確認はどのマッピングも通信したことのある主アドレスからの受信で行う
+	alive := func(client *STUNClient, mapping *net.UDPAddr) (bool, error) {
+		if result.SupportsResponsePort {
+			received, err := stimulateMapping(helper, client, server, mapping.Port, false)
+			if !errors.Is(err, errResponsePortUnsupported) {
+				return received, err
+			}
+			result.SupportsResponsePort = false
+		}
+		current, err := client.SendBindingRequestTo(server, false, false)
+		if err != nil {
+			return false, err
+		}
+		return udpAddrEqual(current.MappedAddress, mapping), nil
+	}
+	inboundAlive, err := alive(inbound, mappings[2])
+	if err != nil {
+		return nil, fmt.Errorf("内向き更新マッピングの確認に失敗: %w", err)
+	}
+	outboundAlive, err := alive(outbound, mappings[1])
+	if err != nil {
+		return nil, fmt.Errorf("外向き更新マッピングの確認に失敗: %w", err)
+	}
+	stopOutbound()
+	controlAlive, err := alive(control, mappings[0])
+	if err != nil {
+		return nil, fmt.Errorf("対照マッピングの確認に失敗: %w", err)
+	}
+
+	result.ControlExpired = !controlAlive
+	result.OutboundRefresh, result.InboundRefresh = determineRefreshDirection(
+		controlAlive, outboundAlive, inboundAlive, result.InboundStimulus != InboundStimulusNone)
+	return result, nil
+}
+
+// selectInboundStimulus は receiver の外部ポート port のマッピングに、サーバーからの
+// 通信だけを届ける方法を選びます。CHANGE-REQUEST で代替アドレス other から届けば
+// InboundStimulusChangeRequest を、届かなければ RESPONSE-PORT だけで主アドレスから
+// 届くか確認して InboundStimulusResponsePort を返す。supportsResponsePort は
+// サーバーが RESPONSE-PORT に応じたかどうか
+func selectInboundStimulus(sender, receiver *STUNClient, server, other *net.UDPAddr, port int) (stimulus InboundStimulus, supportsResponsePort bool, err error) {
+	if other != nil && !other.IP.Equal(server.IP) && other.Port != server.Port {
+		// アドレスやポートに依存するフィルタリングで代替アドレスからの通信が遮断されないよう、
+		// 保持を始める前に receiver から代替アドレスへ 1 度だけ送る。応答は待たない
+		if err := receiver.SendBindingIndication(other); err != nil {
+			return InboundStimulusNone, false, err
+		}
+		received, err := stimulateMapping(sender, receiver, server, port, true)
+		switch {
+		case err == nil && received:
+			return InboundStimulusChangeRequest, true, nil
+		case err != nil && !errors.Is(err, errResponsePortUnsupported) && !errors.Is(err, errChangeRequestUnsupported):
+			return InboundStimulusNone, false, err
+		}
+	}
+
+	// 応答がどこにも届かなかった場合も RESPONSE-PORT を使い、保持中の刺激で数え直す
+	_, err = stimulateMapping(sender, receiver, server, port, false)
+	switch {
+	case errors.Is(err, errResponsePortUnsupported):
+		return InboundStimulusNone, false, nil
+	case err != nil:
+		return InboundStimulusNone, false, err
+	}
+	return InboundStimulusResponsePort, true, nil
+}
+
+// determineRefreshDirection は保持時間後の各マッピングの状態から、
+// 外向き・内向きそれぞれの更新の有無を判定します
+func determineRefreshDirection(controlAlive, outboundAlive, inboundAlive, inboundTested bool) (outbound, inbound RefreshBehavior) {
+	// 対照が生きていれば、保持時間内にタイムアウトしていないので何も言えない
+	if controlAlive {
+		return RefreshUnknown, RefreshUnknown
+	}
+
+	outbound = RefreshFalse
+	if outboundAlive {
+		outbound = RefreshTrue
+	}
+
+	inbound = RefreshUnknown
+	if inboundTested {
+		inbound = RefreshFalse
+		if inboundAlive {
+			inbound = RefreshTrue
+		}
+	}
+	return outbound, inbound
+}
+
+// errResponsePortUnsupported はサーバーが RESPONSE-PORT を受け付けなかったことを示す
+var errResponsePortUnsupported = errors.New("サーバーが RESPONSE-PORT に対応していません")
+
+// errChangeRequestUnsupported はサーバーが CHANGE-REQUEST に従わず、
+// 主アドレスから応答したことを示す
+var errChangeRequestUnsupported = errors.New("サーバーが CHANGE-REQUEST に対応していません")
+
+// stimulateMapping は sender から RESPONSE-PORT 付きの Binding Request を送り、
+// サーバーの応答が外部ポート port のマッピングを持つ receiver に届くかを返します。
+// receiver 自身は送信しないため、receiver のマッピングには内向きの通信だけが発生する
+//
+// changeRequest が true なら CHANGE-REQUEST で IP とポートの変更も要求し、応答を
+// サーバーの代替アドレスから送らせる。主アドレスから届いた場合は CHANGE-REQUEST に
+// 従わなかったとみなし errChangeRequestUnsupported を返す。
+//
+// RESPONSE-PORT を理解しないサーバーはエラーレスポンス (420 Unknown Attribute) を、
+// 無視するサーバーは通常の応答を、いずれもリクエストの送信元である sender に返します。
+// receiver からはタイムアウトにしか見えないため、receiver がタイムアウトしたら sender
+// 側も確認し、応答が sender に届いていた場合は errResponsePortUnsupported を返します
+func stimulateMapping(sender, receiver *STUNClient, server *net.UDPAddr, port int, changeRequest bool) (bool, error) {
+	rto, transmitCount := sender.cfg.retransmission()
+	for attempt := 0; attempt < transmitCount; attempt++ {
+		txID, err := sender.sendBindingRequestWithResponsePort(server, port, changeRequest, changeRequest)
+		if err != nil {
+			return false, err
+		}
+
+		response, err := receiver.awaitBindingResponse(txID, rto)
+		if err == nil {
+			if changeRequest && response.ResponseFrom != nil && response.ResponseFrom.IP.Equal(server.IP) {
+				return false, errChangeRequestUnsupported
+			}
+			return true, nil
+		}
+		if !isTimeoutError(err) {
+			return false, err
+		}
+
+		// sender 宛の応答は receiver の待ち受け中に届いているはずなので、短く確認する
+		var stunErr *STUNError
+		_, err = sender.awaitBindingResponse(txID, rto/4)
+		switch {
+		case err == nil, errors.As(err, &stunErr):
+			return false, errResponsePortUnsupported
+		case !isTimeoutError(err):
+			return false, err
+		}
+		rto *= 2
+	}
+	return false, nil
+}
@@ -0,0 +1,235 @@
+package natchecker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefreshBehaviorString(t *testing.T) {
+	tests := []struct {
+		behavior RefreshBehavior
+		expected string
+	}{
+		{RefreshTrue, "True"},
+		{RefreshFalse, "False"},
+		{RefreshUnknown, "Unknown"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, test.behavior.String(), "RefreshBehavior(%d).String()", test.behavior)
+	}
+}
+
+func TestInboundStimulusString(t *testing.T) {
+	assert.Equal(t, "None", InboundStimulusNone.String())
+	assert.Equal(t, "CHANGE-REQUEST", InboundStimulusChangeRequest.String())
+	assert.Equal(t, "RESPONSE-PORT", InboundStimulusResponsePort.String())
+}
+
+func TestDetermineRefreshDirection(t *testing.T) {
+	tests := []struct {
+		name          string
+		controlAlive  bool
+		outboundAlive bool
+		inboundAlive  bool
+		inboundTested bool
+		outbound      RefreshBehavior
+		inbound       RefreshBehavior
+	}{
+		{
+			name:          "hold time shorter than the NAT timeout",
+			controlAlive:  true,
+			outboundAlive: true,
+			inboundAlive:  true,
+			inboundTested: true,
+			outbound:      RefreshUnknown,
+			inbound:       RefreshUnknown,
+		},
+		{
+			name:          "outbound refresh only (RFC 4787 REQ-6)",
+			outboundAlive: true,
+			inboundTested: true,
+			outbound:      RefreshTrue,
+			inbound:       RefreshFalse,
+		},
+		{
+			name:          "both directions refresh",
+			outboundAlive: true,
+			inboundAlive:  true,
+			inboundTested: true,
+			outbound:      RefreshTrue,
+			inbound:       RefreshTrue,
+		},
+		{
+			name:          "inbound refresh only",
+			inboundAlive:  true,
+			inboundTested: true,
+			outbound:      RefreshFalse,
+			inbound:       RefreshTrue,
+		},
+		{
+			name:          "server without RESPONSE-PORT",
+			outboundAlive: true,
+			outbound:      RefreshTrue,
+			inbound:       RefreshUnknown,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			outbound, inbound := determineRefreshDirection(test.controlAlive, test.outboundAlive, test.inboundAlive, test.inboundTested)
+			assert.Equal(t, test.outbound, outbound, "outbound")
+			assert.Equal(t, test.inbound, inbound, "inbound")
+		})
+	}
+}
+
+func TestCheckRefreshDirectionLoopback(t *testing.T) {
+	for _, honorResponsePort := range []bool{true, false} {
+		server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		require.NoError(t, err)
+		defer server.Close()
+		go serveMappedAddress(server, honorResponsePort)
+
+		result, err := CheckRefreshDirection(server.LocalAddr().String(), 100*time.Millisecond, 30*time.Millisecond,
+			WithAddressFamily(IPv4Only), WithRetransmission(20*time.Millisecond, 2))
+		require.NoError(t, err)
+
+		// NAT が無いので対照のマッピングも失効せず、判定できない
+		assert.Equal(t, honorResponsePort, result.SupportsResponsePort)
+		// OTHER-ADDRESS を返さないサーバーなので CHANGE-REQUEST は使えない
+		if honorResponsePort {
+			assert.Equal(t, InboundStimulusResponsePort, result.InboundStimulus)
+		} else {
+			assert.Equal(t, InboundStimulusNone, result.InboundStimulus)
+		}
+		assert.False(t, result.ControlExpired)
+		assert.Equal(t, RefreshUnknown, result.OutboundRefresh)
+		assert.Equal(t, RefreshUnknown, result.InboundRefresh)
+		if honorResponsePort {
+			assert.Positive(t, result.InboundPackets)
+		}
+	}
+
+	_, err := CheckRefreshDirection("127.0.0.1:3478", time.Second, 0)
+	assert.Error(t, err, "zero interval should be rejected")
+}
+
+// serveRejectResponsePort は RESPONSE-PORT 付きのリクエストに送信元へ 420 を返し、
+// それ以外には XOR-MAPPED-ADDRESS で応答します
+func serveRejectResponsePort(t *MemoryTransport) {
+	buffer := make([]byte, 1500)
+	for {
+		n, from, err := t.Receive(buffer, time.Time{})
+		if err != nil {
+			return
+		}
+		request, err := DecodeMessage(buffer[:n])
+		if err != nil || request.MessageType != BindingRequest {
+			continue
+		}
+		response := STUNMessage{
+			MessageType:   BindingResponse,
+			TransactionID: request.TransactionID,
+			Attributes:    []STUNAttribute{NewAddressAttribute(XorMappedAddress, from, request.TransactionID)},
+		}
+		for _, attr := range request.Attributes {
+			if attr.Type == ResponsePort {
+				response.MessageType = BindingErrorResponse
+				response.Attributes = []STUNAttribute{NewErrorCodeAttribute(420, "Unknown Attribute")}
+			}
+		}
+		t.Send(EncodeMessage(response), from)
+	}
+}
+
+func TestStimulateMappingRejected(t *testing.T) {
+	network := NewMemoryNetwork()
+	server, err := network.Listen(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 3478})
+	require.NoError(t, err)
+	defer server.Close()
+	go serveRejectResponsePort(server)
+
+	opts := []Option{WithTransport(network.Factory(net.ParseIP("198.51.100.1"))), WithRetransmission(20*time.Millisecond, 2)}
+	sender, err := NewSTUNClient(opts...)
+	require.NoError(t, err)
+	defer sender.Close()
+	receiver, err := NewSTUNClient(opts...)
+	require.NoError(t, err)
+	defer receiver.Close()
+	mapped, err := receiver.SendBindingRequestTo(server.Addr(), false, false)
+	require.NoError(t, err)
+
+	// 420 は sender に届くため、受信側のタイムアウトではなく非対応として報告される
+	received, err := stimulateMapping(sender, receiver, server.Addr(), mapped.MappedAddress.Port, false)
+	assert.False(t, received)
+	assert.ErrorIs(t, err, errResponsePortUnsupported)
+
+	result, err := CheckRefreshDirection(server.Addr().String(), 60*time.Millisecond, 20*time.Millisecond, opts...)
+	require.NoError(t, err)
+	assert.False(t, result.SupportsResponsePort)
+	assert.Equal(t, InboundStimulusNone, result.InboundStimulus)
+	assert.Equal(t, RefreshUnknown, result.InboundRefresh)
+}
+
+// serveIgnoreChangeRequest は OTHER-ADDRESS に other を返して RESPONSE-PORT には従うが、
+// CHANGE-REQUEST を無視して常に自身のアドレスから応答します
+func serveIgnoreChangeRequest(t *MemoryTransport, other *net.UDPAddr) {
+	buffer := make([]byte, 1500)
+	for {
+		n, from, err := t.Receive(buffer, time.Time{})
+		if err != nil {
+			return
+		}
+		request, err := DecodeMessage(buffer[:n])
+		if err != nil || request.MessageType != BindingRequest {
+			continue
+		}
+		to := from
+		if attr, ok := request.Attribute(ResponsePort); ok && len(attr.Value) >= 2 {
+			to = &net.UDPAddr{IP: from.IP, Port: int(attr.Value[0])<<8 | int(attr.Value[1])}
+		}
+		t.Send(EncodeMessage(STUNMessage{
+			MessageType:   BindingResponse,
+			TransactionID: request.TransactionID,
+			Attributes: []STUNAttribute{
+				NewAddressAttribute(XorMappedAddress, from, request.TransactionID),
+				NewAddressAttribute(OtherAddress, other, request.TransactionID),
+			},
+		}), to)
+	}
+}
+
+func TestSelectInboundStimulusFallback(t *testing.T) {
+	network := NewMemoryNetwork()
+	server, err := network.Listen(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 3478})
+	require.NoError(t, err)
+	defer server.Close()
+	other := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 3479}
+	go serveIgnoreChangeRequest(server, other)
+
+	opts := []Option{WithTransport(network.Factory(net.ParseIP("198.51.100.1"))), WithRetransmission(20*time.Millisecond, 2)}
+	sender, err := NewSTUNClient(opts...)
+	require.NoError(t, err)
+	defer sender.Close()
+	receiver, err := NewSTUNClient(opts...)
+	require.NoError(t, err)
+	defer receiver.Close()
+	mapped, err := receiver.SendBindingRequestTo(server.Addr(), false, false)
+	require.NoError(t, err)
+	port := mapped.MappedAddress.Port
+
+	// 主アドレスから届いた応答は CHANGE-REQUEST に従っていない
+	received, err := stimulateMapping(sender, receiver, server.Addr(), port, true)
+	assert.False(t, received)
+	assert.ErrorIs(t, err, errChangeRequestUnsupported)
+
+	stimulus, supportsResponsePort, err := selectInboundStimulus(sender, receiver, server.Addr(), other, port)
+	require.NoError(t, err)
+	assert.Equal(t, InboundStimulusResponsePort, stimulus)
+	assert.True(t, supportsResponsePort)
+}
@@ -0,0 +1,421 @@
+package natchecker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Resolver は STUN サーバーの探索に使う DNS リゾルバーです。
+//
+// *net.Resolver はこのインターフェースを満たします。テストではローカルな
+// DNS の代替実装を WithResolver で差し込めます。
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// WithResolver は STUN サーバーの SRV 探索と A/AAAA 解決に使うリゾルバーを指定します。
+// 指定しない場合は net.DefaultResolver が使われます。
+func WithResolver(r Resolver) Option {
+	return func(c *config) {
+		c.resolver = r
+	}
+}
+
+// defaultResolveTimeout は 1 回のサーバー探索 (SRV + A/AAAA) に掛ける時間の上限
+const defaultResolveTimeout = 10 * time.Second
+
+// ServerCandidate は探索で得られた STUN サーバー候補
+type ServerCandidate struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	// FromSRV は DNS SRV レコードから得られた候補の場合に true
+	FromSRV bool `json:"from_srv"`
+	// Transport は候補に接続するトランスポート ("udp" または "tcp")
+	Transport string `json:"transport"`
+	// Secure は TLS/DTLS で接続する候補 (stuns/turns) の場合に true
+	Secure bool `json:"secure,omitempty"`
+}
+
+// String は "host:port" 形式の文字列を返します
+func (c ServerCandidate) String() string {
+	return net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+}
+
+// parseServerSpec は "host"、"host:port"、STUN URI のいずれかを ServerURI に変換します。
+// URI でない形式は "stun" スキーム・UDP として扱う。
+func parseServerSpec(serverAddr string) (*ServerURI, error) {
+	if isServerURI(serverAddr) {
+		return ParseServerURI(serverAddr)
+	}
+
+	u := &ServerURI{Scheme: SchemeSTUN, Transport: TransportUDP, Host: serverAddr}
+	if host, portStr, err := net.SplitHostPort(serverAddr); err == nil {
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %q in %q", portStr, serverAddr)
+		}
+		u.Host, u.Port = host, port
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host in %q", serverAddr)
+	}
+	return u, nil
+}
+
+// DiscoverServers は serverAddr から接続先の STUN サーバー候補を優先順に返します。
+//
+// RFC 8489 Section 8.1: "When a client wishes to locate a STUN server on the
+// public Internet that accepts Binding request/response transactions, the SRV
+// service name is "stun"." — ポートを明示しないドメイン名が指定された場合は
+// SRV レコード (_stun._udp 等) を引き、priority と weight に従って並べる
+// (RFC 2782)。SRV レコードが無い場合は A/AAAA 解決用にドメイン名と既定ポートを返す。
+//
+// ポートが明示されている場合や IP リテラルの場合は SRV を引かずにそのまま返す。
+// r が nil の場合は net.DefaultResolver を使う。
+func DiscoverServers(ctx context.Context, r Resolver, serverAddr string) ([]ServerCandidate, error) {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+
+	u, err := parseServerSpec(serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	fallback := ServerCandidate{Host: u.Host, Port: u.Port, Transport: u.Transport, Secure: u.Secure()}
+	if fallback.Port == 0 {
+		_, portStr, _ := net.SplitHostPort(u.HostPort())
+		fallback.Port, _ = strconv.Atoi(portStr)
+	}
+
+	if u.Port != 0 || net.ParseIP(u.Host) != nil {
+		return []ServerCandidate{fallback}, nil
+	}
+
+	// SRV のサービス名とプロトコル名はスキームとトランスポートから決まる
+	//   RFC 8489 Section 8.1: "_stun._udp" / "_stun._tcp" / "_stuns._tcp"
+	//   RFC 7350 Section 4.2: DTLS 上の STUN は "_stuns._udp"
+	//   RFC 8656 Section 3.1: TURN は "_turn._udp" / "_turn._tcp" / "_turns._tcp"
+	service, proto := u.Scheme, u.Transport
+	_, records, err := r.LookupSRV(ctx, service, proto, u.Host)
+	if err != nil {
+		// SRV の不在（NXDOMAIN 等）は A/AAAA へのフォールバック対象。
+		// コンテキストの期限切れはそれ以上問い合わせても無駄なのでそのまま返す
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return []ServerCandidate{fallback}, nil
+	}
+	if len(records) == 0 {
+		return []ServerCandidate{fallback}, nil
+	}
+
+	// RFC 2782: "A Target of "." means that the service is decidedly not
+	// available at this domain."
+	if len(records) == 1 && (records[0].Target == "." || records[0].Target == "") {
+		return nil, fmt.Errorf("service _%s._%s.%s is not available", service, proto, u.Host)
+	}
+
+	ordered := orderSRV(records, rand.IntN)
+	candidates := make([]ServerCandidate, 0, len(ordered))
+	for _, srv := range ordered {
+		target := srv.Target
+		if n := len(target); n > 0 && target[n-1] == '.' {
+			target = target[:n-1]
+		}
+		candidates = append(candidates, ServerCandidate{
+			Host: target, Port: int(srv.Port), FromSRV: true, Transport: u.Transport, Secure: u.Secure(),
+		})
+	}
+	return candidates, nil
+}
+
+// orderSRV は RFC 2782 の規則で SRV レコードを並べ替えた新しいスライスを返します。
+//
+// priority の小さい順に並べ、同じ priority の中では weight に比例した確率で
+// 先頭を選ぶ重み付きランダム選択を繰り返す。intn は [0, n) の乱数を返す関数。
+// *net.Resolver は既にこの順序で返すが、差し替えられたリゾルバーは順序を
+// 保証しないため、ここで必ず並べ直す。
+func orderSRV(records []*net.SRV, intn func(int) int) []*net.SRV {
+	sorted := make([]*net.SRV, len(records))
+	copy(sorted, records)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority < sorted[j].Priority
+	})
+
+	ordered := make([]*net.SRV, 0, len(sorted))
+	for start := 0; start < len(sorted); {
+		end := start
+		for end < len(sorted) && sorted[end].Priority == sorted[start].Priority {
+			end++
+		}
+
+		// RFC 2782: weight 0 のレコードは先頭に置き、選ばれる機会を残す
+		group := make([]*net.SRV, 0, end-start)
+		for _, srv := range sorted[start:end] {
+			if srv.Weight == 0 {
+				group = append(group, srv)
+			}
+		}
+		for _, srv := range sorted[start:end] {
+			if srv.Weight != 0 {
+				group = append(group, srv)
+			}
+		}
+
+		for len(group) > 0 {
+			total := 0
+			for _, srv := range group {
+				total += int(srv.Weight)
+			}
+			pick := 0
+			if total > 0 {
+				n := intn(total + 1)
+				running := 0
+				for i, srv := range group {
+					running += int(srv.Weight)
+					if running >= n {
+						pick = i
+						break
+					}
+				}
+			}
+			ordered = append(ordered, group[pick])
+			group = append(group[:pick], group[pick+1:]...)
+		}
+
+		start = end
+	}
+	return ordered
+}
+
+// AddressFamily はサーバーアドレスの選択に使うアドレスファミリーの優先順位
+type AddressFamily int
+
+const (
+	// PreferIPv4 は IPv4 と IPv6 のアドレスを交互に並べ、IPv4 から試します（既定）
+	PreferIPv4 AddressFamily = iota
+	// PreferIPv6 は IPv4 と IPv6 のアドレスを交互に並べ、IPv6 から試します (RFC 8305)
+	PreferIPv6
+	// IPv4Only は IPv4 アドレスのみを使い、ソケットも IPv4 (udp4) に限定します
+	IPv4Only
+	// IPv6Only は IPv6 アドレスのみを使い、ソケットも IPv6 (udp6) に限定します
+	IPv6Only
+)
+
+func (f AddressFamily) String() string {
+	switch f {
+	case PreferIPv4:
+		return "Prefer IPv4"
+	case PreferIPv6:
+		return "Prefer IPv6"
+	case IPv4Only:
+		return "IPv4 Only"
+	case IPv6Only:
+		return "IPv6 Only"
+	default:
+		return "Unknown"
+	}
+}
+
+// network は f に対応する net パッケージのネットワーク名を返します
+func (f AddressFamily) network() string {
+	switch f {
+	case IPv4Only:
+		return "udp4"
+	case IPv6Only:
+		return "udp6"
+	default:
+		return "udp"
+	}
+}
+
+// WithAddressFamily はサーバーの解決結果に複数のアドレスがある場合の
+// アドレスファミリーの優先順位を指定します。
+//
+// 既定の PreferIPv4 は従来の net.ResolveUDPAddr と同じく IPv4 を優先しつつ、
+// 応答が無ければ IPv6 のアドレスにもフェイルオーバーします。
+func WithAddressFamily(f AddressFamily) Option {
+	return func(c *config) {
+		c.family = f
+	}
+}
+
+// orderByFamily は addrs をアドレスファミリーで振り分け、優先するファミリーから
+// 交互に並べた新しいスライスを返します。
+//
+// RFC 8305 Section 4: "the client SHOULD ... interleave address families"
+// 一方のファミリーが全滅していても、もう一方を早い段階で試せるようにする。
+// 同じファミリー内の順序 (SRV の優先順位など) は保たれる。
+func orderByFamily(addrs []*net.UDPAddr, f AddressFamily) []*net.UDPAddr {
+	var v4, v6 []*net.UDPAddr
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+
+	switch f {
+	case IPv4Only:
+		return v4
+	case IPv6Only:
+		return v6
+	}
+
+	first, second := v4, v6
+	if f == PreferIPv6 {
+		first, second = v6, v4
+	}
+	ordered := make([]*net.UDPAddr, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+	return ordered
+}
+
+// resolveServers は serverAddr を 1 度だけ探索・解決し、送信先の候補を
+// 試す順に返します。
+//
+// SRV で得た各ターゲットの A/AAAA レコードをすべて集め、重複を除いた上で
+// WithAddressFamily の指定に従って並べる。
+//
+// このライブラリは UDP 上の STUN のみを実装しているため、TLS/DTLS や TCP の候補
+// (stuns: や transport=tcp) は除き、UDP の候補が残らなければエラーにする。
+func (c config) resolveServers(serverAddr string) ([]*net.UDPAddr, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultResolveTimeout)
+	defer cancel()
+
+	candidates, err := DiscoverServers(ctx, c.resolver, serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	candidates = udpCandidates(candidates)
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("unsupported transport for %q: only plain UDP is supported", serverAddr)
+	}
+
+	var addrs []*net.UDPAddr
+	var errs []error
+	seen := make(map[string]bool)
+	for _, candidate := range candidates {
+		ips, err := lookupIP(ctx, c.resolver, candidate.Host)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, ip := range ips {
+			addr := &net.UDPAddr{IP: ip, Port: candidate.Port}
+			if seen[addr.String()] {
+				continue
+			}
+			seen[addr.String()] = true
+			addrs = append(addrs, addr)
+		}
+	}
+
+	ordered := orderByFamily(addrs, c.family)
+	if len(ordered) == 0 {
+		if len(errs) > 0 {
+			return nil, errors.Join(errs...)
+		}
+		return nil, fmt.Errorf("no %s address found for %s", c.family, serverAddr)
+	}
+	return ordered, nil
+}
+
+// resolveServer は serverAddr を探索・解決し、最も優先度の高い送信先を返します。
+func (c *STUNClient) resolveServer(serverAddr string) (*net.UDPAddr, error) {
+	addrs, err := c.cfg.resolveServers(serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	return addrs[0], nil
+}
+
+// failoverTransmitCount はフェイルオーバー中に最後以外の候補アドレスへ送る最大の送信回数。
+// 既定の再送パラメータでは応答の無いアドレス 1 つあたりの待ち時間が
+// 7.5 秒 (500ms + 1s + 2s + 4s) から 1.5 秒 (500ms + 1s) に縮まる
+const failoverTransmitCount = 2
+
+// bindFirstResponsive は servers を順に試し、最初に Binding Response を返した
+// サーバーのアドレスとその結果を返します。
+//
+// 応答が無い（タイムアウト）などで失敗したアドレスは飛ばして次を試す。
+// 応答の無いアドレスごとに再送を待ち切ると候補が多いほど長く待つため、最後以外の
+// 候補は送信回数を failoverTransmitCount に抑え、最後の候補だけ設定どおりに再送する。
+// すべてのアドレスがタイムアウトした場合はタイムアウトのエラーをそのまま返すため、
+// 呼び出し側は isTimeoutError で「どこからも応答が無い」ことを判別できる。
+func (c *STUNClient) bindFirstResponsive(servers []*net.UDPAddr) (*net.UDPAddr, *BindingResult, error) {
+	var errs []error
+	allTimeouts := true
+	_, transmitCount := c.cfg.retransmission()
+	for i, server := range servers {
+		count := transmitCount
+		if i < len(servers)-1 {
+			count = min(count, failoverTransmitCount)
+		}
+		result, err := c.sendBindingRequest(server, false, false, count)
+		if err == nil {
+			return server, result, nil
+		}
+		if !isTimeoutError(err) {
+			allTimeouts = false
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", server, err))
+	}
+
+	if len(errs) == 0 {
+		return nil, nil, fmt.Errorf("no server address to try")
+	}
+	if allTimeouts {
+		return nil, nil, errs[len(errs)-1]
+	}
+	return nil, nil, errors.Join(errs...)
+}
+
+// udpCandidates は candidates のうち、TLS/DTLS を使わない UDP の候補を返します
+func udpCandidates(candidates []ServerCandidate) []ServerCandidate {
+	udp := make([]ServerCandidate, 0, len(candidates))
+	for _, candidate := range candidates {
+		if candidate.Transport == TransportUDP && !candidate.Secure {
+			udp = append(udp, candidate)
+		}
+	}
+	return udp
+}
+
+// lookupIP は host の IP アドレスを返します。IP リテラルは問い合わせずにそのまま返す
+func lookupIP(ctx context.Context, r Resolver, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if r == nil {
+		r = net.DefaultResolver
+	}
+
+	addrs, err := r.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
@@ -0,0 +1,318 @@
+package natchecker
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeResolver はテスト用のローカル DNS の代替実装
+type fakeResolver struct {
+	srv     map[string][]*net.SRV   // "_service._proto.name" → レコード
+	ips     map[string][]net.IPAddr // ホスト名 → アドレス
+	queries []string
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	key := fmt.Sprintf("_%s._%s.%s", service, proto, name)
+	r.queries = append(r.queries, key)
+	records, ok := r.srv[key]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: key, IsNotFound: true}
+	}
+	return key, records, nil
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.queries = append(r.queries, host)
+	addrs, ok := r.ips[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func ipAddrs(ips ...string) []net.IPAddr {
+	addrs := make([]net.IPAddr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs
+}
+
+func TestDiscoverServersSRV(t *testing.T) {
+	r := &fakeResolver{srv: map[string][]*net.SRV{
+		"_stun._udp.example.com": {
+			{Target: "backup.example.com.", Port: 3479, Priority: 20, Weight: 0},
+			{Target: "primary.example.com.", Port: 3478, Priority: 10, Weight: 100},
+		},
+		"_stun._tcp.example.com": {
+			{Target: "tcp.example.com.", Port: 3478, Priority: 10, Weight: 0},
+		},
+		"_stuns._tcp.example.com": {
+			{Target: "tls-backup.example.com.", Port: 5350, Priority: 20, Weight: 0},
+			{Target: "tls.example.com.", Port: 5349, Priority: 10, Weight: 0},
+		},
+	}}
+
+	candidates, err := DiscoverServers(context.Background(), r, "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []ServerCandidate{
+		{Host: "primary.example.com", Port: 3478, FromSRV: true, Transport: "udp"},
+		{Host: "backup.example.com", Port: 3479, FromSRV: true, Transport: "udp"},
+	}, candidates)
+
+	// stun: URI でポートを省略した場合も SRV を引く
+	candidates, err = DiscoverServers(context.Background(), r, "stun:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "primary.example.com:3478", candidates[0].String())
+
+	// stuns: は _stuns._tcp を priority の順に引く
+	candidates, err = DiscoverServers(context.Background(), r, "stuns:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []ServerCandidate{
+		{Host: "tls.example.com", Port: 5349, FromSRV: true, Transport: "tcp", Secure: true},
+		{Host: "tls-backup.example.com", Port: 5350, FromSRV: true, Transport: "tcp", Secure: true},
+	}, candidates)
+
+	// transport=tcp は _stun._tcp を引く
+	candidates, err = DiscoverServers(context.Background(), r, "stun:example.com?transport=tcp")
+	require.NoError(t, err)
+	assert.Equal(t, []ServerCandidate{{Host: "tcp.example.com", Port: 3478, FromSRV: true, Transport: "tcp"}}, candidates)
+}
+
+func TestResolveServersUDPOnly(t *testing.T) {
+	r := &fakeResolver{
+		srv: map[string][]*net.SRV{
+			"_stuns._tcp.example.com": {{Target: "tls.example.com.", Port: 5349}},
+		},
+		ips: map[string][]net.IPAddr{
+			"tls.example.com": ipAddrs("192.0.2.1"),
+			"example.com":     ipAddrs("192.0.2.2"),
+		},
+	}
+	cfg := newConfig([]Option{WithResolver(r)})
+
+	// UDP 以外の候補は探索できても除かれ、接続先が残らなければエラーになる
+	for _, input := range []string{"stuns:example.com", "stun:example.com?transport=tcp", "turns:example.com:443"} {
+		_, err := cfg.resolveServers(input)
+		require.Error(t, err, input)
+		assert.Contains(t, err.Error(), "only plain UDP", input)
+	}
+
+	addrs, err := cfg.resolveServers("stun:example.com?transport=udp")
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.2:3478", addrs[0].String())
+}
+
+func TestDiscoverServersFallback(t *testing.T) {
+	r := &fakeResolver{}
+
+	// SRV レコードが無ければドメイン名と既定ポートで A/AAAA にフォールバック
+	candidates, err := DiscoverServers(context.Background(), r, "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []ServerCandidate{{Host: "example.com", Port: 3478, Transport: "udp"}}, candidates)
+	assert.Equal(t, []string{"_stun._udp.example.com"}, r.queries)
+
+	// ポート指定や IP リテラルの場合は SRV を引かない
+	r.queries = nil
+	for _, input := range []string{"example.com:3479", "192.0.2.1", "[2001:db8::1]:3478", "stun:example.com:3478"} {
+		_, err := DiscoverServers(context.Background(), r, input)
+		require.NoError(t, err, input)
+	}
+	assert.Empty(t, r.queries)
+}
+
+func TestDiscoverServersServiceNotAvailable(t *testing.T) {
+	r := &fakeResolver{srv: map[string][]*net.SRV{
+		"_stun._udp.example.com": {{Target: ".", Port: 0}},
+	}}
+
+	_, err := DiscoverServers(context.Background(), r, "example.com")
+	assert.Error(t, err, `a single "." target means the service is not available`)
+}
+
+func TestOrderSRV(t *testing.T) {
+	records := []*net.SRV{
+		{Target: "c", Priority: 20, Weight: 10},
+		{Target: "a", Priority: 10, Weight: 10},
+		{Target: "b", Priority: 10, Weight: 90},
+		{Target: "zero", Priority: 10, Weight: 0},
+	}
+
+	targets := func(srvs []*net.SRV) []string {
+		var names []string
+		for _, srv := range srvs {
+			names = append(names, srv.Target)
+		}
+		return names
+	}
+
+	// 乱数が 0 なら、weight 0 のレコードが先頭に選ばれる
+	assert.Equal(t, []string{"zero", "a", "b", "c"}, targets(orderSRV(records, func(int) int { return 0 })))
+
+	// 乱数が最大なら、同じ priority の最後のレコードが選ばれる
+	assert.Equal(t, []string{"b", "a", "zero", "c"}, targets(orderSRV(records, func(n int) int { return n - 1 })))
+
+	// 元のスライスは変更しない
+	assert.Equal(t, "c", records[0].Target)
+}
+
+func TestResolveServerWithResolver(t *testing.T) {
+	r := &fakeResolver{
+		srv: map[string][]*net.SRV{
+			"_stun._udp.example.com": {{Target: "stun1.example.com.", Port: 3479, Priority: 10, Weight: 0}},
+		},
+		ips: map[string][]net.IPAddr{
+			"stun1.example.com": ipAddrs("192.0.2.10"),
+			"plain.example.com": ipAddrs("192.0.2.20"),
+		},
+	}
+	client := &STUNClient{cfg: newConfig([]Option{WithResolver(r)})}
+
+	addr, err := client.resolveServer("example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.10:3479", addr.String())
+
+	addr, err = client.resolveServer("stun:plain.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.20:3478", addr.String())
+
+	_, err = client.resolveServer("missing.example.com")
+	assert.Error(t, err)
+
+	_, err = client.resolveServer("stuns:example.com")
+	assert.Error(t, err, "non-UDP transports are not supported")
+}
+
+func TestOrderByFamily(t *testing.T) {
+	v4a := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 3478}
+	v4b := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 3478}
+	v6a := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 3478}
+	v6b := &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 3478}
+	addrs := []*net.UDPAddr{v4a, v4b, v6a, v6b}
+
+	tests := []struct {
+		name   string
+		family AddressFamily
+		want   []*net.UDPAddr
+	}{
+		{"prefer IPv4 interleaves", PreferIPv4, []*net.UDPAddr{v4a, v6a, v4b, v6b}},
+		{"prefer IPv6 interleaves", PreferIPv6, []*net.UDPAddr{v6a, v4a, v6b, v4b}},
+		{"IPv4 only", IPv4Only, []*net.UDPAddr{v4a, v4b}},
+		{"IPv6 only", IPv6Only, []*net.UDPAddr{v6a, v6b}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, orderByFamily(addrs, tt.family))
+		})
+	}
+
+	assert.Equal(t, []*net.UDPAddr{v6a, v6b}, orderByFamily([]*net.UDPAddr{v6a, v6b}, PreferIPv4),
+		"single-family results should keep their order")
+}
+
+func TestAddressFamilyNetwork(t *testing.T) {
+	assert.Equal(t, "udp", PreferIPv4.network())
+	assert.Equal(t, "udp", PreferIPv6.network())
+	assert.Equal(t, "udp4", IPv4Only.network())
+	assert.Equal(t, "udp6", IPv6Only.network())
+	assert.Equal(t, "Prefer IPv6", PreferIPv6.String())
+}
+
+func TestResolveServersCollectsAllAddresses(t *testing.T) {
+	r := &fakeResolver{
+		srv: map[string][]*net.SRV{
+			"_stun._udp.example.com": {
+				{Target: "a.example.com.", Port: 3478, Priority: 10},
+				{Target: "b.example.com.", Port: 3478, Priority: 20},
+			},
+		},
+		ips: map[string][]net.IPAddr{
+			"a.example.com": ipAddrs("192.0.2.1", "2001:db8::1"),
+			"b.example.com": ipAddrs("192.0.2.2", "192.0.2.1"),
+		},
+	}
+
+	addrs, err := newConfig([]Option{WithResolver(r)}).resolveServers("example.com")
+	require.NoError(t, err)
+	var got []string
+	for _, addr := range addrs {
+		got = append(got, addr.String())
+	}
+	assert.Equal(t, []string{"192.0.2.1:3478", "[2001:db8::1]:3478", "192.0.2.2:3478"}, got,
+		"duplicates should be removed and families interleaved")
+
+	_, err = newConfig([]Option{WithResolver(r), WithAddressFamily(IPv6Only)}).resolveServers("b.example.com")
+	assert.Error(t, err, "no IPv6 address should be an error")
+}
+
+func TestBindFirstResponsiveFailsOver(t *testing.T) {
+	// 応答しないサーバー
+	silent, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer silent.Close()
+
+	// Binding Response を返すサーバー
+	responder, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer responder.Close()
+	go func() {
+		buffer := make([]byte, 1500)
+		_, from, err := responder.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		var txID [12]byte
+		copy(txID[:], buffer[8:20])
+		response := buildMessage(txID, []byte{
+			0x00, 0x01, 0x00, 0x08, 0x00, 0x01, 0x30, 0x39, 203, 0, 113, 1, // MAPPED-ADDRESS
+		})
+		responder.WriteToUDP(response, from)
+	}()
+
+	client, err := NewSTUNClient(WithAddressFamily(IPv4Only), WithRetransmission(20*time.Millisecond, 2))
+	require.NoError(t, err)
+	defer client.Close()
+
+	silentAddr := silent.LocalAddr().(*net.UDPAddr)
+	responderAddr := responder.LocalAddr().(*net.UDPAddr)
+	server, result, err := client.bindFirstResponsive([]*net.UDPAddr{silentAddr, responderAddr})
+	require.NoError(t, err)
+	assert.Equal(t, responderAddr, server)
+	assert.Equal(t, "203.0.113.1:12345", result.MappedAddress.String())
+
+	// すべてタイムアウトした場合はタイムアウトとして判別できる
+	_, _, err = client.bindFirstResponsive([]*net.UDPAddr{silentAddr})
+	require.Error(t, err)
+	assert.True(t, isTimeoutError(err))
+}
+
+func TestBindFirstResponsiveFailoverSchedule(t *testing.T) {
+	network := NewMemoryNetwork()
+	server := startMemoryServer(t, network, 0)
+	dead := &net.UDPAddr{IP: net.ParseIP("192.0.2.99"), Port: 3478}
+
+	client, err := NewSTUNClient(WithTransport(network.Factory(net.ParseIP("198.51.100.1"))),
+		WithRetransmission(50*time.Millisecond, 4))
+	require.NoError(t, err)
+	defer client.Close()
+
+	// 最後以外の候補は 2 回 (50ms + 100ms) で諦め、4 回分 (750ms) は待たない
+	start := time.Now()
+	found, _, err := client.bindFirstResponsive([]*net.UDPAddr{dead, server})
+	require.NoError(t, err)
+	assert.Equal(t, server.String(), found.String())
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+
+	// 最後の候補は設定どおりに再送する
+	start = time.Now()
+	_, _, err = client.bindFirstResponsive([]*net.UDPAddr{dead})
+	require.Error(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 750*time.Millisecond)
+}
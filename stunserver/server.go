@@ -0,0 +1,240 @@
+// Package stunserver は RFC 5780 の NAT 動作判定 (Behavior Discovery) に対応した
+// STUN サーバーです。
+//
+// 2 つの IP アドレスと 2 つのポートの組み合わせ 4 つのソケットで待ち受け、
+// Binding Request に XOR-MAPPED-ADDRESS、OTHER-ADDRESS、RESPONSE-ORIGIN を返します。
+// CHANGE-REQUEST (RFC 5780 Section 7.2) と RESPONSE-PORT (Section 7.5) にも対応するため、
+// natchecker のすべての判定をこのサーバーに対して実行できます。
+//
+// Linux では 127.0.0.0/8 全体がループバックなので、127.0.0.1 と 127.0.0.2 で
+// 起動すればネットワークに接続せずにテストできます。
+package stunserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	natchecker "github.com/moepig/nat-checker"
+)
+
+// listenAttempts は空きポートを選ぶ場合に、両方の IP で同じポートを確保できるまで試す回数
+const listenAttempts = 16
+
+// Config はサーバーの待ち受けアドレス
+type Config struct {
+	// PrimaryIP, AlternateIP はサーバーの 2 つの IP アドレス。異なる値でなければならない
+	PrimaryIP   string
+	AlternateIP string
+	// PrimaryPort, AlternatePort はサーバーの 2 つのポート。
+	// 0 の場合は両方の IP で空いているポートが選ばれる
+	PrimaryPort   int
+	AlternatePort int
+	// Software は応答に付ける SOFTWARE 属性の値。空なら付けない
+	Software string
+	// ListenPacket は 4 つのソケットを作る関数 (nil なら net.ListenUDP)。
+	// vnet の仮想ホストを渡すと仮想ネットワーク上で待ち受ける
+	ListenPacket natchecker.ListenPacketFunc
+}
+
+// Server は RFC 5780 対応の STUN サーバー
+type Server struct {
+	// conns[i][j] は i 番目の IP、j 番目のポートのソケット (0: 主、1: 代替)
+	conns [2][2]net.PacketConn
+	cfg   Config
+	wg    sync.WaitGroup
+}
+
+// Listen は cfg の 2 つの IP と 2 つのポートで待ち受けるサーバーを起動します
+func Listen(cfg Config) (*Server, error) {
+	primaryIP, alternateIP := net.ParseIP(cfg.PrimaryIP), net.ParseIP(cfg.AlternateIP)
+	if primaryIP == nil || alternateIP == nil {
+		return nil, fmt.Errorf("invalid server IPs %q, %q", cfg.PrimaryIP, cfg.AlternateIP)
+	}
+	if primaryIP.Equal(alternateIP) {
+		return nil, fmt.Errorf("primary and alternate IPs must differ: %s", primaryIP)
+	}
+	if cfg.PrimaryPort != 0 && cfg.PrimaryPort == cfg.AlternatePort {
+		return nil, fmt.Errorf("primary and alternate ports must differ: %d", cfg.PrimaryPort)
+	}
+
+	var err error
+	for attempt := 0; attempt < listenAttempts; attempt++ {
+		var s *Server
+		s, err = listen(cfg, [2]net.IP{primaryIP, alternateIP})
+		if err == nil {
+			return s, nil
+		}
+		// ポートを指定した場合は再試行しても結果は変わらない
+		if cfg.PrimaryPort != 0 && cfg.AlternatePort != 0 {
+			break
+		}
+	}
+	return nil, err
+}
+
+// ListenLoopback は 127.0.0.1 と 127.0.0.2 の空いているポートで待ち受けるサーバーを起動します
+func ListenLoopback() (*Server, error) {
+	return Listen(Config{PrimaryIP: "127.0.0.1", AlternateIP: "127.0.0.2"})
+}
+
+// listen は 4 つのソケットを開いてサーバーを起動します。
+// 空きポートを選ぶ場合、主 IP で確保したポートを代替 IP でも使う
+func listen(cfg Config, ips [2]net.IP) (*Server, error) {
+	s := &Server{cfg: cfg}
+	ports := [2]int{cfg.PrimaryPort, cfg.AlternatePort}
+	for i, ip := range ips {
+		for j := range ports {
+			conn, err := s.cfg.ListenPacket.Listen("udp", &net.UDPAddr{IP: ip, Port: ports[j]})
+			if err != nil {
+				s.closeConns()
+				return nil, err
+			}
+			s.conns[i][j] = conn
+			ports[j] = conn.LocalAddr().(*net.UDPAddr).Port
+		}
+	}
+
+	for i := range s.conns {
+		for j := range s.conns[i] {
+			s.wg.Add(1)
+			go s.serve(i, j)
+		}
+	}
+	return s, nil
+}
+
+// PrimaryAddr は主 IP・主ポートのアドレスを返します。クライアントはここに接続する
+func (s *Server) PrimaryAddr() *net.UDPAddr {
+	return s.addr(0, 0)
+}
+
+// OtherAddr は代替 IP・代替ポートのアドレス (主アドレス宛の応答の OTHER-ADDRESS) を返します
+func (s *Server) OtherAddr() *net.UDPAddr {
+	return s.addr(1, 1)
+}
+
+// Close はすべてのソケットを閉じ、受信処理の終了を待ちます
+func (s *Server) Close() error {
+	err := s.closeConns()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) closeConns() error {
+	var errs []error
+	for i := range s.conns {
+		for j := range s.conns[i] {
+			if s.conns[i][j] != nil {
+				errs = append(errs, s.conns[i][j].Close())
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Server) addr(ip, port int) *net.UDPAddr {
+	return s.conns[ip][port].LocalAddr().(*net.UDPAddr)
+}
+
+// serve は i 番目の IP、j 番目のポートのソケットで受信したリクエストに応答します
+func (s *Server) serve(i, j int) {
+	defer s.wg.Done()
+	conn := s.conns[i][j]
+	buffer := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		from, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		// デュアルスタックのソケットで受信した IPv4 アドレスを 4 バイト形式にそろえる
+		if ip4 := from.IP.To4(); ip4 != nil {
+			from.IP = ip4
+		}
+
+		request, err := natchecker.DecodeMessage(buffer[:n])
+		if err != nil || request.MessageType != natchecker.BindingRequest {
+			// Binding Indication などの応答不要なメッセージや、STUN 以外のパケットは無視する
+			continue
+		}
+
+		ri, rj, to, response := s.handleBinding(i, j, from, request)
+		s.conns[ri][rj].WriteTo(natchecker.EncodeMessage(response), to)
+	}
+}
+
+// handleBinding は i 番目の IP、j 番目のポートで from から受信した Binding Request に対する
+// 応答を組み立て、応答を送るソケットの添字と宛先とともに返します
+func (s *Server) handleBinding(i, j int, from *net.UDPAddr, request *natchecker.STUNMessage) (int, int, *net.UDPAddr, natchecker.STUNMessage) {
+	response := natchecker.STUNMessage{
+		MessageType:   natchecker.BindingResponse,
+		TransactionID: request.TransactionID,
+	}
+
+	// RFC 8489 Section 6.3.1: 理解できない comprehension-required 属性 (0x0000-0x7FFF) が
+	// あれば 420 (Unknown Attribute) を返す
+	var unknown []byte
+	for _, attr := range request.Attributes {
+		switch attr.Type {
+		case natchecker.ChangeRequest, natchecker.ResponsePort, paddingAttribute:
+		default:
+			if attr.Type < 0x8000 {
+				unknown = binary.BigEndian.AppendUint16(unknown, uint16(attr.Type))
+			}
+		}
+	}
+	if len(unknown) > 0 {
+		response.MessageType = natchecker.BindingErrorResponse
+		response.Attributes = []natchecker.STUNAttribute{
+			natchecker.NewErrorCodeAttribute(420, "Unknown Attribute"),
+			{Type: natchecker.UnknownAttributes, Length: uint16(len(unknown)), Value: unknown},
+		}
+		return i, j, from, response
+	}
+
+	// RFC 5780 Section 6.1: CHANGE-REQUEST で指定された IP・ポートから応答する
+	ri, rj := i, j
+	if attr, ok := request.Attribute(natchecker.ChangeRequest); ok && len(attr.Value) >= 4 {
+		flags := attr.Value[3]
+		if flags&0x04 != 0 {
+			ri = 1 - i
+		}
+		if flags&0x02 != 0 {
+			rj = 1 - j
+		}
+	}
+
+	// RFC 5780 Section 6.1: RESPONSE-PORT があれば送信元 IP のそのポートに応答する
+	to := from
+	if attr, ok := request.Attribute(natchecker.ResponsePort); ok && len(attr.Value) >= 2 {
+		to = &net.UDPAddr{IP: from.IP, Port: int(binary.BigEndian.Uint16(attr.Value)), Zone: from.Zone}
+	}
+
+	// RFC 5780 Section 6.1: OTHER-ADDRESS は受信したソケットと IP・ポートの両方が異なるアドレス、
+	// RESPONSE-ORIGIN は実際に応答を送るソケットのアドレス
+	response.Attributes = []natchecker.STUNAttribute{
+		natchecker.NewAddressAttribute(natchecker.XorMappedAddress, from, request.TransactionID),
+		natchecker.NewAddressAttribute(natchecker.OtherAddress, s.addr(1-i, 1-j), request.TransactionID),
+		natchecker.NewAddressAttribute(natchecker.ResponseOrigin, s.addr(ri, rj), request.TransactionID),
+	}
+	if s.cfg.Software != "" {
+		response.Attributes = append(response.Attributes, natchecker.STUNAttribute{
+			Type:   softwareAttribute,
+			Length: uint16(len(s.cfg.Software)),
+			Value:  []byte(s.cfg.Software),
+		})
+	}
+	return ri, rj, to, response
+}
+
+// paddingAttribute は PADDING 属性 (RFC 5780 Section 7.6)。値は無視する
+const paddingAttribute natchecker.STUNAttributeType = 0x0026
+
+// softwareAttribute は SOFTWARE 属性 (RFC 8489 Section 14.14)
+const softwareAttribute natchecker.STUNAttributeType = 0x8022
@@ -0,0 +1,142 @@
+package stunserver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	natchecker "github.com/moepig/nat-checker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{name: "invalid IP", cfg: Config{PrimaryIP: "not an IP", AlternateIP: "127.0.0.2"}},
+		{name: "same IPs", cfg: Config{PrimaryIP: "127.0.0.1", AlternateIP: "127.0.0.1"}},
+		{name: "same ports", cfg: Config{PrimaryIP: "127.0.0.1", AlternateIP: "127.0.0.2", PrimaryPort: 3478, AlternatePort: 3478}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Listen(test.cfg)
+			assert.Error(t, err)
+		})
+	}
+}
+
+// exchange は server 宛に request を送り、応答とその送信元を返します
+func exchange(t *testing.T, server *net.UDPAddr, request natchecker.STUNMessage, attrs ...natchecker.STUNAttribute) (*natchecker.STUNMessage, *net.UDPAddr) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	request.Attributes = append(request.Attributes, attrs...)
+	_, err = conn.WriteToUDP(natchecker.EncodeMessage(request), server)
+	require.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buffer := make([]byte, 1500)
+	n, from, err := conn.ReadFromUDP(buffer)
+	require.NoError(t, err)
+	response, err := natchecker.DecodeMessage(buffer[:n])
+	require.NoError(t, err)
+	return response, from
+}
+
+func TestServerBindingAttributes(t *testing.T) {
+	server, err := ListenLoopback()
+	require.NoError(t, err)
+	defer server.Close()
+
+	primary, other := server.PrimaryAddr(), server.OtherAddr()
+	txID := [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+
+	tests := []struct {
+		name   string
+		change byte
+		origin *net.UDPAddr
+	}{
+		{name: "no change", change: 0x00, origin: primary},
+		{name: "change port", change: 0x02, origin: &net.UDPAddr{IP: primary.IP, Port: other.Port}},
+		{name: "change IP", change: 0x04, origin: &net.UDPAddr{IP: other.IP, Port: primary.Port}},
+		{name: "change IP and port", change: 0x06, origin: other},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			change := natchecker.STUNAttribute{Type: natchecker.ChangeRequest, Length: 4, Value: []byte{0, 0, 0, test.change}}
+			response, from := exchange(t, primary, natchecker.STUNMessage{MessageType: natchecker.BindingRequest, TransactionID: txID}, change)
+
+			assert.Equal(t, natchecker.BindingResponse, response.MessageType)
+			assert.True(t, test.origin.IP.Equal(from.IP) && test.origin.Port == from.Port, "response from %s, want %s", from, test.origin)
+
+			attr, ok := response.Attribute(natchecker.ResponseOrigin)
+			require.True(t, ok, "RESPONSE-ORIGIN")
+			origin, err := natchecker.ParseAddressAttribute(attr, txID)
+			require.NoError(t, err)
+			assert.Equal(t, from.String(), origin.String())
+
+			attr, ok = response.Attribute(natchecker.OtherAddress)
+			require.True(t, ok, "OTHER-ADDRESS")
+			otherAddr, err := natchecker.ParseAddressAttribute(attr, txID)
+			require.NoError(t, err)
+			assert.Equal(t, other.String(), otherAddr.String())
+
+			attr, ok = response.Attribute(natchecker.XorMappedAddress)
+			require.True(t, ok, "XOR-MAPPED-ADDRESS")
+			mapped, err := natchecker.ParseAddressAttribute(attr, txID)
+			require.NoError(t, err)
+			assert.Equal(t, "127.0.0.1", mapped.IP.String())
+		})
+	}
+}
+
+func TestServerRejectsUnknownAttribute(t *testing.T) {
+	server, err := ListenLoopback()
+	require.NoError(t, err)
+	defer server.Close()
+
+	unknown := natchecker.STUNAttribute{Type: 0x7F00, Length: 4, Value: []byte{0, 0, 0, 0}}
+	response, _ := exchange(t, server.PrimaryAddr(), natchecker.STUNMessage{MessageType: natchecker.BindingRequest}, unknown)
+
+	assert.Equal(t, natchecker.BindingErrorResponse, response.MessageType)
+	code, _ := natchecker.ErrorCodeOf(response)
+	assert.Equal(t, 420, code)
+	attr, ok := response.Attribute(natchecker.UnknownAttributes)
+	require.True(t, ok)
+	assert.Equal(t, []byte{0x7F, 0x00}, attr.Value)
+}
+
+func TestFullNATDetectionAgainstServer(t *testing.T) {
+	server, err := ListenLoopback()
+	require.NoError(t, err)
+	defer server.Close()
+
+	result, err := natchecker.FullNATDetection(server.PrimaryAddr().String(), natchecker.WithAddressFamily(natchecker.IPv4Only))
+	require.NoError(t, err)
+
+	// ループバックでは NAT もフィルタも無い
+	assert.True(t, result.MappingResult.NoNAT)
+	assert.Equal(t, natchecker.EndpointIndependent, result.DetailedType.Mapping)
+	assert.Equal(t, natchecker.EndpointIndependentFiltering, result.DetailedType.Filtering)
+	assert.True(t, result.FilteringResult.ServerSupport.SupportsChangeRequest)
+	assert.True(t, result.FilteringResult.ServerSupport.SupportsOtherAddress)
+	assert.Nil(t, result.MappingResult.ALG)
+}
+
+func TestResponsePortAgainstServer(t *testing.T) {
+	server, err := ListenLoopback()
+	require.NoError(t, err)
+	defer server.Close()
+
+	result, err := natchecker.CheckRefreshDirection(server.PrimaryAddr().String(), 60*time.Millisecond, 20*time.Millisecond,
+		natchecker.WithAddressFamily(natchecker.IPv4Only), natchecker.WithRetransmission(50*time.Millisecond, 2))
+	require.NoError(t, err)
+	assert.True(t, result.SupportsResponsePort)
+	assert.Positive(t, result.InboundPackets)
+}
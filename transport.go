@@ -0,0 +1,132 @@
+package natchecker
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Transport は STUNClient がパケットを送受信する下位層です。
+//
+// 既定では UDP ソケット (UDPTransport) を使います。インメモリの実装 (MemoryTransport) や
+// シミュレーター、プロキシ、ユーザー空間の TCP/IP スタックなどを実装して
+// WithTransport や NewSTUNClientWithTransport に渡すと、その上ですべての判定を実行できます。
+type Transport interface {
+	// Send は addr 宛に data を 1 つのデータグラムとして送信します
+	Send(data []byte, addr *net.UDPAddr) error
+	// Receive は deadline まで待って 1 つのデータグラムを buffer に受信し、
+	// その長さと送信元を返します。deadline がゼロなら期限なしで待つ。
+	// 期限を過ぎた場合は Timeout() が true の net.Error を返さなければならない
+	Receive(buffer []byte, deadline time.Time) (int, *net.UDPAddr, error)
+	// LocalAddr は dst 宛に送信するときの送信元アドレスを返します。
+	// NAT が無い場合はこのアドレスが外部マッピングと一致する
+	LocalAddr(dst *net.UDPAddr) (*net.UDPAddr, error)
+	// Close は Transport を閉じます。待機中の Receive はエラーを返す
+	Close() error
+}
+
+// TransportFactory は network ("udp", "udp4", "udp6") の新しい Transport を作る関数です。
+// Check* 関数は 1 回の判定で複数のソケットを開くため、Transport そのものではなく
+// それを作る関数を受け取ります。
+type TransportFactory func(network string) (Transport, error)
+
+// WithTransport はクライアントの Transport を factory で作ります。
+//
+// Check* 関数が内部で開く複数のソケットもすべて factory で作られます。
+// 指定しない場合は net.ListenUDP で開いたソケットを UDPTransport で使います。
+// WithListenPacket と両方を指定した場合は後に指定したものが使われます。
+func WithTransport(factory TransportFactory) Option {
+	return func(c *config) {
+		c.transport = factory
+	}
+}
+
+// newTransport は設定に従って Transport を作ります
+func (c config) newTransport(network string) (Transport, error) {
+	if c.transport != nil {
+		return c.transport(network)
+	}
+	addr, err := net.ResolveUDPAddr(network, ":0")
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewUDPTransport(conn), nil
+}
+
+// UDPTransport は net.PacketConn (通常は OS の UDP ソケット) による Transport です
+type UDPTransport struct {
+	conn net.PacketConn
+}
+
+// NewUDPTransport は conn を Transport として使います。
+// conn は *net.UDPConn 以外の net.PacketConn でもよいが、LocalAddr は
+// UDP アドレス ("ip:port") でなければならない
+func NewUDPTransport(conn net.PacketConn) *UDPTransport {
+	return &UDPTransport{conn: conn}
+}
+
+// Send は addr 宛に data を送信します
+func (t *UDPTransport) Send(data []byte, addr *net.UDPAddr) error {
+	_, err := t.conn.WriteTo(data, addr)
+	return err
+}
+
+// Receive は deadline まで待って 1 つのデータグラムを受信します
+func (t *UDPTransport) Receive(buffer []byte, deadline time.Time) (int, *net.UDPAddr, error) {
+	if err := t.conn.SetReadDeadline(deadline); err != nil {
+		return 0, nil, err
+	}
+	n, addr, err := t.conn.ReadFrom(buffer)
+	if err != nil {
+		return 0, nil, err
+	}
+	if from, ok := addr.(*net.UDPAddr); ok {
+		return n, from, nil
+	}
+	from, err := net.ResolveUDPAddr("udp", addr.String())
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, from, nil
+}
+
+// LocalAddr は dst 宛に送信するときの送信元 IP と、バインドしているポートの組を返します。
+//
+// ":0"（全インターフェース・任意ポート）にバインドしている場合は conn.LocalAddr() だけでは
+// 送信元 IP が分からない。実際の送信元 IP は宛先へのルーティングで決まるので、
+// プローブ用の接続で解決する。特定の IP にバインドしている場合はその IP を返す。
+//
+// プローブは OS のルーティングを使うため、conn が *net.UDPConn の場合に限って行う。
+// 仮想ネットワークなど他の net.PacketConn で送信元 IP が未指定の場合はエラーを返す。
+func (t *UDPTransport) LocalAddr(dst *net.UDPAddr) (*net.UDPAddr, error) {
+	local, err := net.ResolveUDPAddr("udp", t.conn.LocalAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	if local.IP != nil && !local.IP.IsUnspecified() {
+		return local, nil
+	}
+	if _, ok := t.conn.(*net.UDPConn); !ok {
+		return nil, fmt.Errorf("%T の送信元 IP を解決できません: %s にバインドしています", t.conn, local)
+	}
+
+	probe, err := net.DialUDP("udp", nil, dst)
+	if err != nil {
+		return nil, err
+	}
+	defer probe.Close()
+
+	return &net.UDPAddr{
+		IP:   probe.LocalAddr().(*net.UDPAddr).IP,
+		Port: local.Port,
+	}, nil
+}
+
+// Close はソケットを閉じます
+func (t *UDPTransport) Close() error {
+	return t.conn.Close()
+}
@@ -0,0 +1,204 @@
+package natchecker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveMemoryBinding は t で Binding Request を待ち受け、送信元を XOR-MAPPED-ADDRESS に
+// 入れて応答します。最初の drop 個のリクエストには応答しない
+func serveMemoryBinding(t *MemoryTransport, drop int) {
+	buffer := make([]byte, 1500)
+	for {
+		n, from, err := t.Receive(buffer, time.Time{})
+		if err != nil {
+			return
+		}
+		request, err := DecodeMessage(buffer[:n])
+		if err != nil || request.MessageType != BindingRequest {
+			continue
+		}
+		if drop > 0 {
+			drop--
+			continue
+		}
+		t.Send(EncodeMessage(STUNMessage{
+			MessageType:   BindingResponse,
+			TransactionID: request.TransactionID,
+			Attributes:    []STUNAttribute{NewAddressAttribute(XorMappedAddress, from, request.TransactionID)},
+		}), from)
+	}
+}
+
+func startMemoryServer(t *testing.T, network *MemoryNetwork, drop int) *net.UDPAddr {
+	t.Helper()
+	server, err := network.Listen(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 3478})
+	require.NoError(t, err)
+	t.Cleanup(func() { server.Close() })
+	go serveMemoryBinding(server, drop)
+	return server.Addr()
+}
+
+func TestMemoryTransportRoundTrip(t *testing.T) {
+	network := NewMemoryNetwork()
+	server := startMemoryServer(t, network, 0)
+
+	transport, err := network.Listen(&net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 5000})
+	require.NoError(t, err)
+	client := NewSTUNClientWithTransport(transport, WithRetransmission(50*time.Millisecond, 2))
+	defer client.Close()
+
+	result, err := client.SendBindingRequestTo(server, false, false)
+	require.NoError(t, err)
+	assert.Equal(t, "198.51.100.1:5000", result.MappedAddress.String())
+
+	// プローブ用のソケットを使わずに Transport のアドレスがそのまま返る
+	localAddr, err := client.LocalAddr(server)
+	require.NoError(t, err)
+	assert.Equal(t, "198.51.100.1:5000", localAddr.String())
+}
+
+func TestMemoryTransportRetransmission(t *testing.T) {
+	network := NewMemoryNetwork()
+	server := startMemoryServer(t, network, 2)
+
+	client, err := NewSTUNClient(WithTransport(network.Factory(net.ParseIP("198.51.100.1"))),
+		WithRetransmission(20*time.Millisecond, 3))
+	require.NoError(t, err)
+	defer client.Close()
+
+	// 最初の 2 回の送信は応答されないが、3 回目の再送で応答が届く
+	_, err = client.SendBindingRequestTo(server, false, false)
+	assert.NoError(t, err)
+}
+
+func TestMemoryTransportTimeout(t *testing.T) {
+	network := NewMemoryNetwork()
+	client, err := NewSTUNClient(WithTransport(network.Factory(net.ParseIP("198.51.100.1"))),
+		WithRetransmission(20*time.Millisecond, 2))
+	require.NoError(t, err)
+	defer client.Close()
+
+	// 宛先の無いパケットは捨てられ、UDP と同じくタイムアウトになる
+	_, err = client.SendBindingRequestTo(&net.UDPAddr{IP: net.ParseIP("192.0.2.99"), Port: 3478}, false, false)
+	require.Error(t, err)
+	assert.True(t, isTimeoutError(err), "got %v", err)
+}
+
+func TestCheckMappingTypeWithTransport(t *testing.T) {
+	network := NewMemoryNetwork()
+	server := startMemoryServer(t, network, 0)
+
+	result, err := CheckMappingType(server.String(),
+		WithTransport(network.Factory(net.ParseIP("198.51.100.1"))),
+		WithRetransmission(50*time.Millisecond, 2))
+	require.NoError(t, err)
+	assert.True(t, result.NoNAT)
+	assert.Equal(t, EndpointIndependent, result.NATType)
+	assert.Equal(t, result.Response.LocalAddress.String(), result.Response.Mapping1.String())
+}
+
+func TestMemoryNetworkListen(t *testing.T) {
+	network := NewMemoryNetwork()
+	ip := net.ParseIP("198.51.100.1")
+
+	first, err := network.Listen(&net.UDPAddr{IP: ip})
+	require.NoError(t, err)
+	second, err := network.Listen(&net.UDPAddr{IP: ip})
+	require.NoError(t, err)
+	assert.NotEqual(t, first.Addr().Port, second.Addr().Port, "port 0 allocates a free port")
+
+	_, err = network.Listen(first.Addr())
+	assert.Error(t, err, "the address is in use")
+
+	// 閉じたアドレスは再利用でき、閉じた Transport の受信はタイムアウトではないエラーになる
+	require.NoError(t, first.Close())
+	_, _, err = first.Receive(make([]byte, 10), time.Time{})
+	require.Error(t, err)
+	assert.False(t, isTimeoutError(err))
+	reused, err := network.Listen(first.Addr())
+	require.NoError(t, err)
+	reused.Close()
+	second.Close()
+}
+
+func TestWithListenPacketAndTransport(t *testing.T) {
+	network := NewMemoryNetwork()
+	memory := WithTransport(network.Factory(net.ParseIP("198.51.100.1")))
+	listen := WithListenPacket(func(network string, laddr *net.UDPAddr) (net.PacketConn, error) {
+		return net.ListenUDP(network, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: laddr.Port})
+	})
+
+	// どちらも同じ Transport の設定なので、後に指定したものが使われる
+	client, err := NewSTUNClient(memory, listen)
+	require.NoError(t, err)
+	assert.IsType(t, &UDPTransport{}, client.transport)
+	client.Close()
+
+	client, err = NewSTUNClient(listen, memory)
+	require.NoError(t, err)
+	assert.IsType(t, &MemoryTransport{}, client.transport)
+	client.Close()
+}
+
+func TestMemoryNetworkFactoryFamily(t *testing.T) {
+	network := NewMemoryNetwork()
+	v4 := network.Factory(net.ParseIP("198.51.100.1"))
+	v6 := network.Factory(net.ParseIP("2001:db8::1"))
+
+	for _, test := range []struct {
+		factory TransportFactory
+		network string
+		ok      bool
+	}{
+		{v4, "udp", true},
+		{v4, "udp4", true},
+		{v4, "udp6", false},
+		{v6, "udp", true},
+		{v6, "udp6", true},
+		{v6, "udp4", false},
+	} {
+		transport, err := test.factory(test.network)
+		if !test.ok {
+			assert.Error(t, err, test.network)
+			continue
+		}
+		require.NoError(t, err, test.network)
+		transport.Close()
+	}
+}
+
+// packetConn は *net.UDPConn 以外の net.PacketConn として振る舞うラッパー
+type packetConn struct {
+	net.PacketConn
+}
+
+func TestUDPTransportLocalAddr(t *testing.T) {
+	dst := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3478}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	require.NoError(t, err)
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	// *net.UDPConn ならルーティングで送信元 IP を解決する
+	local, err := NewUDPTransport(conn).LocalAddr(dst)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", local.IP.String())
+	assert.Equal(t, port, local.Port)
+
+	// それ以外の net.PacketConn では OS のルーティングを使わない
+	_, err = NewUDPTransport(packetConn{conn}).LocalAddr(dst)
+	assert.Error(t, err)
+
+	bound, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer bound.Close()
+	local, err = NewUDPTransport(packetConn{bound}).LocalAddr(dst)
+	require.NoError(t, err)
+	assert.Equal(t, bound.LocalAddr().String(), local.String())
+}
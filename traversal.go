@@ -0,0 +1,102 @@
+package natchecker
+
+import "fmt"
+
+// TraversalOutcome は 2 つのピアの間で直接通信を確立できる見込み
+type TraversalOutcome int
+
+const (
+	// TraversalDirect: 外部マッピングを交換して同時に送信すれば直接通信できる
+	TraversalDirect TraversalOutcome = iota
+	// TraversalPortPrediction: 一方の新しいマッピングのポートを予測できれば直接通信できる
+	TraversalPortPrediction
+	// TraversalRelay: 直接通信は期待できず、TURN 等の中継が必要
+	TraversalRelay
+	// TraversalUnknown: NAT の挙動が不明なため判断できない
+	TraversalUnknown
+)
+
+func (o TraversalOutcome) String() string {
+	switch o {
+	case TraversalDirect:
+		return "Direct"
+	case TraversalPortPrediction:
+		return "Port Prediction"
+	case TraversalRelay:
+		return "Relay"
+	default:
+		return "Unknown"
+	}
+}
+
+// TraversalPrediction は PredictTraversal の結果
+type TraversalPrediction struct {
+	Outcome TraversalOutcome `json:"outcome"`
+	// Reason は判断の理由
+	Reason string `json:"reason"`
+}
+
+// String は結果の文字列表現を返す
+func (p TraversalPrediction) String() string {
+	return fmt.Sprintf("%s: %s", p.Outcome, p.Reason)
+}
+
+// PredictTraversal は 2 つのピアの NAT の種類から、UDP ホールパンチングで
+// 直接通信を確立できる見込みを返します
+//
+// 各ピアは STUN で得た外部マッピングをシグナリングで交換し、互いに同時に送信するものとします。
+//
+//   - 両方が Endpoint Independent Mapping: 交換したマッピングが相手宛にもそのまま使われ、
+//     互いの送信でフィルタが開くため、フィルタリングに関わらず直接通信できる
+//   - 一方だけが Address (and Port) Dependent Mapping (Symmetric NAT):
+//     Symmetric 側は相手宛に新しいマッピングを作る。相手のフィルタリングが Endpoint Independent
+//     または Address Dependent なら、IP アドレスが同じ (Paired pooling) 新しいマッピングからの
+//     パケットも通るため直接通信できる。Address and Port Dependent なら、相手は新しいマッピングの
+//     ポートを予測して送信する必要がある (PredictPorts)
+//   - 両方が Symmetric NAT: 双方が互いの新しいポートを同時に当てる必要があり、
+//     実用上は中継が必要
+//
+// マッピングの挙動が不明なピアがある場合、または判断に必要なフィルタリングの挙動が
+// 不明な場合は TraversalUnknown を返します。
+func PredictTraversal(a, b DetailedNATType) TraversalPrediction {
+	switch {
+	case a.Mapping == Unknown:
+		return TraversalPrediction{TraversalUnknown, "mapping behavior of peer A is unknown"}
+	case b.Mapping == Unknown:
+		return TraversalPrediction{TraversalUnknown, "mapping behavior of peer B is unknown"}
+	}
+
+	symmetricA, symmetricB := isSymmetricMapping(a.Mapping), isSymmetricMapping(b.Mapping)
+	switch {
+	case !symmetricA && !symmetricB:
+		return TraversalPrediction{TraversalDirect,
+			"both peers use endpoint independent mapping, so the mappings learned via STUN are reused toward each other"}
+	case symmetricA && symmetricB:
+		return TraversalPrediction{TraversalRelay,
+			"both peers are behind symmetric NATs and would have to predict each other's new ports simultaneously"}
+	}
+
+	symmetric, peer, other := "A", "B", b
+	if symmetricB {
+		symmetric, peer, other = "B", "A", a
+	}
+	switch other.Filtering {
+	case EndpointIndependentFiltering:
+		return TraversalPrediction{TraversalDirect, fmt.Sprintf(
+			"peer %s is behind a symmetric NAT, but peer %s accepts packets from any endpoint", symmetric, peer)}
+	case AddressDependentFiltering:
+		return TraversalPrediction{TraversalDirect, fmt.Sprintf(
+			"peer %s is behind a symmetric NAT, but peer %s filters by address only and the new mapping keeps the same IP", symmetric, peer)}
+	case AddressPortDependentFiltering:
+		return TraversalPrediction{TraversalPortPrediction, fmt.Sprintf(
+			"peer %s is behind a symmetric NAT and peer %s filters by address and port, so peer %s must predict the new mapping's port", symmetric, peer, peer)}
+	default:
+		return TraversalPrediction{TraversalUnknown, fmt.Sprintf(
+			"peer %s is behind a symmetric NAT and the filtering behavior of peer %s is unknown", symmetric, peer)}
+	}
+}
+
+// isSymmetricMapping は宛先ごとに異なるマッピングを作る (Symmetric NAT) かを返します
+func isSymmetricMapping(m NATMappingType) bool {
+	return m == AddressDependent || m == AddressPortDependent
+}
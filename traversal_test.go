@@ -0,0 +1,75 @@
+package natchecker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPredictTraversal(t *testing.T) {
+	fullCone := DetailedNATType{Mapping: EndpointIndependent, Filtering: EndpointIndependentFiltering}
+	portRestricted := DetailedNATType{Mapping: EndpointIndependent, Filtering: AddressPortDependentFiltering}
+	symmetric := DetailedNATType{Mapping: AddressPortDependent, Filtering: AddressPortDependentFiltering}
+
+	// すべてのマッピング × フィルタリングの組み合わせについて、
+	// Full Cone / Port Restricted Cone / Symmetric の相手との見込みを確認する
+	tests := []struct {
+		peer             DetailedNATType
+		vsFullCone       TraversalOutcome
+		vsPortRestricted TraversalOutcome
+		vsSymmetric      TraversalOutcome
+	}{
+		{DetailedNATType{EndpointIndependent, EndpointIndependentFiltering}, TraversalDirect, TraversalDirect, TraversalDirect},
+		{DetailedNATType{EndpointIndependent, AddressDependentFiltering}, TraversalDirect, TraversalDirect, TraversalDirect},
+		{DetailedNATType{EndpointIndependent, AddressPortDependentFiltering}, TraversalDirect, TraversalDirect, TraversalPortPrediction},
+		{DetailedNATType{EndpointIndependent, FilteringUnknown}, TraversalDirect, TraversalDirect, TraversalUnknown},
+		{DetailedNATType{AddressDependent, EndpointIndependentFiltering}, TraversalDirect, TraversalPortPrediction, TraversalRelay},
+		{DetailedNATType{AddressDependent, AddressDependentFiltering}, TraversalDirect, TraversalPortPrediction, TraversalRelay},
+		{DetailedNATType{AddressDependent, AddressPortDependentFiltering}, TraversalDirect, TraversalPortPrediction, TraversalRelay},
+		{DetailedNATType{AddressDependent, FilteringUnknown}, TraversalDirect, TraversalPortPrediction, TraversalRelay},
+		{DetailedNATType{AddressPortDependent, EndpointIndependentFiltering}, TraversalDirect, TraversalPortPrediction, TraversalRelay},
+		{DetailedNATType{AddressPortDependent, AddressDependentFiltering}, TraversalDirect, TraversalPortPrediction, TraversalRelay},
+		{DetailedNATType{AddressPortDependent, AddressPortDependentFiltering}, TraversalDirect, TraversalPortPrediction, TraversalRelay},
+		{DetailedNATType{AddressPortDependent, FilteringUnknown}, TraversalDirect, TraversalPortPrediction, TraversalRelay},
+		{DetailedNATType{Unknown, EndpointIndependentFiltering}, TraversalUnknown, TraversalUnknown, TraversalUnknown},
+		{DetailedNATType{Unknown, AddressDependentFiltering}, TraversalUnknown, TraversalUnknown, TraversalUnknown},
+		{DetailedNATType{Unknown, AddressPortDependentFiltering}, TraversalUnknown, TraversalUnknown, TraversalUnknown},
+		{DetailedNATType{Unknown, FilteringUnknown}, TraversalUnknown, TraversalUnknown, TraversalUnknown},
+	}
+
+	for _, test := range tests {
+		t.Run(test.peer.String(), func(t *testing.T) {
+			for _, c := range []struct {
+				other    DetailedNATType
+				expected TraversalOutcome
+			}{
+				{fullCone, test.vsFullCone},
+				{portRestricted, test.vsPortRestricted},
+				{symmetric, test.vsSymmetric},
+			} {
+				prediction := PredictTraversal(test.peer, c.other)
+				assert.Equal(t, c.expected, prediction.Outcome, "vs %s: %s", c.other.LegacyName(), prediction.Reason)
+				assert.NotEmpty(t, prediction.Reason)
+
+				// ピアの順序を入れ替えても見込みは変わらない
+				assert.Equal(t, prediction.Outcome, PredictTraversal(c.other, test.peer).Outcome, "swapped vs %s", c.other.LegacyName())
+			}
+		})
+	}
+}
+
+func TestTraversalOutcomeString(t *testing.T) {
+	tests := []struct {
+		outcome  TraversalOutcome
+		expected string
+	}{
+		{TraversalDirect, "Direct"},
+		{TraversalPortPrediction, "Port Prediction"},
+		{TraversalRelay, "Relay"},
+		{TraversalUnknown, "Unknown"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, test.outcome.String())
+	}
+}
@@ -0,0 +1,628 @@
+package natchecker
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// TURN (RFC 8656) のメッセージタイプ
+// 成功レスポンスは Class=0b10 (0x0100)、エラーレスポンスは Class=0b11 (0x0110) をリクエストに加えた値
+const (
+	// RFC 8656 Section 7.1: "The client ... sends an Allocate request to the server"
+	AllocateRequest       STUNMessageType = 0x0003
+	AllocateResponse      STUNMessageType = 0x0103
+	AllocateErrorResponse STUNMessageType = 0x0113
+
+	// RFC 8656 Section 7.2: Refresh はアロケーションの寿命を延長・削除する
+	RefreshRequest       STUNMessageType = 0x0004
+	RefreshResponse      STUNMessageType = 0x0104
+	RefreshErrorResponse STUNMessageType = 0x0114
+
+	// RFC 8656 Section 11: Send / Data インディケーションで相手 (peer) とデータを交換する
+	SendIndication STUNMessageType = 0x0016
+	DataIndication STUNMessageType = 0x0017
+
+	// RFC 8656 Section 10: CreatePermission は相手の IP アドレスからの受信を許可する
+	CreatePermissionRequest       STUNMessageType = 0x0008
+	CreatePermissionResponse      STUNMessageType = 0x0108
+	CreatePermissionErrorResponse STUNMessageType = 0x0118
+
+	// RFC 8656 Section 12: ChannelBind は相手のアドレスにチャネル番号を割り当てる
+	ChannelBindRequest       STUNMessageType = 0x0009
+	ChannelBindResponse      STUNMessageType = 0x0109
+	ChannelBindErrorResponse STUNMessageType = 0x0119
+)
+
+// TURN と長期認証 (RFC 8489 Section 9.2) の属性タイプ
+const (
+	// USERNAME 属性 (Type 0x0006) - RFC 8489 Section 14.3
+	Username STUNAttributeType = 0x0006
+	// MESSAGE-INTEGRITY 属性 (Type 0x0008) - RFC 8489 Section 14.5
+	// "The MESSAGE-INTEGRITY attribute contains an HMAC-SHA1 of the STUN message."
+	MessageIntegrity STUNAttributeType = 0x0008
+	// REALM 属性 (Type 0x0014) - RFC 8489 Section 14.9
+	Realm STUNAttributeType = 0x0014
+	// NONCE 属性 (Type 0x0015) - RFC 8489 Section 14.10
+	Nonce STUNAttributeType = 0x0015
+
+	// CHANNEL-NUMBER 属性 (Type 0x000C) - RFC 8656 Section 18.1
+	ChannelNumber STUNAttributeType = 0x000C
+	// LIFETIME 属性 (Type 0x000D) - RFC 8656 Section 18.2
+	// "The LIFETIME attribute represents the duration for which the server
+	// will maintain an allocation in the absence of a refresh."
+	Lifetime STUNAttributeType = 0x000D
+	// XOR-PEER-ADDRESS 属性 (Type 0x0012) - RFC 8656 Section 18.3
+	XorPeerAddress STUNAttributeType = 0x0012
+	// DATA 属性 (Type 0x0013) - RFC 8656 Section 18.4
+	Data STUNAttributeType = 0x0013
+	// XOR-RELAYED-ADDRESS 属性 (Type 0x0016) - RFC 8656 Section 18.5
+	XorRelayedAddress STUNAttributeType = 0x0016
+	// REQUESTED-TRANSPORT 属性 (Type 0x0019) - RFC 8656 Section 18.7
+	RequestedTransport STUNAttributeType = 0x0019
+)
+
+// TURN チャネル番号の範囲
+// RFC 8656 Section 12: "The channel number MUST be in the range 0x4000 through 0x4FFF"
+const (
+	MinChannelNumber uint16 = 0x4000
+	MaxChannelNumber uint16 = 0x4FFF
+)
+
+// protocolUDP は REQUESTED-TRANSPORT で要求するプロトコル番号
+// RFC 8656 Section 18.7: "the value 17 (UDP)"
+const protocolUDP = 17
+
+// messageIntegrityLength は MESSAGE-INTEGRITY の値 (HMAC-SHA1) の長さ
+const messageIntegrityLength = 20
+
+// LongTermKey は長期認証の鍵を返します
+// RFC 8489 Section 9.2.2: key = MD5(username ":" OpaqueString(realm) ":" OpaqueString(password))
+//
+// OpaqueString (RFC 8265) による正規化は行わないため、ASCII 以外の文字を含む
+// ユーザー名やパスワードは事前に正規化しておく必要があります。
+func LongTermKey(username, realm, password string) []byte {
+	sum := md5.Sum([]byte(username + ":" + realm + ":" + password))
+	return sum[:]
+}
+
+// encodeWithIntegrity は msg の末尾に key による MESSAGE-INTEGRITY を付けて符号化します
+//
+// RFC 8489 Section 14.5: HMAC の入力は MESSAGE-INTEGRITY 属性の直前までのメッセージで、
+// ヘッダーの Message Length は MESSAGE-INTEGRITY 属性を含む長さにしておく。
+// encodeMessage は値を 0 で埋めた属性を含めて長さを計算するため、その後で値を埋める。
+func (c *STUNClient) encodeWithIntegrity(msg STUNMessage, key []byte) []byte {
+	msg.Attributes = append(msg.Attributes[:len(msg.Attributes):len(msg.Attributes)], STUNAttribute{
+		Type:   MessageIntegrity,
+		Length: messageIntegrityLength,
+		Value:  make([]byte, messageIntegrityLength),
+	})
+	data := c.encodeMessage(msg)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(data[:len(data)-4-messageIntegrityLength])
+	copy(data[len(data)-messageIntegrityLength:], mac.Sum(nil))
+	return data
+}
+
+// xorAddressValue は addr を XOR-MAPPED-ADDRESS 形式 (RFC 8489 Section 14.2) の属性値に符号化します。
+// XOR-PEER-ADDRESS と XOR-RELAYED-ADDRESS も同じ形式
+func xorAddressValue(addr *net.UDPAddr, txID [12]byte) []byte {
+	xorKey := make([]byte, 16)
+	copy(xorKey[0:4], STUNMagicCookieBytes)
+	copy(xorKey[4:16], txID[:])
+
+	ip := addr.IP.To4()
+	family := byte(0x01)
+	if ip == nil {
+		ip = addr.IP.To16()
+		family = 0x02
+	}
+
+	value := make([]byte, 4+len(ip))
+	value[1] = family
+	binary.BigEndian.PutUint16(value[2:4], uint16(addr.Port)^0x2112)
+	for i := range ip {
+		value[4+i] = ip[i] ^ xorKey[i]
+	}
+	return value
+}
+
+// TURNAllocation は Allocate で得たアロケーションの情報
+type TURNAllocation struct {
+	// RelayedAddress はサーバーが割り当てた中継用のアドレス。相手はここに送信する
+	RelayedAddress *net.UDPAddr `json:"relayed_address"`
+	// MappedAddress はサーバーから見たクライアントの外部アドレス
+	MappedAddress *net.UDPAddr `json:"mapped_address"`
+	// Lifetime はアロケーションの残り寿命
+	Lifetime time.Duration `json:"lifetime"`
+}
+
+// TURNClient は TURN サーバー (RFC 8656) にアロケーションを作り、
+// 中継アドレスを介して相手 (peer) と UDP でデータを交換するクライアントです。
+//
+// STUN のトランザクション（再送・Transaction ID の照合）は STUNClient と共通で、
+// 1 つの TURNClient は 1 つのローカルソケットと 1 つのアロケーションを持ちます。
+type TURNClient struct {
+	stun     *STUNClient
+	server   *net.UDPAddr
+	username string
+	password string
+
+	// realm, nonce, key はサーバーの 401 応答から得た長期認証の情報
+	realm string
+	nonce string
+	key   []byte
+
+	allocation *TURNAllocation
+	// channels は ChannelBind で割り当てたチャネル番号と相手のアドレス
+	channels map[uint16]*net.UDPAddr
+}
+
+// NewTURNClient は serverAddr の TURN サーバーに接続するクライアントを作ります。
+// username, password は長期認証 (RFC 8489 Section 9.2) の資格情報です。
+// opts はソケットのアドレスファミリーや再送パラメータの指定に使われます。
+func NewTURNClient(serverAddr, username, password string, opts ...Option) (*TURNClient, error) {
+	client, err := NewSTUNClient(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("STUNクライアント作成エラー: %w", err)
+	}
+
+	server, err := client.resolveServer(serverAddr)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("サーバーアドレス解決エラー: %w", err)
+	}
+
+	return &TURNClient{
+		stun:     client,
+		server:   server,
+		username: username,
+		password: password,
+		channels: make(map[uint16]*net.UDPAddr),
+	}, nil
+}
+
+// Close はアロケーションがあれば削除 (LIFETIME 0 の Refresh) し、ソケットを閉じます
+func (t *TURNClient) Close() {
+	if t.allocation != nil {
+		t.Refresh(0)
+	}
+	t.stun.Close()
+}
+
+// Server は接続先の TURN サーバーのアドレスを返します
+func (t *TURNClient) Server() *net.UDPAddr {
+	return t.server
+}
+
+// Allocation は現在のアロケーションを返します。Allocate 前は nil
+func (t *TURNClient) Allocation() *TURNAllocation {
+	return t.allocation
+}
+
+// Allocate は UDP の中継アドレスを要求します
+// RFC 8656 Section 7.1: Sending an Allocate Request
+//
+// 最初のリクエストは資格情報なしで送り、サーバーの 401 (Unauthenticated) 応答の
+// REALM と NONCE を使って長期認証付きで再送します。
+func (t *TURNClient) Allocate() (*TURNAllocation, error) {
+	transport := []byte{protocolUDP, 0, 0, 0}
+	response, err := t.transact(AllocateRequest, []STUNAttribute{
+		{Type: RequestedTransport, Length: uint16(len(transport)), Value: transport},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Allocate 失敗: %w", err)
+	}
+
+	allocation := &TURNAllocation{Lifetime: lifetimeOf(response)}
+	for _, attr := range response.Attributes {
+		switch attr.Type {
+		case XorRelayedAddress:
+			allocation.RelayedAddress, err = t.stun.parseAddress(attr.Value, true, response.TransactionID)
+		case XorMappedAddress:
+			allocation.MappedAddress, err = t.stun.parseAddress(attr.Value, true, response.TransactionID)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Allocate レスポンスの解析エラー: %w", err)
+		}
+	}
+	if allocation.RelayedAddress == nil {
+		return nil, fmt.Errorf("relayed address not found in Allocate response")
+	}
+
+	t.allocation = allocation
+	return allocation, nil
+}
+
+// Refresh はアロケーションの寿命を lifetime に更新し、サーバーが認めた寿命を返します
+// RFC 8656 Section 7.2: lifetime に 0 を指定するとアロケーションを削除する
+func (t *TURNClient) Refresh(lifetime time.Duration) (time.Duration, error) {
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, uint32(lifetime/time.Second))
+	response, err := t.transact(RefreshRequest, []STUNAttribute{
+		{Type: Lifetime, Length: 4, Value: value},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Refresh 失敗: %w", err)
+	}
+
+	granted := lifetimeOf(response)
+	if lifetime == 0 {
+		t.allocation = nil
+	} else if t.allocation != nil {
+		t.allocation.Lifetime = granted
+	}
+	return granted, nil
+}
+
+// CreatePermission は peers の IP アドレスから中継アドレスへの受信を許可します
+// RFC 8656 Section 10: パーミッションは IP アドレス単位で、ポートは無視される。
+// 寿命は 5 分で、維持するには再度 CreatePermission を送る必要がある
+func (t *TURNClient) CreatePermission(peers ...*net.UDPAddr) error {
+	if len(peers) == 0 {
+		return fmt.Errorf("no peer address")
+	}
+
+	// XOR の鍵に Transaction ID を使うため、属性は transact の中で組み立てる
+	build := func(txID [12]byte) []STUNAttribute {
+		attrs := make([]STUNAttribute, 0, len(peers))
+		for _, peer := range peers {
+			value := xorAddressValue(peer, txID)
+			attrs = append(attrs, STUNAttribute{Type: XorPeerAddress, Length: uint16(len(value)), Value: value})
+		}
+		return attrs
+	}
+	if _, err := t.transactWith(CreatePermissionRequest, build); err != nil {
+		return fmt.Errorf("CreatePermission 失敗: %w", err)
+	}
+	return nil
+}
+
+// ChannelBind は peer にチャネル番号 channel を割り当てます
+// RFC 8656 Section 12: チャネルに割り当てた相手とは 4 バイトのヘッダーしか持たない
+// ChannelData メッセージでデータを交換でき、パーミッションも同時に作られる
+func (t *TURNClient) ChannelBind(peer *net.UDPAddr, channel uint16) error {
+	if channel < MinChannelNumber || channel > MaxChannelNumber {
+		return fmt.Errorf("invalid channel number 0x%04x", channel)
+	}
+
+	build := func(txID [12]byte) []STUNAttribute {
+		number := make([]byte, 4)
+		binary.BigEndian.PutUint16(number, channel)
+		value := xorAddressValue(peer, txID)
+		return []STUNAttribute{
+			{Type: ChannelNumber, Length: 4, Value: number},
+			{Type: XorPeerAddress, Length: uint16(len(value)), Value: value},
+		}
+	}
+	if _, err := t.transactWith(ChannelBindRequest, build); err != nil {
+		return fmt.Errorf("ChannelBind 失敗: %w", err)
+	}
+
+	t.channels[channel] = peer
+	return nil
+}
+
+// Send は中継アドレスから peer に data を送らせます。
+// peer にチャネルが割り当てられていれば ChannelData で、そうでなければ
+// Send インディケーション (RFC 8656 Section 11.1) で送る
+func (t *TURNClient) Send(peer *net.UDPAddr, data []byte) error {
+	for channel, bound := range t.channels {
+		if udpAddrEqual(bound, peer) {
+			return t.stun.transport.Send(EncodeChannelData(channel, data), t.server)
+		}
+	}
+
+	var txID [12]byte
+	rand.Read(txID[:])
+	peerValue := xorAddressValue(peer, txID)
+	msg := STUNMessage{
+		MessageType:   SendIndication,
+		TransactionID: txID,
+		Attributes: []STUNAttribute{
+			{Type: XorPeerAddress, Length: uint16(len(peerValue)), Value: peerValue},
+			{Type: Data, Length: uint16(len(data)), Value: data},
+		},
+	}
+	return t.stun.transport.Send(t.stun.encodeMessage(msg), t.server)
+}
+
+// Receive は timeout まで待ち、中継アドレスに届いたデータと送信元の相手のアドレスを返します。
+// Data インディケーション (RFC 8656 Section 11.4) と ChannelData (Section 12.6) の両方を受け付ける
+func (t *TURNClient) Receive(timeout time.Duration) ([]byte, *net.UDPAddr, error) {
+	deadline := time.Now().Add(timeout)
+	buffer := make([]byte, 65536)
+	for {
+		n, from, err := t.stun.transport.Receive(buffer, deadline)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !udpAddrEqual(from, t.server) {
+			continue
+		}
+
+		if channel, data, ok := DecodeChannelData(buffer[:n]); ok {
+			if peer, bound := t.channels[channel]; bound {
+				return data, peer, nil
+			}
+			continue
+		}
+
+		msg, err := t.stun.decodeMessage(buffer[:n])
+		if err != nil || msg.MessageType != DataIndication {
+			continue
+		}
+		peerAttr, hasPeer := msg.Attribute(XorPeerAddress)
+		dataAttr, hasData := msg.Attribute(Data)
+		if !hasPeer || !hasData {
+			continue
+		}
+		peer, err := t.stun.parseAddress(peerAttr.Value, true, msg.TransactionID)
+		if err != nil {
+			continue
+		}
+		return dataAttr.Value, peer, nil
+	}
+}
+
+// transact は固定の属性でリクエストを送ります
+func (t *TURNClient) transact(msgType STUNMessageType, attrs []STUNAttribute) (*STUNMessage, error) {
+	return t.transactWith(msgType, func([12]byte) []STUNAttribute { return attrs })
+}
+
+// transactWith は build で組み立てた属性でリクエストを送り、成功レスポンスを返します。
+// 認証情報があれば USERNAME, REALM, NONCE, MESSAGE-INTEGRITY を付ける。
+//
+// RFC 8489 Section 9.2.4: 401 (Unauthenticated) には REALM と NONCE を使って、
+// 438 (Stale Nonce) には新しい NONCE を使って 1 度だけ再送する
+func (t *TURNClient) transactWith(msgType STUNMessageType, build func(txID [12]byte) []STUNAttribute) (*STUNMessage, error) {
+	for attempt := 0; ; attempt++ {
+		var txID [12]byte
+		rand.Read(txID[:])
+		msg := STUNMessage{MessageType: msgType, TransactionID: txID, Attributes: build(txID)}
+
+		var request []byte
+		if t.key != nil {
+			msg.Attributes = append(msg.Attributes,
+				stringAttribute(Username, t.username),
+				stringAttribute(Realm, t.realm),
+				stringAttribute(Nonce, t.nonce))
+			request = t.stun.encodeWithIntegrity(msg, t.key)
+		} else {
+			request = t.stun.encodeMessage(msg)
+		}
+
+		// 署名したリクエストへの応答は同じ鍵で MESSAGE-INTEGRITY を検証する
+		response, _, err := t.stun.roundTrip(t.server, request, txID, t.key)
+		if err != nil {
+			return nil, err
+		}
+		if response.MessageType == msgType|0x0100 {
+			return response, nil
+		}
+		if response.MessageType != msgType|0x0110 {
+			return nil, fmt.Errorf("unexpected response type 0x%04x", uint16(response.MessageType))
+		}
+
+		code, reason := extractErrorCode(response)
+		stunErr := &STUNError{Code: code, Reason: reason}
+		retry := attempt == 0 && (code == 401 || code == 438)
+		if !retry {
+			return nil, stunErr
+		}
+		realm, hasRealm := response.Attribute(Realm)
+		nonce, hasNonce := response.Attribute(Nonce)
+		if !hasNonce || (!hasRealm && t.realm == "") {
+			return nil, stunErr
+		}
+		if hasRealm {
+			t.realm = string(realm.Value)
+		}
+		t.nonce = string(nonce.Value)
+		t.key = LongTermKey(t.username, t.realm, t.password)
+	}
+}
+
+// stringAttribute は文字列の値を持つ属性を返します
+func stringAttribute(t STUNAttributeType, value string) STUNAttribute {
+	return STUNAttribute{Type: t, Length: uint16(len(value)), Value: []byte(value)}
+}
+
+// lifetimeOf はレスポンスの LIFETIME 属性の値を返します。無ければ 0
+func lifetimeOf(msg *STUNMessage) time.Duration {
+	if attr, ok := msg.Attribute(Lifetime); ok && len(attr.Value) >= 4 {
+		return time.Duration(binary.BigEndian.Uint32(attr.Value)) * time.Second
+	}
+	return 0
+}
+
+// EncodeChannelData は ChannelData メッセージを組み立てます
+// RFC 8656 Section 12.4: 2 バイトのチャネル番号と 2 バイトの長さに続けてデータを置く。
+// UDP ではパディングは不要
+func EncodeChannelData(channel uint16, data []byte) []byte {
+	message := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint16(message[0:2], channel)
+	binary.BigEndian.PutUint16(message[2:4], uint16(len(data)))
+	copy(message[4:], data)
+	return message
+}
+
+// DecodeChannelData はパケットが ChannelData メッセージであればチャネル番号とデータを返します
+// RFC 8656 Section 12: 先頭 2 ビットが 0b01 (0x4000-0x7FFF) なら ChannelData、0b00 なら STUN メッセージ
+func DecodeChannelData(packet []byte) (uint16, []byte, bool) {
+	if len(packet) < 4 || packet[0]&0xC0 != 0x40 {
+		return 0, nil, false
+	}
+	channel := binary.BigEndian.Uint16(packet[0:2])
+	length := int(binary.BigEndian.Uint16(packet[2:4]))
+	if 4+length > len(packet) {
+		return 0, nil, false
+	}
+	return channel, packet[4 : 4+length], true
+}
+
+// CheckRelayResult は TURN サーバーを介した中継の確認結果
+type CheckRelayResult struct {
+	Allocation *TURNAllocation `json:"allocation"`
+	// PeerAddress は中継の相手として使ったローカルソケットの、TURN サーバーから見たアドレス
+	PeerAddress *net.UDPAddr `json:"peer_address"`
+	// Inbound は相手 → 中継アドレス → クライアントの方向にデータが届いた場合に true
+	Inbound bool `json:"inbound"`
+	// Outbound はクライアント → 中継アドレス → 相手の方向にデータが届いた場合に true
+	Outbound bool `json:"outbound"`
+	// Channel は ChannelBind したチャネルで双方向にデータが届いた場合に true
+	Channel bool `json:"channel"`
+}
+
+// String は結果の文字列表現を返す
+func (r CheckRelayResult) String() string {
+	return fmt.Sprintf("Relay %s: inbound=%v, outbound=%v, channel=%v",
+		r.Allocation.RelayedAddress, r.Inbound, r.Outbound, r.Channel)
+}
+
+// checkRelayPayload, checkChannelPayload は CheckRelay で中継させるデータ。
+// 再送した Send インディケーションの遅れて届いた複製をチャネルの確認で数えないよう、別の値にする
+var (
+	checkRelayPayload   = []byte("nat-checker relay check")
+	checkChannelPayload = []byte("nat-checker channel check")
+)
+
+// CheckRelay は TURN サーバーでアロケーションを作り、実際にデータが中継されるかを確認します
+//
+// このネットワーク内に相手役のソケットをもう 1 つ開き、次の順に確認します:
+//  1. Allocate で中継アドレスを得る（長期認証）
+//  2. 相手役のソケットから TURN サーバーに Binding を送り、サーバーから見た相手のアドレスを得る
+//  3. CreatePermission で相手のアドレスを許可し、相手から中継アドレスに送信して
+//     クライアントに Data インディケーションとして届くか (Inbound)
+//  4. クライアントから Send インディケーションで送り、中継アドレスから相手に届くか (Outbound)
+//  5. ChannelBind したチャネルで同じ往復ができるか (Channel)
+//
+// 中継されなかった方向は false となり、エラーにはなりません。
+// Symmetric NAT など直接通信が難しい環境で、中継にフォールバックできるかの確認に使います。
+func CheckRelay(serverAddr, username, password string, opts ...Option) (*CheckRelayResult, error) {
+	client, err := NewTURNClient(serverAddr, username, password, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	allocation, err := client.Allocate()
+	if err != nil {
+		return nil, err
+	}
+	result := &CheckRelayResult{Allocation: allocation}
+
+	peer, err := NewSTUNClient(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("STUNクライアント作成エラー: %w", err)
+	}
+	defer peer.Close()
+
+	// TURN サーバーは Binding にも応答する (RFC 8656 Section 3)
+	binding, err := peer.SendBindingRequestTo(client.server, false, false)
+	if err != nil {
+		return nil, fmt.Errorf("相手役ソケットの Binding 失敗: %w", err)
+	}
+	result.PeerAddress = binding.MappedAddress
+
+	if err := client.CreatePermission(result.PeerAddress); err != nil {
+		return nil, err
+	}
+
+	// 相手 → クライアント。相手の NAT に中継アドレス宛のマッピングも作る
+	peerAddr, err := relayInbound(client, peer, allocation.RelayedAddress, checkRelayPayload)
+	if err != nil {
+		return nil, err
+	}
+	result.Inbound = peerAddr != nil
+	if peerAddr == nil {
+		// 相手のパケットが届かなければ、相手の NAT での中継アドレス宛のマッピングは分からない
+		peerAddr = result.PeerAddress
+	}
+
+	// クライアント → 相手
+	result.Outbound, err = relayOutbound(client, peer, peerAddr, allocation.RelayedAddress, checkRelayPayload)
+	if err != nil {
+		return nil, err
+	}
+
+	// チャネル経由の往復
+	if err := client.ChannelBind(peerAddr, MinChannelNumber); err != nil {
+		return nil, err
+	}
+	channelIn, err := relayInbound(client, peer, allocation.RelayedAddress, checkChannelPayload)
+	if err != nil {
+		return nil, err
+	}
+	channelOut, err := relayOutbound(client, peer, peerAddr, allocation.RelayedAddress, checkChannelPayload)
+	if err != nil {
+		return nil, err
+	}
+	result.Channel = channelIn != nil && channelOut
+
+	return result, nil
+}
+
+// relayInbound は peer から relayed に payload を送信し、client に届いた場合は
+// TURN サーバーが通知した相手のアドレスを返します。届かなければ nil
+//
+// データグラムが 1 つ落ちただけで中継できないと判定しないよう、届くまで
+// Binding と同じ RTO の間隔 (RFC 8489 Section 6.2.1) で再送する
+func relayInbound(client *TURNClient, peer *STUNClient, relayed *net.UDPAddr, payload []byte) (*net.UDPAddr, error) {
+	rto, transmitCount := peer.cfg.retransmission()
+	for attempt := 0; attempt < transmitCount; attempt++ {
+		if err := peer.transport.Send(payload, relayed); err != nil {
+			return nil, fmt.Errorf("中継アドレスへの送信エラー: %w", err)
+		}
+
+		deadline := time.Now().Add(rto)
+		for {
+			data, from, err := client.Receive(time.Until(deadline))
+			if err != nil {
+				if isTimeoutError(err) {
+					break
+				}
+				return nil, fmt.Errorf("中継データの受信エラー: %w", err)
+			}
+			if string(data) == string(payload) {
+				return from, nil
+			}
+		}
+		rto *= 2
+	}
+	return nil, nil
+}
+
+// relayOutbound は client から peerAddr 宛に payload を送信し、peer に relayed から届いたかを返します。
+// relayInbound と同じく、届くまで RTO の間隔で再送する
+func relayOutbound(client *TURNClient, peer *STUNClient, peerAddr, relayed *net.UDPAddr, payload []byte) (bool, error) {
+	rto, transmitCount := client.stun.cfg.retransmission()
+	buffer := make([]byte, 1500)
+	for attempt := 0; attempt < transmitCount; attempt++ {
+		if err := client.Send(peerAddr, payload); err != nil {
+			return false, fmt.Errorf("中継データの送信エラー: %w", err)
+		}
+
+		deadline := time.Now().Add(rto)
+		for {
+			n, from, err := peer.transport.Receive(buffer, deadline)
+			if err != nil {
+				if isTimeoutError(err) {
+					break
+				}
+				return false, fmt.Errorf("中継データの受信エラー: %w", err)
+			}
+			if udpAddrEqual(from, relayed) && string(buffer[:n]) == string(payload) {
+				return true, nil
+			}
+		}
+		rto *= 2
+	}
+	return false, nil
+}
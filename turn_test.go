@@ -0,0 +1,210 @@
+package natchecker
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// RFC 5769 Section 2.4: Sample Request with Long-Term Authentication
+// パスワード "The<U+00AD>M<U+00AA>tr<U+2168>" は SASLprep 後の "TheMatrIX" を使う
+func TestEncodeWithIntegrityRFC5769(t *testing.T) {
+	txID := [12]byte{0x78, 0xad, 0x34, 0x33, 0xc6, 0xad, 0x72, 0xc0, 0x29, 0xda, 0x41, 0x2e}
+	msg := STUNMessage{
+		MessageType:   BindingRequest,
+		TransactionID: txID,
+		Attributes: []STUNAttribute{
+			stringAttribute(Username, "マトリックス"),
+			stringAttribute(Nonce, "f//499k954d6OL34oL9FSTvy64sA"),
+			stringAttribute(Realm, "example.org"),
+		},
+	}
+
+	c := &STUNClient{}
+	data := c.encodeWithIntegrity(msg, LongTermKey("マトリックス", "example.org", "TheMatrIX"))
+
+	expected := "000100602112a44278ad3433c6ad72c029da412e" +
+		"00060012e3839ee38388e383aae38383e382afe382b90000" +
+		"0015001c662f2f3439396b39353464364f4c33346f4c39465354767936347341" +
+		"0014000b6578616d706c652e6f726700" +
+		"00080014f67024656dd64a3e02b8e0712e85c9a28ca89666"
+	assert.Equal(t, expected, hex.EncodeToString(data))
+}
+
+func TestXorAddressValueRoundTrip(t *testing.T) {
+	txID := [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	c := &STUNClient{}
+
+	for _, addr := range []*net.UDPAddr{
+		{IP: net.ParseIP("203.0.113.1"), Port: 49152},
+		{IP: net.ParseIP("2001:db8::1"), Port: 3478},
+	} {
+		parsed, err := c.parseAddress(xorAddressValue(addr, txID), true, txID)
+		require.NoError(t, err)
+		assert.True(t, udpAddrEqual(addr, parsed), "%s round trip: got %s", addr, parsed)
+	}
+}
+
+func TestChannelDataCodec(t *testing.T) {
+	packet := EncodeChannelData(0x4001, []byte("hello"))
+	assert.Equal(t, []byte{0x40, 0x01, 0x00, 0x05, 'h', 'e', 'l', 'l', 'o'}, packet)
+
+	channel, data, ok := DecodeChannelData(packet)
+	require.True(t, ok)
+	assert.Equal(t, uint16(0x4001), channel)
+	assert.Equal(t, []byte("hello"), data)
+
+	tests := []struct {
+		name   string
+		packet []byte
+	}{
+		{name: "STUN message", packet: buildMessage([12]byte{}, nil)},
+		{name: "too short", packet: []byte{0x40, 0x01}},
+		{name: "length exceeds packet", packet: []byte{0x40, 0x01, 0x00, 0x08, 'x'}},
+	}
+	for _, test := range tests {
+		_, _, ok := DecodeChannelData(test.packet)
+		assert.False(t, ok, test.name)
+	}
+}
+
+// serveTURNAllocate は Allocate と Refresh にだけ応答するテスト用の TURN サーバー。
+// MESSAGE-INTEGRITY の無いリクエストには 401 を返し、長期認証付きのリクエストは
+// key で検証してから XOR-RELAYED-ADDRESS を返す。成功レスポンスは signKey で署名する
+func serveTURNAllocate(conn *net.UDPConn, key, signKey []byte, relayed *net.UDPAddr) {
+	c := &STUNClient{}
+	buffer := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		msg, err := c.decodeMessage(buffer[:n])
+		if err != nil {
+			continue
+		}
+
+		reply := STUNMessage{MessageType: msg.MessageType | 0x0110, TransactionID: msg.TransactionID}
+		mi, authenticated := msg.Attribute(MessageIntegrity)
+		if authenticated {
+			mac := hmac.New(sha1.New, key)
+			mac.Write(buffer[:n-4-messageIntegrityLength])
+			authenticated = hmac.Equal(mac.Sum(nil), mi.Value)
+		}
+
+		lifetime := make([]byte, 4)
+		binary.BigEndian.PutUint32(lifetime, 600)
+		switch {
+		case !authenticated:
+			reply.Attributes = []STUNAttribute{
+				{Type: ErrorCode, Length: 4, Value: []byte{0, 0, 4, 1}},
+				stringAttribute(Realm, "example.org"),
+				stringAttribute(Nonce, "nonce-1"),
+			}
+		case msg.MessageType == AllocateRequest:
+			relayedValue := xorAddressValue(relayed, msg.TransactionID)
+			mappedValue := xorAddressValue(from, msg.TransactionID)
+			reply.MessageType = AllocateResponse
+			reply.Attributes = []STUNAttribute{
+				{Type: XorRelayedAddress, Length: uint16(len(relayedValue)), Value: relayedValue},
+				{Type: XorMappedAddress, Length: uint16(len(mappedValue)), Value: mappedValue},
+				{Type: Lifetime, Length: 4, Value: lifetime},
+			}
+		case msg.MessageType == RefreshRequest:
+			attr, _ := msg.Attribute(Lifetime)
+			reply.MessageType = RefreshResponse
+			reply.Attributes = []STUNAttribute{{Type: Lifetime, Length: 4, Value: attr.Value}}
+		default:
+			continue
+		}
+		if authenticated && signKey != nil {
+			conn.WriteToUDP(c.encodeWithIntegrity(reply, signKey), from)
+		} else {
+			conn.WriteToUDP(c.encodeMessage(reply), from)
+		}
+	}
+}
+
+func TestTURNClientAllocate(t *testing.T) {
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer server.Close()
+	relayed := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 50000}
+	key := LongTermKey("alice", "example.org", "secret")
+	go serveTURNAllocate(server, key, key, relayed)
+
+	client, err := NewTURNClient(server.LocalAddr().String(), "alice", "secret",
+		WithAddressFamily(IPv4Only), WithRetransmission(50*time.Millisecond, 3))
+	require.NoError(t, err)
+	defer client.Close()
+
+	allocation, err := client.Allocate()
+	require.NoError(t, err)
+	assert.True(t, udpAddrEqual(relayed, allocation.RelayedAddress))
+	assert.NotNil(t, allocation.MappedAddress)
+	assert.Equal(t, 600*time.Second, allocation.Lifetime)
+
+	granted, err := client.Refresh(300 * time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, 300*time.Second, granted)
+	assert.Equal(t, 300*time.Second, client.Allocation().Lifetime)
+}
+
+func TestTURNClientAllocateWrongPassword(t *testing.T) {
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer server.Close()
+	key := LongTermKey("alice", "example.org", "secret")
+	go serveTURNAllocate(server, key, key, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 50000})
+
+	client, err := NewTURNClient(server.LocalAddr().String(), "alice", "wrong",
+		WithAddressFamily(IPv4Only), WithRetransmission(50*time.Millisecond, 3))
+	require.NoError(t, err)
+	defer client.Close()
+
+	_, err = client.Allocate()
+	var stunErr *STUNError
+	require.True(t, errors.As(err, &stunErr), "expected STUN error, got %v", err)
+	assert.Equal(t, 401, stunErr.Code)
+}
+
+func TestTURNClientDiscardsUnauthenticatedResponse(t *testing.T) {
+	key := LongTermKey("alice", "example.org", "secret")
+	for name, signKey := range map[string][]byte{
+		"unsigned":  nil,
+		"wrong key": LongTermKey("alice", "example.org", "other"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+			require.NoError(t, err)
+			defer server.Close()
+			go serveTURNAllocate(server, key, signKey, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 50000})
+
+			client, err := NewTURNClient(server.LocalAddr().String(), "alice", "secret",
+				WithAddressFamily(IPv4Only), WithRetransmission(20*time.Millisecond, 2))
+			require.NoError(t, err)
+			defer client.stun.Close()
+
+			// RFC 8489 Section 9.2.5: 検証できない成功レスポンスは受信しなかったものとして捨てる
+			_, err = client.Allocate()
+			require.Error(t, err)
+			assert.True(t, isTimeoutError(err), "got %v", err)
+		})
+	}
+}
+
+func TestChannelBindRejectsInvalidChannel(t *testing.T) {
+	client := &TURNClient{channels: make(map[uint16]*net.UDPAddr)}
+	for _, channel := range []uint16{0x3FFF, 0x5000} {
+		err := client.ChannelBind(&net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 5000}, channel)
+		assert.Error(t, err, "channel 0x%04x", channel)
+	}
+}
@@ -0,0 +1,635 @@
+// Package turnserver は中継経路をローカルで試験するための最小限の TURN サーバー (RFC 8656) です。
+//
+// UDP のアロケーション、静的なユーザー表による長期認証 (RFC 8489 Section 9.2)、
+// パーミッション、チャネル、寿命の管理に対応します。メッセージの組み立てと解析には
+// natchecker のクライアントと同じコーデックを使うため、natchecker.CheckRelay や
+// natchecker.TURNClient の試験を coturn なしで実行できます。
+//
+// TCP 割り当て (RFC 6062)、DONT-FRAGMENT、EVEN-PORT、RESERVATION-TOKEN、
+// 帯域やアロケーション数の制限には対応しません。
+package turnserver
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	natchecker "github.com/moepig/nat-checker"
+)
+
+// 寿命の既定値
+const (
+	// DefaultLifetime はアロケーションの既定の寿命
+	// RFC 8656 Section 3.2: "the default lifetime of an allocation is 10 minutes"
+	DefaultLifetime = 10 * time.Minute
+	// MaxLifetime はクライアントが要求できる寿命の上限
+	// RFC 8656 Section 7.2: "the server SHOULD NOT allow it to be larger than 3600 seconds"
+	MaxLifetime = time.Hour
+
+	// permissionLifetime はパーミッションの寿命
+	// RFC 8656 Section 9: "The Permission Lifetime MUST be 300 seconds (= 5 minutes)."
+	permissionLifetime = 5 * time.Minute
+	// channelLifetime はチャネルの寿命
+	// RFC 8656 Section 12: "a channel binding lasts for 10 minutes unless refreshed"
+	channelLifetime = 10 * time.Minute
+)
+
+// expiryInterval は期限切れのアロケーション・パーミッション・チャネルを削除する間隔
+const expiryInterval = 100 * time.Millisecond
+
+// protocolUDP は REQUESTED-TRANSPORT の UDP のプロトコル番号 (RFC 8656 Section 18.7)
+const protocolUDP = 17
+
+// Config はサーバーの設定
+type Config struct {
+	// ListenAddr はクライアントからのリクエストを待ち受けるアドレス (例 "127.0.0.1:3478")。
+	// ポートが 0 なら空いているポートが選ばれる
+	ListenAddr string
+	// RelayIP は中継アドレスを割り当てる IP。空なら ListenAddr の IP を使う
+	RelayIP string
+	// Realm は長期認証の REALM。空なら "nat-checker"
+	Realm string
+	// Users はユーザー名とパスワードの表
+	Users map[string]string
+	// Lifetime は LIFETIME を指定しない Allocate・Refresh に与える寿命。0 なら DefaultLifetime。
+	// 要求された寿命もこの値と MaxLifetime の間に丸められる
+	Lifetime time.Duration
+	// ListenPacket は待ち受けと中継 (relayed transport address) のソケットを作る関数
+	// (nil なら net.ListenUDP)
+	ListenPacket natchecker.ListenPacketFunc
+}
+
+// Server は TURN サーバー
+type Server struct {
+	conn    net.PacketConn
+	cfg     Config
+	relayIP net.IP
+
+	// nonce は 401 応答で配る NONCE。Close まで同じ値を使う
+	nonce string
+
+	mu sync.Mutex
+	// allocations はクライアントのアドレス (5-tuple の代わり) ごとのアロケーション
+	allocations map[string]*allocation
+	// closed は Close が始まると true になる。以降のリクエストには応答せず、
+	// Close が待てない中継ソケットと goroutine を作らない
+	closed bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// allocation は 1 つのクライアントに割り当てた中継ソケットとその状態
+type allocation struct {
+	client   *net.UDPAddr
+	relay    net.PacketConn
+	username string
+	key      []byte
+	expires  time.Time
+	// permissions は許可した相手の IP アドレスごとの期限
+	permissions map[string]time.Time
+	channels    map[uint16]*channelBinding
+}
+
+// channelBinding はチャネル番号に割り当てた相手とその期限
+type channelBinding struct {
+	peer    *net.UDPAddr
+	expires time.Time
+}
+
+// Listen は cfg で TURN サーバーを起動します
+func Listen(cfg Config) (*Server, error) {
+	addr, err := net.ResolveUDPAddr("udp", cfg.ListenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("待ち受けアドレス解決エラー: %w", err)
+	}
+	relayIP := addr.IP
+	if cfg.RelayIP != "" {
+		relayIP = net.ParseIP(cfg.RelayIP)
+		if relayIP == nil {
+			return nil, fmt.Errorf("invalid relay IP %q", cfg.RelayIP)
+		}
+	}
+	if relayIP == nil || relayIP.IsUnspecified() {
+		return nil, fmt.Errorf("relay IP must be specified when listening on %q", cfg.ListenAddr)
+	}
+	if cfg.Realm == "" {
+		cfg.Realm = "nat-checker"
+	}
+	if cfg.Lifetime <= 0 {
+		cfg.Lifetime = DefaultLifetime
+	}
+
+	s := &Server{
+		cfg:         cfg,
+		relayIP:     relayIP,
+		nonce:       newNonce(),
+		allocations: make(map[string]*allocation),
+		done:        make(chan struct{}),
+	}
+	conn, err := s.cfg.ListenPacket.Listen("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("ソケット作成エラー: %w", err)
+	}
+	s.conn = conn
+	s.wg.Add(2)
+	go s.serve()
+	go s.expire()
+	return s, nil
+}
+
+// readFrom は conn から 1 つのパケットを受信し、送信元を IPv4 は 4 バイトの形で返します
+func readFrom(conn net.PacketConn, buffer []byte) (int, *net.UDPAddr, error) {
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return 0, nil, err
+		}
+		from, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		if ip4 := from.IP.To4(); ip4 != nil {
+			from = &net.UDPAddr{IP: ip4, Port: from.Port, Zone: from.Zone}
+		}
+		return n, from, nil
+	}
+}
+
+// ListenLoopback は 127.0.0.1 の空いているポートで、users を認証する TURN サーバーを起動します
+func ListenLoopback(users map[string]string) (*Server, error) {
+	return Listen(Config{ListenAddr: "127.0.0.1:0", Users: users})
+}
+
+// Addr はサーバーの待ち受けアドレスを返します
+func (s *Server) Addr() *net.UDPAddr {
+	return s.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Realm は長期認証の REALM を返します
+func (s *Server) Realm() string {
+	return s.cfg.Realm
+}
+
+// Allocations は有効なアロケーションの数を返します
+func (s *Server) Allocations() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.allocations)
+}
+
+// Close はすべてのアロケーションを削除してソケットを閉じ、処理の終了を待ちます
+func (s *Server) Close() error {
+	close(s.done)
+	err := s.conn.Close()
+
+	s.mu.Lock()
+	s.closed = true
+	for key, alloc := range s.allocations {
+		alloc.relay.Close()
+		delete(s.allocations, key)
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// serve はクライアントからのパケットを処理します
+func (s *Server) serve() {
+	defer s.wg.Done()
+	buffer := make([]byte, 65536)
+	for {
+		n, from, err := readFrom(s.conn, buffer)
+		if err != nil {
+			return
+		}
+		packet := buffer[:n]
+
+		// RFC 8656 Section 12: 先頭 2 ビットが 0b01 なら ChannelData
+		if channel, data, ok := natchecker.DecodeChannelData(packet); ok {
+			s.handleChannelData(from, channel, data)
+			continue
+		}
+
+		msg, err := natchecker.DecodeMessage(packet)
+		if err != nil {
+			continue
+		}
+		if msg.MessageType == natchecker.SendIndication {
+			s.handleSend(from, msg)
+			continue
+		}
+		if response, ok := s.handleRequest(from, msg, packet); ok {
+			s.conn.WriteTo(response, from)
+		}
+	}
+}
+
+// expire は期限切れのアロケーション・パーミッション・チャネルを定期的に削除します
+func (s *Server) expire() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for key, alloc := range s.allocations {
+				if now.After(alloc.expires) {
+					alloc.relay.Close()
+					delete(s.allocations, key)
+					continue
+				}
+				for ip, expires := range alloc.permissions {
+					if now.After(expires) {
+						delete(alloc.permissions, ip)
+					}
+				}
+				for channel, binding := range alloc.channels {
+					if now.After(binding.expires) {
+						delete(alloc.channels, channel)
+					}
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// handleRequest はリクエストに対する応答を組み立てます。応答不要なメッセージなら false
+func (s *Server) handleRequest(from *net.UDPAddr, msg *natchecker.STUNMessage, raw []byte) ([]byte, bool) {
+	// リクエストクラス (C1=0, C0=0) 以外には応答しない
+	if uint16(msg.MessageType)&0x0110 != 0 {
+		return nil, false
+	}
+
+	// RFC 8656 Section 3: TURN サーバーは STUN サーバーとして Binding にも応答する
+	if msg.MessageType == natchecker.BindingRequest {
+		return natchecker.EncodeMessage(natchecker.STUNMessage{
+			MessageType:   natchecker.BindingResponse,
+			TransactionID: msg.TransactionID,
+			Attributes: []natchecker.STUNAttribute{
+				natchecker.NewAddressAttribute(natchecker.XorMappedAddress, from, msg.TransactionID),
+			},
+		}), true
+	}
+
+	switch msg.MessageType {
+	case natchecker.AllocateRequest, natchecker.RefreshRequest,
+		natchecker.CreatePermissionRequest, natchecker.ChannelBindRequest:
+	default:
+		return s.errorResponse(msg, 400, "Bad Request", nil), true
+	}
+
+	username, key, failure := s.authenticate(msg, raw)
+	if failure != nil {
+		return failure, true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Close の後に処理が始まったリクエストは読み捨てる
+	if s.closed {
+		return nil, false
+	}
+
+	alloc := s.allocations[from.String()]
+	// RFC 8656 Section 5: アロケーションを作ったユーザーと異なる資格情報は 441 (Wrong Credentials)
+	if alloc != nil && alloc.username != username {
+		return s.errorResponse(msg, 441, "Wrong Credentials", key), true
+	}
+
+	var attrs []natchecker.STUNAttribute
+	var code int
+	var reason string
+	switch msg.MessageType {
+	case natchecker.AllocateRequest:
+		attrs, code, reason = s.allocate(from, msg, username, key, alloc)
+	case natchecker.RefreshRequest:
+		attrs, code, reason = s.refresh(from, msg, alloc)
+	case natchecker.CreatePermissionRequest:
+		code, reason = s.createPermission(msg, alloc)
+	case natchecker.ChannelBindRequest:
+		code, reason = s.channelBind(msg, alloc)
+	}
+	if code != 0 {
+		return s.errorResponse(msg, code, reason, key), true
+	}
+
+	return natchecker.EncodeWithIntegrity(natchecker.STUNMessage{
+		MessageType:   msg.MessageType | 0x0100,
+		TransactionID: msg.TransactionID,
+		Attributes:    attrs,
+	}, key), true
+}
+
+// authenticate は長期認証 (RFC 8489 Section 9.2.4) でリクエストを検証し、
+// ユーザー名と鍵を返します。失敗した場合は送り返すエラーレスポンスを返す
+func (s *Server) authenticate(msg *natchecker.STUNMessage, raw []byte) (string, []byte, []byte) {
+	// 資格情報が無ければ 401 と REALM, NONCE を返し、クライアントに再送させる
+	if _, ok := msg.Attribute(natchecker.MessageIntegrity); !ok {
+		return "", nil, s.challenge(msg, 401, "Unauthenticated")
+	}
+	usernameAttr, hasUsername := msg.Attribute(natchecker.Username)
+	realmAttr, hasRealm := msg.Attribute(natchecker.Realm)
+	nonceAttr, hasNonce := msg.Attribute(natchecker.Nonce)
+	if !hasUsername || !hasRealm || !hasNonce {
+		return "", nil, s.errorResponse(msg, 400, "Bad Request", nil)
+	}
+
+	if string(nonceAttr.Value) != s.nonce {
+		return "", nil, s.challenge(msg, 438, "Stale Nonce")
+	}
+
+	username := string(usernameAttr.Value)
+	password, known := s.cfg.Users[username]
+	if !known || string(realmAttr.Value) != s.cfg.Realm {
+		return "", nil, s.challenge(msg, 401, "Unauthenticated")
+	}
+	key := natchecker.LongTermKey(username, s.cfg.Realm, password)
+	if !natchecker.VerifyIntegrity(raw, key) {
+		return "", nil, s.challenge(msg, 401, "Unauthenticated")
+	}
+	return username, key, nil
+}
+
+// allocate は Allocate リクエストを処理します (RFC 8656 Section 7.2)
+func (s *Server) allocate(from *net.UDPAddr, msg *natchecker.STUNMessage, username string, key []byte, alloc *allocation) ([]natchecker.STUNAttribute, int, string) {
+	if alloc != nil {
+		return nil, 437, "Allocation Mismatch"
+	}
+	transport, ok := msg.Attribute(natchecker.RequestedTransport)
+	if !ok || len(transport.Value) < 1 {
+		return nil, 400, "Bad Request"
+	}
+	if transport.Value[0] != protocolUDP {
+		return nil, 442, "Unsupported Transport Protocol"
+	}
+
+	relay, err := s.cfg.ListenPacket.Listen("udp", &net.UDPAddr{IP: s.relayIP})
+	if err != nil {
+		return nil, 508, "Insufficient Capacity"
+	}
+	lifetime := s.lifetime(msg)
+	alloc = &allocation{
+		client:      from,
+		relay:       relay,
+		username:    username,
+		key:         key,
+		expires:     time.Now().Add(lifetime),
+		permissions: make(map[string]time.Time),
+		channels:    make(map[uint16]*channelBinding),
+	}
+	s.allocations[from.String()] = alloc
+
+	s.wg.Add(1)
+	go s.relay(alloc)
+
+	relayed := relay.LocalAddr().(*net.UDPAddr)
+	return []natchecker.STUNAttribute{
+		natchecker.NewAddressAttribute(natchecker.XorRelayedAddress, relayed, msg.TransactionID),
+		natchecker.NewAddressAttribute(natchecker.XorMappedAddress, from, msg.TransactionID),
+		lifetimeAttribute(lifetime),
+	}, 0, ""
+}
+
+// refresh は Refresh リクエストを処理します (RFC 8656 Section 7.3)
+// LIFETIME が 0 ならアロケーションを削除する
+func (s *Server) refresh(from *net.UDPAddr, msg *natchecker.STUNMessage, alloc *allocation) ([]natchecker.STUNAttribute, int, string) {
+	if alloc == nil {
+		return nil, 437, "Allocation Mismatch"
+	}
+	if attr, ok := msg.Attribute(natchecker.Lifetime); ok && len(attr.Value) >= 4 && binary.BigEndian.Uint32(attr.Value) == 0 {
+		alloc.relay.Close()
+		delete(s.allocations, from.String())
+		return []natchecker.STUNAttribute{lifetimeAttribute(0)}, 0, ""
+	}
+
+	lifetime := s.lifetime(msg)
+	alloc.expires = time.Now().Add(lifetime)
+	return []natchecker.STUNAttribute{lifetimeAttribute(lifetime)}, 0, ""
+}
+
+// createPermission は CreatePermission リクエストを処理します (RFC 8656 Section 10.2)
+// 1 つのリクエストに含まれるすべての XOR-PEER-ADDRESS を許可する
+func (s *Server) createPermission(msg *natchecker.STUNMessage, alloc *allocation) (int, string) {
+	if alloc == nil {
+		return 437, "Allocation Mismatch"
+	}
+	var peers []*net.UDPAddr
+	for _, attr := range msg.Attributes {
+		if attr.Type != natchecker.XorPeerAddress {
+			continue
+		}
+		peer, err := natchecker.ParseAddressAttribute(attr, msg.TransactionID)
+		if err != nil {
+			return 400, "Bad Request"
+		}
+		peers = append(peers, peer)
+	}
+	if len(peers) == 0 {
+		return 400, "Bad Request"
+	}
+
+	expires := time.Now().Add(permissionLifetime)
+	for _, peer := range peers {
+		alloc.permissions[peer.IP.String()] = expires
+	}
+	return 0, ""
+}
+
+// channelBind は ChannelBind リクエストを処理します (RFC 8656 Section 12.2)
+func (s *Server) channelBind(msg *natchecker.STUNMessage, alloc *allocation) (int, string) {
+	if alloc == nil {
+		return 437, "Allocation Mismatch"
+	}
+	numberAttr, hasNumber := msg.Attribute(natchecker.ChannelNumber)
+	peerAttr, hasPeer := msg.Attribute(natchecker.XorPeerAddress)
+	if !hasNumber || !hasPeer || len(numberAttr.Value) < 2 {
+		return 400, "Bad Request"
+	}
+	channel := binary.BigEndian.Uint16(numberAttr.Value)
+	if channel < natchecker.MinChannelNumber || channel > natchecker.MaxChannelNumber {
+		return 400, "Bad Request"
+	}
+	peer, err := natchecker.ParseAddressAttribute(peerAttr, msg.TransactionID)
+	if err != nil {
+		return 400, "Bad Request"
+	}
+
+	// RFC 8656 Section 12.2: チャネルが別の相手に、または相手が別のチャネルに
+	// 割り当て済みなら 400 (Bad Request)
+	for number, binding := range alloc.channels {
+		samePeer := addrEqual(binding.peer, peer)
+		if (number == channel) != samePeer {
+			return 400, "Bad Request"
+		}
+	}
+
+	now := time.Now()
+	alloc.channels[channel] = &channelBinding{peer: peer, expires: now.Add(channelLifetime)}
+	// チャネルの割り当てはパーミッションの作成・更新も兼ねる
+	alloc.permissions[peer.IP.String()] = now.Add(permissionLifetime)
+	return 0, ""
+}
+
+// handleSend は Send インディケーションのデータを中継アドレスから相手に送ります (RFC 8656 Section 11.2)
+// インディケーションには応答しないため、条件を満たさないものは黙って捨てる
+func (s *Server) handleSend(from *net.UDPAddr, msg *natchecker.STUNMessage) {
+	peerAttr, hasPeer := msg.Attribute(natchecker.XorPeerAddress)
+	dataAttr, hasData := msg.Attribute(natchecker.Data)
+	if !hasPeer || !hasData {
+		return
+	}
+	peer, err := natchecker.ParseAddressAttribute(peerAttr, msg.TransactionID)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	alloc := s.allocations[from.String()]
+	permitted := alloc != nil && alloc.permitted(peer.IP)
+	s.mu.Unlock()
+	if permitted {
+		alloc.relay.WriteTo(dataAttr.Value, peer)
+	}
+}
+
+// handleChannelData は ChannelData のデータをチャネルの相手に送ります (RFC 8656 Section 12.5)
+func (s *Server) handleChannelData(from *net.UDPAddr, channel uint16, data []byte) {
+	s.mu.Lock()
+	var peer *net.UDPAddr
+	alloc := s.allocations[from.String()]
+	if alloc != nil {
+		if binding, ok := alloc.channels[channel]; ok {
+			peer = binding.peer
+		}
+	}
+	s.mu.Unlock()
+	if peer != nil {
+		alloc.relay.WriteTo(data, peer)
+	}
+}
+
+// relay は中継ソケットに相手から届いたデータをクライアントに転送します (RFC 8656 Section 11.3)
+// パーミッションの無い相手からのデータは捨てる。チャネルが割り当てられていれば ChannelData、
+// そうでなければ Data インディケーションで送る
+func (s *Server) relay(alloc *allocation) {
+	defer s.wg.Done()
+	buffer := make([]byte, 65536)
+	for {
+		n, peer, err := readFrom(alloc.relay, buffer)
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		permitted := alloc.permitted(peer.IP)
+		channel, bound := alloc.channelFor(peer)
+		s.mu.Unlock()
+		if !permitted {
+			continue
+		}
+
+		if bound {
+			s.conn.WriteTo(natchecker.EncodeChannelData(channel, buffer[:n]), alloc.client)
+			continue
+		}
+		var txID [12]byte
+		rand.Read(txID[:])
+		data := append([]byte(nil), buffer[:n]...)
+		s.conn.WriteTo(natchecker.EncodeMessage(natchecker.STUNMessage{
+			MessageType:   natchecker.DataIndication,
+			TransactionID: txID,
+			Attributes: []natchecker.STUNAttribute{
+				natchecker.NewAddressAttribute(natchecker.XorPeerAddress, peer, txID),
+				{Type: natchecker.Data, Length: uint16(len(data)), Value: data},
+			},
+		}), alloc.client)
+	}
+}
+
+// permitted は ip からの受信・ip への送信が許可されているかを返します。s.mu を保持して呼ぶ
+func (a *allocation) permitted(ip net.IP) bool {
+	expires, ok := a.permissions[ip.String()]
+	return ok && time.Now().Before(expires)
+}
+
+// channelFor は peer に割り当てたチャネル番号を返します。s.mu を保持して呼ぶ
+func (a *allocation) channelFor(peer *net.UDPAddr) (uint16, bool) {
+	for channel, binding := range a.channels {
+		if addrEqual(binding.peer, peer) {
+			return channel, true
+		}
+	}
+	return 0, false
+}
+
+// lifetime はリクエストの LIFETIME を設定の寿命と MaxLifetime の間に丸めて返します
+// RFC 8656 Section 7.2: 要求が既定値より短ければ既定値を、上限より長ければ上限を使う
+func (s *Server) lifetime(msg *natchecker.STUNMessage) time.Duration {
+	lifetime := s.cfg.Lifetime
+	if attr, ok := msg.Attribute(natchecker.Lifetime); ok && len(attr.Value) >= 4 {
+		requested := time.Duration(binary.BigEndian.Uint32(attr.Value)) * time.Second
+		lifetime = max(lifetime, min(requested, MaxLifetime))
+	}
+	return lifetime
+}
+
+// challenge は REALM と NONCE を付けた 401 または 438 のエラーレスポンスを返します
+func (s *Server) challenge(msg *natchecker.STUNMessage, code int, reason string) []byte {
+	return natchecker.EncodeMessage(natchecker.STUNMessage{
+		MessageType:   msg.MessageType | 0x0110,
+		TransactionID: msg.TransactionID,
+		Attributes: []natchecker.STUNAttribute{
+			natchecker.NewErrorCodeAttribute(code, reason),
+			stringAttribute(natchecker.Realm, s.cfg.Realm),
+			stringAttribute(natchecker.Nonce, s.nonce),
+		},
+	})
+}
+
+// errorResponse はエラーレスポンスを返します。key があれば MESSAGE-INTEGRITY を付ける
+func (s *Server) errorResponse(msg *natchecker.STUNMessage, code int, reason string, key []byte) []byte {
+	response := natchecker.STUNMessage{
+		MessageType:   msg.MessageType | 0x0110,
+		TransactionID: msg.TransactionID,
+		Attributes:    []natchecker.STUNAttribute{natchecker.NewErrorCodeAttribute(code, reason)},
+	}
+	if key != nil {
+		return natchecker.EncodeWithIntegrity(response, key)
+	}
+	return natchecker.EncodeMessage(response)
+}
+
+// lifetimeAttribute は秒単位の LIFETIME 属性を返します
+func lifetimeAttribute(lifetime time.Duration) natchecker.STUNAttribute {
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, uint32(lifetime/time.Second))
+	return natchecker.STUNAttribute{Type: natchecker.Lifetime, Length: 4, Value: value}
+}
+
+// stringAttribute は文字列の値を持つ属性を返します
+func stringAttribute(t natchecker.STUNAttributeType, value string) natchecker.STUNAttribute {
+	return natchecker.STUNAttribute{Type: t, Length: uint16(len(value)), Value: []byte(value)}
+}
+
+// newNonce はランダムな NONCE を返します
+func newNonce() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// addrEqual は 2 つのアドレスの IP とポートが等しいかを返します
+func addrEqual(a, b *net.UDPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
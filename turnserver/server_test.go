@@ -0,0 +1,309 @@
+package turnserver
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	natchecker "github.com/moepig/nat-checker"
+	"github.com/moepig/nat-checker/vnet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testUsers = map[string]string{"alice": "secret"}
+
+func newTestClient(t *testing.T, server *Server, password string) *natchecker.TURNClient {
+	t.Helper()
+	client, err := natchecker.NewTURNClient(server.Addr().String(), "alice", password,
+		natchecker.WithAddressFamily(natchecker.IPv4Only),
+		natchecker.WithRetransmission(50*time.Millisecond, 3))
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+	return client
+}
+
+func newPeer(t *testing.T) *net.UDPConn {
+	t.Helper()
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	t.Cleanup(func() { peer.Close() })
+	return peer
+}
+
+func requireSTUNError(t *testing.T, err error, code int) {
+	t.Helper()
+	var stunErr *natchecker.STUNError
+	require.True(t, errors.As(err, &stunErr), "expected STUN error, got %v", err)
+	assert.Equal(t, code, stunErr.Code)
+}
+
+func TestListenValidation(t *testing.T) {
+	_, err := Listen(Config{ListenAddr: "0.0.0.0:0"})
+	assert.Error(t, err, "unspecified relay IP")
+
+	_, err = Listen(Config{ListenAddr: "127.0.0.1:0", RelayIP: "not-an-ip"})
+	assert.Error(t, err)
+}
+
+func TestCheckRelay(t *testing.T) {
+	server, err := ListenLoopback(testUsers)
+	require.NoError(t, err)
+	defer server.Close()
+
+	result, err := natchecker.CheckRelay(server.Addr().String(), "alice", "secret",
+		natchecker.WithAddressFamily(natchecker.IPv4Only),
+		natchecker.WithRetransmission(50*time.Millisecond, 3))
+	require.NoError(t, err)
+
+	assert.True(t, result.Allocation.RelayedAddress.IP.Equal(net.ParseIP("127.0.0.1")))
+	assert.Equal(t, DefaultLifetime, result.Allocation.Lifetime)
+	assert.True(t, result.Inbound, "peer -> client via Data indication")
+	assert.True(t, result.Outbound, "client -> peer via Send indication")
+	assert.True(t, result.Channel, "round trip via ChannelData")
+
+	// CheckRelay は終了時に LIFETIME 0 の Refresh でアロケーションを削除する
+	assert.Equal(t, 0, server.Allocations())
+}
+
+func TestCheckRelayOnVirtualNetwork(t *testing.T) {
+	internet := vnet.New()
+	serverHost, err := internet.AddHost("198.51.100.1")
+	require.NoError(t, err)
+	server, err := Listen(Config{ListenAddr: "198.51.100.1:3478", Users: testUsers, ListenPacket: serverHost.ListenPacket})
+	require.NoError(t, err)
+	defer server.Close()
+
+	// 直接通信が難しい Symmetric NAT の内側からでも中継は使える
+	nat, err := internet.AddNAT("203.0.113.1", vnet.NATConfig{
+		Mapping:   natchecker.AddressPortDependent,
+		Filtering: natchecker.AddressPortDependentFiltering,
+	})
+	require.NoError(t, err)
+	client, err := nat.Inside().AddHost("192.168.0.2")
+	require.NoError(t, err)
+
+	result, err := natchecker.CheckRelay("198.51.100.1:3478", "alice", "secret",
+		natchecker.WithListenPacket(client.ListenPacket),
+		natchecker.WithRetransmission(50*time.Millisecond, 3))
+	require.NoError(t, err)
+	assert.True(t, result.Allocation.RelayedAddress.IP.Equal(net.ParseIP("198.51.100.1")))
+	assert.True(t, result.Allocation.MappedAddress.IP.Equal(nat.PublicIP()))
+	assert.True(t, result.Inbound)
+	assert.True(t, result.Outbound)
+	assert.True(t, result.Channel)
+}
+
+// lossyConn は drop が true を返したデータグラムを送信せずに捨てる net.PacketConn
+type lossyConn struct {
+	net.PacketConn
+	drop func(data []byte) bool
+}
+
+func (c *lossyConn) WriteTo(data []byte, addr net.Addr) (int, error) {
+	if c.drop(data) {
+		return len(data), nil
+	}
+	return c.PacketConn.WriteTo(data, addr)
+}
+
+func TestCheckRelayRetransmitsPayload(t *testing.T) {
+	server, err := ListenLoopback(testUsers)
+	require.NoError(t, err)
+	defer server.Close()
+
+	// 中継させるデータを含む送信を 1 回おきに捨てる。各方向の最初の送信は必ず失われる
+	var mu sync.Mutex
+	payloads := 0
+	drop := func(data []byte) bool {
+		// レルム名 "nat-checker" を含む認証付きリクエストは捨てない
+		if !bytes.Contains(data, []byte(" check")) {
+			return false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		payloads++
+		return payloads%2 == 1
+	}
+	listen := func(network string, laddr *net.UDPAddr) (net.PacketConn, error) {
+		conn, err := net.ListenUDP(network, laddr)
+		if err != nil {
+			return nil, err
+		}
+		return &lossyConn{PacketConn: conn, drop: drop}, nil
+	}
+
+	result, err := natchecker.CheckRelay(server.Addr().String(), "alice", "secret",
+		natchecker.WithAddressFamily(natchecker.IPv4Only),
+		natchecker.WithRetransmission(50*time.Millisecond, 3),
+		natchecker.WithListenPacket(listen))
+	require.NoError(t, err)
+	assert.True(t, result.Inbound)
+	assert.True(t, result.Outbound)
+	assert.True(t, result.Channel)
+	assert.Equal(t, 8, payloads, "each of the four transfers is sent twice")
+}
+
+func TestAuthentication(t *testing.T) {
+	server, err := ListenLoopback(testUsers)
+	require.NoError(t, err)
+	defer server.Close()
+
+	_, err = newTestClient(t, server, "wrong").Allocate()
+	requireSTUNError(t, err, 401)
+
+	unknown, err := natchecker.NewTURNClient(server.Addr().String(), "mallory", "secret",
+		natchecker.WithAddressFamily(natchecker.IPv4Only),
+		natchecker.WithRetransmission(50*time.Millisecond, 3))
+	require.NoError(t, err)
+	defer unknown.Close()
+	_, err = unknown.Allocate()
+	requireSTUNError(t, err, 401)
+
+	assert.Equal(t, 0, server.Allocations())
+}
+
+func TestAllocationMismatch(t *testing.T) {
+	server, err := ListenLoopback(testUsers)
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := newTestClient(t, server, "secret")
+	_, err = client.Refresh(time.Minute)
+	requireSTUNError(t, err, 437)
+
+	_, err = client.Allocate()
+	require.NoError(t, err)
+	_, err = client.Allocate()
+	requireSTUNError(t, err, 437)
+}
+
+func TestRefreshClampsLifetime(t *testing.T) {
+	server, err := ListenLoopback(testUsers)
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := newTestClient(t, server, "secret")
+	_, err = client.Allocate()
+	require.NoError(t, err)
+
+	granted, err := client.Refresh(2 * time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, MaxLifetime, granted)
+
+	granted, err = client.Refresh(time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultLifetime, granted)
+}
+
+func TestAllocationExpires(t *testing.T) {
+	server, err := Listen(Config{ListenAddr: "127.0.0.1:0", Users: testUsers, Lifetime: time.Second})
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := newTestClient(t, server, "secret")
+	allocation, err := client.Allocate()
+	require.NoError(t, err)
+	assert.Equal(t, time.Second, allocation.Lifetime)
+	assert.Equal(t, 1, server.Allocations())
+
+	time.Sleep(time.Second + 3*expiryInterval)
+	assert.Equal(t, 0, server.Allocations())
+	_, err = client.Refresh(time.Minute)
+	requireSTUNError(t, err, 437)
+}
+
+func TestPermissionRequired(t *testing.T) {
+	server, err := ListenLoopback(testUsers)
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := newTestClient(t, server, "secret")
+	allocation, err := client.Allocate()
+	require.NoError(t, err)
+	peer := newPeer(t)
+	peerAddr := peer.LocalAddr().(*net.UDPAddr)
+
+	// パーミッションが無い相手からのデータは中継されない
+	_, err = peer.WriteToUDP([]byte("before"), allocation.RelayedAddress)
+	require.NoError(t, err)
+	_, _, err = client.Receive(200 * time.Millisecond)
+	assert.Error(t, err, "data from a peer without permission must be dropped")
+
+	require.NoError(t, client.CreatePermission(peerAddr))
+	_, err = peer.WriteToUDP([]byte("after"), allocation.RelayedAddress)
+	require.NoError(t, err)
+	data, from, err := client.Receive(time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "after", string(data))
+	assert.Equal(t, peerAddr.Port, from.Port)
+}
+
+func TestChannelBind(t *testing.T) {
+	server, err := ListenLoopback(testUsers)
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := newTestClient(t, server, "secret")
+	allocation, err := client.Allocate()
+	require.NoError(t, err)
+	peer := newPeer(t)
+	peerAddr := peer.LocalAddr().(*net.UDPAddr)
+
+	// チャネルの割り当てはパーミッションも作る
+	require.NoError(t, client.ChannelBind(peerAddr, natchecker.MinChannelNumber))
+	require.NoError(t, client.Send(peerAddr, []byte("hello")))
+
+	buffer := make([]byte, 1500)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := peer.ReadFromUDP(buffer)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buffer[:n]))
+	assert.Equal(t, allocation.RelayedAddress.Port, from.Port)
+
+	// 同じ相手を別のチャネルに割り当てることはできない
+	err = client.ChannelBind(peerAddr, natchecker.MinChannelNumber+1)
+	requireSTUNError(t, err, 400)
+}
+
+func TestAllocateAfterClose(t *testing.T) {
+	server, err := ListenLoopback(testUsers)
+	require.NoError(t, err)
+	require.NoError(t, server.Close())
+
+	// Close がロックを持つ間に読み込まれていた Allocate を、Close の後に処理する
+	attr := func(t natchecker.STUNAttributeType, value []byte) natchecker.STUNAttribute {
+		return natchecker.STUNAttribute{Type: t, Length: uint16(len(value)), Value: value}
+	}
+	msg := natchecker.STUNMessage{
+		MessageType: natchecker.AllocateRequest,
+		Attributes: []natchecker.STUNAttribute{
+			attr(natchecker.RequestedTransport, []byte{protocolUDP, 0, 0, 0}),
+			attr(natchecker.Username, []byte("alice")),
+			attr(natchecker.Realm, []byte(server.Realm())),
+			attr(natchecker.Nonce, []byte(server.nonce)),
+		},
+	}
+	raw := natchecker.EncodeWithIntegrity(msg, natchecker.LongTermKey("alice", server.Realm(), "secret"))
+	decoded, err := natchecker.DecodeMessage(raw)
+	require.NoError(t, err)
+
+	_, ok := server.handleRequest(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000}, decoded, raw)
+	assert.False(t, ok, "requests after Close are dropped")
+	assert.Equal(t, 0, server.Allocations())
+
+	// 中継ソケットの goroutine が残っていなければ待ち合わせはすぐに終わる
+	waited := make(chan struct{})
+	go func() {
+		server.wg.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("a relay goroutine was started after Close")
+	}
+}
@@ -0,0 +1,301 @@
+package natchecker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// STUN/TURN URI のスキーム
+// RFC 7064 Section 3.1: "stun" / "stuns"
+// RFC 7065 Section 3.1: "turn" / "turns"
+const (
+	SchemeSTUN  = "stun"
+	SchemeSTUNS = "stuns"
+	SchemeTURN  = "turn"
+	SchemeTURNS = "turns"
+)
+
+// トランスポート (RFC 7065 Section 3.1 の transport パラメータ)
+const (
+	TransportUDP = "udp"
+	TransportTCP = "tcp"
+)
+
+// defaultSTUNSPort は TLS/DTLS 上の STUN の標準ポート (RFC 8489 Section 8)
+const defaultSTUNSPort = "5349"
+
+// ServerURI は RFC 7064 の STUN URI、または RFC 7065 の TURN URI を表します。
+//
+//	stunURI = scheme ":" host [ ":" port ]
+//	turnURI = scheme ":" host [ ":" port ] [ "?transport=" transport ]
+//
+// WebRTC の設定で使われる "stun:stun.example.com:3478?transport=udp" のように、
+// stun/stuns でも transport パラメータを受け付けます。
+type ServerURI struct {
+	// Scheme は "stun" / "stuns" / "turn" / "turns" のいずれか
+	Scheme string `json:"scheme"`
+	// Host はホスト名または IP アドレス（IPv6 リテラルは角括弧なし）
+	Host string `json:"host"`
+	// Port は URI で指定されたポート。省略された場合は 0
+	Port int `json:"port,omitempty"`
+	// Transport は "udp" または "tcp"。省略された場合はスキームの既定値
+	// (stun/turn は udp、stuns/turns は tcp) が入る
+	Transport string `json:"transport"`
+}
+
+// isServerURI は s が STUN/TURN URI の形式かどうかを返します。
+//
+// "stun:3478" のようにスキーム部分の後ろが数字だけの場合は、
+// "stun" という名前のホストとポートの組として扱う。
+func isServerURI(s string) bool {
+	scheme, rest, ok := strings.Cut(s, ":")
+	if !ok {
+		return false
+	}
+	switch strings.ToLower(scheme) {
+	case SchemeSTUN, SchemeSTUNS, SchemeTURN, SchemeTURNS:
+	default:
+		return false
+	}
+	if _, err := strconv.Atoi(rest); err == nil {
+		return false
+	}
+	return true
+}
+
+// ParseServerURI は STUN/TURN URI を解析します (RFC 7064 Section 3.1, RFC 7065 Section 3.1)。
+//
+// スキームは大文字小文字を区別しません。IPv6 リテラルは "stun:[2001:db8::1]:3478"
+// のように角括弧で囲む必要があります。
+func ParseServerURI(uri string) (*ServerURI, error) {
+	scheme, rest, ok := strings.Cut(uri, ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid STUN URI %q: missing scheme", uri)
+	}
+
+	u := &ServerURI{Scheme: strings.ToLower(scheme)}
+	switch u.Scheme {
+	case SchemeSTUN, SchemeTURN:
+		u.Transport = TransportUDP
+	case SchemeSTUNS, SchemeTURNS:
+		// RFC 7065 Section 3: "turns" の既定のトランスポートは TLS over TCP
+		u.Transport = TransportTCP
+	default:
+		return nil, fmt.Errorf("invalid STUN URI %q: unsupported scheme %q", uri, scheme)
+	}
+
+	// RFC 7064 Section 3.1: STUN URI は階層を持たないため "//" は使わない
+	if strings.HasPrefix(rest, "//") {
+		return nil, fmt.Errorf("invalid STUN URI %q: authority component (\"//\") is not allowed", uri)
+	}
+
+	hostPort, query, hasQuery := strings.Cut(rest, "?")
+	if hasQuery {
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			return nil, fmt.Errorf("invalid STUN URI %q: %w", uri, err)
+		}
+		for key := range values {
+			if key != "transport" {
+				return nil, fmt.Errorf("invalid STUN URI %q: unknown parameter %q", uri, key)
+			}
+		}
+		switch transport := strings.ToLower(values.Get("transport")); transport {
+		case TransportUDP, TransportTCP:
+			u.Transport = transport
+		default:
+			return nil, fmt.Errorf("invalid STUN URI %q: unsupported transport %q", uri, transport)
+		}
+	}
+
+	host, port, err := splitURIHostPort(hostPort)
+	if err != nil {
+		return nil, fmt.Errorf("invalid STUN URI %q: %w", uri, err)
+	}
+	u.Host = host
+	u.Port = port
+	return u, nil
+}
+
+// splitURIHostPort は URI の host [ ":" port ] 部分を分解します。
+// ポートが無い場合は 0 を返します。
+func splitURIHostPort(s string) (string, int, error) {
+	if s == "" {
+		return "", 0, fmt.Errorf("missing host")
+	}
+
+	host, portStr := s, ""
+	if strings.HasPrefix(s, "[") {
+		// IP-literal: "[" IPv6address "]"
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return "", 0, fmt.Errorf("missing ']' in IPv6 literal")
+		}
+		host = s[1:end]
+		if ip := net.ParseIP(host); ip == nil || ip.To4() != nil {
+			return "", 0, fmt.Errorf("invalid IPv6 literal %q", host)
+		}
+		switch after := s[end+1:]; {
+		case after == "":
+		case strings.HasPrefix(after, ":"):
+			portStr = after[1:]
+		default:
+			return "", 0, fmt.Errorf("unexpected %q after IPv6 literal", after)
+		}
+	} else if i := strings.LastIndex(s, ":"); i >= 0 {
+		if strings.Contains(s[:i], ":") {
+			return "", 0, fmt.Errorf("IPv6 literal must be enclosed in brackets")
+		}
+		host, portStr = s[:i], s[i+1:]
+	}
+
+	if host == "" {
+		return "", 0, fmt.Errorf("missing host")
+	}
+	if portStr == "" {
+		if strings.HasSuffix(s, ":") {
+			return "", 0, fmt.Errorf("empty port")
+		}
+		return host, 0, nil
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port %q", portStr)
+	}
+	return host, port, nil
+}
+
+// Secure は TLS/DTLS を使うスキーム (stuns/turns) かどうかを返します
+func (u *ServerURI) Secure() bool {
+	return u.Scheme == SchemeSTUNS || u.Scheme == SchemeTURNS
+}
+
+// HostPort は "host:port" 形式のアドレスを返します。
+// ポートが省略されている場合はスキームの既定ポート
+// (stun/turn は 3478、stuns/turns は 5349) を補います。
+func (u *ServerURI) HostPort() string {
+	if u.Port != 0 {
+		return net.JoinHostPort(u.Host, strconv.Itoa(u.Port))
+	}
+	if u.Secure() {
+		return net.JoinHostPort(u.Host, defaultSTUNSPort)
+	}
+	return net.JoinHostPort(u.Host, defaultSTUNPort)
+}
+
+// String は URI の文字列表現を返します
+func (u *ServerURI) String() string {
+	host := u.Host
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	s := u.Scheme + ":" + host
+	if u.Port != 0 {
+		s += ":" + strconv.Itoa(u.Port)
+	}
+	if u.Transport != "" {
+		s += "?transport=" + u.Transport
+	}
+	return s
+}
+
+// ICEServer は WebRTC の RTCIceServer 相当の設定を表します
+//
+// JSON では urls に文字列 1 つ、または文字列の配列を指定できます:
+//
+//	{"urls": "stun:stun.example.com"}
+//	{"urls": ["turn:turn.example.com?transport=udp"], "username": "u", "credential": "p"}
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// UnmarshalJSON は urls が文字列・配列のどちらでも受け付けます
+func (s *ICEServer) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		URLs       json.RawMessage `json:"urls"`
+		Username   string          `json:"username"`
+		Credential string          `json:"credential"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	s.Username = raw.Username
+	s.Credential = raw.Credential
+	s.URLs = nil
+
+	if len(raw.URLs) == 0 {
+		return fmt.Errorf("ICE server has no urls")
+	}
+	var single string
+	if err := json.Unmarshal(raw.URLs, &single); err == nil {
+		s.URLs = []string{single}
+		return nil
+	}
+	return json.Unmarshal(raw.URLs, &s.URLs)
+}
+
+// URIs は URLs を解析した結果を返します。解析できない URL があればエラーを返します
+func (s ICEServer) URIs() ([]*ServerURI, error) {
+	uris := make([]*ServerURI, 0, len(s.URLs))
+	for _, raw := range s.URLs {
+		u, err := ParseServerURI(raw)
+		if err != nil {
+			return nil, err
+		}
+		uris = append(uris, u)
+	}
+	return uris, nil
+}
+
+// ParseICEServers は WebRTC 形式の ICE サーバー設定 (JSON) を解析します。
+//
+// RTCIceServer の配列、または RTCConfiguration のように "iceServers" キーを
+// 持つオブジェクトのどちらも受け付けます。STUN/TURN URI として解析できない URL
+// は取り除き、使える URL が 1 つも無いエントリは読み飛ばします。turns: や
+// transport=tcp の URL も解析はできるので残り、接続する時点で未対応のエラーになります。
+// 使えるエントリが 1 つも無い場合はエラーを返します。
+func ParseICEServers(data []byte) ([]ICEServer, error) {
+	var servers []ICEServer
+	if err := json.Unmarshal(data, &servers); err != nil {
+		var wrapped struct {
+			ICEServers []ICEServer `json:"iceServers"`
+		}
+		if wrappedErr := json.Unmarshal(data, &wrapped); wrappedErr != nil || wrapped.ICEServers == nil {
+			return nil, fmt.Errorf("invalid ICE server configuration: %w", err)
+		}
+		servers = wrapped.ICEServers
+	}
+
+	usable := make([]ICEServer, 0, len(servers))
+	var errs []error
+	for _, server := range servers {
+		urls := make([]string, 0, len(server.URLs))
+		for _, raw := range server.URLs {
+			if _, err := ParseServerURI(raw); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			urls = append(urls, raw)
+		}
+		if len(urls) == 0 {
+			continue
+		}
+		server.URLs = urls
+		usable = append(usable, server)
+	}
+	if len(usable) == 0 {
+		if len(errs) == 0 {
+			return nil, fmt.Errorf("invalid ICE server configuration: no servers")
+		}
+		return nil, fmt.Errorf("invalid ICE server configuration: %w", errors.Join(errs...))
+	}
+	return usable, nil
+}
@@ -0,0 +1,136 @@
+package natchecker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseServerURI(t *testing.T) {
+	tests := []struct {
+		input     string
+		scheme    string
+		host      string
+		port      int
+		transport string
+		hostPort  string
+	}{
+		{"stun:stun.example.com", "stun", "stun.example.com", 0, "udp", "stun.example.com:3478"},
+		{"stun:stun.example.com:19302", "stun", "stun.example.com", 19302, "udp", "stun.example.com:19302"},
+		{"stun:stun.example.com:3478?transport=udp", "stun", "stun.example.com", 3478, "udp", "stun.example.com:3478"},
+		{"STUN:stun.example.com", "stun", "stun.example.com", 0, "udp", "stun.example.com:3478"},
+		{"stuns:stun.example.com", "stuns", "stun.example.com", 0, "tcp", "stun.example.com:5349"},
+		{"stun:192.0.2.1", "stun", "192.0.2.1", 0, "udp", "192.0.2.1:3478"},
+		{"stun:[2001:db8::1]", "stun", "2001:db8::1", 0, "udp", "[2001:db8::1]:3478"},
+		{"stun:[2001:db8::1]:3479", "stun", "2001:db8::1", 3479, "udp", "[2001:db8::1]:3479"},
+		{"turn:turn.example.com?transport=tcp", "turn", "turn.example.com", 0, "tcp", "turn.example.com:3478"},
+		{"turns:turn.example.com:443?transport=tcp", "turns", "turn.example.com", 443, "tcp", "turn.example.com:443"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			u, err := ParseServerURI(test.input)
+			require.NoError(t, err)
+			assert.Equal(t, test.scheme, u.Scheme)
+			assert.Equal(t, test.host, u.Host)
+			assert.Equal(t, test.port, u.Port)
+			assert.Equal(t, test.transport, u.Transport)
+			assert.Equal(t, test.hostPort, u.HostPort())
+
+			// String() の結果は再度同じ URI として解析できる
+			again, err := ParseServerURI(u.String())
+			require.NoError(t, err)
+			assert.Equal(t, u, again)
+		})
+	}
+}
+
+func TestParseServerURIErrors(t *testing.T) {
+	inputs := []string{
+		"stun.example.com",
+		"http:stun.example.com",
+		"stun://stun.example.com",
+		"stun:",
+		"stun:stun.example.com:",
+		"stun:stun.example.com:0",
+		"stun:stun.example.com:65536",
+		"stun:2001:db8::1",
+		"stun:[2001:db8::1",
+		"stun:[192.0.2.1]",
+		"stun:stun.example.com?transport=sctp",
+		"stun:stun.example.com?foo=bar",
+	}
+
+	for _, input := range inputs {
+		t.Run(input, func(t *testing.T) {
+			_, err := ParseServerURI(input)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestParseServerSpec(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"stun.example.com", "stun.example.com:3478"},
+		{"stun.example.com:19302", "stun.example.com:19302"},
+		{"stun:stun.example.com", "stun.example.com:3478"},
+		{"stun:stun.example.com:3478?transport=udp", "stun.example.com:3478"},
+		{"stun:[2001:db8::1]:3479", "[2001:db8::1]:3479"},
+		// "stun" という名前のホストとポートの組
+		{"stun:3478", "stun:3478"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			u, err := parseServerSpec(test.input)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, u.HostPort())
+		})
+	}
+}
+
+func TestParseICEServers(t *testing.T) {
+	data := []byte(`[
+		{"urls": "stun:stun.example.com"},
+		{"urls": ["turn:turn.example.com?transport=udp", "turns:turn.example.com"], "username": "user", "credential": "pass"}
+	]`)
+
+	servers, err := ParseICEServers(data)
+	require.NoError(t, err)
+	require.Len(t, servers, 2)
+	assert.Equal(t, []string{"stun:stun.example.com"}, servers[0].URLs)
+	assert.Equal(t, "user", servers[1].Username)
+	assert.Equal(t, "pass", servers[1].Credential)
+
+	uris, err := servers[1].URIs()
+	require.NoError(t, err)
+	require.Len(t, uris, 2)
+	assert.Equal(t, "udp", uris[0].Transport)
+	assert.True(t, uris[1].Secure())
+
+	// RTCConfiguration 形式
+	wrapped, err := ParseICEServers([]byte(`{"iceServers": [{"urls": "stun:[2001:db8::1]:3478"}]}`))
+	require.NoError(t, err)
+	require.Len(t, wrapped, 1)
+
+	// 解析できない URL は取り除き、URL の残らないエントリは読み飛ばす
+	mixed, err := ParseICEServers([]byte(`[
+		{"urls": ["http://example.com", "turn:turn.example.com?transport=tcp"]},
+		{"urls": "not a uri"},
+		{"urls": "turns:turn.example.com:443"}
+	]`))
+	require.NoError(t, err)
+	require.Len(t, mixed, 2)
+	assert.Equal(t, []string{"turn:turn.example.com?transport=tcp"}, mixed[0].URLs)
+	assert.Equal(t, []string{"turns:turn.example.com:443"}, mixed[1].URLs)
+
+	// 使えるエントリが 1 つも無ければエラー
+	_, err = ParseICEServers([]byte(`[{"urls": "http://example.com"}]`))
+	assert.Error(t, err)
+	_, err = ParseICEServers([]byte(`[]`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,281 @@
+package vnet
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	natchecker "github.com/moepig/nat-checker"
+)
+
+// 外部ポートの既定の範囲
+const (
+	defaultMinPort = 1024
+	defaultMaxPort = 65535
+)
+
+// NATConfig は NAT の動作 (RFC 4787) の設定。ゼロ値は Full Cone NAT
+// (Endpoint-Independent Mapping / Filtering、ポート保存、タイムアウトなし)
+type NATConfig struct {
+	// Mapping は外部アドレスの割り当て方 (RFC 4787 Section 4.1)
+	Mapping natchecker.NATMappingType
+	// Filtering は外部からのパケットを通す条件 (RFC 4787 Section 5)
+	Filtering natchecker.NATFilteringType
+	// Hairpin が true なら、内側のホストから NAT の外部アドレス宛のパケットを
+	// 内側に折り返す (RFC 4787 Section 6)
+	Hairpin bool
+	// MappingTimeout は通信の無いマッピングを削除するまでの時間。0 なら削除しない
+	// RFC 4787 REQ-5: "A NAT UDP mapping timer MUST NOT expire in less than two minutes"
+	MappingTimeout time.Duration
+	// InboundRefresh が true なら、外部からのパケットでもマッピングのタイマーを更新する。
+	// 内側からのパケットでは常に更新する (RFC 4787 REQ-6)
+	InboundRefresh bool
+	// PortAllocation は外部ポートの割り当て方式 (RFC 4787 Section 4.2)。
+	// PortPreservation は内部ポートが空いていればそのまま使い、使われていれば
+	// PortSequential と同じく次の空きポートを使う
+	PortAllocation natchecker.PortAllocationBehavior
+	// MinPort, MaxPort は外部ポートの範囲。0 なら 1024-65535
+	MinPort, MaxPort int
+	// Seed は PortRandom の乱数の種。同じ種なら同じ順序でポートが割り当てられる
+	Seed uint64
+}
+
+// NAT は外側のネットワークに 1 つの外部 IP アドレスを持ち、内側の LAN との間で
+// アドレスを変換する仮想 NAT
+type NAT struct {
+	cfg      NATConfig
+	publicIP net.IP
+	outside  *Network
+	inside   *Network
+
+	mu sync.Mutex
+	// mappings は内部アドレスと (マッピング方式に応じた) 宛先の組ごとのマッピング
+	mappings map[string]*natMapping
+	// byPort は外部ポートごとのマッピング
+	byPort   map[int]*natMapping
+	nextPort int
+	rng      *rand.Rand
+}
+
+// natMapping は 1 つのマッピング
+type natMapping struct {
+	key      string
+	internal *net.UDPAddr
+	port     int
+	expires  time.Time
+	// contacted はこのマッピングから送信した宛先の IP と IP:ポート。フィルタリングに使う
+	contacted map[string]bool
+}
+
+// AddNAT は外部 IP アドレス publicIP を持つ NAT をネットワークに追加します。
+// 内側のホストは NAT.Inside のネットワークに追加する。NAT の内側にさらに NAT を
+// 置けば、CGN のような多段 NAT も作れる
+func (n *Network) AddNAT(publicIP string, cfg NATConfig) (*NAT, error) {
+	ip, err := parseIPv4(publicIP)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MinPort == 0 {
+		cfg.MinPort = defaultMinPort
+	}
+	if cfg.MaxPort == 0 {
+		cfg.MaxPort = defaultMaxPort
+	}
+	if cfg.MinPort < 1 || cfg.MaxPort > 65535 || cfg.MinPort > cfg.MaxPort {
+		return nil, fmt.Errorf("invalid port range %d-%d", cfg.MinPort, cfg.MaxPort)
+	}
+
+	nat := &NAT{
+		cfg:      cfg,
+		publicIP: ip,
+		outside:  n,
+		mappings: make(map[string]*natMapping),
+		byPort:   make(map[int]*natMapping),
+		nextPort: cfg.MinPort,
+		rng:      rand.New(rand.NewPCG(cfg.Seed, cfg.Seed)),
+	}
+	nat.inside = &Network{nodes: make(map[string]node), uplink: nat}
+	if err := n.attach(nat, ip); err != nil {
+		return nil, err
+	}
+	return nat, nil
+}
+
+// Inside は NAT の内側のネットワークを返します
+func (nat *NAT) Inside() *Network {
+	return nat.inside
+}
+
+// PublicIP は NAT の外部 IP アドレスを返します
+func (nat *NAT) PublicIP() net.IP {
+	return nat.publicIP
+}
+
+// Mappings は有効なマッピングの数を返します
+func (nat *NAT) Mappings() int {
+	nat.mu.Lock()
+	defer nat.mu.Unlock()
+	now := time.Now()
+	count := 0
+	for _, m := range nat.mappings {
+		if !nat.expired(m, now) {
+			count++
+		}
+	}
+	return count
+}
+
+// outbound は内側から外へ向かうパケットの送信元を外部アドレスに変換して転送します
+func (nat *NAT) outbound(p packet) {
+	nat.mu.Lock()
+	now := time.Now()
+	key := nat.mappingKey(p.src, p.dst)
+	m := nat.mappings[key]
+	if m != nil && nat.expired(m, now) {
+		nat.remove(m)
+		m = nil
+	}
+	if m == nil {
+		port, ok := nat.allocatePort(p.src.Port, now)
+		if !ok {
+			// 外部ポートが尽きた場合は捨てる
+			nat.mu.Unlock()
+			return
+		}
+		m = &natMapping{key: key, internal: p.src, port: port, contacted: make(map[string]bool)}
+		nat.mappings[key] = m
+		nat.byPort[port] = m
+	}
+	nat.refresh(m, now)
+	m.contacted[p.dst.IP.String()] = true
+	m.contacted[p.dst.String()] = true
+	src := &net.UDPAddr{IP: nat.publicIP, Port: m.port}
+	nat.mu.Unlock()
+
+	nat.outside.route(packet{src: src, dst: p.dst, data: p.data})
+}
+
+// deliver は外部アドレス宛のパケットをフィルタリングし、内部アドレスに変換して転送します
+func (nat *NAT) deliver(p packet) {
+	nat.mu.Lock()
+	now := time.Now()
+	m := nat.byPort[p.dst.Port]
+	if m != nil && nat.expired(m, now) {
+		nat.remove(m)
+		m = nil
+	}
+	// RFC 4787 Section 6: 内側から自分の外部アドレス宛に送られたパケット (ヘアピン)
+	hairpin := p.src.IP.Equal(nat.publicIP)
+	if m == nil || !nat.permits(m, p.src) || (hairpin && !nat.cfg.Hairpin) {
+		nat.mu.Unlock()
+		return
+	}
+	if nat.cfg.InboundRefresh {
+		nat.refresh(m, now)
+	}
+	dst := m.internal
+	nat.mu.Unlock()
+
+	nat.inside.route(packet{src: p.src, dst: dst, data: p.data})
+}
+
+// mappingKey はマッピング方式に応じて、同じ外部アドレスを使う通信をまとめるキーを返します
+// RFC 4787 Section 4.1: EIM は宛先によらず、ADM は宛先 IP ごと、APDM は宛先 IP とポートごと
+func (nat *NAT) mappingKey(src, dst *net.UDPAddr) string {
+	switch nat.cfg.Mapping {
+	case natchecker.AddressDependent:
+		return src.String() + "|" + dst.IP.String()
+	case natchecker.AddressPortDependent:
+		return src.String() + "|" + dst.String()
+	default:
+		return src.String()
+	}
+}
+
+// permits はマッピング m の外部アドレスに from からのパケットを通すかを返します
+// RFC 4787 Section 5: EIF はすべて、ADF は送信したことのある IP から、
+// APDF は送信したことのある IP とポートからのパケットだけを通す
+func (nat *NAT) permits(m *natMapping, from *net.UDPAddr) bool {
+	switch nat.cfg.Filtering {
+	case natchecker.AddressDependentFiltering:
+		return m.contacted[from.IP.String()]
+	case natchecker.AddressPortDependentFiltering:
+		return m.contacted[from.String()]
+	default:
+		return true
+	}
+}
+
+// allocatePort は新しいマッピングの外部ポートを割り当てます
+func (nat *NAT) allocatePort(internalPort int, now time.Time) (int, bool) {
+	size := nat.cfg.MaxPort - nat.cfg.MinPort + 1
+	if len(nat.byPort) >= size {
+		// 失効したマッピングを片付けてから空きを数え直す
+		for _, m := range nat.mappings {
+			if nat.expired(m, now) {
+				nat.remove(m)
+			}
+		}
+		if len(nat.byPort) >= size {
+			return 0, false
+		}
+	}
+
+	switch nat.cfg.PortAllocation {
+	case natchecker.PortRandom:
+		for {
+			port := nat.cfg.MinPort + nat.rng.IntN(size)
+			if nat.portFree(port, now) {
+				return port, true
+			}
+		}
+	case natchecker.PortPreservation:
+		if internalPort >= nat.cfg.MinPort && internalPort <= nat.cfg.MaxPort {
+			if nat.portFree(internalPort, now) {
+				return internalPort, true
+			}
+			nat.nextPort = max(nat.nextPort, internalPort)
+		}
+	}
+
+	for {
+		port := nat.nextPort
+		nat.nextPort++
+		if nat.nextPort > nat.cfg.MaxPort {
+			nat.nextPort = nat.cfg.MinPort
+		}
+		if nat.portFree(port, now) {
+			return port, true
+		}
+	}
+}
+
+// portFree は外部ポートが使われていないかを返します。失効したマッピングのポートは解放する
+func (nat *NAT) portFree(port int, now time.Time) bool {
+	m := nat.byPort[port]
+	if m != nil && nat.expired(m, now) {
+		nat.remove(m)
+		m = nil
+	}
+	return m == nil
+}
+
+// refresh はマッピングのタイマーを更新します
+func (nat *NAT) refresh(m *natMapping, now time.Time) {
+	if nat.cfg.MappingTimeout > 0 {
+		m.expires = now.Add(nat.cfg.MappingTimeout)
+	}
+}
+
+// expired はマッピングが失効しているかを返します
+func (nat *NAT) expired(m *natMapping, now time.Time) bool {
+	return nat.cfg.MappingTimeout > 0 && now.After(m.expires)
+}
+
+// remove はマッピングを削除します
+func (nat *NAT) remove(m *natMapping) {
+	delete(nat.mappings, m.key)
+	delete(nat.byPort, m.port)
+}
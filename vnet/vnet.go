@@ -0,0 +1,343 @@
+// Package vnet はインメモリの仮想パケットネットワークと NAT のシミュレーターです。
+//
+// 仮想ホストの ListenPacket を natchecker.WithListenPacket や stunserver.Config に
+// 渡すと、OS のソケットやインターネットを使わずに STUN クライアントとサーバーを
+// 動かせます。NAT のマッピング・フィルタリング・ヘアピン・タイムアウト・ポート割り当てを
+// 設定できるため、すべての NAT の組み合わせに対する判定結果を決定的に試験できます。
+//
+// ネットワークは IPv4 の UDP のみを扱い、パケットは送信と同時に同期的に配送されます。
+// 遅延や損失は模擬しません。
+//
+//	internet := vnet.New()
+//	server, _ := internet.AddHost("198.51.100.1", "198.51.100.2")
+//	nat, _ := internet.AddNAT("203.0.113.1", vnet.NATConfig{Mapping: natchecker.AddressPortDependent})
+//	client, _ := nat.Inside().AddHost("192.168.0.2")
+//	natchecker.CheckMappingType("198.51.100.1:3478", natchecker.WithListenPacket(client.ListenPacket))
+package vnet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ephemeralPortStart は ListenPacket でポート 0 を指定した場合に割り当てるポートの先頭
+// RFC 6335 Section 6: Dynamic Ports 49152-65535
+const ephemeralPortStart = 49152
+
+// queueLength はソケットごとの受信キューの長さ。溢れたパケットは捨てられる
+const queueLength = 256
+
+// packet はネットワーク上を流れる 1 つの UDP データグラム
+type packet struct {
+	src, dst *net.UDPAddr
+	data     []byte
+}
+
+// node はネットワークに接続された IP アドレスの持ち主 (ホストまたは NAT の外側)
+type node interface {
+	deliver(p packet)
+}
+
+// Network は 1 つのネットワークセグメント。New で作るものがインターネットにあたり、
+// NAT.Inside で得るものがその NAT の内側の LAN
+type Network struct {
+	mu    sync.Mutex
+	nodes map[string]node
+	// uplink はセグメント内に宛先が無いパケットを転送する NAT。インターネットでは nil
+	uplink *NAT
+}
+
+// New は空のネットワーク (インターネット) を作ります
+func New() *Network {
+	return &Network{nodes: make(map[string]node)}
+}
+
+// AddHost は ips の IP アドレスを持つホストをネットワークに追加します。
+// 最初の IP が、ListenPacket で IP を指定しない場合の送信元になる
+func (n *Network) AddHost(ips ...string) (*Host, error) {
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("host needs at least one IP address")
+	}
+	h := &Host{network: n, conns: make(map[string]*Conn), nextPort: ephemeralPortStart}
+	for _, s := range ips {
+		ip, err := parseIPv4(s)
+		if err != nil {
+			return nil, err
+		}
+		h.ips = append(h.ips, ip)
+	}
+	if err := n.attach(h, h.ips...); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// attach は ips の持ち主として nd を登録します
+func (n *Network) attach(nd node, ips ...net.IP) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, ip := range ips {
+		if _, exists := n.nodes[ip.String()]; exists {
+			return fmt.Errorf("IP address %s is already in use", ip)
+		}
+	}
+	for _, ip := range ips {
+		n.nodes[ip.String()] = nd
+	}
+	return nil
+}
+
+// route は p をセグメント内の宛先に届け、宛先が無ければ上位の NAT に転送します。
+// どちらも無ければ捨てる
+func (n *Network) route(p packet) {
+	n.mu.Lock()
+	target := n.nodes[p.dst.IP.String()]
+	uplink := n.uplink
+	n.mu.Unlock()
+
+	switch {
+	case target != nil:
+		target.deliver(p)
+	case uplink != nil:
+		uplink.outbound(p)
+	}
+}
+
+// Host は 1 つ以上の IP アドレスを持つ仮想ホスト
+type Host struct {
+	network *Network
+	ips     []net.IP
+
+	mu       sync.Mutex
+	conns    map[string]*Conn
+	nextPort int
+}
+
+// IP はホストの最初の IP アドレスを返します
+func (h *Host) IP() net.IP {
+	return h.ips[0]
+}
+
+// ListenPacket は laddr で待ち受けるソケットを作ります。
+// 引数は net.ListenUDP と同じで、natchecker.ListenPacketFunc として使えます。
+//
+// laddr の IP が未指定ならホストの最初の IP、ポートが 0 なら空いているポートを使う。
+// IPv6 のソケット ("udp6") は作れない
+func (h *Host) ListenPacket(network string, laddr *net.UDPAddr) (net.PacketConn, error) {
+	if network != "udp" && network != "udp4" {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+
+	ip, port := h.ips[0], 0
+	if laddr != nil {
+		port = laddr.Port
+		if laddr.IP != nil && !laddr.IP.IsUnspecified() {
+			ip = laddr.IP.To4()
+			if !h.hasIP(ip) {
+				return nil, &net.OpError{Op: "listen", Net: network, Addr: laddr, Err: errors.New("cannot assign requested address")}
+			}
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if port == 0 {
+		for attempts := 0; ; attempts++ {
+			if attempts > 65535-ephemeralPortStart {
+				return nil, &net.OpError{Op: "listen", Net: network, Err: errors.New("no free port")}
+			}
+			candidate := h.nextPort
+			h.nextPort++
+			if h.nextPort > 65535 {
+				h.nextPort = ephemeralPortStart
+			}
+			if _, used := h.conns[(&net.UDPAddr{IP: ip, Port: candidate}).String()]; !used {
+				port = candidate
+				break
+			}
+		}
+	}
+
+	addr := &net.UDPAddr{IP: ip, Port: port}
+	if _, used := h.conns[addr.String()]; used {
+		return nil, &net.OpError{Op: "listen", Net: network, Addr: addr, Err: errors.New("address already in use")}
+	}
+	c := &Conn{
+		host:    h,
+		addr:    addr,
+		queue:   make(chan packet, queueLength),
+		closed:  make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+	h.conns[addr.String()] = c
+	return c, nil
+}
+
+func (h *Host) hasIP(ip net.IP) bool {
+	for _, own := range h.ips {
+		if own.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver は宛先のソケットの受信キューに p を入れます。待ち受けていなければ捨てる
+func (h *Host) deliver(p packet) {
+	h.mu.Lock()
+	c := h.conns[p.dst.String()]
+	h.mu.Unlock()
+	if c != nil {
+		c.enqueue(p)
+	}
+}
+
+// Conn は仮想ホストの UDP ソケット。net.PacketConn を実装する
+type Conn struct {
+	host *Host
+	addr *net.UDPAddr
+
+	queue     chan packet
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu       sync.Mutex
+	deadline time.Time
+	// changed は読み込み期限が変わると閉じられ、待機中の ReadFrom に期限を読み直させる
+	changed chan struct{}
+}
+
+// ReadFrom は 1 つのパケットを受信します。期限を過ぎると os.ErrDeadlineExceeded を返す
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		deadline, changed := c.deadline, c.changed
+		c.mu.Unlock()
+
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, nil, c.opError("read", os.ErrDeadlineExceeded)
+			}
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+
+		n, from, done, err := c.wait(b, timeout, changed)
+		if timer != nil {
+			timer.Stop()
+		}
+		if done {
+			return n, from, err
+		}
+	}
+}
+
+// wait はパケットの到着・ソケットのクローズ・期限切れ・期限の変更のいずれかを待ちます。
+// 期限が変わった場合は done が false になる
+func (c *Conn) wait(b []byte, timeout <-chan time.Time, changed <-chan struct{}) (n int, from net.Addr, done bool, err error) {
+	select {
+	case p := <-c.queue:
+		return copy(b, p.data), p.src, true, nil
+	case <-c.closed:
+		return 0, nil, true, c.opError("read", net.ErrClosed)
+	case <-timeout:
+		return 0, nil, true, c.opError("read", os.ErrDeadlineExceeded)
+	case <-changed:
+		return 0, nil, false, nil
+	}
+}
+
+// WriteTo は addr 宛に b を送信します
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, c.opError("write", net.ErrClosed)
+	default:
+	}
+
+	dst, ok := addr.(*net.UDPAddr)
+	if !ok {
+		var err error
+		if dst, err = net.ResolveUDPAddr("udp", addr.String()); err != nil {
+			return 0, c.opError("write", err)
+		}
+	}
+	ip := dst.IP.To4()
+	if ip == nil {
+		return 0, c.opError("write", errors.New("network is unreachable"))
+	}
+
+	c.host.network.route(packet{
+		src:  &net.UDPAddr{IP: c.addr.IP, Port: c.addr.Port},
+		dst:  &net.UDPAddr{IP: ip, Port: dst.Port},
+		data: append([]byte(nil), b...),
+	})
+	return len(b), nil
+}
+
+// Close はソケットを閉じ、ポートを解放します
+func (c *Conn) Close() error {
+	err := c.opError("close", net.ErrClosed)
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.host.mu.Lock()
+		delete(c.host.conns, c.addr.String())
+		c.host.mu.Unlock()
+		err = nil
+	})
+	return err
+}
+
+// LocalAddr はソケットのアドレスを *net.UDPAddr で返します
+func (c *Conn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// SetDeadline は読み込み期限を設定します。書き込みは常に即座に完了する
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline は読み込み期限を設定します
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	close(c.changed)
+	c.changed = make(chan struct{})
+	c.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline は何もしません。書き込みは常に即座に完了する
+func (c *Conn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// enqueue は受信キューに p を入れます。閉じているか、キューが一杯なら捨てる
+func (c *Conn) enqueue(p packet) {
+	select {
+	case <-c.closed:
+	case c.queue <- p:
+	default:
+	}
+}
+
+func (c *Conn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "udp", Addr: c.addr, Err: err}
+}
+
+// parseIPv4 は IPv4 アドレスの文字列を 4 バイト形式で返します
+func parseIPv4(s string) (net.IP, error) {
+	ip := net.ParseIP(s).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IPv4 address %q", s)
+	}
+	return ip, nil
+}
@@ -0,0 +1,335 @@
+package vnet
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	natchecker "github.com/moepig/nat-checker"
+	"github.com/moepig/nat-checker/stunserver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const stunAddr = "198.51.100.1:3478"
+
+// newTopology はインターネット上の RFC 5780 STUN サーバーと、cfg の NAT の内側の
+// クライアントホストを作ります
+func newTopology(t *testing.T, cfg NATConfig) (*NAT, *Host) {
+	t.Helper()
+	internet := New()
+	serverHost, err := internet.AddHost("198.51.100.1", "198.51.100.2")
+	require.NoError(t, err)
+	server, err := stunserver.Listen(stunserver.Config{
+		PrimaryIP:     "198.51.100.1",
+		AlternateIP:   "198.51.100.2",
+		PrimaryPort:   3478,
+		AlternatePort: 3479,
+		ListenPacket:  serverHost.ListenPacket,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { server.Close() })
+
+	nat, err := internet.AddNAT("203.0.113.1", cfg)
+	require.NoError(t, err)
+	client, err := nat.Inside().AddHost("192.168.0.2")
+	require.NoError(t, err)
+	return nat, client
+}
+
+func clientOptions(client *Host) []natchecker.Option {
+	return []natchecker.Option{
+		natchecker.WithListenPacket(client.ListenPacket),
+		natchecker.WithAddressFamily(natchecker.IPv4Only),
+		natchecker.WithRetransmission(20*time.Millisecond, 2),
+	}
+}
+
+func TestFullNATDetectionMatrix(t *testing.T) {
+	mappings := []natchecker.NATMappingType{
+		natchecker.EndpointIndependent,
+		natchecker.AddressDependent,
+		natchecker.AddressPortDependent,
+	}
+	filterings := []natchecker.NATFilteringType{
+		natchecker.EndpointIndependentFiltering,
+		natchecker.AddressDependentFiltering,
+		natchecker.AddressPortDependentFiltering,
+	}
+
+	for _, mapping := range mappings {
+		for _, filtering := range filterings {
+			t.Run(fmt.Sprintf("%s/%s", mapping, filtering), func(t *testing.T) {
+				_, client := newTopology(t, NATConfig{Mapping: mapping, Filtering: filtering})
+
+				result, err := natchecker.FullNATDetection(stunAddr, clientOptions(client)...)
+				require.NoError(t, err)
+				assert.False(t, result.MappingResult.NoNAT)
+				assert.Equal(t, mapping, result.DetailedType.Mapping)
+				assert.Equal(t, filtering, result.DetailedType.Filtering)
+				assert.True(t, result.MappingResult.Response.Mapping1.IP.Equal(net.ParseIP("203.0.113.1")))
+			})
+		}
+	}
+}
+
+func TestClassicNATDetection(t *testing.T) {
+	tests := []struct {
+		mapping   natchecker.NATMappingType
+		filtering natchecker.NATFilteringType
+		expected  natchecker.ClassicNATType
+	}{
+		{natchecker.EndpointIndependent, natchecker.EndpointIndependentFiltering, natchecker.ClassicFullCone},
+		{natchecker.EndpointIndependent, natchecker.AddressDependentFiltering, natchecker.ClassicRestrictedCone},
+		{natchecker.EndpointIndependent, natchecker.AddressPortDependentFiltering, natchecker.ClassicPortRestrictedCone},
+		{natchecker.AddressDependent, natchecker.AddressDependentFiltering, natchecker.ClassicSymmetric},
+		{natchecker.AddressPortDependent, natchecker.AddressPortDependentFiltering, natchecker.ClassicSymmetric},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%s", tt.mapping, tt.filtering), func(t *testing.T) {
+			_, client := newTopology(t, NATConfig{Mapping: tt.mapping, Filtering: tt.filtering})
+
+			result, err := natchecker.ClassicNATDetection(stunAddr, clientOptions(client)...)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, result.NATType)
+			assert.False(t, result.Legacy)
+			assert.True(t, result.Response.TestIResponse)
+			assert.False(t, result.Response.ChangeRequestRejected)
+			assert.True(t, result.Response.MappedAddress.IP.Equal(net.ParseIP("203.0.113.1")))
+			// Test II は Full Cone のときだけ届く
+			assert.Equal(t, tt.expected == natchecker.ClassicFullCone, result.Response.TestIIResponse, "Test II")
+			// Test III は Restricted Cone のときだけ届き、Symmetric では実行しない
+			assert.Equal(t, tt.expected == natchecker.ClassicRestrictedCone, result.Response.TestIIIResponse, "Test III")
+			if tt.expected == natchecker.ClassicSymmetric {
+				assert.NotEqual(t, result.Response.MappedAddress.String(), result.Response.ChangedMappedAddress.String())
+			}
+		})
+	}
+}
+
+func TestNoNAT(t *testing.T) {
+	internet := New()
+	serverHost, err := internet.AddHost("198.51.100.1", "198.51.100.2")
+	require.NoError(t, err)
+	server, err := stunserver.Listen(stunserver.Config{
+		PrimaryIP:     "198.51.100.1",
+		AlternateIP:   "198.51.100.2",
+		PrimaryPort:   3478,
+		AlternatePort: 3479,
+		ListenPacket:  serverHost.ListenPacket,
+	})
+	require.NoError(t, err)
+	defer server.Close()
+	client, err := internet.AddHost("192.0.2.10")
+	require.NoError(t, err)
+
+	result, err := natchecker.CheckMappingType(stunAddr, clientOptions(client)...)
+	require.NoError(t, err)
+	assert.True(t, result.NoNAT)
+	assert.True(t, result.Response.LocalAddress.IP.Equal(net.ParseIP("192.0.2.10")))
+
+	classic, err := natchecker.ClassicNATDetection(stunAddr, clientOptions(client)...)
+	require.NoError(t, err)
+	assert.Equal(t, natchecker.ClassicOpenInternet, classic.NATType)
+}
+
+func TestPortAllocation(t *testing.T) {
+	tests := []struct {
+		allocation natchecker.PortAllocationBehavior
+	}{
+		{natchecker.PortPreservation},
+		{natchecker.PortSequential},
+		{natchecker.PortRandom},
+	}
+	for _, tt := range tests {
+		t.Run(tt.allocation.String(), func(t *testing.T) {
+			_, client := newTopology(t, NATConfig{
+				Mapping:        natchecker.AddressPortDependent,
+				PortAllocation: tt.allocation,
+				Seed:           1,
+			})
+
+			result, err := natchecker.CheckPortAllocation(stunAddr, clientOptions(client)...)
+			require.NoError(t, err)
+			assert.Equal(t, tt.allocation, result.Behavior)
+		})
+	}
+}
+
+func TestPredictPorts(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []natchecker.Option
+		probes int
+	}{
+		{name: "default burst", probes: 8},
+		{name: "custom burst", opts: []natchecker.Option{natchecker.WithSampleCount(12)}, probes: 12},
+		{name: "short burst", opts: []natchecker.Option{natchecker.WithSampleCount(3)}, probes: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, client := newTopology(t, NATConfig{
+				Mapping:        natchecker.AddressPortDependent,
+				PortAllocation: natchecker.PortSequential,
+			})
+
+			result, err := natchecker.PredictPorts(stunAddr, append(clientOptions(client), tt.opts...)...)
+			require.NoError(t, err)
+			require.Len(t, result.Probes, tt.probes)
+			for i, probe := range result.Probes {
+				assert.Equal(t, i >= 4, probe.Auxiliary, "probe %d", i+1)
+			}
+			assert.Equal(t, natchecker.AddressPortDependent, result.MappingType)
+			assert.Equal(t, 1, result.Delta)
+			assert.Equal(t, tt.probes-2, result.AccuracyTrials)
+			assert.InDelta(t, 1, result.Accuracy, 1e-9)
+		})
+	}
+}
+
+func TestHairpin(t *testing.T) {
+	for _, hairpin := range []bool{true, false} {
+		t.Run(fmt.Sprintf("hairpin=%v", hairpin), func(t *testing.T) {
+			internet := New()
+			nat, err := internet.AddNAT("203.0.113.1", NATConfig{Hairpin: hairpin})
+			require.NoError(t, err)
+			a, err := nat.Inside().AddHost("192.168.0.2")
+			require.NoError(t, err)
+			b, err := nat.Inside().AddHost("192.168.0.3")
+			require.NoError(t, err)
+
+			connA, err := a.ListenPacket("udp4", nil)
+			require.NoError(t, err)
+			defer connA.Close()
+			connB, err := b.ListenPacket("udp4", nil)
+			require.NoError(t, err)
+			defer connB.Close()
+
+			// Full Cone かつポート保存なので、B の外部アドレスは公開 IP と B のポート
+			_, err = connB.WriteTo([]byte("open"), &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 3478})
+			require.NoError(t, err)
+			external := &net.UDPAddr{IP: nat.PublicIP(), Port: connB.LocalAddr().(*net.UDPAddr).Port}
+
+			_, err = connA.WriteTo([]byte("hello"), external)
+			require.NoError(t, err)
+			connB.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			buffer := make([]byte, 100)
+			n, from, err := connB.ReadFrom(buffer)
+			if !hairpin {
+				assert.Error(t, err, "hairpin packet must be dropped")
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "hello", string(buffer[:n]))
+			// RFC 4787 REQ-9: 折り返したパケットの送信元は A の外部アドレス
+			assert.True(t, from.(*net.UDPAddr).IP.Equal(nat.PublicIP()))
+		})
+	}
+}
+
+func TestMappingTimeout(t *testing.T) {
+	tests := []struct {
+		name           string
+		mapping        natchecker.NATMappingType
+		filtering      natchecker.NATFilteringType
+		inboundRefresh bool
+		expected       natchecker.RefreshBehavior
+		stimulus       natchecker.InboundStimulus
+	}{
+		{
+			name:     "outbound only",
+			expected: natchecker.RefreshFalse,
+			stimulus: natchecker.InboundStimulusChangeRequest,
+		},
+		{
+			name:           "inbound refresh",
+			inboundRefresh: true,
+			expected:       natchecker.RefreshTrue,
+			stimulus:       natchecker.InboundStimulusChangeRequest,
+		},
+		{
+			// 保持前に代替アドレスへ送っているので、代替アドレスからの通信も通る
+			name:           "inbound refresh through port dependent filtering",
+			filtering:      natchecker.AddressPortDependentFiltering,
+			inboundRefresh: true,
+			expected:       natchecker.RefreshTrue,
+			stimulus:       natchecker.InboundStimulusChangeRequest,
+		},
+		{
+			// 代替アドレス宛は別のマッピングになり、代替アドレスからの通信が届かない
+			name:           "symmetric NAT falls back to RESPONSE-PORT",
+			mapping:        natchecker.AddressPortDependent,
+			filtering:      natchecker.AddressPortDependentFiltering,
+			inboundRefresh: true,
+			expected:       natchecker.RefreshTrue,
+			stimulus:       natchecker.InboundStimulusResponsePort,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, client := newTopology(t, NATConfig{
+				Mapping:        tt.mapping,
+				Filtering:      tt.filtering,
+				MappingTimeout: 100 * time.Millisecond,
+				InboundRefresh: tt.inboundRefresh,
+			})
+
+			result, err := natchecker.CheckRefreshDirection(stunAddr, 300*time.Millisecond, 40*time.Millisecond,
+				clientOptions(client)...)
+			require.NoError(t, err)
+			assert.True(t, result.ControlExpired)
+			assert.Equal(t, natchecker.RefreshTrue, result.OutboundRefresh)
+			assert.Equal(t, tt.expected, result.InboundRefresh)
+			assert.Equal(t, tt.stimulus, result.InboundStimulus)
+			assert.True(t, result.SupportsResponsePort)
+		})
+	}
+}
+
+func TestNATMappingsExpire(t *testing.T) {
+	internet := New()
+	nat, err := internet.AddNAT("203.0.113.1", NATConfig{MappingTimeout: 20 * time.Millisecond})
+	require.NoError(t, err)
+	host, err := nat.Inside().AddHost("192.168.0.2")
+	require.NoError(t, err)
+	conn, err := host.ListenPacket("udp", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.WriteTo([]byte("x"), &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 3478})
+	require.NoError(t, err)
+	assert.Equal(t, 1, nat.Mappings())
+	time.Sleep(40 * time.Millisecond)
+	assert.Equal(t, 0, nat.Mappings())
+}
+
+func TestListenPacket(t *testing.T) {
+	internet := New()
+	host, err := internet.AddHost("192.0.2.1")
+	require.NoError(t, err)
+
+	_, err = host.ListenPacket("udp6", nil)
+	assert.Error(t, err)
+	_, err = host.ListenPacket("udp", &net.UDPAddr{IP: net.ParseIP("192.0.2.99")})
+	assert.Error(t, err, "IP not owned by the host")
+
+	conn, err := host.ListenPacket("udp", &net.UDPAddr{Port: 5000})
+	require.NoError(t, err)
+	_, err = host.ListenPacket("udp", &net.UDPAddr{Port: 5000})
+	assert.Error(t, err, "port in use")
+	require.NoError(t, conn.Close())
+	conn, err = host.ListenPacket("udp", &net.UDPAddr{Port: 5000})
+	require.NoError(t, err, "port is released on Close")
+
+	// 期限切れは net.Error の Timeout として返る
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, _, err = conn.ReadFrom(make([]byte, 10))
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+
+	_, err = internet.AddHost("192.0.2.1")
+	assert.Error(t, err, "duplicate IP")
+}